@@ -3,9 +3,13 @@ package internal
 import (
 	"bytes"
 	"context"
-	"encoding/json"
+	"errors"
+	"expvar"
 	"fmt"
 	"net/http"
+	"os"
+	"sync"
+	"syscall"
 	"time"
 
 	"github.com/Maksat-luci/Telegram-Bot/internal/config"
@@ -13,8 +17,12 @@ import (
 	"github.com/Maksat-luci/Telegram-Bot/internal/service"
 	"github.com/Maksat-luci/Telegram-Bot/pkg/client/imgur"
 	"github.com/Maksat-luci/Telegram-Bot/pkg/client/mq"
-	"github.com/Maksat-luci/Telegram-Bot/pkg/client/mq/rabbitmq"
+	"github.com/Maksat-luci/Telegram-Bot/pkg/client/mq/claimcheck"
+	"github.com/Maksat-luci/Telegram-Bot/pkg/client/mq/envelope"
+	"github.com/Maksat-luci/Telegram-Bot/pkg/client/mq/memory"
+	"github.com/Maksat-luci/Telegram-Bot/pkg/client/mq/payload"
 	"github.com/Maksat-luci/Telegram-Bot/pkg/logging"
+	"github.com/Maksat-luci/Telegram-Bot/pkg/shutdown"
 	tele "gopkg.in/telebot.v3"
 )
 
@@ -24,7 +32,15 @@ type app struct {
 	httpServer   *http.Server
 	imgurService service.ImgurService
 	bot          *tele.Bot
+	consumer     mq.Consumer
 	producer     mq.Producer
+	rpc          mq.RPCClient
+	pools        []*pool
+	events       *envelope.Registry
+	metrics      *appMetrics
+	broker       *memory.Broker
+	claims       *claimcheck.Config
+	payloadCfg   payload.Config
 }
 
 // App интерфейс для работы со структурой
@@ -39,69 +55,199 @@ func NewApp(logger *logging.Logger, cfg *config.Config) (App, error) {
 	imgurClient := imgur.NewClient(cfg.Imgur.URL, cfg.Imgur.AccessToken, cfg.Imgur.ClientID, &client)
 	imgurService := service.NewImgurService(imgurClient, logger)
 
+	registry, err := events.NewRegistry(envelope.Config{
+		Source:      cfg.Events.Source,
+		ContentType: cfg.Events.ContentType,
+	})
+	if err != nil {
+		return nil, err
+	}
+
 	return &app{
 		cfg:          cfg,
 		logger:       logger,
 		imgurService: imgurService,
+		events:       registry,
 	}, nil
 }
 
 func (a *app) Run() {
-	a.startConsume()
-	a.startBot()
+	// корневой контекст приложения, его отмена останавливает чтение очередей
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	// метрики поднимаются первыми, чтобы обёртки mq и обработчики бота их уже видели
+	if a.cfg.Metrics.Enabled {
+		if err := a.startMetrics(); err != nil {
+			a.logger.Fatal(err)
+		}
+	}
+	// бот создаётся до воркеров, обработчики событий отправляют ответы через него.
+	// Апдейты он начнёт получать только после bot.Start, когда rpc клиент уже создан
+	a.startBot(ctx)
+	a.startConsume(ctx)
+
+	// по сигналу бот перестаёт принимать апдейты, воркеры дообрабатывают сообщения и только потом закрываются соединения
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		shutdown.Graceful([]os.Signal{syscall.SIGINT, syscall.SIGTERM, syscall.SIGHUP, os.Interrupt}, a)
+	}()
 	a.bot.Start()
+	<-stopped
+}
 
+// Close останавливает бота, дожидается воркеров и закрывает подключения к брокеру
+func (a *app) Close() error {
+	if a.bot != nil {
+		a.bot.Stop()
+	}
+	// сначала перестаём читать очередь и ждём обработчики, иначе закрытие канала вернёт в очередь
+	// сообщения которые уже отправляются в чат, и пользователь получит их ещё раз
+	ctx, cancel := context.WithTimeout(context.Background(), a.cfg.AppConfig.ShutdownTimeout)
+	defer cancel()
+	var wg sync.WaitGroup
+	for _, p := range a.pools {
+		wg.Add(1)
+		go func(p *pool) {
+			defer wg.Done()
+			stats, err := p.stop(ctx)
+			if err != nil {
+				a.logger.Errorf("pool %s workers did not finish in %s, %d messages requeued, %d handlers abandoned: %v",
+					p.cfg.Queue, a.cfg.AppConfig.ShutdownTimeout, stats.Requeued, stats.Abandoned, err)
+				return
+			}
+			a.logger.Infof("pool %s drained, %d messages requeued", p.cfg.Queue, stats.Requeued)
+		}(p)
+	}
+	wg.Wait()
 
+	if err := a.rpc.Close(); err != nil {
+		a.logger.Errorf("failed to close rpc client due to error %v", err)
+	}
+	if err := a.producer.Close(); err != nil {
+		a.logger.Errorf("failed to close producer due to error %v", err)
+	}
+	if err := a.consumer.Close(); err != nil {
+		a.logger.Errorf("failed to close consumer due to error %v", err)
+	}
+	a.stopMetrics()
+	return nil
 }
-func (a *app) startConsume() {
+
+func (a *app) startConsume(ctx context.Context) {
 	a.logger.Info("start Consuming")
-	// используем конструктор консьюмера и получаем интерфейс консьюмера
-	consumer, err := rabbitmq.NewRabbitMQConsumer(rabbitmq.ConsumerConfig{
-		BaseConfig: rabbitmq.BaseConfig{
-			Host:     a.cfg.RabbitMQ.Host,
-			Port:     a.cfg.RabbitMQ.Port,
-			Username: a.cfg.RabbitMQ.Username,
-			Password: a.cfg.RabbitMQ.Password,
-		},
-		PrefetchCount: a.cfg.RabbitMQ.Consumer.MessagesBufferSize,
-	})
+	// получаем консьюмера и продьюсера брокера, выбранного в конфиге
+	consumer, producer, err := a.newMessageQueue()
 	// валидируем на ошибки
 	if err != nil {
 		a.logger.Fatal(err)
 	}
-	// получаем интерфейс продьюсера с помошью конструктора
-	producer, err := rabbitmq.NewRabbitMQProducer(rabbitmq.ProducerConfig{
-		BaseConfig: rabbitmq.BaseConfig{
-			Host:     a.cfg.RabbitMQ.Host,
-			Port:     a.cfg.RabbitMQ.Port,
-			Username: a.cfg.RabbitMQ.Username,
-			Password: a.cfg.RabbitMQ.Password,
-		},
-	})
-	// валидируем на ошибки
+	// очереди из конфига могут ещё не существовать, объявляем их до подписки
+	if err := a.applyTopology(ctx, consumer); err != nil {
+		a.logger.Fatal(err)
+	}
+	pools := a.poolConfigs()
+	if a.metrics != nil {
+		queues := []string{a.cfg.RabbitMQ.Producer.Queue}
+		for _, pool := range pools {
+			queues = append(queues, pool.Queue)
+		}
+		if err := a.metrics.mq.Queues(consumer, queues...); err != nil {
+			a.logger.Errorf("failed to register queue metrics due to error %v", err)
+		}
+		a.metrics.mq.WatchState("producer", producer)
+		producer = a.metrics.mq.Producer(producer)
+	}
+	// большие тела идут через хранилище, обработчики получают сообщение уже с телом
+	if a.cfg.ClaimCheck.Enabled {
+		claims, err := a.newClaimCheck()
+		if err != nil {
+			a.logger.Fatal(err)
+		}
+		a.claims = &claims
+	}
+	a.payloadCfg, err = a.payloadConfig()
 	if err != nil {
 		a.logger.Fatal(err)
 	}
-	// отправляем в консьюмер очередь, затем считываем с очереди сообщения переконвертируем канал Delivery в наш канал Message и возвращаем его, всё это происходит паралельно
-	messages, err := consumer.Consume(a.cfg.RabbitMQ.Consumer.Queue)
-	// валидируем на ошибки
+	// консьюмер для ответов rpc, очереди пулов читают собственные консьюмеры
+	consumer, err = a.wrapConsumer("consumer", consumer)
 	if err != nil {
 		a.logger.Fatal(err)
 	}
+	// паника в обработчике не должна ронять бота, неудачи пишем в лог вместе с итогом
+	middlewares := []mq.Middleware{mq.Recover(), mq.Logging(a.logger.Errorf)}
+	if a.metrics != nil {
+		middlewares = append(middlewares, a.metrics.mq.Middleware())
+	}
+	// повторная доставка уже обработанного ответа не должна отправлять трек в чат второй раз
+	deduplicate, err := a.newDedup()
+	if err != nil {
+		a.logger.Fatal(err)
+	}
+	if deduplicate != nil {
+		middlewares = append(middlewares, deduplicate)
+	}
 
-	// запускаем цикл по количеству событий, указанному в конфиге
-	for i := 0; i < a.cfg.AppConfig.Eventworkers; i++ {
-		// с помошью конструктора получаем обьект Воркера
-		worker := events.NewWorker(i, consumer, producer, messages, a.logger,a.bot)
-		// запускаем горутину процесс
-		go worker.Proccess()
-		// уведомляем о старте воркера
-		a.logger.Infof("Event Worker #%d started", i)
+	// роутер передаёт событие обработчику его типа, событие без обработчика уходит в parking очередь
+	router := events.NewRouter(a.events, a.logger)
+	if err := events.RegisterHandlers(router, a.bot); err != nil {
+		a.logger.Fatal(err)
+	}
+	for _, route := range router.Routes() {
+		a.logger.Infof("event %s v%v routed to %s", route.Type, route.Versions, route.Handler)
+	}
+	expvar.Publish("event_routes", expvar.Func(func() interface{} {
+		return router.Routes()
+	}))
+	// у каждой очереди свой пул воркеров, пул который не запустился не мешает остальным
+	for _, cfg := range pools {
+		a.pools = append(a.pools, a.startPool(ctx, cfg, router, middlewares))
 	}
+	expvar.Publish("pools", expvar.Func(func() interface{} {
+		statuses := make([]poolStatus, 0, len(a.pools))
+		for _, p := range a.pools {
+			statuses = append(statuses, p.status())
+		}
+		return statuses
+	}))
+	// исходящие сообщения сначала пишутся в outbox, так запросы переживают недоступность брокера
+	if a.cfg.Outbox.Enabled {
+		producer, err = a.newOutbox(ctx, producer)
+		if err != nil {
+			a.logger.Fatal(err)
+		}
+	}
+	// тело сохраняется в хранилище до записи в outbox, так в базе outbox лежит только ссылка
+	if a.claims != nil {
+		producer = claimcheck.NewProducer(producer, *a.claims)
+	}
+	// сжатие и шифрование до claim check, так тело и в брокере, и в хранилище лежит в закрытом виде
+	producer, err = payload.NewProducer(producer, a.payloadCfg)
+	if err != nil {
+		a.logger.Fatal(err)
+	}
+	// клиент запрос/ответ, ответы на /yt приходят в собственную очередь инстанса
+	rpc, err := mq.NewRPCClient(ctx, producer, consumer, mq.RPCConfig{
+		ReplyQueue: a.cfg.RabbitMQ.RPC.ReplyQueue,
+		Timeout:    a.cfg.RabbitMQ.RPC.Timeout,
+		// ответ пришедший после таймаута отдаём воркерам, они отправят трек в чат по RequestID
+		Late: func(msg mq.Message) {
+			if err := producer.PublishMessage(ctx, a.cfg.RabbitMQ.Consumer.Queue, msg); err != nil {
+				a.logger.Errorf("failed to forward late reply %s due to error %v", msg.CorrelationID, err)
+			}
+		},
+	})
+	if err != nil {
+		a.logger.Fatal(err)
+	}
+	a.consumer = consumer
 	a.producer = producer
+	a.rpc = rpc
 }
 
-func (a *app) startBot() {
+func (a *app) startBot(ctx context.Context) {
 	a.logger.Info()
 
 	pref := tele.Settings{
@@ -125,18 +271,37 @@ func (a *app) startBot() {
 			Name:      trackName,
 		}
 
-		marshal, err := json.Marshal(request)
+		msg, err := a.events.Encode(request)
 		if err != nil {
-			c.Send("Не удалось сконвертировать ваш запрос")
+			return c.Send("Не удалось сконвертировать ваш запрос")
 		}
 
-		if err := a.producer.Publish(a.cfg.RabbitMQ.Producer.Queue, marshal); err != nil {
+		// ждём ответ сервиса поиска, но не дольше таймаута из конфига, публикация тоже укладывается в этот дедлайн
+		callCtx, cancel := context.WithTimeout(ctx, a.cfg.RabbitMQ.RPC.Timeout)
+		defer cancel()
+		reply, err := a.rpc.CallMessage(callCtx, a.cfg.RabbitMQ.Producer.Queue, msg)
+		if errors.Is(err, mq.ErrRPCTimeout) {
+			return c.Send("Поиск трека занимает больше времени чем обычно, пришлю ответ как только он будет готов")
+		}
+		if err != nil {
 			return c.Send("не удалось обработать ваш запрос, по следующей причине ", err)
 		}
 
-		sendText = "какой-то трек, текст заглушка, проблемы с Google service Youtube Data API"
+		decoded, err := a.events.Decode(reply)
+		if err != nil {
+			a.logger.Errorf("failed to decode search track response due to error %v", err)
+			return c.Send("Запрос не обработан, произошла ошибка")
+		}
+		response, ok := decoded.Payload.(*events.SearchTrackResponse)
+		if !ok {
+			a.logger.Errorf("unexpected reply event %s v%d", decoded.Type, decoded.Version)
+			return c.Send("Запрос не обработан, произошла ошибка")
+		}
+		if response.Success == "true" {
+			sendText = response.Name
+		}
 		return c.Send(fmt.Sprintf("Вот твой трек: %s", sendText))
-	})
+	}, a.botHandler("/yt"))
 
 	a.bot.Handle(tele.OnPhoto, func(c tele.Context) error {
 		photo := c.Message().Photo
@@ -162,12 +327,12 @@ func (a *app) startBot() {
 		}
 
 		var image string
-		image, err = a.imgurService.ShareImage(context.Background(), buf.Bytes())
+		image, err = a.imgurService.ShareImage(ctx, buf.Bytes())
 		if err != nil {
 			return c.Send("Не удалось залить изображение!")
 		}
 		return c.Send(image)
-	})
+	}, a.botHandler("photo"))
 
 }
 
@@ -3,10 +3,33 @@ package config
 import (
 	"log"
 	"sync"
+	"time"
 
 	"github.com/ilyakaznacheev/cleanenv"
 )
 
+// бэкенды брокера сообщений
+const (
+	BackendRabbitMQ = "rabbitmq"
+	BackendMemory   = "memory"
+	BackendNATS     = "nats"
+	BackendRedis    = "redis"
+)
+
+// хранилища дедупликации
+const (
+	DedupMemory = "memory"
+	DedupRedis  = "redis"
+	DedupBolt   = "bolt"
+	DedupNone   = "none"
+)
+
+// хранилища тел больших сообщений
+const (
+	ClaimCheckFile = "file"
+	ClaimCheckS3   = "s3"
+)
+
 // Config основная структура конфигурации
 type Config struct {
 	IsDebug       bool `yaml:"is_debug" env:"ST_BOT_IS_DEBUG" env-default:"false"`
@@ -15,22 +38,194 @@ type Config struct {
 		Token string `yaml:"token" env:"ST_BOT_TELEGRAM_TOKEN"  env-default:"5497403137:AAE8gjAgTjUqzEObDSxf2PxKVriPurMAJb0"`
 	}
 	RabbitMQ struct {
+		// URI полный адрес amqp:// или amqps://, если задан то host, port, username и password не нужны
+		URI      string `yaml:"uri" env:"ST_BOT_RABBIT_URI"`
 		Host     string `yaml:"host" env:"ST_BOT_RABBIT_HOST" `
 		Port     string `yaml:"port" env:"ST_BOT_RABBIT_PORT" `
 		Username string `yaml:"username" env:"ST_BOT_RABBIT_USERNAME" `
 		Password string `yaml:"password" env:"ST_BOT_RABBIT_PASSWORD" `
+		VHost    string `yaml:"vhost" env:"ST_BOT_RABBIT_VHOST"`
+		TLS      struct {
+			Enabled    bool   `yaml:"enabled" env:"ST_BOT_RABBIT_TLS_ENABLED" env-default:"false"`
+			CAFile     string `yaml:"ca_file" env:"ST_BOT_RABBIT_TLS_CA_FILE"`
+			CertFile   string `yaml:"cert_file" env:"ST_BOT_RABBIT_TLS_CERT_FILE"`
+			KeyFile    string `yaml:"key_file" env:"ST_BOT_RABBIT_TLS_KEY_FILE"`
+			ServerName string `yaml:"server_name" env:"ST_BOT_RABBIT_TLS_SERVER_NAME"`
+			// SkipVerify не проверять сертификат брокера, только для разработки
+			SkipVerify bool `yaml:"skip_verify" env:"ST_BOT_RABBIT_TLS_SKIP_VERIFY" env-default:"false"`
+		} `yaml:"tls"`
+		Heartbeat      time.Duration `yaml:"heartbeat" env:"ST_BOT_RABBIT_HEARTBEAT" env-default:"10s"`
+		ConnectionName string        `yaml:"connection_name" env:"ST_BOT_RABBIT_CONNECTION_NAME" env-default:"telegram-bot"`
+		// Reconnect задержки между попытками переподключения к RabbitMQ
+		Reconnect struct {
+			Initial    time.Duration `yaml:"initial" env:"ST_BOT_RABBIT_RECONNECT_INITIAL" env-default:"1s"`
+			Max        time.Duration `yaml:"max" env:"ST_BOT_RABBIT_RECONNECT_MAX" env-default:"1m"`
+			Multiplier float64       `yaml:"multiplier" env:"ST_BOT_RABBIT_RECONNECT_MULTIPLIER" env-default:"2"`
+			// Jitter случайное отклонение задержки, ноль в конфиге заменяется значением по умолчанию, -1 отключает отклонение
+			Jitter     float64       `yaml:"jitter" env:"ST_BOT_RABBIT_RECONNECT_JITTER" env-default:"0.2"`
+		} `yaml:"reconnect"`
 		Consumer struct {
 			// Youtube            string `yaml:"youtube" env:"ST_BOT_RABBIT_CONSUMER_YOUTUBE" `
 			// Imgur              string `yaml:"imgur" env:"ST_BOT_RABBIT_CONSUMER_IMGUR" `
 			Queue              string `yaml:"queue"`
 			MessagesBufferSize int    `yaml:"messages_buff_size" env:"ST_BOT_RABBIT_CONSUMER_MBS" env-default:"100"`
+			// Queues очереди с собственными пулами воркеров. Если список пуст, очередь queue читает один пул
+			// с app.event_workers.youtube воркерами и всеми обработчиками событий
+			Queues []struct {
+				Name string `yaml:"name"`
+				// Workers сколько сообщений очереди обрабатывается параллельно
+				Workers int `yaml:"workers"`
+				// Prefetch сколько неподтверждённых сообщений брокер отдаёт пулу, 0 значит messages_buff_size
+				Prefetch int `yaml:"prefetch"`
+				// Handlers имена обработчиков событий пула, пусто значит все. Событие без обработчика в пуле уходит в parking очередь
+				Handlers []string `yaml:"handlers"`
+			} `yaml:"queues"`
+			// Retry повторы обработки сообщений, переменные окружения ST_BOT_RABBIT_RETRY_*
+			Retry Retry `yaml:"retry" env-prefix:"ST_BOT_RABBIT_"`
 		} `yaml:"consumer"`
 		Producer struct {
 			// Youtube string `yaml:"youtube" env:"ST_BOT_RABBIT_PRODUCER_YOUTUBE" `
 			// Imgur   string `yaml:"imgur" env:"ST_BOT_RABBIT_PRODUCER_IMGUR" `
-			Queue string `yaml:"queue"`
+			Queue          string        `yaml:"queue"`
+			Confirm        bool          `yaml:"confirm" env:"ST_BOT_RABBIT_PRODUCER_CONFIRM" env-default:"true"`
+			ConfirmTimeout time.Duration `yaml:"confirm_timeout" env:"ST_BOT_RABBIT_PRODUCER_CONFIRM_TIMEOUT" env-default:"5s"`
+			// AppID и ContentType по умолчанию для публикуемых сообщений, бот отправляет JSON
+			AppID       string `yaml:"app_id" env:"ST_BOT_RABBIT_PRODUCER_APP_ID" env-default:"telegram-bot"`
+			ContentType string `yaml:"content_type" env:"ST_BOT_RABBIT_PRODUCER_CONTENT_TYPE" env-default:"application/json"`
+			// Channels размер пула каналов для параллельных публикаций из обработчиков бота
+			Channels int `yaml:"channels" env:"ST_BOT_RABBIT_PRODUCER_CHANNELS" env-default:"4"`
+			// DelayPrecision до скольки округляется задержка отложенных сообщений, на каждое значение своя очередь задержки
+			DelayPrecision time.Duration `yaml:"delay_precision" env:"ST_BOT_RABBIT_PRODUCER_DELAY_PRECISION" env-default:"1s"`
 		} `yaml:"producer"`
+		RPC struct {
+			// ReplyQueue очередь ответов инстанса, если пусто то имя генерируется
+			ReplyQueue string        `yaml:"reply_queue" env:"ST_BOT_RABBIT_RPC_REPLY_QUEUE"`
+			Timeout    time.Duration `yaml:"timeout" env:"ST_BOT_RABBIT_RPC_TIMEOUT" env-default:"30s"`
+		} `yaml:"rpc"`
 	}`yaml:"rabbit_mq"`
+	// NATS подключение для бэкенда nats, очереди берутся из rabbit_mq
+	NATS struct {
+		URL           string        `yaml:"url" env:"ST_BOT_NATS_URL" env-default:"nats://127.0.0.1:4222"`
+		Name          string        `yaml:"name" env:"ST_BOT_NATS_NAME" env-default:"telegram-bot"`
+		ReconnectWait time.Duration `yaml:"reconnect_wait" env:"ST_BOT_NATS_RECONNECT_WAIT" env-default:"2s"`
+		// AckWait через сколько неподтверждённое сообщение доставляется заново
+		AckWait time.Duration `yaml:"ack_wait" env:"ST_BOT_NATS_ACK_WAIT" env-default:"30s"`
+		// Producer переменные окружения ST_BOT_NATS_PRODUCER_*
+		Producer Publishing `yaml:"producer" env-prefix:"ST_BOT_NATS_"`
+		// Retry переменные окружения ST_BOT_NATS_RETRY_*
+		Retry Retry `yaml:"retry" env-prefix:"ST_BOT_NATS_"`
+	} `yaml:"nats"`
+	// Redis подключение для бэкенда redis (Redis Streams), очереди берутся из rabbit_mq
+	Redis struct {
+		Addr     string `yaml:"addr" env:"ST_BOT_REDIS_ADDR" env-default:"127.0.0.1:6379"`
+		Username string `yaml:"username" env:"ST_BOT_REDIS_USERNAME"`
+		Password string `yaml:"password" env:"ST_BOT_REDIS_PASSWORD"`
+		DB       int    `yaml:"db" env:"ST_BOT_REDIS_DB" env-default:"0"`
+		Group    string `yaml:"group" env:"ST_BOT_REDIS_GROUP" env-default:"telegram-bot"`
+		// ClaimIdle через сколько сообщение упавшего инстанса забирает другой инстанс
+		ClaimIdle time.Duration `yaml:"claim_idle" env:"ST_BOT_REDIS_CLAIM_IDLE" env-default:"1m"`
+		// MaxLen примерная максимальная длина стрима, 0 без ограничения
+		MaxLen int64 `yaml:"max_len" env:"ST_BOT_REDIS_MAX_LEN" env-default:"0"`
+		// Producer переменные окружения ST_BOT_REDIS_PRODUCER_*
+		Producer Publishing `yaml:"producer" env-prefix:"ST_BOT_REDIS_"`
+		// Retry переменные окружения ST_BOT_REDIS_RETRY_*
+		Retry Retry `yaml:"retry" env-prefix:"ST_BOT_REDIS_"`
+	} `yaml:"redis"`
+	// Events формат событий в очередях
+	Events struct {
+		// ContentType кодек конверта: application/json, application/x-msgpack или application/x-protobuf, последний только для protobuf событий
+		ContentType string `yaml:"content_type" env:"ST_BOT_EVENTS_CONTENT_TYPE" env-default:"application/json"`
+		// Source имя сервиса которое попадает в конверт события
+		Source string `yaml:"source" env:"ST_BOT_EVENTS_SOURCE" env-default:"telegram-bot"`
+	} `yaml:"events"`
+	// Outbox локальная база исходящих сообщений, из неё они доставляются брокеру когда он доступен
+	Outbox struct {
+		Enabled        bool          `yaml:"enabled" env:"ST_BOT_OUTBOX_ENABLED" env-default:"false"`
+		Path           string        `yaml:"path" env:"ST_BOT_OUTBOX_PATH" env-default:"data/outbox.db"`
+		BatchSize      int           `yaml:"batch_size" env:"ST_BOT_OUTBOX_BATCH_SIZE" env-default:"100"`
+		RetryInterval  time.Duration `yaml:"retry_interval" env:"ST_BOT_OUTBOX_RETRY_INTERVAL" env-default:"1s"`
+		PublishTimeout time.Duration `yaml:"publish_timeout" env:"ST_BOT_OUTBOX_PUBLISH_TIMEOUT" env-default:"10s"`
+		// MaxAttempts после стольких отказов подключённого брокера запись откладывается в parked, 0 без ограничения
+		MaxAttempts int `yaml:"max_attempts" env:"ST_BOT_OUTBOX_MAX_ATTEMPTS" env-default:"10"`
+	} `yaml:"outbox"`
+	// Dedup хранилище ключей обработанных сообщений, по нему воркеры пропускают повторные доставки
+	Dedup struct {
+		// Store memory, redis (подключение из секции redis), bolt или none
+		Store string        `yaml:"store" env:"ST_BOT_DEDUP_STORE" env-default:"memory"`
+		TTL   time.Duration `yaml:"ttl" env:"ST_BOT_DEDUP_TTL" env-default:"24h"`
+		Lease time.Duration `yaml:"lease" env:"ST_BOT_DEDUP_LEASE" env-default:"1m"`
+		// Size сколько ключей помнит хранилище memory
+		Size int `yaml:"size" env:"ST_BOT_DEDUP_SIZE" env-default:"10000"`
+		// Path файл базы для хранилища bolt
+		Path string `yaml:"path" env:"ST_BOT_DEDUP_PATH" env-default:"data/dedup.db"`
+		// CorrelationFallback сообщения без message id проверяются по correlation id. Только если на каждый запрос
+		// приходит один ответ, иначе ответы на один запрос отбросятся как дубликаты
+		CorrelationFallback bool `yaml:"correlation_fallback" env:"ST_BOT_DEDUP_CORRELATION_FALLBACK" env-default:"false"`
+	} `yaml:"dedup"`
+	// Topology exchange, очереди и привязки которые бот объявляет при старте и после каждого переподключения.
+	// Очереди rabbit_mq.consumer.queue и rabbit_mq.producer.queue объявляются durable даже если их здесь нет
+	Topology struct {
+		Exchanges []struct {
+			Name       string                 `yaml:"name"`
+			Kind       string                 `yaml:"kind"`
+			Durable    bool                   `yaml:"durable"`
+			AutoDelete bool                   `yaml:"auto_delete"`
+			Args       map[string]interface{} `yaml:"args"`
+		} `yaml:"exchanges"`
+		// Queues очереди с аргументами брокера, например x-queue-type: quorum, x-max-length, x-message-ttl, x-dead-letter-exchange
+		Queues []struct {
+			Name       string                 `yaml:"name"`
+			Durable    bool                   `yaml:"durable"`
+			AutoDelete bool                   `yaml:"auto_delete"`
+			Exclusive  bool                   `yaml:"exclusive"`
+			Args       map[string]interface{} `yaml:"args"`
+		} `yaml:"queues"`
+		Bindings []struct {
+			Queue    string                 `yaml:"queue"`
+			Exchange string                 `yaml:"exchange"`
+			Key      string                 `yaml:"key"`
+			Args     map[string]interface{} `yaml:"args"`
+		} `yaml:"bindings"`
+	} `yaml:"topology"`
+	// Metrics HTTP эндпоинт с метриками Prometheus
+	Metrics struct {
+		Enabled bool   `yaml:"enabled" env:"ST_BOT_METRICS_ENABLED" env-default:"false"`
+		Listen  string `yaml:"listen" env:"ST_BOT_METRICS_LISTEN" env-default:":9090"`
+		Path    string `yaml:"path" env:"ST_BOT_METRICS_PATH" env-default:"/metrics"`
+	} `yaml:"metrics"`
+	// ClaimCheck тела сообщений больше порога кладутся в хранилище, через брокер идёт только ссылка на них
+	ClaimCheck struct {
+		Enabled bool `yaml:"enabled" env:"ST_BOT_CLAIM_CHECK_ENABLED" env-default:"false"`
+		// Threshold размер тела в байтах после которого оно уходит в хранилище
+		Threshold int `yaml:"threshold" env:"ST_BOT_CLAIM_CHECK_THRESHOLD" env-default:"262144"`
+		// Store file (каталог общий для продьюсера и консьюмера) или s3 (S3 совместимое хранилище, например MinIO)
+		Store string `yaml:"store" env:"ST_BOT_CLAIM_CHECK_STORE" env-default:"file"`
+		// Path каталог для хранилища file
+		Path string `yaml:"path" env:"ST_BOT_CLAIM_CHECK_PATH" env-default:"data/claims"`
+		S3   struct {
+			Endpoint  string `yaml:"endpoint" env:"ST_BOT_CLAIM_CHECK_S3_ENDPOINT" env-default:"http://127.0.0.1:9000"`
+			Region    string `yaml:"region" env:"ST_BOT_CLAIM_CHECK_S3_REGION" env-default:"us-east-1"`
+			Bucket    string `yaml:"bucket" env:"ST_BOT_CLAIM_CHECK_S3_BUCKET" env-default:"telegram-bot"`
+			AccessKey string `yaml:"access_key" env:"ST_BOT_CLAIM_CHECK_S3_ACCESS_KEY"`
+			SecretKey string `yaml:"secret_key" env:"ST_BOT_CLAIM_CHECK_S3_SECRET_KEY"`
+			Prefix    string `yaml:"prefix" env:"ST_BOT_CLAIM_CHECK_S3_PREFIX" env-default:"claims/"`
+		} `yaml:"s3"`
+	} `yaml:"claim_check"`
+	// Payload сжатие и шифрование тел сообщений, консьюмер восстанавливает тело по заголовкам сообщения
+	Payload struct {
+		// Compression none, gzip или zstd
+		Compression string `yaml:"compression" env:"ST_BOT_PAYLOAD_COMPRESSION" env-default:"none"`
+		// CompressMinSize тела меньше этого размера в байтах не сжимаются
+		CompressMinSize int `yaml:"compress_min_size" env:"ST_BOT_PAYLOAD_COMPRESS_MIN_SIZE" env-default:"1024"`
+		Encryption      struct {
+			Enabled bool `yaml:"enabled" env:"ST_BOT_PAYLOAD_ENCRYPTION_ENABLED" env-default:"false"`
+			// PrimaryKey идентификатор ключа которым шифруются новые сообщения
+			PrimaryKey string `yaml:"primary_key" env:"ST_BOT_PAYLOAD_ENCRYPTION_PRIMARY_KEY"`
+			// Keys ключи AES в base64 по идентификатору, 16, 24 или 32 байта. Старые ключи остаются в списке
+			// пока в очередях есть сообщения зашифрованные ими
+			Keys map[string]string `yaml:"keys" env:"ST_BOT_PAYLOAD_ENCRYPTION_KEYS"`
+		} `yaml:"encryption"`
+	} `yaml:"payload"`
 	Imgur struct {
 		RefreshToken string `yaml:"refresh_token"`
 		AccessToken  string `yaml:"access_token"`
@@ -39,17 +234,58 @@ type Config struct {
 		URL          string `yaml:"url"`
 	} `yaml:"imgur"`
 
+	// MQBackend брокер сообщений: rabbitmq, nats, redis или memory (очереди внутри процесса, для локального запуска)
+	MQBackend string    `yaml:"mq_backend" env:"ST_BOT_MQ_BACKEND" env-default:"rabbitmq"`
 	AppConfig AppConfig `yaml:"app"`
 }
 
 //AppConfig струтура приложения именно конфигурации
 type AppConfig struct {
-	Eventworkers int `yaml:"event_worker" env-default:"3"`
+	// EventWorker устаревший ключ числа воркеров, читается только если event_workers.youtube не задан
+	EventWorker int `yaml:"event_worker"`
+	// EventWorkers воркеры пулов по умолчанию, youtube читает rabbit_mq.consumer.queue если rabbit_mq.consumer.queues не задан
 	EventWorkers struct {
-		Youtube int `yaml:"youtube" env:"ST_BOT_EVENT_WORKERS_YT" env-default:"3"`
+		// Youtube без env-default, иначе не отличить незаданное значение от устаревшего event_worker, по умолчанию defaultEventWorkers
+		Youtube int `yaml:"youtube" env:"ST_BOT_EVENT_WORKERS_YT"`
 		Imgur   int `yaml:"imgur" env:"ST_BOT_EVENT_WORKERS_IMGUR" env-default:"3"`
 	} `yaml:"event_workers"`
 	LogLevel string `yaml:"log_level" env:"ST_BOT_LOG_LEVEL" env-default:"error"`
+	// ShutdownTimeout сколько при остановке ждать воркеров, которые ещё обрабатывают сообщения
+	ShutdownTimeout time.Duration `yaml:"shutdown_timeout" env:"ST_BOT_SHUTDOWN_TIMEOUT" env-default:"30s"`
+}
+
+// Retry повторы обработки сообщений консьюмером, у каждого бэкенда своя секция. Имена переменных
+// окружения получают префикс бэкенда из тега env-prefix поля
+type Retry struct {
+	MaxRetries   int           `yaml:"max_retries" env:"RETRY_MAX" env-default:"3"`
+	InitialDelay time.Duration `yaml:"initial_delay" env:"RETRY_INITIAL_DELAY" env-default:"1s"`
+	Multiplier   float64       `yaml:"multiplier" env:"RETRY_MULTIPLIER" env-default:"2"`
+	MaxDelay     time.Duration `yaml:"max_delay" env:"RETRY_MAX_DELAY" env-default:"1m"`
+	DeadLetter   bool          `yaml:"dead_letter" env:"RETRY_DEAD_LETTER" env-default:"true"`
+}
+
+// Publishing AppID и ContentType по умолчанию для публикуемых сообщений бэкендов nats и redis,
+// у rabbitmq они в rabbit_mq.producer
+type Publishing struct {
+	AppID       string `yaml:"app_id" env:"PRODUCER_APP_ID" env-default:"telegram-bot"`
+	ContentType string `yaml:"content_type" env:"PRODUCER_CONTENT_TYPE" env-default:"application/json"`
+}
+
+// defaultEventWorkers воркеры пула youtube если не задан ни event_workers.youtube, ни event_worker
+const defaultEventWorkers = 3
+
+// applyDeprecated переносит значение устаревшего ключа event_worker в event_workers.youtube,
+// так конфиги написанные до появления event_workers продолжают работать с тем же числом воркеров
+func (c *AppConfig) applyDeprecated() {
+	switch {
+	case c.EventWorker > 0 && c.EventWorkers.Youtube > 0:
+		log.Printf("app.event_worker is deprecated and ignored, app.event_workers.youtube is %d", c.EventWorkers.Youtube)
+	case c.EventWorker > 0:
+		log.Printf("app.event_worker is deprecated, use app.event_workers.youtube")
+		c.EventWorkers.Youtube = c.EventWorker
+	case c.EventWorkers.Youtube <= 0:
+		c.EventWorkers.Youtube = defaultEventWorkers
+	}
 }
 
 var instance *Config
@@ -67,6 +303,7 @@ func GetConfig(path string) *Config {
 			log.Print(help)
 			log.Fatal(err)
 		}
+		instance.AppConfig.applyDeprecated()
 	})
 	return instance
 }
@@ -0,0 +1,38 @@
+package config
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/ilyakaznacheev/cleanenv"
+)
+
+func TestEventWorkersFallback(t *testing.T) {
+	tests := []struct {
+		name string
+		app  string
+		want int
+	}{
+		{name: "default", app: "log_level: info", want: defaultEventWorkers},
+		{name: "deprecated key", app: "event_worker: 7", want: 7},
+		{name: "new key", app: "event_workers:\n    youtube: 5", want: 5},
+		{name: "new key wins", app: "event_worker: 7\n  event_workers:\n    youtube: 5", want: 5},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "config.yml")
+			if err := os.WriteFile(path, []byte("app:\n  "+tt.app+"\n"), 0o600); err != nil {
+				t.Fatal(err)
+			}
+			var cfg Config
+			if err := cleanenv.ReadConfig(path, &cfg); err != nil {
+				t.Fatal(err)
+			}
+			cfg.AppConfig.applyDeprecated()
+			if got := cfg.AppConfig.EventWorkers.Youtube; got != tt.want {
+				t.Fatalf("got %d youtube workers, want %d", got, tt.want)
+			}
+		})
+	}
+}
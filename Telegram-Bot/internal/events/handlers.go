@@ -0,0 +1,48 @@
+package events
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+
+	"github.com/Maksat-luci/Telegram-Bot/pkg/client/mq"
+	"github.com/Maksat-luci/Telegram-Bot/pkg/client/mq/envelope"
+	tele "gopkg.in/telebot.v3"
+)
+
+//searchTrackHandler отправляет в чат ответ сервиса поиска
+type searchTrackHandler struct {
+	bot *tele.Bot
+}
+
+//RegisterHandlers регистрирует в роутере обработчики событий бота
+func RegisterHandlers(router *Router, bot *tele.Bot) error {
+	if bot == nil {
+		return errors.New("bot is not created, handlers have nothing to send replies with")
+	}
+	search := &searchTrackHandler{bot: bot}
+	return router.Handle(TypeSearchTrackResponse, "search_track", search.Handle)
+}
+
+// Handle обрабатывает ответ сервиса поиска и отправляет трек в чат
+func (h *searchTrackHandler) Handle(ctx context.Context, e envelope.Event) error {
+	event, ok := e.Payload.(*SearchTrackResponse)
+	if !ok {
+		return mq.WithOutcome(fmt.Errorf("unexpected payload %T of event %s", e.Payload, e.Type), mq.OutcomeDeadLetter)
+	}
+	i,_ := strconv.ParseInt(event.RequestID, 10 , 64)
+	id, err  := h.bot.ChatByID(i)
+	if err != nil {
+		// телеграм мог быть временно недоступен, повторяем позже
+		return fmt.Errorf("failed to get chat bu id due to error %v", err)
+	}
+	message := "Запрос не обработан, произошла ошибка"
+	if event.Success == "true"{
+		message = event.Name
+	}
+	if _, err := h.bot.Send(id,message); err != nil {
+		return fmt.Errorf("failed to Send chat bu id due to error %v", err)
+	}
+	return nil
+}
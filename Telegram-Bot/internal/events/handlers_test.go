@@ -0,0 +1,29 @@
+package events
+
+import (
+	"testing"
+
+	"github.com/Maksat-luci/Telegram-Bot/pkg/client/mq/envelope"
+	tele "gopkg.in/telebot.v3"
+)
+
+func TestRegisterHandlers(t *testing.T) {
+	registry, err := NewRegistry(envelope.Config{Source: "test"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// без бота обработчику нечем отправлять ответы, регистрация должна упасть сразу, а не в воркере
+	if err := RegisterHandlers(NewRouter(registry, nil), nil); err == nil {
+		t.Fatal("handlers registered without bot")
+	}
+
+	router := NewRouter(registry, nil)
+	if err := RegisterHandlers(router, &tele.Bot{}); err != nil {
+		t.Fatal(err)
+	}
+	routes := router.Routes()
+	if len(routes) != 1 || routes[0].Type != TypeSearchTrackResponse || routes[0].Handler != "search_track" {
+		t.Fatalf("unexpected routes %+v", routes)
+	}
+}
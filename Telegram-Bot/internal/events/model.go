@@ -1,5 +1,15 @@
 package events
 
+import (
+	"github.com/Maksat-luci/Telegram-Bot/pkg/client/mq/envelope"
+)
+
+// типы событий бота, версия схемы хранится в конверте отдельно
+const (
+	TypeSearchTrackRequest  = "youtube.search_track.request"
+	TypeSearchTrackResponse = "youtube.search_track.response"
+)
+
 // SearchTrackRequest структура консьюмера для rabbit MQ
 type SearchTrackRequest struct {
 	RequestID string `json:"request_id"`
@@ -13,3 +23,22 @@ type SearchTrackResponse struct {
 	Success   string `json:"success,omitempty"`
 	Error     string `json:"err,omitempty"`
 }
+
+// NewRegistry конструктор реестра с событиями бота. Сервис поиска пока отвечает без конверта,
+// поэтому такие сообщения читаются как SearchTrackResponse первой версии
+func NewRegistry(cfg envelope.Config) (*envelope.Registry, error) {
+	registry, err := envelope.NewRegistry(cfg)
+	if err != nil {
+		return nil, err
+	}
+	if err := registry.Register(TypeSearchTrackRequest, 1, SearchTrackRequest{}); err != nil {
+		return nil, err
+	}
+	if err := registry.Register(TypeSearchTrackResponse, 1, SearchTrackResponse{}); err != nil {
+		return nil, err
+	}
+	if err := registry.SetLegacy(TypeSearchTrackResponse, 1); err != nil {
+		return nil, err
+	}
+	return registry, nil
+}
@@ -0,0 +1,120 @@
+package events
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+
+	"github.com/Maksat-luci/Telegram-Bot/pkg/client/mq"
+	"github.com/Maksat-luci/Telegram-Bot/pkg/client/mq/envelope"
+	"github.com/Maksat-luci/Telegram-Bot/pkg/logging"
+)
+
+// Handler обработчик событий одного типа, payload уже раскодирован и переведён на последнюю версию схемы.
+// Ошибка без итога повторяется, итог задаётся через mq.WithOutcome
+type Handler func(ctx context.Context, event envelope.Event) error
+
+// Route маршрут роутера для диагностики
+type Route struct {
+	// Type тип события
+	Type string `json:"type"`
+	// Versions версии схемы события которые знает реестр
+	Versions []int `json:"versions"`
+	// Handler имя обработчика
+	Handler string `json:"handler"`
+}
+
+// route обработчик и его имя
+type route struct {
+	name    string
+	handler Handler
+}
+
+// errUnrouted для типа события нет обработчика
+var errUnrouted = errors.New("no handler for event")
+
+// Router раскрывает конверт и передаёт событие обработчику его типа. Очередь читает mq.Subscriber,
+// Dispatch это его обработчик, так новой интеграции достаточно зарегистрировать свой Handler
+type Router struct {
+	registry *envelope.Registry
+	logger   *logging.Logger
+	lock     sync.RWMutex
+	routes   map[string]route
+}
+
+// NewRouter конструктор роутера, типы событий должны быть зарегистрированы в registry. Без logger роутер не пишет лог
+func NewRouter(registry *envelope.Registry, logger *logging.Logger) *Router {
+	if logger == nil {
+		logger = logging.Discard()
+	}
+	return &Router{registry: registry, logger: logger, routes: make(map[string]route)}
+}
+
+// Handle регистрирует обработчик name для событий eventType, у типа может быть только один обработчик
+func (r *Router) Handle(eventType, name string, handler Handler) error {
+	if len(r.registry.Versions(eventType)) == 0 {
+		return fmt.Errorf("failed to route %s due %w", eventType, envelope.ErrUnknownEvent)
+	}
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if existing, ok := r.routes[eventType]; ok {
+		return fmt.Errorf("event %s already routed to %s", eventType, existing.name)
+	}
+	r.routes[eventType] = route{name: name, handler: handler}
+	return nil
+}
+
+// Subset возвращает роутер только с обработчиками names, пустой список значит все обработчики роутера
+func (r *Router) Subset(names []string) (*Router, error) {
+	if len(names) == 0 {
+		return r, nil
+	}
+	r.lock.RLock()
+	defer r.lock.RUnlock()
+	subset := NewRouter(r.registry, r.logger)
+	for _, name := range names {
+		found := false
+		for eventType, route := range r.routes {
+			if route.name == name {
+				subset.routes[eventType] = route
+				found = true
+			}
+		}
+		if !found {
+			return nil, fmt.Errorf("unknown event handler %q", name)
+		}
+	}
+	return subset, nil
+}
+
+// Routes возвращает маршруты отсортированные по типу события
+func (r *Router) Routes() []Route {
+	r.lock.RLock()
+	defer r.lock.RUnlock()
+	routes := make([]Route, 0, len(r.routes))
+	for eventType, route := range r.routes {
+		routes = append(routes, Route{Type: eventType, Versions: r.registry.Versions(eventType), Handler: route.name})
+	}
+	sort.Slice(routes, func(i, j int) bool { return routes[i].Type < routes[j].Type })
+	return routes
+}
+
+// Dispatch раскодирует сообщение и вызывает обработчик его типа. Битое сообщение и событие без обработчика
+// повторять бесполезно, они откладываются в parking очередь для разбора
+func (r *Router) Dispatch(ctx context.Context, msg mq.Message) error {
+	// кодек выбирается по ContentType, тип payload по типу и версии события
+	event, err := r.registry.Decode(msg)
+	if err != nil {
+		r.logger.Debugf("[router]: body: %s", msg.Body)
+		return mq.WithOutcome(fmt.Errorf("failed to decode event due to error %w", err), mq.OutcomeDeadLetter)
+	}
+	r.lock.RLock()
+	route, ok := r.routes[event.Type]
+	r.lock.RUnlock()
+	if !ok {
+		return mq.WithOutcome(fmt.Errorf("%w %s v%d", errUnrouted, event.Type, event.Version), mq.OutcomeDeadLetter)
+	}
+	return route.handler(ctx, event)
+}
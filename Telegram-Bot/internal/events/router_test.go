@@ -0,0 +1,144 @@
+package events
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/Maksat-luci/Telegram-Bot/pkg/client/mq"
+	"github.com/Maksat-luci/Telegram-Bot/pkg/client/mq/envelope"
+)
+
+// события для тестов роутера, у test.created две версии схемы
+type (
+	createdV1 struct {
+		Name string `json:"name"`
+	}
+	createdV2 struct {
+		Name  string `json:"name"`
+		Count int    `json:"count"`
+	}
+	deleted struct {
+		Name string `json:"name"`
+	}
+	unrouted struct{}
+)
+
+// newTestRouter роутер без логгера с обработчиками test.created и test.deleted, обработчики пишут полученные события в events
+func newTestRouter(t *testing.T) (*envelope.Registry, *Router, *[]envelope.Event) {
+	t.Helper()
+	registry, err := envelope.NewRegistry(envelope.Config{Source: "test"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, r := range []struct {
+		eventType string
+		version   int
+		payload   interface{}
+	}{
+		{"test.created", 1, createdV1{}},
+		{"test.created", 2, createdV2{}},
+		{"test.deleted", 1, deleted{}},
+		{"test.unrouted", 1, unrouted{}},
+	} {
+		if err := registry.Register(r.eventType, r.version, r.payload); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := registry.RegisterUpgrade("test.created", 1, func(payload interface{}) (interface{}, error) {
+		return &createdV2{Name: payload.(*createdV1).Name, Count: 1}, nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	var events []envelope.Event
+	router := NewRouter(registry, nil)
+	for eventType, name := range map[string]string{"test.created": "created", "test.deleted": "deleted"} {
+		if err := router.Handle(eventType, name, func(ctx context.Context, e envelope.Event) error {
+			events = append(events, e)
+			return nil
+		}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return registry, router, &events
+}
+
+func TestRouterDispatch(t *testing.T) {
+	ctx := context.Background()
+	registry, router, events := newTestRouter(t)
+
+	for _, payload := range []interface{}{createdV1{Name: "old"}, createdV2{Name: "new", Count: 5}, deleted{Name: "gone"}} {
+		msg, err := registry.Encode(payload)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := router.Dispatch(ctx, msg); err != nil {
+			t.Fatalf("dispatch %T: %v", payload, err)
+		}
+	}
+
+	if len(*events) != 3 {
+		t.Fatalf("handlers got %d events, want 3", len(*events))
+	}
+	// первая версия доходит до обработчика уже переведённой на вторую
+	for i, want := range []createdV2{{Name: "old", Count: 1}, {Name: "new", Count: 5}} {
+		e := (*events)[i]
+		payload, ok := e.Payload.(*createdV2)
+		if e.Type != "test.created" || e.Version != 2 || !ok || *payload != want {
+			t.Fatalf("event %d: got %s v%d %+v, want test.created v2 %+v", i, e.Type, e.Version, e.Payload, want)
+		}
+	}
+	if e := (*events)[2]; e.Type != "test.deleted" || e.Payload.(*deleted).Name != "gone" {
+		t.Fatalf("got %s %+v, want test.deleted", e.Type, e.Payload)
+	}
+}
+
+func TestRouterDispatchDeadLetter(t *testing.T) {
+	ctx := context.Background()
+	registry, router, events := newTestRouter(t)
+
+	withoutHandler, err := registry.Encode(unrouted{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	other, err := envelope.NewRegistry(envelope.Config{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := other.Register("test.unknown", 1, deleted{}); err != nil {
+		t.Fatal(err)
+	}
+	unknown, err := other.Encode(deleted{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name    string
+		msg     mq.Message
+		wantErr error
+	}{
+		{name: "no handler", msg: withoutHandler, wantErr: errUnrouted},
+		{name: "unknown type", msg: unknown, wantErr: envelope.ErrUnknownEvent},
+		// роутер без логгера не должен падать на битом сообщении
+		{name: "undecodable body", msg: mq.Message{Body: []byte("{not json"), ContentType: envelope.ContentTypeJSON}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := router.Dispatch(ctx, tt.msg)
+			if err == nil {
+				t.Fatal("message dispatched")
+			}
+			if outcome := mq.OutcomeOf(err); outcome != mq.OutcomeDeadLetter {
+				t.Fatalf("got outcome %v, want %v", outcome, mq.OutcomeDeadLetter)
+			}
+			if tt.wantErr != nil && !errors.Is(err, tt.wantErr) {
+				t.Fatalf("got %v, want %v", err, tt.wantErr)
+			}
+		})
+	}
+	if len(*events) != 0 {
+		t.Fatalf("handlers got %d events, want none", len(*events))
+	}
+}
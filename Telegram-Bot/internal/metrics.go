@@ -0,0 +1,140 @@
+package internal
+
+import (
+	"context"
+	"errors"
+	"expvar"
+	"net/http"
+	"time"
+
+	"github.com/Maksat-luci/Telegram-Bot/pkg/client/mq/metrics"
+	"github.com/Maksat-luci/Telegram-Bot/pkg/client/mq/outbox"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	tele "gopkg.in/telebot.v3"
+)
+
+// httpShutdownTimeout сколько при остановке ждать текущие запросы к /metrics
+const httpShutdownTimeout = 5 * time.Second
+
+// appMetrics метрики бота: mq и обработчики команд
+type appMetrics struct {
+	registry    *prometheus.Registry
+	mq          *metrics.Metrics
+	botHandled  *prometheus.CounterVec
+	botDuration *prometheus.HistogramVec
+}
+
+// startMetrics создаёт реестр метрик и поднимает httpServer с эндпоинтом из конфига и /debug/vars
+func (a *app) startMetrics() error {
+	registry := prometheus.NewRegistry()
+	registry.MustRegister(
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+	)
+	mqMetrics, err := metrics.New(registry)
+	if err != nil {
+		return err
+	}
+	m := &appMetrics{
+		registry: registry,
+		mq:       mqMetrics,
+		botHandled: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "bot_updates_handled_total",
+			Help: "Telegram updates handled, by handler and result.",
+		}, []string{"handler", "result"}),
+		botDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name:    "bot_handle_duration_seconds",
+			Help:    "Time spent in a Telegram handler, including RPC calls to other services.",
+			Buckets: []float64{.05, .1, .25, .5, 1, 2.5, 5, 10, 30, 60},
+		}, []string{"handler"}),
+	}
+	registry.MustRegister(m.botHandled, m.botDuration)
+	a.metrics = m
+
+	mux := http.NewServeMux()
+	mux.Handle(a.cfg.Metrics.Path, promhttp.HandlerFor(registry, promhttp.HandlerOpts{}))
+	// состояние outbox и маршруты событий для диагностики
+	mux.Handle("/debug/vars", expvar.Handler())
+	a.httpServer = &http.Server{Addr: a.cfg.Metrics.Listen, Handler: mux}
+	go func() {
+		a.logger.Infof("metrics listening on %s%s", a.cfg.Metrics.Listen, a.cfg.Metrics.Path)
+		if err := a.httpServer.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			a.logger.Errorf("metrics server stopped due to error %v", err)
+		}
+	}()
+	return nil
+}
+
+// stopMetrics останавливает httpServer
+func (a *app) stopMetrics() {
+	if a.httpServer == nil {
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), httpShutdownTimeout)
+	defer cancel()
+	if err := a.httpServer.Shutdown(ctx); err != nil {
+		a.logger.Errorf("failed to stop metrics server due to error %v", err)
+	}
+}
+
+// botHandler middleware обработчика телеграма, считает результат и время обработки под именем name
+func (a *app) botHandler(name string) tele.MiddlewareFunc {
+	return func(next tele.HandlerFunc) tele.HandlerFunc {
+		if a.metrics == nil {
+			return next
+		}
+		return func(c tele.Context) error {
+			start := time.Now()
+			err := next(c)
+			a.metrics.botDuration.WithLabelValues(name).Observe(time.Since(start).Seconds())
+			result := "ok"
+			if err != nil {
+				result = "error"
+			}
+			a.metrics.botHandled.WithLabelValues(name, result).Inc()
+			return err
+		}
+	}
+}
+
+// outboxMetrics публикует размер outbox и счётчики relay
+func (m *appMetrics) outboxMetrics(box outbox.Outbox) {
+	m.registry.MustRegister(
+		prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Name: "outbox_pending_messages",
+			Help: "Messages written to the outbox and not yet delivered to the broker.",
+		}, func() float64 {
+			return float64(box.Stats().Pending)
+		}),
+		prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Name: "outbox_parked_messages",
+			Help: "Outbox messages the broker did not accept after the maximum number of attempts.",
+		}, func() float64 {
+			return float64(box.Stats().Parked)
+		}),
+		prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Name: "outbox_oldest_age_seconds",
+			Help: "Age of the oldest pending outbox message, 0 if the outbox is empty.",
+		}, func() float64 {
+			oldest := box.Stats().Oldest
+			if oldest.IsZero() {
+				return 0
+			}
+			return time.Since(oldest).Seconds()
+		}),
+		prometheus.NewCounterFunc(prometheus.CounterOpts{
+			Name: "outbox_delivered_total",
+			Help: "Outbox messages delivered to the broker since start.",
+		}, func() float64 {
+			return float64(box.Stats().Delivered)
+		}),
+		prometheus.NewCounterFunc(prometheus.CounterOpts{
+			Name: "outbox_failed_total",
+			Help: "Failed outbox publish attempts since start.",
+		}, func() float64 {
+			return float64(box.Stats().Failed)
+		}),
+	)
+}
@@ -0,0 +1,388 @@
+package internal
+
+import (
+	"context"
+	"encoding/base64"
+	"expvar"
+	"fmt"
+	"time"
+
+	"github.com/Maksat-luci/Telegram-Bot/internal/config"
+	"github.com/Maksat-luci/Telegram-Bot/pkg/client/mq"
+	"github.com/Maksat-luci/Telegram-Bot/pkg/client/mq/claimcheck"
+	"github.com/Maksat-luci/Telegram-Bot/pkg/client/mq/dedup"
+	"github.com/Maksat-luci/Telegram-Bot/pkg/client/mq/memory"
+	"github.com/Maksat-luci/Telegram-Bot/pkg/client/mq/nats"
+	"github.com/Maksat-luci/Telegram-Bot/pkg/client/mq/outbox"
+	"github.com/Maksat-luci/Telegram-Bot/pkg/client/mq/payload"
+	"github.com/Maksat-luci/Telegram-Bot/pkg/client/mq/rabbitmq"
+	"github.com/Maksat-luci/Telegram-Bot/pkg/client/mq/redisstream"
+)
+
+// newMessageQueue создаёт консьюмера и продьюсера бэкенда, выбранного в конфиге
+func (a *app) newMessageQueue() (mq.Consumer, mq.Producer, error) {
+	consumer, err := a.newConsumer("consumer", a.cfg.RabbitMQ.Consumer.MessagesBufferSize)
+	if err != nil {
+		return nil, nil, err
+	}
+	producer, err := a.newProducer()
+	if err != nil {
+		_ = consumer.Close()
+		return nil, nil, err
+	}
+	return consumer, producer, nil
+}
+
+// newConsumer создаёт консьюмера бэкенда из конфига с собственным подключением и prefetch,
+// name попадает в лог смены состояния подключения
+func (a *app) newConsumer(name string, prefetch int) (mq.Consumer, error) {
+	var consumer mq.Consumer
+	var err error
+	switch a.cfg.MQBackend {
+	case config.BackendRabbitMQ:
+		// используем конструктор консьюмера и получаем интерфейс консьюмера
+		consumer, err = rabbitmq.NewRabbitMQConsumer(rabbitmq.ConsumerConfig{
+			BaseConfig:    a.rabbitMQBase(),
+			PrefetchCount: prefetch,
+			Retry:         retryPolicy(a.cfg.RabbitMQ.Consumer.Retry),
+			// копии в retry и parking очередях ждут подтверждения столько же сколько публикации продьюсера
+			ConfirmTimeout: a.cfg.RabbitMQ.Producer.ConfirmTimeout,
+		})
+	case config.BackendNATS:
+		consumer, err = nats.NewNATSConsumer(nats.ConsumerConfig{
+			Config:        a.natsBase(),
+			PrefetchCount: prefetch,
+			AckWait:       a.cfg.NATS.AckWait,
+			Retry:         retryPolicy(a.cfg.NATS.Retry),
+		})
+	case config.BackendRedis:
+		consumer, err = redisstream.NewRedisConsumer(redisstream.ConsumerConfig{
+			Config:        a.redisBase(),
+			PrefetchCount: prefetch,
+			ClaimIdle:     a.cfg.Redis.ClaimIdle,
+			Retry:         retryPolicy(a.cfg.Redis.Retry),
+		})
+	case config.BackendMemory:
+		// брокер живёт внутри процесса, бот работает одним бинарником без RabbitMQ
+		consumer = memory.NewMemoryConsumer(a.memoryBroker(), memory.ConsumerConfig{
+			PrefetchCount: prefetch,
+			Retry:         retryPolicy(a.cfg.RabbitMQ.Consumer.Retry),
+		})
+	default:
+		err = fmt.Errorf("unknown mq backend %q", a.cfg.MQBackend)
+	}
+	if err != nil {
+		return nil, err
+	}
+	a.watchState(name, consumer)
+	return consumer, nil
+}
+
+// newProducer создаёт продьюсера бэкенда, выбранного в конфиге
+func (a *app) newProducer() (mq.Producer, error) {
+	var producer mq.Producer
+	var err error
+	switch a.cfg.MQBackend {
+	case config.BackendRabbitMQ:
+		// получаем интерфейс продьюсера с помошью конструктора
+		producer, err = rabbitmq.NewRabbitMQProducer(rabbitmq.ProducerConfig{
+			BaseConfig:     a.rabbitMQBase(),
+			Confirm:        a.cfg.RabbitMQ.Producer.Confirm,
+			ConfirmTimeout: a.cfg.RabbitMQ.Producer.ConfirmTimeout,
+			AppID:          a.cfg.RabbitMQ.Producer.AppID,
+			ContentType:    a.cfg.RabbitMQ.Producer.ContentType,
+			Channels:       a.cfg.RabbitMQ.Producer.Channels,
+			DelayPrecision: a.cfg.RabbitMQ.Producer.DelayPrecision,
+		})
+	case config.BackendNATS:
+		producer, err = nats.NewNATSProducer(nats.ProducerConfig{
+			Config:      a.natsBase(),
+			AppID:       a.cfg.NATS.Producer.AppID,
+			ContentType: a.cfg.NATS.Producer.ContentType,
+		})
+	case config.BackendRedis:
+		producer, err = redisstream.NewRedisProducer(redisstream.ProducerConfig{
+			Config:      a.redisBase(),
+			MaxLen:      a.cfg.Redis.MaxLen,
+			AppID:       a.cfg.Redis.Producer.AppID,
+			ContentType: a.cfg.Redis.Producer.ContentType,
+		})
+	case config.BackendMemory:
+		producer = memory.NewMemoryProducer(a.memoryBroker(), memory.ProducerConfig{
+			AppID:       a.cfg.RabbitMQ.Producer.AppID,
+			ContentType: a.cfg.RabbitMQ.Producer.ContentType,
+		})
+	default:
+		err = fmt.Errorf("unknown mq backend %q", a.cfg.MQBackend)
+	}
+	if err != nil {
+		return nil, err
+	}
+	a.watchState("producer", producer)
+	return producer, nil
+}
+
+// memoryBroker брокер внутри процесса, общий для всех консьюмеров и продьюсера
+func (a *app) memoryBroker() *memory.Broker {
+	if a.broker == nil {
+		a.broker = memory.NewBroker()
+	}
+	return a.broker
+}
+
+// rabbitMQBase подключение к RabbitMQ из конфига
+func (a *app) rabbitMQBase() rabbitmq.BaseConfig {
+	return rabbitmq.BaseConfig{
+		URI:      a.cfg.RabbitMQ.URI,
+		Host:     a.cfg.RabbitMQ.Host,
+		Port:     a.cfg.RabbitMQ.Port,
+		Username: a.cfg.RabbitMQ.Username,
+		Password: a.cfg.RabbitMQ.Password,
+		VHost:    a.cfg.RabbitMQ.VHost,
+		TLS: rabbitmq.TLSConfig{
+			Enabled:            a.cfg.RabbitMQ.TLS.Enabled,
+			CAFile:             a.cfg.RabbitMQ.TLS.CAFile,
+			CertFile:           a.cfg.RabbitMQ.TLS.CertFile,
+			KeyFile:            a.cfg.RabbitMQ.TLS.KeyFile,
+			ServerName:         a.cfg.RabbitMQ.TLS.ServerName,
+			InsecureSkipVerify: a.cfg.RabbitMQ.TLS.SkipVerify,
+		},
+		Heartbeat:      a.cfg.RabbitMQ.Heartbeat,
+		ConnectionName: a.cfg.RabbitMQ.ConnectionName,
+		Reconnect: rabbitmq.Backoff{
+			Initial:    a.cfg.RabbitMQ.Reconnect.Initial,
+			Max:        a.cfg.RabbitMQ.Reconnect.Max,
+			Multiplier: a.cfg.RabbitMQ.Reconnect.Multiplier,
+			Jitter:     a.cfg.RabbitMQ.Reconnect.Jitter,
+		},
+	}
+}
+
+// natsBase подключение к NATS JetStream из конфига
+func (a *app) natsBase() nats.Config {
+	return nats.Config{
+		URL:           a.cfg.NATS.URL,
+		Name:          a.cfg.NATS.Name,
+		ReconnectWait: a.cfg.NATS.ReconnectWait,
+	}
+}
+
+// redisBase подключение к Redis Streams из конфига
+func (a *app) redisBase() redisstream.Config {
+	return redisstream.Config{
+		Addr:     a.cfg.Redis.Addr,
+		Username: a.cfg.Redis.Username,
+		Password: a.cfg.Redis.Password,
+		DB:       a.cfg.Redis.DB,
+		Group:    a.cfg.Redis.Group,
+	}
+}
+
+// wrapConsumer оборачивает консьюмера метриками, claim check и расшифровкой тел. Порядок обратный
+// продьюсеру: claim check достаёт тело из хранилища, и только потом оно расшифровывается
+func (a *app) wrapConsumer(name string, consumer mq.Consumer) (mq.Consumer, error) {
+	if a.metrics != nil {
+		// состояние подключения берётся у самого бэкенда, обёртки его не сообщают
+		a.metrics.mq.WatchState(name, consumer)
+		consumer = a.metrics.mq.Consumer(consumer)
+	}
+	if a.claims != nil {
+		consumer = claimcheck.NewConsumer(consumer, *a.claims)
+	}
+	return payload.NewConsumer(consumer, a.payloadCfg)
+}
+
+// watchState пишет в лог смену состояния подключения, если бэкенд о ней сообщает
+func (a *app) watchState(name string, backend interface{}) {
+	notifier, ok := backend.(mq.StateNotifier)
+	if !ok {
+		return
+	}
+	states := make(chan mq.StateEvent, 16)
+	notifier.NotifyState(states)
+
+	go func() {
+		for event := range states {
+			switch event.State {
+			case mq.StateDisconnected:
+				a.logger.Warnf("mq %s disconnected (attempt %d): %v", name, event.Attempt, event.Err)
+			case mq.StateReconnecting:
+				a.logger.Infof("mq %s reconnecting, attempt %d", name, event.Attempt)
+			default:
+				a.logger.Infof("mq %s %s", name, event.State)
+				if event.State == mq.StateClosed {
+					return
+				}
+			}
+		}
+	}()
+}
+
+// newOutbox оборачивает продьюсера в outbox и публикует его размер в expvar под именем outbox и в метриках
+func (a *app) newOutbox(ctx context.Context, producer mq.Producer) (mq.Producer, error) {
+	box, err := outbox.NewOutbox(ctx, producer, outbox.Config{
+		Path:           a.cfg.Outbox.Path,
+		BatchSize:      a.cfg.Outbox.BatchSize,
+		RetryInterval:  a.cfg.Outbox.RetryInterval,
+		PublishTimeout: a.cfg.Outbox.PublishTimeout,
+		MaxAttempts:    a.cfg.Outbox.MaxAttempts,
+	})
+	if err != nil {
+		return nil, err
+	}
+	stats := box.Stats()
+	if stats.Pending > 0 {
+		a.logger.Infof("outbox has %d pending messages since %s", stats.Pending, stats.Oldest.Format(time.RFC3339))
+	}
+	if stats.Parked > 0 {
+		a.logger.Warnf("outbox has %d parked messages that the broker did not accept", stats.Parked)
+	}
+	expvar.Publish("outbox", expvar.Func(func() interface{} {
+		return box.Stats()
+	}))
+	if a.metrics != nil {
+		a.metrics.outboxMetrics(box)
+	}
+	return box, nil
+}
+
+// newDedup создаёт middleware дедупликации с хранилищем из конфига, nil если дедупликация выключена
+func (a *app) newDedup() (mq.Middleware, error) {
+	var store dedup.Store
+	switch a.cfg.Dedup.Store {
+	case config.DedupNone:
+		return nil, nil
+	case config.DedupMemory:
+		store = dedup.NewMemoryStore(a.cfg.Dedup.Size)
+	case config.DedupRedis:
+		var err error
+		store, err = dedup.NewRedisStore(dedup.RedisConfig{
+			Addr:     a.cfg.Redis.Addr,
+			Username: a.cfg.Redis.Username,
+			Password: a.cfg.Redis.Password,
+			DB:       a.cfg.Redis.DB,
+		})
+		if err != nil {
+			return nil, err
+		}
+	case config.DedupBolt:
+		var err error
+		store, err = dedup.NewBoltStore(a.cfg.Dedup.Path)
+		if err != nil {
+			return nil, err
+		}
+	default:
+		return nil, fmt.Errorf("unknown dedup store %q", a.cfg.Dedup.Store)
+	}
+	// хранилище и middleware общие для всех пулов, ключ включает очередь сообщения
+	key := dedup.MessageKey
+	if a.cfg.Dedup.CorrelationFallback {
+		key = dedup.CorrelationKey
+	}
+	return dedup.Middleware(dedup.Config{
+		Store: store,
+		TTL:   a.cfg.Dedup.TTL,
+		Lease: a.cfg.Dedup.Lease,
+		Key:   key,
+	}), nil
+}
+
+// newClaimCheck настройки claim check с хранилищем из конфига
+func (a *app) newClaimCheck() (claimcheck.Config, error) {
+	var store claimcheck.Store
+	var err error
+	switch a.cfg.ClaimCheck.Store {
+	case config.ClaimCheckFile:
+		store, err = claimcheck.NewFileStore(a.cfg.ClaimCheck.Path)
+	case config.ClaimCheckS3:
+		store, err = claimcheck.NewS3Store(claimcheck.S3Config{
+			Endpoint:  a.cfg.ClaimCheck.S3.Endpoint,
+			Region:    a.cfg.ClaimCheck.S3.Region,
+			Bucket:    a.cfg.ClaimCheck.S3.Bucket,
+			AccessKey: a.cfg.ClaimCheck.S3.AccessKey,
+			SecretKey: a.cfg.ClaimCheck.S3.SecretKey,
+			Prefix:    a.cfg.ClaimCheck.S3.Prefix,
+		})
+	default:
+		err = fmt.Errorf("unknown claim check store %q", a.cfg.ClaimCheck.Store)
+	}
+	if err != nil {
+		return claimcheck.Config{}, err
+	}
+	return claimcheck.Config{Store: store, Threshold: a.cfg.ClaimCheck.Threshold}, nil
+}
+
+// payloadConfig настройки сжатия и шифрования из конфига
+func (a *app) payloadConfig() (payload.Config, error) {
+	cfg := payload.Config{
+		Compression: a.cfg.Payload.Compression,
+		MinSize:     a.cfg.Payload.CompressMinSize,
+	}
+	if !a.cfg.Payload.Encryption.Enabled {
+		return cfg, nil
+	}
+	keys := make(map[string][]byte, len(a.cfg.Payload.Encryption.Keys))
+	for id, encoded := range a.cfg.Payload.Encryption.Keys {
+		key, err := base64.StdEncoding.DecodeString(encoded)
+		if err != nil {
+			return cfg, fmt.Errorf("failed to decode encryption key %q due %v", id, err)
+		}
+		keys[id] = key
+	}
+	keyring, err := payload.NewKeyring(a.cfg.Payload.Encryption.PrimaryKey, keys)
+	if err != nil {
+		return cfg, err
+	}
+	cfg.Keys = keyring
+	return cfg, nil
+}
+
+// retryPolicy настройки повторов консьюмера из секции retry бэкенда
+func retryPolicy(cfg config.Retry) mq.RetryPolicy {
+	return mq.RetryPolicy{
+		MaxRetries:   cfg.MaxRetries,
+		InitialDelay: cfg.InitialDelay,
+		Multiplier:   cfg.Multiplier,
+		MaxDelay:     cfg.MaxDelay,
+		DeadLetter:   cfg.DeadLetter,
+	}
+}
+
+// topology топология из конфига вместе с очередями консьюмера, продьюсера и пулов, которые нужны боту всегда
+func (a *app) topology() mq.Topology {
+	var t mq.Topology
+	for _, ex := range a.cfg.Topology.Exchanges {
+		kind := ex.Kind
+		if kind == "" {
+			kind = mq.ExchangeDirect
+		}
+		t.Exchanges = append(t.Exchanges, mq.ExchangeSpec{Name: ex.Name, Kind: kind, Durable: ex.Durable, AutoDelete: ex.AutoDelete, Args: ex.Args})
+	}
+	for _, q := range a.cfg.Topology.Queues {
+		t.Queues = append(t.Queues, mq.QueueSpec{Name: q.Name, Durable: q.Durable, AutoDelete: q.AutoDelete, Exclusive: q.Exclusive, Args: q.Args})
+	}
+	names := []string{a.cfg.RabbitMQ.Consumer.Queue, a.cfg.RabbitMQ.Producer.Queue}
+	for _, pool := range a.poolConfigs() {
+		names = append(names, pool.Queue)
+	}
+	for _, name := range names {
+		if name != "" && !t.HasQueue(name) {
+			t.Queues = append(t.Queues, mq.QueueSpec{Name: name, Durable: true})
+		}
+	}
+	for _, b := range a.cfg.Topology.Bindings {
+		t.Bindings = append(t.Bindings, mq.BindingSpec{Queue: b.Queue, Exchange: b.Exchange, Key: b.Key, Args: b.Args})
+	}
+	return t
+}
+
+// applyTopology объявляет топологию при старте. После переподключения её объявляют заново сами бэкенды,
+// rabbitmq и nats помнят всё что через них объявлялось
+func (a *app) applyTopology(ctx context.Context, queue mq.MessageQueue) error {
+	topology := a.topology()
+	if err := topology.Apply(ctx, queue); err != nil {
+		return err
+	}
+	a.logger.Infof("topology applied: %d exchanges, %d queues, %d bindings", len(topology.Exchanges), len(topology.Queues), len(topology.Bindings))
+	return nil
+}
@@ -0,0 +1,190 @@
+package internal
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/Maksat-luci/Telegram-Bot/internal/events"
+	"github.com/Maksat-luci/Telegram-Bot/pkg/client/mq"
+)
+
+// состояния пула
+const (
+	poolStarting     = "starting"
+	poolRunning      = "running"
+	poolDisconnected = "disconnected"
+	poolFailed       = "failed"
+	poolStopping     = "stopping"
+	poolStopped      = "stopped"
+)
+
+// poolConfig очередь пула и его настройки
+type poolConfig struct {
+	Queue    string
+	Workers  int
+	Prefetch int
+	Handlers []string
+}
+
+// poolStatus состояние пула для диагностики
+type poolStatus struct {
+	Queue    string    `json:"queue"`
+	Workers  int       `json:"workers"`
+	Prefetch int       `json:"prefetch"`
+	Handlers []string  `json:"handlers,omitempty"`
+	State    string    `json:"state"`
+	Since    time.Time `json:"since"`
+	Error    string    `json:"error,omitempty"`
+}
+
+// pool пул воркеров одной очереди. У пула свой консьюмер, поэтому prefetch и подключение у каждого свои,
+// и пулы запускаются и останавливаются независимо друг от друга
+type pool struct {
+	cfg        poolConfig
+	consumer   mq.Consumer
+	subscriber mq.Subscriber
+
+	lock  sync.Mutex
+	state string
+	since time.Time
+	err   error
+}
+
+// poolConfigs пулы из конфига, без списка очередей один пул читает rabbit_mq.consumer.queue всеми обработчиками
+func (a *app) poolConfigs() []poolConfig {
+	if len(a.cfg.RabbitMQ.Consumer.Queues) == 0 {
+		return []poolConfig{{
+			Queue:    a.cfg.RabbitMQ.Consumer.Queue,
+			Workers:  a.cfg.AppConfig.EventWorkers.Youtube,
+			Prefetch: a.cfg.RabbitMQ.Consumer.MessagesBufferSize,
+		}}
+	}
+	pools := make([]poolConfig, 0, len(a.cfg.RabbitMQ.Consumer.Queues))
+	for _, q := range a.cfg.RabbitMQ.Consumer.Queues {
+		prefetch := q.Prefetch
+		if prefetch <= 0 {
+			prefetch = a.cfg.RabbitMQ.Consumer.MessagesBufferSize
+		}
+		pools = append(pools, poolConfig{Queue: q.Name, Workers: q.Workers, Prefetch: prefetch, Handlers: q.Handlers})
+	}
+	return pools
+}
+
+// startPool подключает консьюмера пула и начинает читать очередь. Пул который не удалось запустить
+// остаётся в состоянии failed, остальные пулы работают дальше
+func (a *app) startPool(ctx context.Context, cfg poolConfig, router *events.Router, middlewares []mq.Middleware) *pool {
+	p := &pool{cfg: cfg}
+	p.setState(poolStarting, nil)
+	if err := p.start(ctx, a, router, middlewares); err != nil {
+		a.logger.Errorf("failed to start pool %s due to error %v", cfg.Queue, err)
+		p.setState(poolFailed, err)
+		return p
+	}
+	a.logger.Infof("pool %s started: %d workers, prefetch %d", cfg.Queue, cfg.Workers, cfg.Prefetch)
+	return p
+}
+
+// start создаёт консьюмера и подписчика пула
+func (p *pool) start(ctx context.Context, a *app, router *events.Router, middlewares []mq.Middleware) error {
+	router, err := router.Subset(p.cfg.Handlers)
+	if err != nil {
+		return err
+	}
+	name := fmt.Sprintf("pool %s", p.cfg.Queue)
+	consumer, err := a.newConsumer(name, p.cfg.Prefetch)
+	if err != nil {
+		return err
+	}
+	p.watch(consumer)
+	if p.consumer, err = a.wrapConsumer(name, consumer); err != nil {
+		_ = consumer.Close()
+		return err
+	}
+
+	// подписчик обрабатывает столько сообщений параллельно, сколько воркеров у пула,
+	// результат обработчика сам решает подтвердить сообщение, повторить или отложить в parking очередь
+	p.subscriber = mq.NewSubscriber(p.consumer, mq.SubscriberConfig{
+		Workers:     p.cfg.Workers,
+		Middlewares: middlewares,
+	})
+	if err := p.subscriber.Subscribe(ctx, p.cfg.Queue, router.Dispatch); err != nil {
+		_ = p.consumer.Close()
+		return err
+	}
+	p.setState(poolRunning, nil)
+	return nil
+}
+
+// watch переводит пул в disconnected и обратно по состоянию подключения его консьюмера
+func (p *pool) watch(consumer mq.Consumer) {
+	notifier, ok := consumer.(mq.StateNotifier)
+	if !ok {
+		return
+	}
+	states := make(chan mq.StateEvent, 16)
+	notifier.NotifyState(states)
+	go func() {
+		for event := range states {
+			switch event.State {
+			case mq.StateConnected:
+				p.transition(poolDisconnected, poolRunning, nil)
+			case mq.StateDisconnected:
+				p.transition(poolRunning, poolDisconnected, event.Err)
+			case mq.StateClosed:
+				return
+			}
+		}
+	}()
+}
+
+// stop дожидается обработчиков пула и закрывает его консьюмера, возвращает сколько сообщений вернулось в очередь
+// и сколько обработчиков так и не завершились
+func (p *pool) stop(ctx context.Context) (mq.DrainStats, error) {
+	if p.subscriber == nil {
+		return mq.DrainStats{}, nil
+	}
+	p.setState(poolStopping, nil)
+	stats, err := p.subscriber.Drain(ctx)
+	if closeErr := p.consumer.Close(); closeErr != nil && err == nil {
+		err = closeErr
+	}
+	p.setState(poolStopped, err)
+	return stats, err
+}
+
+// status возвращает состояние пула
+func (p *pool) status() poolStatus {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	status := poolStatus{
+		Queue:    p.cfg.Queue,
+		Workers:  p.cfg.Workers,
+		Prefetch: p.cfg.Prefetch,
+		Handlers: p.cfg.Handlers,
+		State:    p.state,
+		Since:    p.since,
+	}
+	if p.err != nil {
+		status.Error = p.err.Error()
+	}
+	return status
+}
+
+// setState переводит пул в состояние state
+func (p *pool) setState(state string, err error) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	p.state, p.err, p.since = state, err, time.Now()
+}
+
+// transition переводит пул в состояние to только из состояния from, так переподключение не оживит остановленный пул
+func (p *pool) transition(from, to string, err error) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	if p.state != from {
+		return
+	}
+	p.state, p.err, p.since = to, err, time.Now()
+}
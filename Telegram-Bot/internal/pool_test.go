@@ -0,0 +1,226 @@
+package internal
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Maksat-luci/Telegram-Bot/internal/config"
+	"github.com/Maksat-luci/Telegram-Bot/internal/events"
+	"github.com/Maksat-luci/Telegram-Bot/pkg/client/mq"
+	"github.com/Maksat-luci/Telegram-Bot/pkg/client/mq/envelope"
+	"github.com/Maksat-luci/Telegram-Bot/pkg/client/mq/memory"
+	"github.com/Maksat-luci/Telegram-Bot/pkg/logging"
+)
+
+// waitTimeout сколько тест ждёт обработки события
+const waitTimeout = time.Second
+
+// trackFound событие для тестов пулов
+type trackFound struct {
+	Name string `json:"name"`
+}
+
+// newTestApp приложение на брокере в памяти и роутер с обработчиком tracks события test.track.found.
+// handle вызывается для каждого события
+func newTestApp(t *testing.T, handle func(ctx context.Context, e envelope.Event) error) (*app, *envelope.Registry, *events.Router) {
+	t.Helper()
+	a := &app{
+		cfg:    &config.Config{MQBackend: config.BackendMemory},
+		logger: logging.Discard(),
+	}
+	registry, err := envelope.NewRegistry(envelope.Config{Source: "test"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := registry.Register("test.track.found", 1, trackFound{}); err != nil {
+		t.Fatal(err)
+	}
+	router := events.NewRouter(registry, nil)
+	if err := router.Handle("test.track.found", "tracks", handle); err != nil {
+		t.Fatal(err)
+	}
+	return a, registry, router
+}
+
+// publishEvent публикует событие в очередь queue брокера приложения
+func publishEvent(t *testing.T, a *app, registry *envelope.Registry, queue string, name string) {
+	t.Helper()
+	msg, err := registry.Encode(trackFound{Name: name})
+	if err != nil {
+		t.Fatal(err)
+	}
+	producer := memory.NewMemoryProducer(a.memoryBroker(), memory.ProducerConfig{})
+	defer producer.Close()
+	if err := producer.PublishMessage(context.Background(), queue, msg); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// receiveEvent ждёт имя трека из обработанного события
+func receiveEvent(t *testing.T, handled <-chan string) string {
+	t.Helper()
+	select {
+	case name := <-handled:
+		return name
+	case <-time.After(waitTimeout):
+		t.Fatal("timed out waiting for event")
+	}
+	return ""
+}
+
+// record обработчик который отдаёт имена треков в канал
+func record(handled chan<- string) func(ctx context.Context, e envelope.Event) error {
+	return func(ctx context.Context, e envelope.Event) error {
+		handled <- e.Payload.(*trackFound).Name
+		return nil
+	}
+}
+
+func TestPoolLifecycle(t *testing.T) {
+	handled := make(chan string, 1)
+	a, registry, router := newTestApp(t, record(handled))
+
+	cfg := poolConfig{Queue: "tracks", Workers: 2, Prefetch: 4, Handlers: []string{"tracks"}}
+	p := a.startPool(context.Background(), cfg, router, nil)
+	status := p.status()
+	if status.State != poolRunning || status.Error != "" {
+		t.Fatalf("got status %+v, want running", status)
+	}
+	if status.Queue != "tracks" || status.Workers != 2 || status.Prefetch != 4 || len(status.Handlers) != 1 {
+		t.Fatalf("status %+v does not match pool config", status)
+	}
+
+	publishEvent(t, a, registry, "tracks", "song")
+	if name := receiveEvent(t, handled); name != "song" {
+		t.Fatalf("got %q, want song", name)
+	}
+
+	started := status.Since
+	stats, err := p.stop(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats != (mq.DrainStats{}) {
+		t.Fatalf("got %+v, want nothing requeued", stats)
+	}
+	status = p.status()
+	if status.State != poolStopped || !status.Since.After(started) {
+		t.Fatalf("got status %+v, want stopped", status)
+	}
+	// обработанное событие подтверждено и в очередь не вернулось
+	if n := a.memoryBroker().Len("tracks"); n != 0 {
+		t.Fatalf("queue has %d messages, want 0", n)
+	}
+}
+
+func TestPoolStopDeadline(t *testing.T) {
+	started := make(chan string, 1)
+	a, registry, router := newTestApp(t, func(ctx context.Context, e envelope.Event) error {
+		started <- e.Payload.(*trackFound).Name
+		<-ctx.Done()
+		return ctx.Err()
+	})
+	p := a.startPool(context.Background(), poolConfig{Queue: "tracks", Workers: 1}, router, nil)
+	publishEvent(t, a, registry, "tracks", "song")
+	receiveEvent(t, started)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	stats, err := p.stop(ctx)
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("got %v, want %v", err, context.DeadlineExceeded)
+	}
+	if stats.Requeued != 1 {
+		t.Fatalf("got %+v, want the interrupted event requeued", stats)
+	}
+	if status := p.status(); status.State != poolStopped || status.Error == "" {
+		t.Fatalf("got status %+v, want stopped with error", status)
+	}
+	if n := a.memoryBroker().Len("tracks"); n != 1 {
+		t.Fatalf("queue has %d messages, want 1", n)
+	}
+}
+
+func TestPoolFailureIsolation(t *testing.T) {
+	handled := make(chan string, 1)
+	a, registry, router := newTestApp(t, record(handled))
+
+	ctx := context.Background()
+	failed := a.startPool(ctx, poolConfig{Queue: "albums", Workers: 1, Handlers: []string{"albums"}}, router, nil)
+	running := a.startPool(ctx, poolConfig{Queue: "tracks", Workers: 1}, router, nil)
+
+	status := failed.status()
+	if status.State != poolFailed || !strings.Contains(status.Error, "albums") {
+		t.Fatalf("got status %+v, want failed on unknown handler", status)
+	}
+	if status := running.status(); status.State != poolRunning {
+		t.Fatalf("got status %+v, want running", status)
+	}
+	publishEvent(t, a, registry, "tracks", "song")
+	if name := receiveEvent(t, handled); name != "song" {
+		t.Fatalf("got %q, want song", name)
+	}
+
+	// незапущенный пул останавливать нечего, он остаётся failed
+	if stats, err := failed.stop(ctx); err != nil || stats != (mq.DrainStats{}) {
+		t.Fatalf("got %+v, %v stopping failed pool", stats, err)
+	}
+	if status := failed.status(); status.State != poolFailed {
+		t.Fatalf("got status %+v, want failed", status)
+	}
+	if _, err := running.stop(ctx); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// notifyingConsumer консьюмер который сообщает о смене состояния подключения
+type notifyingConsumer struct {
+	mq.Consumer
+	states chan<- mq.StateEvent
+}
+
+func (c *notifyingConsumer) NotifyState(ch chan<- mq.StateEvent) {
+	c.states = ch
+}
+
+func TestPoolWatch(t *testing.T) {
+	p := &pool{cfg: poolConfig{Queue: "tracks"}}
+	p.setState(poolRunning, nil)
+	consumer := &notifyingConsumer{}
+	p.watch(consumer)
+
+	// ждёт пока пул перейдёт в состояние state
+	wait := func(state string) poolStatus {
+		t.Helper()
+		deadline := time.Now().Add(waitTimeout)
+		for {
+			status := p.status()
+			if status.State == state {
+				return status
+			}
+			if time.Now().After(deadline) {
+				t.Fatalf("got state %s, want %s", status.State, state)
+			}
+			time.Sleep(time.Millisecond)
+		}
+	}
+	consumer.states <- mq.StateEvent{State: mq.StateDisconnected, Err: errors.New("connection reset")}
+	if status := wait(poolDisconnected); status.Error != "connection reset" {
+		t.Fatalf("got error %q, want connection reset", status.Error)
+	}
+	consumer.states <- mq.StateEvent{State: mq.StateConnected}
+	wait(poolRunning)
+
+	// переподключение не оживляет остановленный пул
+	p.setState(poolStopped, nil)
+	consumer.states <- mq.StateEvent{State: mq.StateDisconnected}
+	consumer.states <- mq.StateEvent{State: mq.StateConnected}
+	consumer.states <- mq.StateEvent{State: mq.StateClosed}
+	time.Sleep(10 * time.Millisecond)
+	if status := p.status(); status.State != poolStopped {
+		t.Fatalf("got state %s, want stopped", status.State)
+	}
+}
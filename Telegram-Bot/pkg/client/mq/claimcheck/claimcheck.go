@@ -0,0 +1,59 @@
+// Package claimcheck передача больших сообщений через хранилище. Продьюсер кладёт тело больше порога
+// в хранилище и публикует только ссылку на него в заголовке, консьюмер подставляет тело обратно перед
+// обработкой и удаляет его из хранилища после подтверждения
+package claimcheck
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// HeaderClaimCheck заголовок с ключом тела сообщения в хранилище
+const HeaderClaimCheck = "x-claim-check"
+
+const (
+	// defaultThreshold размер тела после которого оно уходит в хранилище
+	defaultThreshold = 256 << 10
+	// deleteTimeout сколько ждать хранилище при удалении тела вне контекста вызывающего
+	deleteTimeout = 10 * time.Second
+)
+
+// Store хранилище тел сообщений
+type Store interface {
+	Put(ctx context.Context, key string, body []byte) error
+	// Get возвращает тело по ключу или ErrNotFound
+	Get(ctx context.Context, key string) ([]byte, error)
+	// Delete удаляет тело, отсутствующий ключ не ошибка
+	Delete(ctx context.Context, key string) error
+}
+
+// Config настройки продьюсера и консьюмера
+type Config struct {
+	Store Store
+	// Threshold тела больше этого размера в байтах уходят в хранилище, по умолчанию 256KB
+	Threshold int
+}
+
+// ErrNotFound тела нет в хранилище, например его уже удалил другой консьюмер после подтверждения
+var ErrNotFound = errors.New("claim check not found")
+
+// errInvalidKey ключ из заголовка не похож на ключ который создаёт продьюсер
+var errInvalidKey = errors.New("invalid claim check key")
+
+// validKey проверяет ключ до обращения к хранилищу, ключ приходит из заголовка сообщения
+// и не должен выходить за пределы каталога или бакета
+func validKey(key string) error {
+	if key == "" || key[0] == '.' {
+		return fmt.Errorf("%w %q", errInvalidKey, key)
+	}
+	for _, r := range key {
+		switch {
+		case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z', r >= '0' && r <= '9', r == '-', r == '_', r == '.':
+		default:
+			return fmt.Errorf("%w %q", errInvalidKey, key)
+		}
+	}
+	return nil
+}
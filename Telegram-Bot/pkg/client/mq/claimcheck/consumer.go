@@ -0,0 +1,184 @@
+package claimcheck
+
+import (
+	"context"
+	"errors"
+	"log"
+	"sync"
+
+	"github.com/Maksat-luci/Telegram-Bot/pkg/client/mq"
+)
+
+// NewConsumer оборачивает консьюмера, сообщения со ссылкой доставляются уже с телом из хранилища.
+// Тело удаляется после Ack или после Settle который выбросил сообщение. Повтор и parking очередь
+// публикуют сообщение снова со ссылкой, поэтому тело остаётся в хранилище, как и после Nack и Reject:
+// брокер может отправить такое сообщение в dead letter exchange
+func NewConsumer(c mq.Consumer, cfg Config) mq.Consumer {
+	return &consumer{Consumer: c, cfg: cfg, claims: make(map[uint64]string)}
+}
+
+// consumer подставляет тела сообщений, объявления передаёт как есть
+type consumer struct {
+	mq.Consumer
+	cfg Config
+
+	mu sync.Mutex
+	// claims ключи тел доставленных и ещё не подтверждённых сообщений по номеру доставки
+	claims map[uint64]string
+}
+
+// Consume доставляет сообщения очереди target с телами из хранилища. Сообщение тело которого не удалось
+// получить завершается без обработки: повторяется если хранилище недоступно и откладывается
+// в parking очередь если ссылка неверная. Тела нет если его удалил консьюмер который уже подтвердил
+// сообщение, а брокер доставил его ещё раз, такое сообщение просто подтверждается
+func (c *consumer) Consume(ctx context.Context, target string) (<-chan mq.Message, error) {
+	messages, err := c.Consumer.Consume(ctx, target)
+	if err != nil {
+		return nil, err
+	}
+	ch := make(chan mq.Message)
+	go func() {
+		defer close(ch)
+		for msg := range messages {
+			resolved, err := c.resolve(ctx, msg)
+			if err != nil {
+				c.fail(msg, err)
+				continue
+			}
+			select {
+			case ch <- resolved:
+			case <-ctx.Done():
+				// сообщение не подтверждено, брокер доставит его снова
+				c.forget(resolved.ID, false)
+			}
+		}
+	}()
+	return ch, nil
+}
+
+// resolve подставляет тело сообщения со ссылкой и запоминает ключ до подтверждения
+func (c *consumer) resolve(ctx context.Context, msg mq.Message) (mq.Message, error) {
+	claim, ok := msg.Headers[HeaderClaimCheck].(string)
+	if !ok {
+		return msg, nil
+	}
+	if err := validKey(claim); err != nil {
+		return msg, err
+	}
+	body, err := c.cfg.Store.Get(ctx, claim)
+	if err != nil {
+		return msg, err
+	}
+	// обработчик получает обычное сообщение, без заголовка его можно переслать дальше как новое
+	headers := make(map[string]interface{}, len(msg.Headers))
+	for k, v := range msg.Headers {
+		if k != HeaderClaimCheck {
+			headers[k] = v
+		}
+	}
+	msg.Headers = headers
+	msg.Body = body
+
+	c.mu.Lock()
+	c.claims[msg.ID] = claim
+	c.mu.Unlock()
+	return msg, nil
+}
+
+// fail завершает сообщение тело которого не удалось получить
+func (c *consumer) fail(msg mq.Message, err error) {
+	if errors.Is(err, ErrNotFound) {
+		log.Printf("claim check of message %s is already deleted, message was processed", msg.MessageID)
+		if err := c.Consumer.Ack(context.Background(), msg.ID, false); err != nil {
+			log.Printf("failed to ack message %s due %v", msg.MessageID, err)
+		}
+		return
+	}
+	outcome := mq.OutcomeRetry
+	if errors.Is(err, errInvalidKey) {
+		outcome = mq.OutcomeDeadLetter
+	}
+	log.Printf("failed to resolve claim check of message %s due %v, %s", msg.MessageID, err, outcome)
+	if _, err := c.Consumer.Settle(context.Background(), msg, outcome); err != nil {
+		log.Printf("failed to settle message %s due %v", msg.MessageID, err)
+	}
+}
+
+// Ack подтверждает сообщение и удаляет его тело из хранилища
+func (c *consumer) Ack(ctx context.Context, id uint64, multiple bool) error {
+	err := c.Consumer.Ack(ctx, id, multiple)
+	// неподтверждённое сообщение брокер доставит заново под другим номером, тело ещё понадобится
+	claims := c.forget(id, multiple)
+	if err != nil {
+		return err
+	}
+	for _, claim := range claims {
+		c.delete(ctx, claim)
+	}
+	return nil
+}
+
+// Nack возвращает или отбрасывает сообщение, тело остаётся в хранилище
+func (c *consumer) Nack(ctx context.Context, id uint64, multiple bool, requeue bool) error {
+	c.forget(id, multiple)
+	return c.Consumer.Nack(ctx, id, multiple, requeue)
+}
+
+// Reject отклоняет сообщение, тело остаётся в хранилище
+func (c *consumer) Reject(ctx context.Context, id uint64, requeue bool) error {
+	c.forget(id, false)
+	return c.Consumer.Reject(ctx, id, requeue)
+}
+
+// Settle завершает неудачное сообщение. Бэкенду передаётся ссылка вместо тела, так повтор
+// не публикует большое тело через брокер
+func (c *consumer) Settle(ctx context.Context, msg mq.Message, outcome mq.Outcome) (mq.Outcome, error) {
+	claims := c.forget(msg.ID, false)
+	if len(claims) == 0 {
+		return c.Consumer.Settle(ctx, msg, outcome)
+	}
+	claim := claims[0]
+	headers := make(map[string]interface{}, len(msg.Headers)+1)
+	for k, v := range msg.Headers {
+		headers[k] = v
+	}
+	headers[HeaderClaimCheck] = claim
+	msg.Headers = headers
+	msg.Body = nil
+
+	applied, err := c.Consumer.Settle(ctx, msg, outcome)
+	if err == nil && applied == mq.OutcomeDrop {
+		c.delete(ctx, claim)
+	}
+	return applied, err
+}
+
+// forget убирает ключи сообщения id, а при multiple и всех доставленных раньше него
+func (c *consumer) forget(id uint64, multiple bool) []string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	var claims []string
+	if !multiple {
+		if claim, ok := c.claims[id]; ok {
+			claims = append(claims, claim)
+			delete(c.claims, id)
+		}
+		return claims
+	}
+	for tag, claim := range c.claims {
+		if tag <= id {
+			claims = append(claims, claim)
+			delete(c.claims, tag)
+		}
+	}
+	return claims
+}
+
+// delete удаляет тело подтверждённого сообщения, ошибка только пишется в лог: сообщение уже подтверждено
+func (c *consumer) delete(ctx context.Context, claim string) {
+	ctx, cancel := context.WithTimeout(ctx, deleteTimeout)
+	defer cancel()
+	if err := c.cfg.Store.Delete(ctx, claim); err != nil {
+		log.Printf("failed to delete claim check %s due %v", claim, err)
+	}
+}
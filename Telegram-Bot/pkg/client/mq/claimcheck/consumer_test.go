@@ -0,0 +1,180 @@
+package claimcheck
+
+import (
+	"bytes"
+	"context"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/Maksat-luci/Telegram-Bot/pkg/client/mq"
+	"github.com/Maksat-luci/Telegram-Bot/pkg/client/mq/memory"
+)
+
+// newPair оборачивает продьюсера и консьюмера брокера в памяти, тела больше 16 байт уходят в хранилище
+func newPair(t *testing.T) (*memory.Broker, Store, mq.Producer, mq.Consumer) {
+	t.Helper()
+	store, err := NewFileStore(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	broker := memory.NewBroker()
+	retry := mq.RetryPolicy{MaxRetries: 3, InitialDelay: time.Millisecond, Multiplier: 1, DeadLetter: true}
+	cfg := Config{Store: store, Threshold: 16}
+	producer := NewProducer(memory.NewMemoryProducer(broker, memory.ProducerConfig{}), cfg)
+	consumer := NewConsumer(memory.NewMemoryConsumer(broker, memory.ConsumerConfig{Retry: retry}), cfg)
+	t.Cleanup(func() {
+		_ = producer.Close()
+		_ = consumer.Close()
+	})
+	return broker, store, producer, consumer
+}
+
+// receive ждёт следующее сообщение из канала консьюмера
+func receive(t *testing.T, messages <-chan mq.Message) mq.Message {
+	t.Helper()
+	select {
+	case msg, ok := <-messages:
+		if !ok {
+			t.Fatal("messages channel closed")
+		}
+		return msg
+	case <-time.After(time.Second):
+		t.Fatal("timed out waiting for message")
+	}
+	return mq.Message{}
+}
+
+// expectNone проверяет что сообщений больше не доставляется
+func expectNone(t *testing.T, messages <-chan mq.Message) {
+	t.Helper()
+	select {
+	case msg := <-messages:
+		t.Fatalf("unexpected message %q", msg.Body)
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+func TestClaimCheckRoundTrip(t *testing.T) {
+	ctx := context.Background()
+	broker, store, producer, consumer := newPair(t)
+
+	messages, err := consumer.Consume(ctx, "tracks")
+	if err != nil {
+		t.Fatal(err)
+	}
+	body := bytes.Repeat([]byte("track"), 100)
+	if err := producer.PublishMessage(ctx, "tracks", mq.Message{Body: body, Headers: map[string]interface{}{"x-source": "test"}}); err != nil {
+		t.Fatal(err)
+	}
+	if err := producer.Publish(ctx, "tracks", []byte("small")); err != nil {
+		t.Fatal(err)
+	}
+
+	large := receive(t, messages)
+	if !bytes.Equal(large.Body, body) {
+		t.Fatalf("got %d bytes, want %d", len(large.Body), len(body))
+	}
+	if _, ok := large.Headers[HeaderClaimCheck]; ok || large.Headers["x-source"] != "test" {
+		t.Fatalf("unexpected headers %v", large.Headers)
+	}
+	small := receive(t, messages)
+	if string(small.Body) != "small" {
+		t.Fatalf("got %q, want small", small.Body)
+	}
+
+	if keys := storedKeys(t, store); len(keys) != 1 {
+		t.Fatalf("store has bodies %v, want one", keys)
+	}
+	if err := consumer.Ack(ctx, large.ID, false); err != nil {
+		t.Fatal(err)
+	}
+	if err := consumer.Ack(ctx, small.ID, false); err != nil {
+		t.Fatal(err)
+	}
+	// тело подтверждённого сообщения больше не нужно
+	if keys := storedKeys(t, store); len(keys) != 0 {
+		t.Fatalf("store has bodies %v after ack, want none", keys)
+	}
+	if n := broker.Len("tracks"); n != 0 {
+		t.Fatalf("queue has %d messages, want 0", n)
+	}
+}
+
+func TestClaimCheckRetryKeepsBody(t *testing.T) {
+	ctx := context.Background()
+	_, store, producer, consumer := newPair(t)
+
+	messages, err := consumer.Consume(ctx, "tracks")
+	if err != nil {
+		t.Fatal(err)
+	}
+	body := bytes.Repeat([]byte("track"), 100)
+	if err := producer.Publish(ctx, "tracks", body); err != nil {
+		t.Fatal(err)
+	}
+
+	msg := receive(t, messages)
+	if _, err := consumer.Settle(ctx, msg, mq.OutcomeRetry); err != nil {
+		t.Fatal(err)
+	}
+	retried := receive(t, messages)
+	if !bytes.Equal(retried.Body, body) || retried.RetryCount() != 1 {
+		t.Fatalf("got %d bytes with retry count %d", len(retried.Body), retried.RetryCount())
+	}
+	outcome, err := consumer.Settle(ctx, retried, mq.OutcomeDrop)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if outcome != mq.OutcomeDrop {
+		t.Fatalf("got outcome %v, want %v", outcome, mq.OutcomeDrop)
+	}
+	if keys := storedKeys(t, store); len(keys) != 0 {
+		t.Fatalf("body of dropped message is still stored: %v", keys)
+	}
+}
+
+// Тело удалил консьюмер который уже обработал и подтвердил сообщение, а брокер доставил его ещё раз.
+// Такое сообщение подтверждается, в parking очереди ему не место
+func TestClaimCheckMissingBodyIsAcked(t *testing.T) {
+	ctx := context.Background()
+	broker, _, _, consumer := newPair(t)
+	raw := memory.NewMemoryProducer(broker, memory.ProducerConfig{})
+	defer raw.Close()
+
+	messages, err := consumer.Consume(ctx, "tracks")
+	if err != nil {
+		t.Fatal(err)
+	}
+	processed := mq.Message{Headers: map[string]interface{}{HeaderClaimCheck: "deleted"}}
+	if err := raw.PublishMessage(ctx, "tracks", processed); err != nil {
+		t.Fatal(err)
+	}
+	// неверная ссылка это ошибка продьюсера, такое сообщение откладывается
+	invalid := mq.Message{Headers: map[string]interface{}{HeaderClaimCheck: "../outside"}}
+	if err := raw.PublishMessage(ctx, "tracks", invalid); err != nil {
+		t.Fatal(err)
+	}
+
+	expectNone(t, messages)
+	if n := broker.Len("tracks"); n != 0 {
+		t.Fatalf("queue has %d messages, want 0", n)
+	}
+	if n := broker.Len("tracks.parking"); n != 1 {
+		t.Fatalf("parking queue has %d messages, want only the invalid one", n)
+	}
+}
+
+// storedKeys ключи тел которые лежат в файловом хранилище
+func storedKeys(t *testing.T, store Store) []string {
+	t.Helper()
+	entries, err := os.ReadDir(store.(*fileStore).dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keys := make([]string, 0, len(entries))
+	for _, entry := range entries {
+		keys = append(keys, entry.Name())
+	}
+	return keys
+}
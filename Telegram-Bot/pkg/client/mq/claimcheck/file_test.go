@@ -0,0 +1,69 @@
+package claimcheck
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"os"
+	"testing"
+)
+
+func TestFileStore(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+	store, err := NewFileStore(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	body := bytes.Repeat([]byte("track"), 1000)
+	if err := store.Put(ctx, "claim-1", body); err != nil {
+		t.Fatal(err)
+	}
+	got, err := store.Get(ctx, "claim-1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, body) {
+		t.Fatalf("got %d bytes, want %d", len(got), len(body))
+	}
+	// временный файл записи переименован, в каталоге только тело
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 || entries[0].Name() != "claim-1" {
+		t.Fatalf("unexpected files in store directory: %v", entries)
+	}
+
+	if err := store.Delete(ctx, "claim-1"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := store.Get(ctx, "claim-1"); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("get after delete: got %v, want %v", err, ErrNotFound)
+	}
+	if err := store.Delete(ctx, "claim-1"); err != nil {
+		t.Fatalf("delete of missing key: %v", err)
+	}
+}
+
+func TestFileStoreInvalidKey(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+	store, err := NewFileStore(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// ключ приходит из заголовка сообщения и не должен выводить за пределы каталога
+	for _, key := range []string{"", "../outside", "a/b", ".hidden", "..", `a\b`} {
+		if err := store.Put(ctx, key, []byte("x")); !errors.Is(err, errInvalidKey) {
+			t.Fatalf("put %q: got %v, want %v", key, err, errInvalidKey)
+		}
+		if _, err := store.Get(ctx, key); !errors.Is(err, errInvalidKey) {
+			t.Fatalf("get %q: got %v, want %v", key, err, errInvalidKey)
+		}
+		if err := store.Delete(ctx, key); !errors.Is(err, errInvalidKey) {
+			t.Fatalf("delete %q: got %v, want %v", key, err, errInvalidKey)
+		}
+	}
+}
@@ -0,0 +1,169 @@
+package claimcheck
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/Maksat-luci/Telegram-Bot/pkg/client/mq"
+)
+
+// NewProducer оборачивает продьюсера, тела больше порога публикуются ссылкой на хранилище.
+// Обёртка реализует BatchProducer и ScheduledProducer только если их реализует сам продьюсер
+func NewProducer(p mq.Producer, cfg Config) mq.Producer {
+	if cfg.Threshold <= 0 {
+		cfg.Threshold = defaultThreshold
+	}
+	base := &producer{Producer: p, cfg: cfg}
+	batch, isBatch := p.(mq.BatchProducer)
+	scheduled, isScheduled := p.(mq.ScheduledProducer)
+	switch {
+	case isBatch && isScheduled:
+		return &struct {
+			*producer
+			batching
+			scheduling
+		}{base, batching{base, batch}, scheduling{base, scheduled}}
+	case isBatch:
+		return &struct {
+			*producer
+			batching
+		}{base, batching{base, batch}}
+	case isScheduled:
+		return &struct {
+			*producer
+			scheduling
+		}{base, scheduling{base, scheduled}}
+	}
+	return base
+}
+
+// producer публикует большие тела через хранилище, объявления передаёт как есть
+type producer struct {
+	mq.Producer
+	cfg Config
+}
+
+// Publish отправляет сообщение в очередь target
+func (p *producer) Publish(ctx context.Context, target string, body []byte) error {
+	return p.PublishExchange(ctx, "", target, mq.Message{Body: body})
+}
+
+// PublishMessage отправляет сообщение в очередь target через default exchange
+func (p *producer) PublishMessage(ctx context.Context, target string, msg mq.Message) error {
+	return p.PublishExchange(ctx, "", target, msg)
+}
+
+// PublishExchange отправляет сообщение, большое тело сначала сохраняется в хранилище
+func (p *producer) PublishExchange(ctx context.Context, exchange, key string, msg mq.Message) error {
+	msg, claim, err := p.claim(ctx, msg)
+	if err != nil {
+		return err
+	}
+	err = p.Producer.PublishExchange(ctx, exchange, key, msg)
+	p.release(claim, err)
+	return err
+}
+
+// claim сохраняет тело больше порога и заменяет его ссылкой, возвращает ключ или пустую строку
+// если сообщение публикуется как есть
+func (p *producer) claim(ctx context.Context, msg mq.Message) (mq.Message, string, error) {
+	if len(msg.Body) <= p.cfg.Threshold {
+		return msg, "", nil
+	}
+	claim := mq.NewID()
+	if err := p.cfg.Store.Put(ctx, claim, msg.Body); err != nil {
+		return msg, "", fmt.Errorf("failed to store message body due %v", err)
+	}
+	headers := make(map[string]interface{}, len(msg.Headers)+1)
+	for k, v := range msg.Headers {
+		headers[k] = v
+	}
+	headers[HeaderClaimCheck] = claim
+	msg.Headers = headers
+	msg.Body = nil
+	return msg, claim, nil
+}
+
+// release удаляет тело если сообщение со ссылкой на него не было опубликовано
+func (p *producer) release(claim string, err error) {
+	if claim == "" || err == nil {
+		return
+	}
+	// ctx публикации мог уже истечь, удаление ограничено своим таймаутом
+	ctx, cancel := context.WithTimeout(context.Background(), deleteTimeout)
+	defer cancel()
+	if err := p.cfg.Store.Delete(ctx, claim); err != nil {
+		log.Printf("failed to delete claim check %s of unpublished message due %v", claim, err)
+	}
+}
+
+// batching публикует асинхронно и пакетами
+type batching struct {
+	p     *producer
+	batch mq.BatchProducer
+}
+
+// PublishAsync отправляет сообщение, тело удаляется если брокер его не подтвердит
+func (b batching) PublishAsync(ctx context.Context, exchange, key string, msg mq.Message) <-chan error {
+	result := make(chan error, 1)
+	msg, claim, err := b.p.claim(ctx, msg)
+	if err != nil {
+		result <- err
+		return result
+	}
+	confirmed := b.batch.PublishAsync(ctx, exchange, key, msg)
+	go func() {
+		err := <-confirmed
+		b.p.release(claim, err)
+		result <- err
+	}()
+	return result
+}
+
+// PublishBatch отправляет пакет, при ошибке тела всего пакета удаляются
+func (b batching) PublishBatch(ctx context.Context, exchange, key string, msgs []mq.Message) error {
+	claimed := make([]mq.Message, len(msgs))
+	claims := make([]string, 0, len(msgs))
+	var err error
+	for i, msg := range msgs {
+		var claim string
+		claimed[i], claim, err = b.p.claim(ctx, msg)
+		if err != nil {
+			break
+		}
+		if claim != "" {
+			claims = append(claims, claim)
+		}
+	}
+	if err == nil {
+		err = b.batch.PublishBatch(ctx, exchange, key, claimed)
+	}
+	for _, claim := range claims {
+		b.p.release(claim, err)
+	}
+	return err
+}
+
+// scheduling публикует отложенные сообщения, тело лежит в хранилище пока сообщение ждёт у брокера
+type scheduling struct {
+	p         *producer
+	scheduled mq.ScheduledProducer
+}
+
+// PublishAt отправляет сообщение не раньше at
+func (s scheduling) PublishAt(ctx context.Context, exchange, key string, msg mq.Message, at time.Time) error {
+	msg, claim, err := s.p.claim(ctx, msg)
+	if err != nil {
+		return err
+	}
+	err = s.scheduled.PublishAt(ctx, exchange, key, msg, at)
+	s.p.release(claim, err)
+	return err
+}
+
+// PublishAfter отправляет сообщение через delay
+func (s scheduling) PublishAfter(ctx context.Context, exchange, key string, msg mq.Message, delay time.Duration) error {
+	return s.PublishAt(ctx, exchange, key, msg, time.Now().Add(delay))
+}
@@ -0,0 +1,226 @@
+package claimcheck
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+)
+
+// S3Config подключение к S3 совместимому хранилищу, например MinIO
+type S3Config struct {
+	// Endpoint адрес хранилища со схемой, например http://127.0.0.1:9000
+	Endpoint  string
+	Region    string
+	Bucket    string
+	AccessKey string
+	SecretKey string
+	// Prefix добавляется к ключам тел, так бот может делить бакет с другими данными
+	Prefix string
+}
+
+// defaultRegion регион по умолчанию, MinIO принимает его если свой регион не задан
+const defaultRegion = "us-east-1"
+
+// emptyHash sha256 пустого тела запроса
+const emptyHash = "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855"
+
+// s3Store хранит тела объектами бакета, запросы подписываются AWS Signature Version 4.
+// Адреса объектов в path-style, его поддерживают и AWS, и MinIO без настройки DNS
+type s3Store struct {
+	endpoint *url.URL
+	cfg      S3Config
+	client   *http.Client
+}
+
+// NewS3Store создаёт хранилище в бакете cfg.Bucket, бакет должен уже существовать
+func NewS3Store(cfg S3Config) (Store, error) {
+	endpoint, err := url.Parse(cfg.Endpoint)
+	if err != nil || endpoint.Scheme == "" || endpoint.Host == "" {
+		return nil, fmt.Errorf("invalid s3 endpoint %q", cfg.Endpoint)
+	}
+	if cfg.Bucket == "" {
+		return nil, fmt.Errorf("s3 bucket is not set")
+	}
+	if cfg.Region == "" {
+		cfg.Region = defaultRegion
+	}
+	return &s3Store{endpoint: endpoint, cfg: cfg, client: &http.Client{}}, nil
+}
+
+// Put загружает тело объектом
+func (s *s3Store) Put(ctx context.Context, key string, body []byte) error {
+	resp, err := s.do(ctx, http.MethodPut, key, body)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return s.responseError(http.MethodPut, key, resp)
+	}
+	return nil
+}
+
+// Get скачивает тело объекта
+func (s *s3Store) Get(ctx context.Context, key string) ([]byte, error) {
+	resp, err := s.do(ctx, http.MethodGet, key, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	switch resp.StatusCode {
+	case http.StatusOK:
+		return io.ReadAll(resp.Body)
+	case http.StatusNotFound:
+		return nil, ErrNotFound
+	}
+	return nil, s.responseError(http.MethodGet, key, resp)
+}
+
+// Delete удаляет объект, S3 отвечает успехом и на отсутствующий объект
+func (s *s3Store) Delete(ctx context.Context, key string) error {
+	resp, err := s.do(ctx, http.MethodDelete, key, nil)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusNoContent && resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusNotFound {
+		return s.responseError(http.MethodDelete, key, resp)
+	}
+	return nil
+}
+
+// do отправляет подписанный запрос к объекту key
+func (s *s3Store) do(ctx context.Context, method, key string, body []byte) (*http.Response, error) {
+	if err := validKey(key); err != nil {
+		return nil, err
+	}
+	u := *s.endpoint
+	u.Path = strings.TrimSuffix(u.Path, "/") + "/" + s.cfg.Bucket + "/" + s.cfg.Prefix + key
+	// путь отправляется в том же кодировании что и подписывается
+	u.RawPath = uriEncode(u.Path, false)
+	req, err := http.NewRequestWithContext(ctx, method, u.String(), bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.ContentLength = int64(len(body))
+	payloadHash := emptyHash
+	if len(body) > 0 {
+		sum := sha256.Sum256(body)
+		payloadHash = hex.EncodeToString(sum[:])
+	}
+	req.Header.Set("X-Amz-Content-Sha256", payloadHash)
+	req.Header.Set("X-Amz-Date", time.Now().UTC().Format(amzDateFormat))
+	s.sign(req, payloadHash)
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to %s claim check %s due %v", strings.ToLower(method), key, err)
+	}
+	return resp, nil
+}
+
+// responseError ошибка из ответа хранилища, S3 возвращает её текст в теле
+func (s *s3Store) responseError(method, key string, resp *http.Response) error {
+	text, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+	return fmt.Errorf("failed to %s claim check %s: %s %s", strings.ToLower(method), key, resp.Status, bytes.TrimSpace(text))
+}
+
+// форматы времени подписи
+const (
+	amzDateFormat   = "20060102T150405Z"
+	scopeDateFormat = "20060102"
+)
+
+// sign добавляет заголовок Authorization по Signature Version 4. Подписываются host и все заголовки запроса,
+// поэтому X-Amz-Date и X-Amz-Content-Sha256 должны быть уже проставлены
+func (s *s3Store) sign(req *http.Request, payloadHash string) {
+	amzDate := req.Header.Get("X-Amz-Date")
+	date, _ := time.Parse(amzDateFormat, amzDate)
+	scope := date.Format(scopeDateFormat) + "/" + s.cfg.Region + "/s3/aws4_request"
+
+	headers := map[string]string{"host": req.URL.Host}
+	for name, values := range req.Header {
+		headers[strings.ToLower(name)] = strings.TrimSpace(strings.Join(values, ","))
+	}
+	names := make([]string, 0, len(headers))
+	for name := range headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var canonicalHeaders strings.Builder
+	for _, name := range names {
+		canonicalHeaders.WriteString(name + ":" + headers[name] + "\n")
+	}
+	signedHeaders := strings.Join(names, ";")
+
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		uriEncode(req.URL.Path, false),
+		canonicalQuery(req.URL.Query()),
+		canonicalHeaders.String(),
+		signedHeaders,
+		payloadHash,
+	}, "\n")
+	requestHash := sha256.Sum256([]byte(canonicalRequest))
+	stringToSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + hex.EncodeToString(requestHash[:])
+
+	key := hmacSHA256([]byte("AWS4"+s.cfg.SecretKey), date.Format(scopeDateFormat))
+	key = hmacSHA256(key, s.cfg.Region)
+	key = hmacSHA256(key, "s3")
+	key = hmacSHA256(key, "aws4_request")
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		s.cfg.AccessKey, scope, signedHeaders, signature))
+}
+
+// canonicalQuery параметры запроса отсортированные по имени
+func canonicalQuery(query url.Values) string {
+	keys := make([]string, 0, len(query))
+	for k := range query {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	var pairs []string
+	for _, k := range keys {
+		values := query[k]
+		sort.Strings(values)
+		for _, v := range values {
+			pairs = append(pairs, uriEncode(k, true)+"="+uriEncode(v, true))
+		}
+	}
+	return strings.Join(pairs, "&")
+}
+
+// uriEncode кодирует всё кроме unreserved символов RFC 3986, слеш кодируется только в параметрах запроса
+func uriEncode(s string, encodeSlash bool) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case c >= 'a' && c <= 'z', c >= 'A' && c <= 'Z', c >= '0' && c <= '9', c == '-', c == '_', c == '.', c == '~':
+			b.WriteByte(c)
+		case c == '/' && !encodeSlash:
+			b.WriteByte(c)
+		default:
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+	return b.String()
+}
+
+// hmacSHA256 подпись data ключом key
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
@@ -1,27 +1,164 @@
 package mq
 
-import "io"
-//MessageQueue интерфейс очереди
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"time"
+)
+//MessageQueue интерфейс очереди, каждый вызов ограничен контекстом вызывающего
 type MessageQueue interface {
 	io.Closer
-	DeclareQueue(name string, durable, autoDelete, exclusive bool, args map[string]interface{}) error
+	DeclareQueue(ctx context.Context, name string, durable, autoDelete, exclusive bool, args map[string]interface{}) error
+	DeclareExchange(ctx context.Context, name, kind string, durable, autoDelete bool, args map[string]interface{}) error
+	// BindQueue привязывает очередь к exchange по ключу маршрутизации
+	BindQueue(ctx context.Context, queue, exchange, key string, args map[string]interface{}) error
 }
+
+// типы exchange
+const (
+	ExchangeDirect  = "direct"
+	ExchangeTopic   = "topic"
+	ExchangeFanout  = "fanout"
+	ExchangeHeaders = "headers"
+)
 // Producer интерфейс продьюсера
 type Producer interface {
 	MessageQueue
-	Publish(target string, body []byte) error
+	Publish(ctx context.Context, target string, body []byte) error
+	PublishMessage(ctx context.Context, target string, msg Message) error
+	// PublishExchange отправляет сообщение в exchange с ключом маршрутизации key
+	PublishExchange(ctx context.Context, exchange, key string, msg Message) error
+}
+// BatchProducer продьюсер который умеет публиковать не дожидаясь подтверждения каждого сообщения
+type BatchProducer interface {
+	Producer
+	// PublishAsync отправляет сообщение, результат подтверждения придёт в канал
+	PublishAsync(ctx context.Context, exchange, key string, msg Message) <-chan error
+	// PublishBatch отправляет все сообщения и ждёт подтверждения всех
+	PublishBatch(ctx context.Context, exchange, key string, msgs []Message) error
 }
+// ScheduledProducer продьюсер который умеет откладывать публикацию
+type ScheduledProducer interface {
+	Producer
+	// PublishAt отправляет сообщение в exchange с ключом key не раньше at, прошедшее время публикует сразу
+	PublishAt(ctx context.Context, exchange, key string, msg Message, at time.Time) error
+	// PublishAfter отправляет сообщение через delay
+	PublishAfter(ctx context.Context, exchange, key string, msg Message, delay time.Duration) error
+}
+// ErrStaleDelivery сообщение доставлено каналом которого после переподключения уже нет. Подтвердить его
+// нельзя, брокер доставит его ещё раз
+var ErrStaleDelivery = errors.New("delivery from a closed channel")
 // Consumer интерфейс  консьюмера
 type Consumer interface {
 	MessageQueue
-	Consume(target string) (<-chan Message, error)
-	Ack(id uint64, multiple bool) error
-	Nack(id uint64, multiple bool, requeue bool) error
-	Reject(id uint64, requeue bool) error
+	// Consume доставляет сообщения очереди пока ctx не отменён, после отмены канал закрывается
+	Consume(ctx context.Context, target string) (<-chan Message, error)
+	Ack(ctx context.Context, id uint64, multiple bool) error
+	Nack(ctx context.Context, id uint64, multiple bool, requeue bool) error
+	Reject(ctx context.Context, id uint64, requeue bool) error
+	// Settle завершает сообщение которое не удалось обработать и возвращает итог который был применён на самом деле
+	Settle(ctx context.Context, msg Message, outcome Outcome) (Outcome, error)
+}
+
+// Outcome итог для сообщения которое не удалось обработать
+type Outcome int
+
+const (
+	// OutcomeRetry повторить обработку позже с задержкой
+	OutcomeRetry Outcome = iota + 1
+	// OutcomeDeadLetter отложить сообщение в очередь для разбора
+	OutcomeDeadLetter
+	// OutcomeDrop выбросить сообщение
+	OutcomeDrop
+	// OutcomeRequeue сразу вернуть сообщение в очередь без задержки и без счётчика повторов.
+	// Бэкенды его не знают, Subscriber применяет его через Nack
+	OutcomeRequeue
+)
+
+func (o Outcome) String() string {
+	switch o {
+	case OutcomeRetry:
+		return "retry"
+	case OutcomeDeadLetter:
+		return "dead-letter"
+	case OutcomeDrop:
+		return "drop"
+	case OutcomeRequeue:
+		return "requeue"
+	}
+	return fmt.Sprintf("outcome(%d)", int(o))
 }
 
+// HeaderRetryCount заголовок в котором хранится сколько раз сообщение уже повторялось
+const HeaderRetryCount = "x-retry-count"
+
 // Message структура Сообщения
 type Message struct {
+	// ID номер доставки, по нему сообщение подтверждается консьюмером
 	ID   uint64
 	Body []byte
+	// MessageID постоянный идентификатор сообщения, не меняется при повторах
+	MessageID string
+	// CorrelationID связывает ответ с запросом
+	CorrelationID string
+	// Timestamp время публикации
+	Timestamp time.Time
+	// ContentType тип содержимого Body
+	ContentType string
+	// AppID приложение которое опубликовало сообщение
+	AppID string
+	// Redelivered сообщение уже доставлялось раньше и не было подтверждено
+	Redelivered bool
+	// ReplyTo очередь в которую нужно отправить ответ
+	ReplyTo string
+	// Queue очередь из которой сообщение было получено
+	Queue string
+	// Exchange и RoutingKey с которыми сообщение было опубликовано
+	Exchange   string
+	RoutingKey string
+	// Headers заголовки сообщения
+	Headers map[string]interface{}
+}
+
+// WithDefaults заполняет метаданные которые продьюсер проставляет при публикации, если они не заданы
+func (m Message) WithDefaults(appID, contentType string) Message {
+	if m.MessageID == "" {
+		m.MessageID = NewID()
+	}
+	if m.Timestamp.IsZero() {
+		m.Timestamp = time.Now()
+	}
+	if m.AppID == "" {
+		m.AppID = appID
+	}
+	if m.ContentType == "" {
+		m.ContentType = contentType
+	}
+	return m
+}
+
+// RetryCount возвращает сколько раз сообщение уже повторялось
+func (m Message) RetryCount() int {
+	switch v := m.Headers[HeaderRetryCount].(type) {
+	case int:
+		return v
+	case int32:
+		return int(v)
+	case int64:
+		return int(v)
+	}
+	return 0
+}
+
+// NewID генерирует случайный идентификатор для сообщений и запросов
+func NewID() string {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		panic(fmt.Sprintf("failed to read random bytes due %v", err))
+	}
+	return hex.EncodeToString(b)
 }
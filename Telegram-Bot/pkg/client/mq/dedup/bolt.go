@@ -0,0 +1,149 @@
+package dedup
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// bucketKeys бакет с ключами, значение это состояние и время истечения
+var bucketKeys = []byte("keys")
+
+const (
+	// sweepInterval как часто из базы удаляются истёкшие ключи
+	sweepInterval = time.Minute
+	// openTimeout сколько ждать блокировку файла, его может держать другой процесс
+	openTimeout = 5 * time.Second
+)
+
+// boltStore хранилище во встроенной базе, переживает перезапуск бота но видно только одному инстансу
+type boltStore struct {
+	db        *bolt.DB
+	done      chan struct{}
+	stopped   chan struct{}
+	closeOnce sync.Once
+}
+
+// NewBoltStore открывает базу path и запускает удаление истёкших ключей
+func NewBoltStore(path string) (Store, error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return nil, fmt.Errorf("failed to create dedup directory due %v", err)
+	}
+	db, err := bolt.Open(path, 0o600, &bolt.Options{Timeout: openTimeout})
+	if err != nil {
+		return nil, fmt.Errorf("failed to open dedup store due %v", err)
+	}
+	err = db.Update(func(tx *bolt.Tx) error {
+		_, err := tx.CreateBucketIfNotExists(bucketKeys)
+		return err
+	})
+	if err != nil {
+		_ = db.Close()
+		return nil, fmt.Errorf("failed to open dedup store due %v", err)
+	}
+
+	s := &boltStore{db: db, done: make(chan struct{}), stopped: make(chan struct{})}
+	go s.sweep()
+	return s, nil
+}
+
+// Begin отмечает ключ обрабатываемым если его нет или его отметка истекла
+func (s *boltStore) Begin(ctx context.Context, key string, lease time.Duration) (Status, error) {
+	status := StatusNew
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(bucketKeys)
+		now := time.Now()
+		if existing, expires, ok := decodeValue(b.Get([]byte(key))); ok && now.Before(expires) {
+			status = existing
+			return nil
+		}
+		return b.Put([]byte(key), encodeValue(StatusProcessing, now.Add(lease)))
+	})
+	return status, err
+}
+
+// Complete отмечает ключ обработанным на ttl
+func (s *boltStore) Complete(ctx context.Context, key string, ttl time.Duration) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(bucketKeys).Put([]byte(key), encodeValue(StatusDone, time.Now().Add(ttl)))
+	})
+}
+
+// Release удаляет ключ если он ещё обрабатывается
+func (s *boltStore) Release(ctx context.Context, key string) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(bucketKeys)
+		if status, _, ok := decodeValue(b.Get([]byte(key))); ok && status == StatusProcessing {
+			return b.Delete([]byte(key))
+		}
+		return nil
+	})
+}
+
+// sweep раз в sweepInterval удаляет истёкшие ключи пока хранилище не закрыто
+func (s *boltStore) sweep() {
+	defer close(s.stopped)
+	ticker := time.NewTicker(sweepInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-s.done:
+			return
+		}
+		err := s.db.Update(func(tx *bolt.Tx) error {
+			now := time.Now()
+			b := tx.Bucket(bucketKeys)
+			var expired [][]byte
+			_ = b.ForEach(func(k, v []byte) error {
+				if _, expires, ok := decodeValue(v); !ok || !now.Before(expires) {
+					expired = append(expired, append([]byte(nil), k...))
+				}
+				return nil
+			})
+			for _, k := range expired {
+				if err := b.Delete(k); err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+		if err != nil {
+			log.Printf("failed to sweep dedup store due %v", err)
+		}
+	}
+}
+
+// Close останавливает удаление истёкших ключей и закрывает базу
+func (s *boltStore) Close() error {
+	var err error
+	s.closeOnce.Do(func() {
+		close(s.done)
+		<-s.stopped
+		err = s.db.Close()
+	})
+	return err
+}
+
+// encodeValue состояние в первом байте, время истечения в наносекундах за ним
+func encodeValue(status Status, expires time.Time) []byte {
+	v := make([]byte, 9)
+	v[0] = byte(status)
+	binary.BigEndian.PutUint64(v[1:], uint64(expires.UnixNano()))
+	return v
+}
+
+// decodeValue раскодирует значение ключа, ok false если значения нет или оно битое
+func decodeValue(v []byte) (Status, time.Time, bool) {
+	if len(v) != 9 {
+		return 0, time.Time{}, false
+	}
+	return Status(v[0]), time.Unix(0, int64(binary.BigEndian.Uint64(v[1:]))), true
+}
@@ -0,0 +1,131 @@
+// Package dedup идемпотентная обработка сообщений. Доставка at-least-once, поэтому одно и то же
+// сообщение может прийти несколько раз: middleware запоминает ключи обработанных сообщений
+// в хранилище и подтверждает дубликаты не вызывая обработчик
+package dedup
+
+import (
+	"context"
+	"errors"
+	"io"
+	"log"
+	"time"
+
+	"github.com/Maksat-luci/Telegram-Bot/pkg/client/mq"
+)
+
+// Status состояние ключа в хранилище
+type Status int
+
+const (
+	// StatusNew ключа не было, хранилище отметило его как обрабатываемый
+	StatusNew Status = iota
+	// StatusProcessing сообщение с этим ключом сейчас обрабатывает другой воркер или инстанс
+	StatusProcessing
+	// StatusDone сообщение с этим ключом уже обработано
+	StatusDone
+)
+
+// Store хранилище ключей обработанных сообщений
+type Store interface {
+	io.Closer
+	// Begin атомарно отмечает ключ обрабатываемым на lease, если его нет, и возвращает прежнее состояние.
+	// Отметка с истёкшим lease считается отсутствующей, так ключ упавшего инстанса не блокирует сообщение
+	Begin(ctx context.Context, key string, lease time.Duration) (Status, error)
+	// Complete отмечает ключ обработанным на ttl
+	Complete(ctx context.Context, key string, ttl time.Duration) error
+	// Release снимает отметку обработки, сообщение можно будет обработать снова
+	Release(ctx context.Context, key string) error
+}
+
+// Config настройки middleware
+type Config struct {
+	Store Store
+	// TTL сколько помнить обработанные ключи, должно быть больше чем брокер может держать сообщение
+	TTL time.Duration
+	// Lease сколько ключ считается обрабатываемым, должно быть больше времени обработки одного сообщения
+	Lease time.Duration
+	// Key ключ сообщения, по умолчанию MessageKey. Одно хранилище обычно общее для всех очередей,
+	// поэтому ключ должен включать очередь. Сообщения с пустым ключом обрабатываются без проверки
+	Key func(msg mq.Message) string
+}
+
+// значения по умолчанию
+const (
+	defaultTTL   = 24 * time.Hour
+	defaultLease = time.Minute
+)
+
+// ErrInProgress сообщение с тем же ключом сейчас обрабатывается, его нужно повторить позже
+var ErrInProgress = errors.New("message with the same key is being processed")
+
+// Middleware возвращает middleware которое подтверждает уже обработанные сообщения не вызывая обработчик.
+// Дубликат сообщения которое ещё обрабатывается возвращает ErrInProgress, итог по умолчанию повтор,
+// так сообщение не теряется если первая обработка завершится ошибкой или инстанс упадёт
+func Middleware(cfg Config) mq.Middleware {
+	if cfg.TTL <= 0 {
+		cfg.TTL = defaultTTL
+	}
+	if cfg.Lease <= 0 {
+		cfg.Lease = defaultLease
+	}
+	if cfg.Key == nil {
+		cfg.Key = MessageKey
+	}
+
+	return func(next mq.Handler) mq.Handler {
+		return func(ctx context.Context, msg mq.Message) error {
+			key := cfg.Key(msg)
+			if key == "" {
+				return next(ctx, msg)
+			}
+
+			status, err := cfg.Store.Begin(ctx, key, cfg.Lease)
+			if err != nil {
+				// недоступное хранилище не должно останавливать обработку, дубликат лучше потерянного сообщения
+				log.Printf("failed to check message %s for duplicates due %v", key, err)
+				return next(ctx, msg)
+			}
+			switch status {
+			case StatusDone:
+				return nil
+			case StatusProcessing:
+				return ErrInProgress
+			}
+
+			if err := next(ctx, msg); err != nil {
+				if err := cfg.Store.Release(ctx, key); err != nil {
+					log.Printf("failed to release message %s due %v", key, err)
+				}
+				return err
+			}
+			if err := cfg.Store.Complete(ctx, key, cfg.TTL); err != nil {
+				log.Printf("failed to complete message %s due %v", key, err)
+			}
+			return nil
+		}
+	}
+}
+
+// MessageKey ключ по умолчанию: очередь и MessageID. Сообщение разосланное в несколько очередей
+// обрабатывается в каждой из них, сообщение без MessageID обрабатывается без проверки
+func MessageKey(msg mq.Message) string {
+	return queueKey(msg.Queue, msg.MessageID)
+}
+
+// CorrelationKey очередь и MessageID, а если его нет то CorrelationID. Подходит только для очередей
+// в которые на каждый запрос приходит ровно один ответ без MessageID, иначе ответы с общим CorrelationID
+// считаются дубликатами друг друга
+func CorrelationKey(msg mq.Message) string {
+	if msg.MessageID != "" {
+		return queueKey(msg.Queue, msg.MessageID)
+	}
+	return queueKey(msg.Queue, msg.CorrelationID)
+}
+
+// queueKey ключ id в пределах очереди, пустой если id нет
+func queueKey(queue, id string) string {
+	if id == "" {
+		return ""
+	}
+	return queue + "/" + id
+}
@@ -0,0 +1,192 @@
+package dedup
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/Maksat-luci/Telegram-Bot/pkg/client/mq"
+)
+
+// counter обработчик который считает вызовы по телу сообщения
+type counter struct {
+	lock  sync.Mutex
+	calls map[string]int
+}
+
+func newCounter() *counter {
+	return &counter{calls: make(map[string]int)}
+}
+
+func (c *counter) handle(ctx context.Context, msg mq.Message) error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.calls[string(msg.Body)]++
+	return nil
+}
+
+func (c *counter) count(body string) int {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.calls[body]
+}
+
+func TestMiddlewareSkipsDuplicates(t *testing.T) {
+	ctx := context.Background()
+	c := newCounter()
+	handler := Middleware(Config{Store: NewMemoryStore(0)})(c.handle)
+
+	msg := mq.Message{Body: []byte("track"), MessageID: "id-1", Queue: "tracks"}
+	for i := 0; i < 3; i++ {
+		if err := handler(ctx, msg); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if n := c.count("track"); n != 1 {
+		t.Fatalf("handler called %d times, want 1", n)
+	}
+
+	// без MessageID сообщение не с чем сравнить, оно обрабатывается каждый раз
+	anonymous := mq.Message{Body: []byte("anonymous"), Queue: "tracks"}
+	for i := 0; i < 2; i++ {
+		if err := handler(ctx, anonymous); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if n := c.count("anonymous"); n != 2 {
+		t.Fatalf("handler called %d times for message without id, want 2", n)
+	}
+}
+
+// Одно хранилище обслуживает все пулы: копия сообщения в другой очереди не дубликат
+func TestMiddlewareKeyIncludesQueue(t *testing.T) {
+	ctx := context.Background()
+	c := newCounter()
+	handler := Middleware(Config{Store: NewMemoryStore(0)})(c.handle)
+
+	for _, queue := range []string{"tracks", "photos"} {
+		if err := handler(ctx, mq.Message{Body: []byte(queue), MessageID: "id-1", Queue: queue}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if c.count("tracks") != 1 || c.count("photos") != 1 {
+		t.Fatalf("fanned out message handled %d and %d times, want once in each queue", c.count("tracks"), c.count("photos"))
+	}
+}
+
+func TestCorrelationKey(t *testing.T) {
+	replies := []mq.Message{
+		{Body: []byte("first"), CorrelationID: "request-1", Queue: "replies"},
+		{Body: []byte("second"), CorrelationID: "request-1", Queue: "replies"},
+	}
+	tests := []struct {
+		name   string
+		key    func(mq.Message) string
+		second int
+	}{
+		// по умолчанию ответы с общим CorrelationID не схлопываются
+		{name: "message key", key: MessageKey, second: 1},
+		{name: "correlation key", key: CorrelationKey, second: 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := newCounter()
+			handler := Middleware(Config{Store: NewMemoryStore(0), Key: tt.key})(c.handle)
+			for _, msg := range replies {
+				if err := handler(context.Background(), msg); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if c.count("first") != 1 || c.count("second") != tt.second {
+				t.Fatalf("handled first %d and second %d times, want 1 and %d", c.count("first"), c.count("second"), tt.second)
+			}
+		})
+	}
+	if key := CorrelationKey(mq.Message{MessageID: "id-1", CorrelationID: "request-1", Queue: "replies"}); key != "replies/id-1" {
+		t.Fatalf("got key %q, MessageID should win", key)
+	}
+}
+
+// Дубликат сообщения которое ещё обрабатывается повторяется позже, а не подтверждается
+func TestMiddlewareInProgress(t *testing.T) {
+	ctx := context.Background()
+	started := make(chan struct{})
+	release := make(chan struct{})
+	handler := Middleware(Config{Store: NewMemoryStore(0)})(func(ctx context.Context, msg mq.Message) error {
+		close(started)
+		<-release
+		return nil
+	})
+
+	msg := mq.Message{MessageID: "id-1", Queue: "tracks"}
+	first := make(chan error, 1)
+	go func() { first <- handler(ctx, msg) }()
+	<-started
+
+	err := handler(ctx, msg)
+	if !errors.Is(err, ErrInProgress) {
+		t.Fatalf("got %v, want %v", err, ErrInProgress)
+	}
+	if outcome := mq.OutcomeOf(err); outcome != mq.OutcomeRetry {
+		t.Fatalf("got outcome %v, want %v", outcome, mq.OutcomeRetry)
+	}
+	close(release)
+	if err := <-first; err != nil {
+		t.Fatal(err)
+	}
+}
+
+// Неудачная обработка снимает отметку, повторная доставка обрабатывается снова
+func TestMiddlewareReleasesOnError(t *testing.T) {
+	ctx := context.Background()
+	failure := errors.New("telegram is down")
+	calls := 0
+	handler := Middleware(Config{Store: NewMemoryStore(0)})(func(ctx context.Context, msg mq.Message) error {
+		calls++
+		if calls == 1 {
+			return failure
+		}
+		return nil
+	})
+
+	msg := mq.Message{MessageID: "id-1", Queue: "tracks"}
+	if err := handler(ctx, msg); !errors.Is(err, failure) {
+		t.Fatalf("got %v, want %v", err, failure)
+	}
+	if err := handler(ctx, msg); err != nil {
+		t.Fatal(err)
+	}
+	if err := handler(ctx, msg); err != nil {
+		t.Fatal(err)
+	}
+	if calls != 2 {
+		t.Fatalf("handler called %d times, want 2", calls)
+	}
+}
+
+// brokenStore хранилище которое всегда недоступно
+type brokenStore struct{}
+
+func (brokenStore) Begin(ctx context.Context, key string, lease time.Duration) (Status, error) {
+	return 0, errors.New("store is down")
+}
+func (brokenStore) Complete(ctx context.Context, key string, ttl time.Duration) error { return nil }
+func (brokenStore) Release(ctx context.Context, key string) error                     { return nil }
+func (brokenStore) Close() error                                                      { return nil }
+
+// Недоступное хранилище не останавливает обработку
+func TestMiddlewareStoreDown(t *testing.T) {
+	c := newCounter()
+	handler := Middleware(Config{Store: brokenStore{}})(c.handle)
+	msg := mq.Message{Body: []byte("track"), MessageID: "id-1", Queue: "tracks"}
+	for i := 0; i < 2; i++ {
+		if err := handler(context.Background(), msg); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if n := c.count("track"); n != 2 {
+		t.Fatalf("handler called %d times, want 2", n)
+	}
+}
@@ -0,0 +1,96 @@
+package dedup
+
+import (
+	"container/list"
+	"context"
+	"sync"
+	"time"
+)
+
+// defaultSize сколько ключей помнит хранилище в памяти по умолчанию
+const defaultSize = 10000
+
+// memoryStore LRU хранилище в памяти процесса. Ключи живут до истечения TTL или пока их
+// не вытеснят более свежие, дубликаты между инстансами бота оно не видит
+type memoryStore struct {
+	lock  sync.Mutex
+	size  int
+	order *list.List
+	items map[string]*list.Element
+}
+
+// memoryItem элемент списка LRU
+type memoryItem struct {
+	key     string
+	status  Status
+	expires time.Time
+}
+
+// NewMemoryStore конструктор хранилища в памяти на size ключей
+func NewMemoryStore(size int) Store {
+	if size <= 0 {
+		size = defaultSize
+	}
+	return &memoryStore{
+		size:  size,
+		order: list.New(),
+		items: make(map[string]*list.Element),
+	}
+}
+
+// Begin отмечает ключ обрабатываемым если его нет или его отметка истекла
+func (s *memoryStore) Begin(ctx context.Context, key string, lease time.Duration) (Status, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	now := time.Now()
+	if el, ok := s.items[key]; ok {
+		item := el.Value.(*memoryItem)
+		if now.Before(item.expires) {
+			s.order.MoveToFront(el)
+			return item.status, nil
+		}
+	}
+	s.set(key, StatusProcessing, now.Add(lease))
+	return StatusNew, nil
+}
+
+// Complete отмечает ключ обработанным
+func (s *memoryStore) Complete(ctx context.Context, key string, ttl time.Duration) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.set(key, StatusDone, time.Now().Add(ttl))
+	return nil
+}
+
+// Release удаляет ключ если он ещё обрабатывается
+func (s *memoryStore) Release(ctx context.Context, key string) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if el, ok := s.items[key]; ok && el.Value.(*memoryItem).status == StatusProcessing {
+		s.order.Remove(el)
+		delete(s.items, key)
+	}
+	return nil
+}
+
+// set записывает ключ в начало списка и вытесняет самые старые ключи сверх размера
+func (s *memoryStore) set(key string, status Status, expires time.Time) {
+	if el, ok := s.items[key]; ok {
+		item := el.Value.(*memoryItem)
+		item.status = status
+		item.expires = expires
+		s.order.MoveToFront(el)
+		return
+	}
+	s.items[key] = s.order.PushFront(&memoryItem{key: key, status: status, expires: expires})
+	for s.order.Len() > s.size {
+		oldest := s.order.Back()
+		s.order.Remove(oldest)
+		delete(s.items, oldest.Value.(*memoryItem).key)
+	}
+}
+
+// Close ничего не делает, хранилище живёт в памяти
+func (s *memoryStore) Close() error {
+	return nil
+}
@@ -0,0 +1,106 @@
+package dedup
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+)
+
+// RedisConfig настройки хранилища в Redis
+type RedisConfig struct {
+	Addr     string
+	Username string
+	Password string
+	DB       int
+	// Prefix префикс ключей, по умолчанию mq:dedup:
+	Prefix string
+}
+
+// значения ключа в Redis
+const (
+	redisProcessing = "processing"
+	redisDone       = "done"
+
+	defaultPrefix = "mq:dedup:"
+	// connectTimeout сколько ждать ответа Redis при подключении
+	connectTimeout = 5 * time.Second
+)
+
+// releaseScript удаляет ключ только если он ещё обрабатывается, обработанный ключ не трогается
+var releaseScript = redis.NewScript(`
+if redis.call("GET", KEYS[1]) == ARGV[1] then
+	return redis.call("DEL", KEYS[1])
+end
+return 0`)
+
+// redisStore хранилище в Redis, общее для всех инстансов бота
+type redisStore struct {
+	client *redis.Client
+	prefix string
+}
+
+// NewRedisStore конструктор который подключается к Redis и возвращает хранилище
+func NewRedisStore(cfg RedisConfig) (Store, error) {
+	client := redis.NewClient(&redis.Options{
+		Addr:     cfg.Addr,
+		Username: cfg.Username,
+		Password: cfg.Password,
+		DB:       cfg.DB,
+	})
+	ctx, cancel := context.WithTimeout(context.Background(), connectTimeout)
+	defer cancel()
+	if err := client.Ping(ctx).Err(); err != nil {
+		_ = client.Close()
+		return nil, fmt.Errorf("failed to connect to Redis due %v", err)
+	}
+
+	prefix := cfg.Prefix
+	if prefix == "" {
+		prefix = defaultPrefix
+	}
+	return &redisStore{client: client, prefix: prefix}, nil
+}
+
+// Begin ставит ключ через SET NX, отметка истекает вместе с lease
+func (s *redisStore) Begin(ctx context.Context, key string, lease time.Duration) (Status, error) {
+	// между SET NX и GET ключ может истечь, тогда пробуем ещё раз
+	for i := 0; i < 2; i++ {
+		ok, err := s.client.SetNX(ctx, s.prefix+key, redisProcessing, lease).Result()
+		if err != nil {
+			return 0, err
+		}
+		if ok {
+			return StatusNew, nil
+		}
+		value, err := s.client.Get(ctx, s.prefix+key).Result()
+		if errors.Is(err, redis.Nil) {
+			continue
+		}
+		if err != nil {
+			return 0, err
+		}
+		if value == redisDone {
+			return StatusDone, nil
+		}
+		return StatusProcessing, nil
+	}
+	return StatusProcessing, nil
+}
+
+// Complete отмечает ключ обработанным на ttl
+func (s *redisStore) Complete(ctx context.Context, key string, ttl time.Duration) error {
+	return s.client.Set(ctx, s.prefix+key, redisDone, ttl).Err()
+}
+
+// Release удаляет отметку обработки
+func (s *redisStore) Release(ctx context.Context, key string) error {
+	return releaseScript.Run(ctx, s.client, []string{s.prefix + key}, redisProcessing).Err()
+}
+
+// Close закрывает подключение к Redis
+func (s *redisStore) Close() error {
+	return s.client.Close()
+}
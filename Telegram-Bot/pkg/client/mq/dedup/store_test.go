@@ -0,0 +1,143 @@
+package dedup
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+)
+
+// testStore хранилище и способ сдвинуть для него время
+type testStore struct {
+	name  string
+	open  func(t *testing.T) (Store, func(d time.Duration))
+	lease time.Duration
+}
+
+// sleep сдвигает время для хранилищ которые считают его по часам процесса
+func sleep(d time.Duration) { time.Sleep(d) }
+
+var stores = []testStore{
+	{name: "memory", lease: 20 * time.Millisecond, open: func(t *testing.T) (Store, func(time.Duration)) {
+		return NewMemoryStore(0), sleep
+	}},
+	{name: "redis", lease: time.Second, open: func(t *testing.T) (Store, func(time.Duration)) {
+		server := miniredis.RunT(t)
+		store, err := NewRedisStore(RedisConfig{Addr: server.Addr()})
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { _ = store.Close() })
+		// miniredis не истекает ключи сам, время сдвигается вручную
+		return store, server.FastForward
+	}},
+	{name: "bolt", lease: 20 * time.Millisecond, open: func(t *testing.T) (Store, func(time.Duration)) {
+		store, err := NewBoltStore(filepath.Join(t.TempDir(), "dedup", "keys.db"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { _ = store.Close() })
+		return store, sleep
+	}},
+}
+
+func TestStore(t *testing.T) {
+	ctx := context.Background()
+	for _, tt := range stores {
+		t.Run(tt.name, func(t *testing.T) {
+			store, advance := tt.open(t)
+			begin := func(key string, want Status) {
+				t.Helper()
+				status, err := store.Begin(ctx, key, tt.lease)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if status != want {
+					t.Fatalf("begin %s: got status %d, want %d", key, status, want)
+				}
+			}
+
+			begin("done", StatusNew)
+			begin("done", StatusProcessing)
+			if err := store.Complete(ctx, "done", time.Hour); err != nil {
+				t.Fatal(err)
+			}
+			begin("done", StatusDone)
+			// Release не снимает отметку с обработанного ключа
+			if err := store.Release(ctx, "done"); err != nil {
+				t.Fatal(err)
+			}
+			begin("done", StatusDone)
+
+			begin("released", StatusNew)
+			if err := store.Release(ctx, "released"); err != nil {
+				t.Fatal(err)
+			}
+			begin("released", StatusNew)
+
+			// отметка упавшего обработчика истекает вместе с lease
+			begin("lease", StatusNew)
+			advance(2 * tt.lease)
+			begin("lease", StatusNew)
+
+			// обработанный ключ забывается через ttl
+			begin("ttl", StatusNew)
+			if err := store.Complete(ctx, "ttl", tt.lease); err != nil {
+				t.Fatal(err)
+			}
+			begin("ttl", StatusDone)
+			advance(2 * tt.lease)
+			begin("ttl", StatusNew)
+		})
+	}
+}
+
+func TestMemoryStoreEviction(t *testing.T) {
+	ctx := context.Background()
+	store := NewMemoryStore(2)
+	for _, key := range []string{"a", "b"} {
+		if err := store.Complete(ctx, key, time.Hour); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// обращение к a делает его свежим, следующий ключ вытесняет b
+	if status, _ := store.Begin(ctx, "a", time.Minute); status != StatusDone {
+		t.Fatalf("a: got status %d, want done", status)
+	}
+	if err := store.Complete(ctx, "c", time.Hour); err != nil {
+		t.Fatal(err)
+	}
+
+	for key, want := range map[string]Status{"a": StatusDone, "c": StatusDone, "b": StatusNew} {
+		if status, _ := store.Begin(ctx, key, time.Minute); status != want {
+			t.Fatalf("%s: got status %d, want %d", key, status, want)
+		}
+	}
+}
+
+// Ключи bolt переживают перезапуск бота
+func TestBoltStoreReopen(t *testing.T) {
+	ctx := context.Background()
+	path := filepath.Join(t.TempDir(), "keys.db")
+	store, err := NewBoltStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := store.Complete(ctx, "a", time.Hour); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	store, err = NewBoltStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+	if status, err := store.Begin(ctx, "a", time.Minute); err != nil || status != StatusDone {
+		t.Fatalf("got status %d, %v, want done", status, err)
+	}
+}
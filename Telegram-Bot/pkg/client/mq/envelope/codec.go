@@ -0,0 +1,159 @@
+package envelope
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/vmihailenco/msgpack/v5"
+)
+
+// ContentType кодеков из коробки
+const (
+	ContentTypeJSON     = "application/json"
+	ContentTypeProtobuf = "application/x-protobuf"
+	ContentTypeMsgpack  = "application/x-msgpack"
+)
+
+// Codec кодирует payload и сам конверт. Конверт кодируется тем же форматом что и payload,
+// так подписчик читает сообщение целиком одним кодеком
+type Codec interface {
+	// ContentType под которым кодек регистрируется и проставляется сообщениям
+	ContentType() string
+	Marshal(v interface{}) ([]byte, error)
+	Unmarshal(data []byte, v interface{}) error
+	MarshalEnvelope(env Envelope) ([]byte, error)
+	// UnmarshalEnvelope возвращает ErrNotEnvelope если в данных нет типа события
+	UnmarshalEnvelope(data []byte) (Envelope, error)
+}
+
+// JSONCodec кодек JSON, payload лежит в конверте как вложенный объект
+type JSONCodec struct{}
+
+// jsonEnvelope конверт в формате JSON
+type jsonEnvelope struct {
+	ID         string          `json:"id"`
+	Type       string          `json:"type"`
+	Version    int             `json:"version"`
+	Source     string          `json:"source,omitempty"`
+	OccurredAt time.Time       `json:"occurred_at"`
+	SentAt     time.Time       `json:"sent_at"`
+	Payload    json.RawMessage `json:"payload"`
+}
+
+// ContentType возвращает application/json
+func (JSONCodec) ContentType() string { return ContentTypeJSON }
+
+// Marshal кодирует v в JSON
+func (JSONCodec) Marshal(v interface{}) ([]byte, error) { return json.Marshal(v) }
+
+// Unmarshal раскодирует JSON в v
+func (JSONCodec) Unmarshal(data []byte, v interface{}) error { return json.Unmarshal(data, v) }
+
+// MarshalEnvelope кодирует конверт, Data должен быть JSON
+func (JSONCodec) MarshalEnvelope(env Envelope) ([]byte, error) {
+	return json.Marshal(jsonEnvelope{
+		ID:         env.ID,
+		Type:       env.Type,
+		Version:    env.Version,
+		Source:     env.Source,
+		OccurredAt: env.OccurredAt,
+		SentAt:     env.SentAt,
+		Payload:    env.Data,
+	})
+}
+
+// UnmarshalEnvelope раскодирует конверт
+func (JSONCodec) UnmarshalEnvelope(data []byte) (Envelope, error) {
+	var e jsonEnvelope
+	if err := json.Unmarshal(data, &e); err != nil {
+		return Envelope{}, err
+	}
+	if e.Type == "" {
+		return Envelope{}, ErrNotEnvelope
+	}
+	return Envelope{
+		ID:         e.ID,
+		Type:       e.Type,
+		Version:    e.Version,
+		Source:     e.Source,
+		OccurredAt: e.OccurredAt,
+		SentAt:     e.SentAt,
+		Data:       e.Payload,
+	}, nil
+}
+
+// MsgpackCodec кодек MessagePack. Поля структур без тега msgpack берут имена из тега json,
+// поэтому одни и те же структуры событий подходят для обоих кодеков
+type MsgpackCodec struct{}
+
+// msgpackEnvelope конверт в формате MessagePack
+type msgpackEnvelope struct {
+	ID         string             `msgpack:"id"`
+	Type       string             `msgpack:"type"`
+	Version    int                `msgpack:"version"`
+	Source     string             `msgpack:"source,omitempty"`
+	OccurredAt time.Time          `msgpack:"occurred_at"`
+	SentAt     time.Time          `msgpack:"sent_at"`
+	Payload    msgpack.RawMessage `msgpack:"payload"`
+}
+
+// ContentType возвращает application/x-msgpack
+func (MsgpackCodec) ContentType() string { return ContentTypeMsgpack }
+
+// Marshal кодирует v в MessagePack
+func (MsgpackCodec) Marshal(v interface{}) ([]byte, error) {
+	var buf bytes.Buffer
+	enc := msgpack.NewEncoder(&buf)
+	enc.SetCustomStructTag("json")
+	if err := enc.Encode(v); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// Unmarshal раскодирует MessagePack в v
+func (MsgpackCodec) Unmarshal(data []byte, v interface{}) error {
+	dec := msgpack.NewDecoder(bytes.NewReader(data))
+	dec.SetCustomStructTag("json")
+	return dec.Decode(v)
+}
+
+// MarshalEnvelope кодирует конверт, Data должен быть MessagePack
+func (c MsgpackCodec) MarshalEnvelope(env Envelope) ([]byte, error) {
+	return c.Marshal(msgpackEnvelope{
+		ID:         env.ID,
+		Type:       env.Type,
+		Version:    env.Version,
+		Source:     env.Source,
+		OccurredAt: env.OccurredAt,
+		SentAt:     env.SentAt,
+		Payload:    env.Data,
+	})
+}
+
+// UnmarshalEnvelope раскодирует конверт
+func (c MsgpackCodec) UnmarshalEnvelope(data []byte) (Envelope, error) {
+	var e msgpackEnvelope
+	if err := c.Unmarshal(data, &e); err != nil {
+		return Envelope{}, err
+	}
+	if e.Type == "" {
+		return Envelope{}, ErrNotEnvelope
+	}
+	return Envelope{
+		ID:         e.ID,
+		Type:       e.Type,
+		Version:    e.Version,
+		Source:     e.Source,
+		OccurredAt: e.OccurredAt,
+		SentAt:     e.SentAt,
+		Data:       e.Payload,
+	}, nil
+}
+
+// unsupported ошибка для значения которое кодек не умеет кодировать
+func unsupported(codec Codec, v interface{}) error {
+	return fmt.Errorf("codec %s does not support %T", codec.ContentType(), v)
+}
@@ -0,0 +1,50 @@
+// Package envelope стандартный конверт событий поверх mq.Message. Конверт хранит тип события,
+// версию схемы, идентификатор и время, а payload кодируется кодеком из реестра по ContentType,
+// поэтому в одной очереди могут лежать события разных типов и версий
+package envelope
+
+import (
+	"errors"
+	"time"
+)
+
+// Envelope конверт события
+type Envelope struct {
+	// ID постоянный идентификатор события, совпадает с MessageID сообщения
+	ID string
+	// Type тип события, например youtube.search_track.response
+	Type string
+	// Version версия схемы payload, начинается с 1
+	Version int
+	// Source сервис который создал событие
+	Source string
+	// OccurredAt когда событие произошло
+	OccurredAt time.Time
+	// SentAt когда событие было упаковано для отправки
+	SentAt time.Time
+	// Data payload закодированный кодеком конверта
+	Data []byte
+}
+
+// Event раскодированное событие
+type Event struct {
+	Envelope
+	// Payload указатель на значение типа, зарегистрированного для Type и Version
+	Payload interface{}
+}
+
+// заголовки сообщения в которых дублируются тип и версия, по ним можно маршрутизировать через headers exchange
+const (
+	HeaderEventType    = "x-event-type"
+	HeaderEventVersion = "x-event-version"
+)
+
+// ошибки конверта и реестра
+var (
+	// ErrNotEnvelope тело сообщения не является конвертом, например событие старого формата
+	ErrNotEnvelope = errors.New("message is not an envelope")
+	// ErrUnknownEvent для типа события не зарегистрирована подходящая версия
+	ErrUnknownEvent = errors.New("unknown event type")
+	// ErrUnknownContentType для ContentType сообщения нет кодека
+	ErrUnknownContentType = errors.New("unknown content type")
+)
@@ -0,0 +1,182 @@
+package envelope
+
+import (
+	"errors"
+	"time"
+
+	"google.golang.org/protobuf/encoding/protowire"
+	"google.golang.org/protobuf/proto"
+)
+
+// ProtobufCodec кодек protobuf. Payload должен быть сгенерированным proto.Message,
+// конверт кодируется по схеме envelope.proto без сгенерированного кода
+type ProtobufCodec struct{}
+
+// номера полей конверта из envelope.proto
+const (
+	fieldID         protowire.Number = 1
+	fieldType       protowire.Number = 2
+	fieldVersion    protowire.Number = 3
+	fieldSource     protowire.Number = 4
+	fieldOccurredAt protowire.Number = 5
+	fieldSentAt     protowire.Number = 6
+	fieldPayload    protowire.Number = 7
+
+	// поля google.protobuf.Timestamp
+	fieldSeconds protowire.Number = 1
+	fieldNanos   protowire.Number = 2
+)
+
+// ContentType возвращает application/x-protobuf
+func (ProtobufCodec) ContentType() string { return ContentTypeProtobuf }
+
+// Marshal кодирует proto.Message
+func (c ProtobufCodec) Marshal(v interface{}) ([]byte, error) {
+	m, ok := v.(proto.Message)
+	if !ok {
+		return nil, unsupported(c, v)
+	}
+	return proto.Marshal(m)
+}
+
+// Unmarshal раскодирует данные в proto.Message
+func (c ProtobufCodec) Unmarshal(data []byte, v interface{}) error {
+	m, ok := v.(proto.Message)
+	if !ok {
+		return unsupported(c, v)
+	}
+	return proto.Unmarshal(data, m)
+}
+
+// MarshalEnvelope кодирует конверт, Data должен быть protobuf
+func (ProtobufCodec) MarshalEnvelope(env Envelope) ([]byte, error) {
+	var b []byte
+	appendString := func(num protowire.Number, s string) {
+		if s != "" {
+			b = protowire.AppendTag(b, num, protowire.BytesType)
+			b = protowire.AppendString(b, s)
+		}
+	}
+	appendTime := func(num protowire.Number, t time.Time) {
+		if t.IsZero() {
+			return
+		}
+		var ts []byte
+		ts = protowire.AppendTag(ts, fieldSeconds, protowire.VarintType)
+		ts = protowire.AppendVarint(ts, uint64(t.Unix()))
+		if nanos := t.Nanosecond(); nanos != 0 {
+			ts = protowire.AppendTag(ts, fieldNanos, protowire.VarintType)
+			ts = protowire.AppendVarint(ts, uint64(nanos))
+		}
+		b = protowire.AppendTag(b, num, protowire.BytesType)
+		b = protowire.AppendBytes(b, ts)
+	}
+
+	appendString(fieldID, env.ID)
+	appendString(fieldType, env.Type)
+	if env.Version != 0 {
+		b = protowire.AppendTag(b, fieldVersion, protowire.VarintType)
+		b = protowire.AppendVarint(b, uint64(env.Version))
+	}
+	appendString(fieldSource, env.Source)
+	appendTime(fieldOccurredAt, env.OccurredAt)
+	appendTime(fieldSentAt, env.SentAt)
+	if len(env.Data) > 0 {
+		b = protowire.AppendTag(b, fieldPayload, protowire.BytesType)
+		b = protowire.AppendBytes(b, env.Data)
+	}
+	return b, nil
+}
+
+// UnmarshalEnvelope раскодирует конверт, неизвестные поля пропускаются
+func (ProtobufCodec) UnmarshalEnvelope(data []byte) (Envelope, error) {
+	var env Envelope
+	for len(data) > 0 {
+		num, typ, n := protowire.ConsumeTag(data)
+		if n < 0 {
+			return Envelope{}, protowire.ParseError(n)
+		}
+		data = data[n:]
+
+		switch {
+		case typ == protowire.BytesType && num != fieldVersion:
+			v, n := protowire.ConsumeBytes(data)
+			if n < 0 {
+				return Envelope{}, protowire.ParseError(n)
+			}
+			data = data[n:]
+			switch num {
+			case fieldID:
+				env.ID = string(v)
+			case fieldType:
+				env.Type = string(v)
+			case fieldSource:
+				env.Source = string(v)
+			case fieldOccurredAt, fieldSentAt:
+				t, err := consumeTime(v)
+				if err != nil {
+					return Envelope{}, err
+				}
+				if num == fieldOccurredAt {
+					env.OccurredAt = t
+				} else {
+					env.SentAt = t
+				}
+			case fieldPayload:
+				env.Data = append([]byte(nil), v...)
+			}
+		case typ == protowire.VarintType && num == fieldVersion:
+			v, n := protowire.ConsumeVarint(data)
+			if n < 0 {
+				return Envelope{}, protowire.ParseError(n)
+			}
+			data = data[n:]
+			env.Version = int(int32(v))
+		default:
+			n := protowire.ConsumeFieldValue(num, typ, data)
+			if n < 0 {
+				return Envelope{}, protowire.ParseError(n)
+			}
+			data = data[n:]
+		}
+	}
+	if env.Type == "" {
+		return Envelope{}, ErrNotEnvelope
+	}
+	return env, nil
+}
+
+// consumeTime раскодирует google.protobuf.Timestamp
+func consumeTime(data []byte) (time.Time, error) {
+	var seconds, nanos int64
+	for len(data) > 0 {
+		num, typ, n := protowire.ConsumeTag(data)
+		if n < 0 {
+			return time.Time{}, protowire.ParseError(n)
+		}
+		data = data[n:]
+		if typ != protowire.VarintType {
+			n = protowire.ConsumeFieldValue(num, typ, data)
+			if n < 0 {
+				return time.Time{}, protowire.ParseError(n)
+			}
+			data = data[n:]
+			continue
+		}
+		v, n := protowire.ConsumeVarint(data)
+		if n < 0 {
+			return time.Time{}, protowire.ParseError(n)
+		}
+		data = data[n:]
+		switch num {
+		case fieldSeconds:
+			seconds = int64(v)
+		case fieldNanos:
+			nanos = int64(int32(v))
+		}
+	}
+	if nanos < 0 || nanos >= int64(time.Second) {
+		return time.Time{}, errors.New("invalid timestamp nanos")
+	}
+	return time.Unix(seconds, nanos), nil
+}
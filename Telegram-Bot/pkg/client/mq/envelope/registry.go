@@ -0,0 +1,302 @@
+package envelope
+
+import (
+	"errors"
+	"fmt"
+	"mime"
+	"reflect"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/Maksat-luci/Telegram-Bot/pkg/client/mq"
+)
+
+// Config настройки реестра
+type Config struct {
+	// Source проставляется в конверт каждого события
+	Source string
+	// ContentType кодек которым Encode кодирует события, по умолчанию JSON
+	ContentType string
+}
+
+// Upgrade переводит payload версии from в payload версии from+1
+type Upgrade func(payload interface{}) (interface{}, error)
+
+// schema тип события и версия его схемы
+type schema struct {
+	eventType string
+	version   int
+}
+
+// Registry реестр кодеков и типов событий. Кодек выбирается по ContentType сообщения,
+// тип payload по типу и версии из конверта
+type Registry struct {
+	lock        sync.RWMutex
+	source      string
+	contentType string
+	codecs      map[string]Codec
+	// types версии каждого типа события и их Go типы
+	types    map[string]map[int]reflect.Type
+	schemas  map[reflect.Type]schema
+	upgrades map[schema]Upgrade
+	// legacy схема для сообщений без конверта, nil если такие сообщения ошибка
+	legacy *schema
+}
+
+// NewRegistry конструктор реестра с кодеками JSON, protobuf и MessagePack
+func NewRegistry(cfg Config) (*Registry, error) {
+	r := &Registry{
+		source:      cfg.Source,
+		contentType: cfg.ContentType,
+		codecs:      make(map[string]Codec),
+		types:       make(map[string]map[int]reflect.Type),
+		schemas:     make(map[reflect.Type]schema),
+		upgrades:    make(map[schema]Upgrade),
+	}
+	if r.contentType == "" {
+		r.contentType = ContentTypeJSON
+	}
+	r.RegisterCodec(JSONCodec{})
+	r.RegisterCodec(ProtobufCodec{})
+	r.RegisterCodec(MsgpackCodec{})
+	if _, err := r.codec(r.contentType); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// RegisterCodec добавляет кодек или заменяет кодек с тем же ContentType
+func (r *Registry) RegisterCodec(codec Codec) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.codecs[codec.ContentType()] = codec
+}
+
+// Register регистрирует Go тип payload для версии version события eventType.
+// payload это значение или указатель нужного типа, например SearchTrackResponse{}
+func (r *Registry) Register(eventType string, version int, payload interface{}) error {
+	if eventType == "" || version < 1 {
+		return fmt.Errorf("invalid event schema %q version %d", eventType, version)
+	}
+	t := typeOf(payload)
+	if t == nil {
+		return fmt.Errorf("invalid payload for event %s", eventType)
+	}
+
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if existing, ok := r.schemas[t]; ok {
+		return fmt.Errorf("type %s already registered as %s v%d", t, existing.eventType, existing.version)
+	}
+	if _, ok := r.types[eventType][version]; ok {
+		return fmt.Errorf("event %s v%d already registered", eventType, version)
+	}
+	if r.types[eventType] == nil {
+		r.types[eventType] = make(map[int]reflect.Type)
+	}
+	r.types[eventType][version] = t
+	r.schemas[t] = schema{eventType: eventType, version: version}
+	return nil
+}
+
+// RegisterUpgrade регистрирует перевод payload из версии from в следующую. После раскодирования
+// старой версии Decode применяет переводы по цепочке, так подписчик работает только с последней версией
+func (r *Registry) RegisterUpgrade(eventType string, from int, upgrade Upgrade) error {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	for _, version := range []int{from, from + 1} {
+		if _, ok := r.types[eventType][version]; !ok {
+			return fmt.Errorf("failed to register upgrade of %s v%d due %w", eventType, version, ErrUnknownEvent)
+		}
+	}
+	r.upgrades[schema{eventType: eventType, version: from}] = upgrade
+	return nil
+}
+
+// SetLegacy задаёт схему для сообщений без конверта, которые отправляют сервисы ещё не перешедшие на конверт
+func (r *Registry) SetLegacy(eventType string, version int) error {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if _, ok := r.types[eventType][version]; !ok {
+		return fmt.Errorf("failed to set legacy event %s v%d due %w", eventType, version, ErrUnknownEvent)
+	}
+	r.legacy = &schema{eventType: eventType, version: version}
+	return nil
+}
+
+// Versions возвращает зарегистрированные версии события eventType по возрастанию, пустой список если тип неизвестен
+func (r *Registry) Versions(eventType string) []int {
+	r.lock.RLock()
+	defer r.lock.RUnlock()
+	versions := make([]int, 0, len(r.types[eventType]))
+	for v := range r.types[eventType] {
+		versions = append(versions, v)
+	}
+	sort.Ints(versions)
+	return versions
+}
+
+// Encode упаковывает payload зарегистрированного типа в конверт кодеком по умолчанию
+func (r *Registry) Encode(payload interface{}) (mq.Message, error) {
+	return r.EncodeAs(r.contentType, payload)
+}
+
+// EncodeAs упаковывает payload в конверт кодеком contentType и возвращает сообщение для публикации
+func (r *Registry) EncodeAs(contentType string, payload interface{}) (mq.Message, error) {
+	codec, err := r.codec(contentType)
+	if err != nil {
+		return mq.Message{}, err
+	}
+	r.lock.RLock()
+	s, ok := r.schemas[typeOf(payload)]
+	r.lock.RUnlock()
+	if !ok {
+		return mq.Message{}, fmt.Errorf("failed to encode %T due %w", payload, ErrUnknownEvent)
+	}
+
+	data, err := codec.Marshal(payload)
+	if err != nil {
+		return mq.Message{}, fmt.Errorf("failed to encode %s due %v", s.eventType, err)
+	}
+	now := time.Now()
+	env := Envelope{
+		ID:         mq.NewID(),
+		Type:       s.eventType,
+		Version:    s.version,
+		Source:     r.source,
+		OccurredAt: now,
+		SentAt:     now,
+		Data:       data,
+	}
+	body, err := codec.MarshalEnvelope(env)
+	if err != nil {
+		return mq.Message{}, fmt.Errorf("failed to encode %s due %v", s.eventType, err)
+	}
+	return mq.Message{
+		Body:        body,
+		MessageID:   env.ID,
+		Timestamp:   env.SentAt,
+		ContentType: codec.ContentType(),
+		Headers: map[string]interface{}{
+			HeaderEventType:    env.Type,
+			HeaderEventVersion: env.Version,
+		},
+	}, nil
+}
+
+// Decode раскодирует конверт сообщения и его payload. Если версии из конверта нет в реестре,
+// берётся ближайшая более старая версия: новые поля отбрасываются, а старый подписчик продолжает работать.
+// Version события это версия полученного Payload после всех Upgrade.
+// Сообщение с ContentType без кодека, например text/plain старого продьюсера, читается кодеком по умолчанию,
+// а если это не конверт, то как сообщение без конверта
+func (r *Registry) Decode(msg mq.Message) (Event, error) {
+	contentType := msg.ContentType
+	if contentType == "" {
+		contentType = r.contentType
+	}
+	codec, err := r.codec(contentType)
+	unknown := errors.Is(err, ErrUnknownContentType)
+	if unknown {
+		codec, err = r.codec(r.contentType)
+	}
+	if err != nil {
+		return Event{}, err
+	}
+
+	env, err := codec.UnmarshalEnvelope(msg.Body)
+	if errors.Is(err, ErrNotEnvelope) || (unknown && err != nil) {
+		env, err = r.legacyEnvelope(msg)
+	}
+	if err != nil && unknown {
+		return Event{}, fmt.Errorf("failed to decode %q message due %w", msg.ContentType, ErrUnknownContentType)
+	}
+	if err != nil {
+		return Event{}, fmt.Errorf("failed to decode envelope due %w", err)
+	}
+
+	version, t, err := r.resolve(env.Type, env.Version)
+	if err != nil {
+		return Event{}, err
+	}
+	payload := reflect.New(t).Interface()
+	if err := codec.Unmarshal(env.Data, payload); err != nil {
+		return Event{}, fmt.Errorf("failed to decode %s v%d due %v", env.Type, version, err)
+	}
+
+	for {
+		r.lock.RLock()
+		upgrade, ok := r.upgrades[schema{eventType: env.Type, version: version}]
+		r.lock.RUnlock()
+		if !ok {
+			break
+		}
+		if payload, err = upgrade(payload); err != nil {
+			return Event{}, fmt.Errorf("failed to upgrade %s v%d due %v", env.Type, version, err)
+		}
+		version++
+	}
+	env.Version = version
+	return Event{Envelope: env, Payload: payload}, nil
+}
+
+// legacyEnvelope оборачивает тело сообщения без конверта в конверт legacy схемы
+func (r *Registry) legacyEnvelope(msg mq.Message) (Envelope, error) {
+	r.lock.RLock()
+	legacy := r.legacy
+	r.lock.RUnlock()
+	if legacy == nil {
+		return Envelope{}, ErrNotEnvelope
+	}
+	return Envelope{
+		ID:      msg.MessageID,
+		Type:    legacy.eventType,
+		Version: legacy.version,
+		SentAt:  msg.Timestamp,
+		Data:    msg.Body,
+	}, nil
+}
+
+// resolve находит зарегистрированную версию для события eventType версии version
+func (r *Registry) resolve(eventType string, version int) (int, reflect.Type, error) {
+	r.lock.RLock()
+	defer r.lock.RUnlock()
+	versions := r.types[eventType]
+	if t, ok := versions[version]; ok {
+		return version, t, nil
+	}
+	registered := make([]int, 0, len(versions))
+	for v := range versions {
+		registered = append(registered, v)
+	}
+	sort.Sort(sort.Reverse(sort.IntSlice(registered)))
+	for _, v := range registered {
+		if v < version {
+			return v, versions[v], nil
+		}
+	}
+	return 0, nil, fmt.Errorf("failed to decode %s v%d due %w", eventType, version, ErrUnknownEvent)
+}
+
+// codec возвращает кодек по ContentType, параметры вроде charset не учитываются
+func (r *Registry) codec(contentType string) (Codec, error) {
+	if mediaType, _, err := mime.ParseMediaType(contentType); err == nil {
+		contentType = mediaType
+	}
+	r.lock.RLock()
+	defer r.lock.RUnlock()
+	codec, ok := r.codecs[contentType]
+	if !ok {
+		return nil, fmt.Errorf("failed to find codec for %q due %w", contentType, ErrUnknownContentType)
+	}
+	return codec, nil
+}
+
+// typeOf тип payload без указателя
+func typeOf(payload interface{}) reflect.Type {
+	t := reflect.TypeOf(payload)
+	for t != nil && t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	return t
+}
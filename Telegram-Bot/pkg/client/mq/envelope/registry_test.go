@@ -0,0 +1,241 @@
+package envelope
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/Maksat-luci/Telegram-Bot/pkg/client/mq"
+	"google.golang.org/protobuf/types/known/wrapperspb"
+)
+
+// события для тестов, у track три версии схемы
+type (
+	trackV1 struct {
+		Name string `json:"name"`
+	}
+	trackV2 struct {
+		Name   string `json:"name"`
+		Artist string `json:"artist"`
+	}
+	trackV3 struct {
+		Name   string `json:"name"`
+		Artist string `json:"artist"`
+		Plays  int    `json:"plays"`
+	}
+)
+
+// newTestRegistry создаёт реестр или останавливает тест
+func newTestRegistry(t *testing.T, cfg Config) *Registry {
+	t.Helper()
+	r, err := NewRegistry(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return r
+}
+
+// register регистрирует версии события track, versions это payload каждой версии начиная с первой
+func register(t *testing.T, r *Registry, versions ...interface{}) {
+	t.Helper()
+	for i, payload := range versions {
+		if err := r.Register("track", i+1, payload); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestRegistryRoundTrip(t *testing.T) {
+	tests := []struct {
+		contentType string
+		payload     interface{}
+		check       func(t *testing.T, payload interface{})
+	}{
+		{contentType: ContentTypeJSON, payload: trackV1{Name: "song"}, check: func(t *testing.T, payload interface{}) {
+			if got, ok := payload.(*trackV1); !ok || got.Name != "song" {
+				t.Fatalf("got %+v", payload)
+			}
+		}},
+		{contentType: ContentTypeMsgpack, payload: trackV1{Name: "song"}, check: func(t *testing.T, payload interface{}) {
+			if got, ok := payload.(*trackV1); !ok || got.Name != "song" {
+				t.Fatalf("got %+v", payload)
+			}
+		}},
+		{contentType: ContentTypeProtobuf, payload: wrapperspb.String("song"), check: func(t *testing.T, payload interface{}) {
+			if got, ok := payload.(*wrapperspb.StringValue); !ok || got.GetValue() != "song" {
+				t.Fatalf("got %+v", payload)
+			}
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.contentType, func(t *testing.T) {
+			r := newTestRegistry(t, Config{Source: "bot", ContentType: tt.contentType})
+			register(t, r, tt.payload)
+
+			msg, err := r.Encode(tt.payload)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if msg.ContentType != tt.contentType || msg.MessageID == "" {
+				t.Fatalf("got content type %q and id %q", msg.ContentType, msg.MessageID)
+			}
+			if msg.Headers[HeaderEventType] != "track" || msg.Headers[HeaderEventVersion] != 1 {
+				t.Fatalf("unexpected headers %v", msg.Headers)
+			}
+
+			event, err := r.Decode(msg)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if event.ID != msg.MessageID || event.Type != "track" || event.Version != 1 || event.Source != "bot" {
+				t.Fatalf("unexpected envelope %+v", event.Envelope)
+			}
+			if !event.SentAt.Equal(msg.Timestamp) {
+				t.Fatalf("got sent at %v, want %v", event.SentAt, msg.Timestamp)
+			}
+			tt.check(t, event.Payload)
+		})
+	}
+}
+
+func TestRegistryEncodeAs(t *testing.T) {
+	r := newTestRegistry(t, Config{})
+	register(t, r, trackV1{})
+
+	// подписчик читает сообщение кодеком из ContentType, а не кодеком по умолчанию
+	msg, err := r.EncodeAs(ContentTypeMsgpack, trackV1{Name: "song"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	msg.ContentType += "; charset=utf-8"
+	event, err := r.Decode(msg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if event.Payload.(*trackV1).Name != "song" {
+		t.Fatalf("got %+v", event.Payload)
+	}
+
+	if _, err := r.Encode(trackV2{}); !errors.Is(err, ErrUnknownEvent) {
+		t.Fatalf("unregistered payload: got %v, want %v", err, ErrUnknownEvent)
+	}
+	if _, err := NewRegistry(Config{ContentType: "text/plain"}); !errors.Is(err, ErrUnknownContentType) {
+		t.Fatalf("unknown default codec: got %v, want %v", err, ErrUnknownContentType)
+	}
+}
+
+// Подписчик знает версии 1 и 2, событие версии 3 читается как версия 2 без новых полей
+func TestRegistryVersionResolution(t *testing.T) {
+	producer := newTestRegistry(t, Config{})
+	register(t, producer, trackV1{}, trackV2{}, trackV3{})
+	consumer := newTestRegistry(t, Config{})
+	register(t, consumer, trackV1{}, trackV2{})
+
+	msg, err := producer.Encode(trackV3{Name: "song", Artist: "band", Plays: 10})
+	if err != nil {
+		t.Fatal(err)
+	}
+	event, err := consumer.Decode(msg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, ok := event.Payload.(*trackV2)
+	if event.Version != 2 || !ok || *got != (trackV2{Name: "song", Artist: "band"}) {
+		t.Fatalf("got v%d %+v, want v2", event.Version, event.Payload)
+	}
+	if versions := consumer.Versions("track"); len(versions) != 2 || versions[0] != 1 || versions[1] != 2 {
+		t.Fatalf("got versions %v", versions)
+	}
+
+	// версии старше зарегистрированных подобрать нельзя
+	newer := newTestRegistry(t, Config{})
+	if err := newer.Register("track", 2, trackV2{}); err != nil {
+		t.Fatal(err)
+	}
+	old, err := producer.Encode(trackV1{Name: "song"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := newer.Decode(old); !errors.Is(err, ErrUnknownEvent) {
+		t.Fatalf("got %v, want %v", err, ErrUnknownEvent)
+	}
+}
+
+func TestRegistryUpgrade(t *testing.T) {
+	r := newTestRegistry(t, Config{})
+	register(t, r, trackV1{}, trackV2{}, trackV3{})
+	if err := r.RegisterUpgrade("track", 1, func(payload interface{}) (interface{}, error) {
+		return &trackV2{Name: payload.(*trackV1).Name, Artist: "unknown"}, nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if err := r.RegisterUpgrade("track", 2, func(payload interface{}) (interface{}, error) {
+		v2 := payload.(*trackV2)
+		return &trackV3{Name: v2.Name, Artist: v2.Artist}, nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if err := r.RegisterUpgrade("track", 3, nil); !errors.Is(err, ErrUnknownEvent) {
+		t.Fatalf("upgrade to missing version: got %v, want %v", err, ErrUnknownEvent)
+	}
+
+	msg, err := r.Encode(trackV1{Name: "song"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	event, err := r.Decode(msg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, ok := event.Payload.(*trackV3)
+	if event.Version != 3 || !ok || *got != (trackV3{Name: "song", Artist: "unknown"}) {
+		t.Fatalf("got v%d %+v, want v3 upgraded through v2", event.Version, event.Payload)
+	}
+}
+
+// Сервис поиска отвечает без конверта, старый продьюсер отправлял такие ответы как text/plain
+func TestRegistryLegacy(t *testing.T) {
+	body := []byte(`{"name":"song"}`)
+	r := newTestRegistry(t, Config{})
+	register(t, r, trackV1{}, trackV2{})
+
+	plain := mq.Message{Body: body, ContentType: "text/plain"}
+	if _, err := r.Decode(plain); !errors.Is(err, ErrUnknownContentType) {
+		t.Fatalf("without legacy schema: got %v, want %v", err, ErrUnknownContentType)
+	}
+	if _, err := r.Decode(mq.Message{Body: body}); !errors.Is(err, ErrNotEnvelope) {
+		t.Fatalf("without legacy schema: got %v, want %v", err, ErrNotEnvelope)
+	}
+
+	if err := r.SetLegacy("track", 1); err != nil {
+		t.Fatal(err)
+	}
+	for _, contentType := range []string{"", ContentTypeJSON, "text/plain", "text/plain; charset=utf-8", "application/octet-stream"} {
+		msg := mq.Message{Body: body, ContentType: contentType, MessageID: "id-1"}
+		event, err := r.Decode(msg)
+		if err != nil {
+			t.Fatalf("content type %q: %v", contentType, err)
+		}
+		got, ok := event.Payload.(*trackV1)
+		if event.Type != "track" || event.Version != 1 || event.ID != "id-1" || !ok || got.Name != "song" {
+			t.Fatalf("content type %q: got %s v%d %+v", contentType, event.Type, event.Version, event.Payload)
+		}
+	}
+
+	// конверт с неизвестным ContentType читается как конверт, а не как legacy
+	msg, err := r.Encode(trackV2{Name: "song", Artist: "band"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	msg.ContentType = "text/plain"
+	event, err := r.Decode(msg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if event.Version != 2 || event.Payload.(*trackV2).Artist != "band" {
+		t.Fatalf("got v%d %+v", event.Version, event.Payload)
+	}
+
+	if err := r.SetLegacy("missing", 1); !errors.Is(err, ErrUnknownEvent) {
+		t.Fatalf("got %v, want %v", err, ErrUnknownEvent)
+	}
+}
@@ -0,0 +1,9 @@
+package mq
+
+// PendingCalls сколько запросов клиента ещё ждут ответа
+func PendingCalls(client RPCClient) int {
+	c := client.(*rpcClient)
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return len(c.pending)
+}
@@ -0,0 +1,40 @@
+package mq
+
+import (
+	"context"
+	"errors"
+)
+
+// Handler обрабатывает одно сообщение. nil означает что сообщение обработано и его можно подтвердить,
+// ошибка завершает сообщение итогом из OutcomeOf
+type Handler func(ctx context.Context, msg Message) error
+
+// Middleware оборачивает обработчик, например чтобы пропускать дубликаты
+type Middleware func(next Handler) Handler
+
+// outcomeError ошибка обработчика с итогом для сообщения
+type outcomeError struct {
+	outcome Outcome
+	err     error
+}
+
+func (e *outcomeError) Error() string { return e.err.Error() }
+
+func (e *outcomeError) Unwrap() error { return e.err }
+
+// WithOutcome добавляет к ошибке обработчика итог, например OutcomeDeadLetter для битого сообщения
+func WithOutcome(err error, outcome Outcome) error {
+	if err == nil {
+		return nil
+	}
+	return &outcomeError{outcome: outcome, err: err}
+}
+
+// OutcomeOf возвращает итог для ошибки обработчика, по умолчанию сообщение повторяется
+func OutcomeOf(err error) Outcome {
+	var oe *outcomeError
+	if errors.As(err, &oe) {
+		return oe.outcome
+	}
+	return OutcomeRetry
+}
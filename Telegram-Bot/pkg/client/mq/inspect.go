@@ -0,0 +1,16 @@
+package mq
+
+import "context"
+
+// QueueStats состояние очереди у брокера
+type QueueStats struct {
+	// Messages сколько сообщений ждёт доставки
+	Messages int
+	// Consumers сколько консьюмеров читает очередь, -1 если бэкенд этого не знает
+	Consumers int
+}
+
+// QueueInspector бэкенд который умеет сообщать глубину очереди
+type QueueInspector interface {
+	InspectQueue(ctx context.Context, name string) (QueueStats, error)
+}
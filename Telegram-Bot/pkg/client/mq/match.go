@@ -0,0 +1,48 @@
+package mq
+
+import (
+	"reflect"
+	"strings"
+)
+
+// MatchTopic подходит ли ключ маршрутизации key под шаблон привязки topic exchange,
+// * заменяет одно слово, # ноль или больше слов
+func MatchTopic(pattern, key string) bool {
+	return matchWords(strings.Split(pattern, "."), strings.Split(key, "."))
+}
+
+func matchWords(pattern, words []string) bool {
+	if len(pattern) == 0 {
+		return len(words) == 0
+	}
+	if pattern[0] == "#" {
+		for i := 0; i <= len(words); i++ {
+			if matchWords(pattern[1:], words[i:]) {
+				return true
+			}
+		}
+		return false
+	}
+	if len(words) == 0 || (pattern[0] != "*" && pattern[0] != words[0]) {
+		return false
+	}
+	return matchWords(pattern[1:], words[1:])
+}
+
+// MatchHeaders сравнивает заголовки сообщения с аргументами привязки headers exchange, x-match any или all (по умолчанию)
+func MatchHeaders(args, headers map[string]interface{}) bool {
+	matchAny := args["x-match"] == "any"
+	for k, v := range args {
+		if strings.HasPrefix(k, "x-") {
+			continue
+		}
+		matched := reflect.DeepEqual(headers[k], v)
+		if matchAny && matched {
+			return true
+		}
+		if !matchAny && !matched {
+			return false
+		}
+	}
+	return !matchAny
+}
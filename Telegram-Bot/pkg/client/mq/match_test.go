@@ -0,0 +1,55 @@
+package mq
+
+import "testing"
+
+func TestMatchTopic(t *testing.T) {
+	tests := []struct {
+		pattern string
+		key     string
+		want    bool
+	}{
+		{pattern: "track.created", key: "track.created", want: true},
+		{pattern: "track.created", key: "track.deleted", want: false},
+		{pattern: "track.*", key: "track.created", want: true},
+		{pattern: "track.*", key: "track", want: false},
+		{pattern: "track.*", key: "track.created.v2", want: false},
+		{pattern: "*.created", key: "album.created", want: true},
+		{pattern: "track.#", key: "track", want: true},
+		{pattern: "track.#", key: "track.created.v2", want: true},
+		{pattern: "#.v2", key: "track.created.v2", want: true},
+		{pattern: "#.v2", key: "track.created.v1", want: false},
+		{pattern: "track.#.v2", key: "track.v2", want: true},
+		{pattern: "#", key: "anything.at.all", want: true},
+		{pattern: "*", key: "", want: true},
+		{pattern: "track", key: "", want: false},
+	}
+	for _, tt := range tests {
+		if got := MatchTopic(tt.pattern, tt.key); got != tt.want {
+			t.Errorf("MatchTopic(%q, %q) = %v, want %v", tt.pattern, tt.key, got, tt.want)
+		}
+	}
+}
+
+func TestMatchHeaders(t *testing.T) {
+	headers := map[string]interface{}{"format": "mp3", "source": "upload"}
+	tests := []struct {
+		name string
+		args map[string]interface{}
+		want bool
+	}{
+		{name: "all match", args: map[string]interface{}{"format": "mp3", "source": "upload"}, want: true},
+		{name: "all default", args: map[string]interface{}{"format": "mp3", "source": "link"}, want: false},
+		{name: "all explicit", args: map[string]interface{}{"x-match": "all", "format": "mp3"}, want: true},
+		{name: "any one", args: map[string]interface{}{"x-match": "any", "format": "flac", "source": "upload"}, want: true},
+		{name: "any none", args: map[string]interface{}{"x-match": "any", "format": "flac"}, want: false},
+		{name: "missing header", args: map[string]interface{}{"bitrate": 320}, want: false},
+		{name: "only x- args", args: map[string]interface{}{"x-match": "all"}, want: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := MatchHeaders(tt.args, headers); got != tt.want {
+				t.Fatalf("got %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
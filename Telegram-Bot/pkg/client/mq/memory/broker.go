@@ -0,0 +1,216 @@
+package memory
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+
+	"github.com/Maksat-luci/Telegram-Bot/pkg/client/mq"
+)
+
+// константные ошибки бэкенда в памяти
+var (
+	errClosed           = errors.New("memory message queue closed")
+	errExchangeNotFound = errors.New("exchange not found")
+	errQueueNotFound    = errors.New("queue not found")
+	errUnknownTag       = errors.New("unknown delivery tag")
+)
+
+// Broker брокер в памяти, продьюсеры и консьюмеры созданные от одного брокера видят одни и те же очереди
+type Broker struct {
+	lock      sync.Mutex
+	queues    map[string]*queue
+	exchanges map[string]*exchange
+	// wheel откладывает повторы и отложенные публикации
+	wheel timerWheel
+}
+
+// queue очередь сообщений готовых к доставке
+type queue struct {
+	name     string
+	messages []mq.Message
+	// ready закрывается и пересоздаётся когда в очереди появляется сообщение, так просыпаются все ждущие консьюмеры
+	ready chan struct{}
+}
+
+// exchange маршрутизирует сообщения в привязанные очереди
+type exchange struct {
+	kind     string
+	bindings []binding
+}
+
+// binding привязка очереди к exchange
+type binding struct {
+	queue string
+	key   string
+	args  map[string]interface{}
+}
+
+// NewBroker конструктор пустого брокера
+func NewBroker() *Broker {
+	return &Broker{
+		queues:    make(map[string]*queue),
+		exchanges: make(map[string]*exchange),
+	}
+}
+
+// declareQueue возвращает очередь, создавая её при первом обращении. Вызывается под локом брокера
+func (b *Broker) declareQueue(name string) *queue {
+	q, ok := b.queues[name]
+	if !ok {
+		q = &queue{name: name, ready: make(chan struct{})}
+		b.queues[name] = q
+	}
+	return q
+}
+
+// DeclareQueue объявляет очередь, повторное объявление ничего не меняет
+func (b *Broker) DeclareQueue(name string) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	b.declareQueue(name)
+}
+
+// DeclareExchange объявляет exchange, тип уже объявленного exchange поменять нельзя
+func (b *Broker) DeclareExchange(name, kind string) error {
+	switch kind {
+	case mq.ExchangeDirect, mq.ExchangeTopic, mq.ExchangeFanout, mq.ExchangeHeaders:
+	default:
+		return fmt.Errorf("unsupported exchange kind %q", kind)
+	}
+
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	if ex, ok := b.exchanges[name]; ok {
+		if ex.kind != kind {
+			return fmt.Errorf("exchange %s already declared with kind %s", name, ex.kind)
+		}
+		return nil
+	}
+	b.exchanges[name] = &exchange{kind: kind}
+	return nil
+}
+
+// BindQueue привязывает очередь к exchange
+func (b *Broker) BindQueue(queue, exchange, key string, args map[string]interface{}) error {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	ex, ok := b.exchanges[exchange]
+	if !ok {
+		return fmt.Errorf("failed to bind queue %s due %w", queue, errExchangeNotFound)
+	}
+	if _, ok := b.queues[queue]; !ok {
+		return fmt.Errorf("failed to bind queue %s due %w", queue, errQueueNotFound)
+	}
+	for _, bind := range ex.bindings {
+		if bind.queue == queue && bind.key == key {
+			return nil
+		}
+	}
+	ex.bindings = append(ex.bindings, binding{queue: queue, key: key, args: args})
+	return nil
+}
+
+// Len количество сообщений готовых к доставке в очереди
+func (b *Broker) Len(name string) int {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	if q, ok := b.queues[name]; ok {
+		return len(q.messages)
+	}
+	return 0
+}
+
+// route маршрутизирует сообщение. Default exchange кладёт сообщение в очередь с именем key
+func (b *Broker) route(exchangeName, key string, msg mq.Message) error {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	msg.Exchange = exchangeName
+	msg.RoutingKey = key
+
+	if exchangeName == "" {
+		b.push(b.declareQueue(key), msg, false)
+		return nil
+	}
+
+	ex, ok := b.exchanges[exchangeName]
+	if !ok {
+		return fmt.Errorf("failed to publish to %s due %w", exchangeName, errExchangeNotFound)
+	}
+	// одна очередь получает сообщение один раз, даже если подходит несколько привязок
+	routed := make(map[string]bool)
+	for _, bind := range ex.bindings {
+		if routed[bind.queue] || !ex.matches(bind, key, msg.Headers) {
+			continue
+		}
+		routed[bind.queue] = true
+		b.push(b.declareQueue(bind.queue), msg, false)
+	}
+	return nil
+}
+
+// requeue возвращает сообщение в очередь из которой оно было получено. front ставит его в начало очереди
+func (b *Broker) requeue(name string, msg mq.Message, front bool) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	b.push(b.declareQueue(name), msg, front)
+}
+
+// push кладёт копию сообщения в очередь и будит консьюмеров. Вызывается под локом брокера
+func (b *Broker) push(q *queue, msg mq.Message, front bool) {
+	msg.ID = 0
+	msg.Queue = ""
+	msg.Headers = copyHeaders(msg.Headers)
+
+	if front {
+		q.messages = append([]mq.Message{msg}, q.messages...)
+	} else {
+		q.messages = append(q.messages, msg)
+	}
+	close(q.ready)
+	q.ready = make(chan struct{})
+}
+
+// pop достаёт первое сообщение очереди, если очередь пуста возвращает канал по которому ждать
+func (b *Broker) pop(name string) (mq.Message, bool, <-chan struct{}) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	q := b.declareQueue(name)
+	if len(q.messages) == 0 {
+		return mq.Message{}, false, q.ready
+	}
+	msg := q.messages[0]
+	q.messages = q.messages[1:]
+	msg.Queue = name
+	return msg, true, nil
+}
+
+// matches подходит ли сообщение под привязку по правилам типа exchange
+func (ex *exchange) matches(bind binding, key string, headers map[string]interface{}) bool {
+	switch ex.kind {
+	case mq.ExchangeFanout:
+		return true
+	case mq.ExchangeDirect:
+		return bind.key == key
+	case mq.ExchangeTopic:
+		return mq.MatchTopic(bind.key, key)
+	case mq.ExchangeHeaders:
+		return mq.MatchHeaders(bind.args, headers)
+	}
+	return false
+}
+
+// copyHeaders копирует заголовки чтобы копии сообщения в разных очередях не делили одну мапу
+func copyHeaders(headers map[string]interface{}) map[string]interface{} {
+	if headers == nil {
+		return nil
+	}
+	c := make(map[string]interface{}, len(headers))
+	for k, v := range headers {
+		c[k] = v
+	}
+	return c
+}
@@ -0,0 +1,136 @@
+package memory
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/Maksat-luci/Telegram-Bot/pkg/client/mq"
+)
+
+func TestRoute(t *testing.T) {
+	tests := []struct {
+		name    string
+		kind    string
+		binding string
+		args    map[string]interface{}
+		key     string
+		headers map[string]interface{}
+		routed  bool
+	}{
+		{name: "direct match", kind: mq.ExchangeDirect, binding: "tracks", key: "tracks", routed: true},
+		{name: "direct mismatch", kind: mq.ExchangeDirect, binding: "tracks", key: "photos"},
+		{name: "fanout", kind: mq.ExchangeFanout, binding: "ignored", key: "any", routed: true},
+		{name: "topic wildcard", kind: mq.ExchangeTopic, binding: "track.*", key: "track.found", routed: true},
+		{name: "topic mismatch", kind: mq.ExchangeTopic, binding: "track.*", key: "photo.found"},
+		{
+			name:    "headers match",
+			kind:    mq.ExchangeHeaders,
+			args:    map[string]interface{}{"x-match": "all", "type": "track"},
+			headers: map[string]interface{}{"type": "track"},
+			routed:  true,
+		},
+		{
+			name:    "headers mismatch",
+			kind:    mq.ExchangeHeaders,
+			args:    map[string]interface{}{"x-match": "all", "type": "track"},
+			headers: map[string]interface{}{"type": "photo"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			broker := NewBroker()
+			broker.DeclareQueue("q")
+			if err := broker.DeclareExchange("events", tt.kind); err != nil {
+				t.Fatal(err)
+			}
+			if err := broker.BindQueue("q", "events", tt.binding, tt.args); err != nil {
+				t.Fatal(err)
+			}
+			if err := broker.route("events", tt.key, mq.Message{Headers: tt.headers}); err != nil {
+				t.Fatal(err)
+			}
+			want := 0
+			if tt.routed {
+				want = 1
+			}
+			if n := broker.Len("q"); n != want {
+				t.Fatalf("queue has %d messages, want %d", n, want)
+			}
+		})
+	}
+}
+
+func TestRouteOncePerQueue(t *testing.T) {
+	broker := NewBroker()
+	broker.DeclareQueue("q")
+	if err := broker.DeclareExchange("events", mq.ExchangeTopic); err != nil {
+		t.Fatal(err)
+	}
+	for _, key := range []string{"track.*", "#"} {
+		if err := broker.BindQueue("q", "events", key, nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := broker.route("events", "track.found", mq.Message{}); err != nil {
+		t.Fatal(err)
+	}
+	if n := broker.Len("q"); n != 1 {
+		t.Fatalf("queue has %d messages, want 1", n)
+	}
+}
+
+func TestRouteErrors(t *testing.T) {
+	broker := NewBroker()
+	if err := broker.route("missing", "key", mq.Message{}); !errors.Is(err, errExchangeNotFound) {
+		t.Fatalf("publish to missing exchange: got %v, want %v", err, errExchangeNotFound)
+	}
+	if err := broker.DeclareExchange("events", "x-delayed"); err == nil {
+		t.Fatal("unsupported exchange kind was declared")
+	}
+	if err := broker.DeclareExchange("events", mq.ExchangeDirect); err != nil {
+		t.Fatal(err)
+	}
+	if err := broker.DeclareExchange("events", mq.ExchangeFanout); err == nil {
+		t.Fatal("exchange was redeclared with another kind")
+	}
+	if err := broker.BindQueue("missing", "events", "", nil); !errors.Is(err, errQueueNotFound) {
+		t.Fatalf("bind missing queue: got %v, want %v", err, errQueueNotFound)
+	}
+}
+
+func TestPublishAfter(t *testing.T) {
+	ctx := context.Background()
+	_, producer, consumer := newPair(t, ConsumerConfig{})
+	scheduled, ok := producer.(mq.ScheduledProducer)
+	if !ok {
+		t.Fatal("memory producer does not implement mq.ScheduledProducer")
+	}
+
+	messages, err := consumer.Consume(ctx, "tracks")
+	if err != nil {
+		t.Fatal(err)
+	}
+	start := time.Now()
+	if err := scheduled.PublishAfter(ctx, "", "tracks", mq.Message{Body: []byte("later")}, 30*time.Millisecond); err != nil {
+		t.Fatal(err)
+	}
+	msg := receive(t, messages)
+	if elapsed := time.Since(start); elapsed < 30*time.Millisecond {
+		t.Fatalf("message delivered after %s, want at least 30ms", elapsed)
+	}
+	if string(msg.Body) != "later" {
+		t.Fatalf("got %q, want later", msg.Body)
+	}
+}
+
+func TestClosedProducer(t *testing.T) {
+	producer := NewMemoryProducer(NewBroker(), ProducerConfig{})
+	if err := producer.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := producer.Publish(context.Background(), "tracks", nil); !errors.Is(err, errClosed) {
+		t.Fatalf("publish after close: got %v, want %v", err, errClosed)
+	}
+}
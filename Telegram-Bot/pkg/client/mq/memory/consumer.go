@@ -0,0 +1,305 @@
+package memory
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"sync"
+
+	"github.com/Maksat-luci/Telegram-Bot/pkg/client/mq"
+)
+
+// ConsumerConfig настройки консьюмера в памяти
+type ConsumerConfig struct {
+	// PrefetchCount сколько неподтверждённых сообщений может быть у консьюмера одновременно, 0 без ограничений
+	PrefetchCount int
+	// Retry настройки повторов и parking очереди
+	Retry mq.RetryPolicy
+}
+
+// memoryConsumer консьюмер который забирает сообщения из очередей брокера в памяти
+type memoryConsumer struct {
+	*memoryBase
+	prefetchCount int
+	retry         mq.RetryPolicy
+
+	nextTag uint64
+	unacked map[uint64]mq.Message
+	// undelivered номера неподтверждённых сообщений которые ещё не отданы в канал, при возврате в очередь
+	// они не помечаются повторными
+	undelivered map[uint64]bool
+	// deliveries горутины доставки, Close ждёт их прежде чем вернуть сообщения в очередь
+	deliveries sync.WaitGroup
+	// settled закрывается и пересоздаётся при каждом подтверждении, так доставка узнаёт что prefetch освободился
+	settled chan struct{}
+	done    chan struct{}
+}
+
+// NewMemoryConsumer конструктор консьюмера поверх брокера в памяти
+func NewMemoryConsumer(broker *Broker, cfg ConsumerConfig) mq.Consumer {
+	return &memoryConsumer{
+		memoryBase:    &memoryBase{broker: broker},
+		prefetchCount: cfg.PrefetchCount,
+		retry:         cfg.Retry,
+		unacked:       make(map[uint64]mq.Message),
+		undelivered:   make(map[uint64]bool),
+		settled:       make(chan struct{}),
+		done:          make(chan struct{}),
+	}
+}
+
+// parkingQueue очередь в которую уходят сообщения после исчерпания повторов
+func parkingQueue(queue string) string {
+	return fmt.Sprintf("%s.parking", queue)
+}
+
+// Consume начинает доставлять сообщения очереди target, очередь создаётся если её ещё нет.
+// Доставка идёт пока не отменён ctx или не закрыт консьюмер
+func (c *memoryConsumer) Consume(ctx context.Context, target string) (<-chan mq.Message, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	c.lock.Lock()
+	if c.closed {
+		c.lock.Unlock()
+		return nil, errClosed
+	}
+	c.deliveries.Add(1)
+	c.lock.Unlock()
+	c.broker.DeclareQueue(target)
+
+	ch := make(chan mq.Message)
+	go c.deliver(ctx, target, ch)
+	return ch, nil
+}
+
+// deliver отдаёт сообщения в канал пока консьюмер не закрыт и ctx не отменён
+func (c *memoryConsumer) deliver(ctx context.Context, target string, ch chan<- mq.Message) {
+	defer c.deliveries.Done()
+	defer close(ch)
+	for {
+		msg, wait := c.next(target)
+		if wait != nil {
+			select {
+			case <-wait:
+			case <-ctx.Done():
+				return
+			case <-c.done:
+				return
+			}
+			continue
+		}
+
+		select {
+		case ch <- msg:
+			c.delivered(msg.ID)
+		case <-ctx.Done():
+			// сообщение так и не отдали, возвращаем его в очередь не помечая повторным
+			if taken, err := c.take(msg.ID, false); err == nil {
+				c.requeueFront(taken)
+			}
+			return
+		case <-c.done:
+			// сообщение числится неподтверждённым, Close вернёт его в очередь после выхода доставки
+			return
+		}
+	}
+}
+
+// next достаёт следующее сообщение, либо возвращает канал по которому ждать: освобождения prefetch или нового сообщения
+func (c *memoryConsumer) next(target string) (mq.Message, <-chan struct{}) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if c.closed {
+		return mq.Message{}, c.done
+	}
+	if c.prefetchCount > 0 && len(c.unacked) >= c.prefetchCount {
+		return mq.Message{}, c.settled
+	}
+	msg, ok, ready := c.broker.pop(target)
+	if !ok {
+		return mq.Message{}, ready
+	}
+	c.nextTag++
+	msg.ID = c.nextTag
+	c.unacked[msg.ID] = msg
+	c.undelivered[msg.ID] = true
+	return msg, nil
+}
+
+// delivered отмечает что сообщение отдано в канал
+func (c *memoryConsumer) delivered(id uint64) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	delete(c.undelivered, id)
+}
+
+// take убирает сообщения из неподтверждённых, multiple забирает все с номером не больше id
+func (c *memoryConsumer) take(id uint64, multiple bool) ([]mq.Message, error) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if c.closed {
+		return nil, errClosed
+	}
+
+	var taken []mq.Message
+	if multiple {
+		for _, tag := range sortedTags(c.unacked) {
+			if tag <= id {
+				taken = append(taken, c.unacked[tag])
+				delete(c.unacked, tag)
+				delete(c.undelivered, tag)
+			}
+		}
+	} else {
+		msg, ok := c.unacked[id]
+		if !ok {
+			return nil, fmt.Errorf("message with id %d: %w", id, errUnknownTag)
+		}
+		taken = append(taken, msg)
+		delete(c.unacked, id)
+		delete(c.undelivered, id)
+	}
+
+	close(c.settled)
+	c.settled = make(chan struct{})
+	return taken, nil
+}
+
+// Ack подтверждает обработку сообщения
+func (c *memoryConsumer) Ack(ctx context.Context, id uint64, multiple bool) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	if _, err := c.take(id, multiple); err != nil {
+		return fmt.Errorf("failed to ack due %w", err)
+	}
+	return nil
+}
+
+// Nack отклоняет сообщения, requeue возвращает их в начало очереди в исходном порядке
+func (c *memoryConsumer) Nack(ctx context.Context, id uint64, multiple bool, requeue bool) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	taken, err := c.take(id, multiple)
+	if err != nil {
+		return fmt.Errorf("failed to nack due %w", err)
+	}
+	if requeue {
+		c.requeueFront(redelivered(taken))
+	}
+	return nil
+}
+
+// Reject отклоняет одно сообщение
+func (c *memoryConsumer) Reject(ctx context.Context, id uint64, requeue bool) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	taken, err := c.take(id, false)
+	if err != nil {
+		return fmt.Errorf("failed to reject due %w", err)
+	}
+	if requeue {
+		c.requeueFront(redelivered(taken))
+	}
+	return nil
+}
+
+// Settle применяет итог так же как rabbitmq: повтор через задержку, parking очередь после исчерпания повторов,
+// а без retry политики сообщение выбрасывается
+func (c *memoryConsumer) Settle(ctx context.Context, msg mq.Message, outcome mq.Outcome) (mq.Outcome, error) {
+	if err := ctx.Err(); err != nil {
+		return 0, err
+	}
+	if outcome == mq.OutcomeRetry && msg.RetryCount() >= c.retry.MaxRetries {
+		outcome = mq.OutcomeDeadLetter
+	}
+	if outcome == mq.OutcomeDeadLetter && !c.retry.Enabled() {
+		outcome = mq.OutcomeDrop
+	}
+	switch outcome {
+	case mq.OutcomeRetry, mq.OutcomeDeadLetter, mq.OutcomeDrop:
+	default:
+		return 0, fmt.Errorf("unknown outcome %v", outcome)
+	}
+
+	if _, err := c.take(msg.ID, false); err != nil {
+		return 0, fmt.Errorf("failed to %s due %w", outcome, err)
+	}
+
+	switch outcome {
+	case mq.OutcomeRetry:
+		retried := msg
+		retried.Headers = copyHeaders(msg.Headers)
+		if retried.Headers == nil {
+			retried.Headers = make(map[string]interface{})
+		}
+		retried.Headers[mq.HeaderRetryCount] = msg.RetryCount() + 1
+		c.broker.wheel.schedule(c.retry.Delay(msg.RetryCount()), func() {
+			c.broker.requeue(msg.Queue, retried, false)
+		})
+	case mq.OutcomeDeadLetter:
+		c.broker.requeue(parkingQueue(msg.Queue), msg, false)
+	}
+	return outcome, nil
+}
+
+// Close останавливает доставку и возвращает все неподтверждённые сообщения в начало их очередей.
+// Повторными помечаются только те что успели попасть в канал
+func (c *memoryConsumer) Close() error {
+	c.lock.Lock()
+	if c.closed {
+		c.lock.Unlock()
+		return errClosed
+	}
+	c.closed = true
+	close(c.done)
+	c.lock.Unlock()
+	// после выхода доставки известно какие сообщения отданы в канал
+	c.deliveries.Wait()
+
+	c.lock.Lock()
+	var unacked []mq.Message
+	for _, tag := range sortedTags(c.unacked) {
+		msg := c.unacked[tag]
+		if !c.undelivered[tag] {
+			msg.Redelivered = true
+		}
+		unacked = append(unacked, msg)
+	}
+	c.unacked = make(map[uint64]mq.Message)
+	c.undelivered = make(map[uint64]bool)
+	c.lock.Unlock()
+
+	c.requeueFront(unacked)
+	return nil
+}
+
+// requeueFront возвращает сообщения в начало их очередей так, что первым снова будет самое раннее
+func (c *memoryConsumer) requeueFront(msgs []mq.Message) {
+	for i := len(msgs) - 1; i >= 0; i-- {
+		c.broker.requeue(msgs[i].Queue, msgs[i], true)
+	}
+}
+
+// redelivered помечает сообщения которые консьюмер получил и вернул как повторные
+func redelivered(msgs []mq.Message) []mq.Message {
+	for i := range msgs {
+		msgs[i].Redelivered = true
+	}
+	return msgs
+}
+
+// sortedTags номера неподтверждённых сообщений по возрастанию
+func sortedTags(unacked map[uint64]mq.Message) []uint64 {
+	tags := make([]uint64, 0, len(unacked))
+	for tag := range unacked {
+		tags = append(tags, tag)
+	}
+	sort.Slice(tags, func(i, j int) bool { return tags[i] < tags[j] })
+	return tags
+}
@@ -0,0 +1,428 @@
+package memory
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/Maksat-luci/Telegram-Bot/pkg/client/mq"
+)
+
+// receiveTimeout сколько тест ждёт доставки сообщения
+const receiveTimeout = time.Second
+
+// receive ждёт следующее сообщение из канала консьюмера
+func receive(t *testing.T, messages <-chan mq.Message) mq.Message {
+	t.Helper()
+	select {
+	case msg, ok := <-messages:
+		if !ok {
+			t.Fatal("messages channel closed")
+		}
+		return msg
+	case <-time.After(receiveTimeout):
+		t.Fatal("timed out waiting for message")
+	}
+	return mq.Message{}
+}
+
+// expectNone проверяет что сообщений больше не доставляется
+func expectNone(t *testing.T, messages <-chan mq.Message) {
+	t.Helper()
+	select {
+	case msg := <-messages:
+		t.Fatalf("unexpected message %q", msg.Body)
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+// newPair создаёт продьюсера и консьюмера поверх нового брокера
+func newPair(t *testing.T, cfg ConsumerConfig) (*Broker, mq.Producer, mq.Consumer) {
+	t.Helper()
+	broker := NewBroker()
+	producer := NewMemoryProducer(broker, ProducerConfig{AppID: "test", ContentType: "text/plain"})
+	consumer := NewMemoryConsumer(broker, cfg)
+	t.Cleanup(func() {
+		_ = producer.Close()
+		_ = consumer.Close()
+	})
+	return broker, producer, consumer
+}
+
+func TestPublishConsume(t *testing.T) {
+	ctx := context.Background()
+	_, producer, consumer := newPair(t, ConsumerConfig{})
+
+	messages, err := consumer.Consume(ctx, "tracks")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = producer.PublishMessage(ctx, "tracks", mq.Message{
+		Body:          []byte("first"),
+		CorrelationID: "42",
+		Headers:       map[string]interface{}{"x-source": "test"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := producer.Publish(ctx, "tracks", []byte("second")); err != nil {
+		t.Fatal(err)
+	}
+
+	first := receive(t, messages)
+	if string(first.Body) != "first" || first.CorrelationID != "42" || first.Headers["x-source"] != "test" {
+		t.Fatalf("unexpected first message %+v", first)
+	}
+	if first.AppID != "test" || first.ContentType != "text/plain" {
+		t.Fatalf("producer defaults not applied: app id %q, content type %q", first.AppID, first.ContentType)
+	}
+	if first.Queue != "tracks" || first.Redelivered {
+		t.Fatalf("unexpected delivery metadata %+v", first)
+	}
+	second := receive(t, messages)
+	if string(second.Body) != "second" {
+		t.Fatalf("messages out of order: got %q", second.Body)
+	}
+	if first.ID == second.ID {
+		t.Fatalf("messages share delivery id %d", first.ID)
+	}
+}
+
+func TestAck(t *testing.T) {
+	ctx := context.Background()
+	broker, producer, consumer := newPair(t, ConsumerConfig{})
+
+	messages, err := consumer.Consume(ctx, "tracks")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := producer.Publish(ctx, "tracks", []byte("track")); err != nil {
+		t.Fatal(err)
+	}
+	msg := receive(t, messages)
+	if err := consumer.Ack(ctx, msg.ID, false); err != nil {
+		t.Fatal(err)
+	}
+	if err := consumer.Ack(ctx, msg.ID, false); !errors.Is(err, errUnknownTag) {
+		t.Fatalf("second ack: got %v, want %v", err, errUnknownTag)
+	}
+
+	// подтверждённое сообщение не возвращается в очередь даже при закрытии консьюмера
+	if err := consumer.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if n := broker.Len("tracks"); n != 0 {
+		t.Fatalf("queue has %d messages after ack, want 0", n)
+	}
+}
+
+func TestAckMultiple(t *testing.T) {
+	ctx := context.Background()
+	broker, producer, consumer := newPair(t, ConsumerConfig{})
+
+	messages, err := consumer.Consume(ctx, "tracks")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, body := range []string{"a", "b", "c"} {
+		if err := producer.Publish(ctx, "tracks", []byte(body)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	receive(t, messages)
+	second := receive(t, messages)
+	receive(t, messages)
+
+	// подтверждаются первые два, третье при закрытии возвращается в очередь
+	if err := consumer.Ack(ctx, second.ID, true); err != nil {
+		t.Fatal(err)
+	}
+	if err := consumer.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if n := broker.Len("tracks"); n != 1 {
+		t.Fatalf("queue has %d messages, want 1", n)
+	}
+}
+
+func TestNackRequeueRedelivers(t *testing.T) {
+	ctx := context.Background()
+	_, producer, consumer := newPair(t, ConsumerConfig{})
+
+	messages, err := consumer.Consume(ctx, "tracks")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, body := range []string{"first", "second"} {
+		if err := producer.Publish(ctx, "tracks", []byte(body)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	first := receive(t, messages)
+	if err := consumer.Nack(ctx, first.ID, false, true); err != nil {
+		t.Fatal(err)
+	}
+
+	// второе сообщение уже было отдано до Nack, возвращённое встаёт в начало очереди
+	second := receive(t, messages)
+	if string(second.Body) != "second" {
+		t.Fatalf("got %q, want second", second.Body)
+	}
+	redelivered := receive(t, messages)
+	if string(redelivered.Body) != "first" || !redelivered.Redelivered {
+		t.Fatalf("got %q redelivered %v, want first redelivered", redelivered.Body, redelivered.Redelivered)
+	}
+	if redelivered.ID == first.ID {
+		t.Fatalf("redelivery reused delivery id %d", first.ID)
+	}
+}
+
+func TestNackWithoutRequeueDrops(t *testing.T) {
+	ctx := context.Background()
+	broker, producer, consumer := newPair(t, ConsumerConfig{})
+
+	messages, err := consumer.Consume(ctx, "tracks")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := producer.Publish(ctx, "tracks", []byte("track")); err != nil {
+		t.Fatal(err)
+	}
+	msg := receive(t, messages)
+	if err := consumer.Nack(ctx, msg.ID, false, false); err != nil {
+		t.Fatal(err)
+	}
+	expectNone(t, messages)
+	if n := broker.Len("tracks"); n != 0 {
+		t.Fatalf("queue has %d messages after nack, want 0", n)
+	}
+}
+
+func TestRejectRequeue(t *testing.T) {
+	ctx := context.Background()
+	_, producer, consumer := newPair(t, ConsumerConfig{})
+
+	messages, err := consumer.Consume(ctx, "tracks")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := producer.Publish(ctx, "tracks", []byte("track")); err != nil {
+		t.Fatal(err)
+	}
+	msg := receive(t, messages)
+	if err := consumer.Reject(ctx, msg.ID, true); err != nil {
+		t.Fatal(err)
+	}
+	if redelivered := receive(t, messages); !redelivered.Redelivered {
+		t.Fatal("rejected message was not marked as redelivered")
+	}
+}
+
+func TestCloseRequeuesUnacked(t *testing.T) {
+	ctx := context.Background()
+	broker, producer, consumer := newPair(t, ConsumerConfig{})
+
+	messages, err := consumer.Consume(ctx, "tracks")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, body := range []string{"first", "second"} {
+		if err := producer.Publish(ctx, "tracks", []byte(body)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	receive(t, messages)
+	receive(t, messages)
+	if err := consumer.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := consumer.Close(); !errors.Is(err, errClosed) {
+		t.Fatalf("second close: got %v, want %v", err, errClosed)
+	}
+
+	// другой консьюмер получает оба сообщения в исходном порядке как повторные
+	next := NewMemoryConsumer(broker, ConsumerConfig{})
+	defer next.Close()
+	redelivered, err := next.Consume(ctx, "tracks")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{"first", "second"} {
+		msg := receive(t, redelivered)
+		if string(msg.Body) != want || !msg.Redelivered {
+			t.Fatalf("got %q redelivered %v, want %q redelivered", msg.Body, msg.Redelivered, want)
+		}
+	}
+}
+
+func TestCancelRequeuesUndelivered(t *testing.T) {
+	broker, producer, consumer := newPair(t, ConsumerConfig{})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	if _, err := consumer.Consume(ctx, "tracks"); err != nil {
+		t.Fatal(err)
+	}
+	if err := producer.Publish(context.Background(), "tracks", []byte("track")); err != nil {
+		t.Fatal(err)
+	}
+	// сообщение уже взято из очереди, но его никто не читает. После отмены оно должно вернуться в очередь
+	deadline := time.Now().Add(receiveTimeout)
+	for broker.Len("tracks") != 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("message was not taken from the queue")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	cancel()
+	for broker.Len("tracks") != 1 {
+		if time.Now().After(deadline) {
+			t.Fatal("message was not requeued after cancel")
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	// его так никто и не получил, поэтому повторным оно не считается
+	next := NewMemoryConsumer(broker, ConsumerConfig{})
+	defer next.Close()
+	messages, err := next.Consume(context.Background(), "tracks")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if msg := receive(t, messages); msg.Redelivered {
+		t.Fatal("undelivered message marked as redelivered")
+	}
+}
+
+func TestCloseKeepsUndeliveredFresh(t *testing.T) {
+	ctx := context.Background()
+	broker, producer, consumer := newPair(t, ConsumerConfig{})
+
+	messages, err := consumer.Consume(ctx, "tracks")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, body := range []string{"first", "second"} {
+		if err := producer.Publish(ctx, "tracks", []byte(body)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	receive(t, messages)
+	// второе сообщение уже взято из очереди и ждёт пока его прочитают из канала
+	deadline := time.Now().Add(receiveTimeout)
+	for broker.Len("tracks") != 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("second message was not taken from the queue")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	if err := consumer.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	next := NewMemoryConsumer(broker, ConsumerConfig{})
+	defer next.Close()
+	redelivered, err := next.Consume(ctx, "tracks")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []struct {
+		body        string
+		redelivered bool
+	}{{"first", true}, {"second", false}} {
+		msg := receive(t, redelivered)
+		if string(msg.Body) != want.body || msg.Redelivered != want.redelivered {
+			t.Fatalf("got %q redelivered %v, want %q redelivered %v", msg.Body, msg.Redelivered, want.body, want.redelivered)
+		}
+	}
+}
+
+func TestPrefetch(t *testing.T) {
+	ctx := context.Background()
+	_, producer, consumer := newPair(t, ConsumerConfig{PrefetchCount: 1})
+
+	messages, err := consumer.Consume(ctx, "tracks")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, body := range []string{"first", "second"} {
+		if err := producer.Publish(ctx, "tracks", []byte(body)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	first := receive(t, messages)
+	expectNone(t, messages)
+
+	if err := consumer.Ack(ctx, first.ID, false); err != nil {
+		t.Fatal(err)
+	}
+	if second := receive(t, messages); string(second.Body) != "second" {
+		t.Fatalf("got %q, want second", second.Body)
+	}
+}
+
+func TestSettle(t *testing.T) {
+	ctx := context.Background()
+	retry := mq.RetryPolicy{MaxRetries: 1, InitialDelay: 10 * time.Millisecond, Multiplier: 2, DeadLetter: true}
+	broker, producer, consumer := newPair(t, ConsumerConfig{Retry: retry})
+
+	messages, err := consumer.Consume(ctx, "tracks")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := producer.Publish(ctx, "tracks", []byte("track")); err != nil {
+		t.Fatal(err)
+	}
+
+	msg := receive(t, messages)
+	outcome, err := consumer.Settle(ctx, msg, mq.OutcomeRetry)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if outcome != mq.OutcomeRetry {
+		t.Fatalf("got outcome %v, want %v", outcome, mq.OutcomeRetry)
+	}
+
+	// повтор приходит после задержки с увеличенным счётчиком
+	retried := receive(t, messages)
+	if retried.RetryCount() != 1 {
+		t.Fatalf("got retry count %d, want 1", retried.RetryCount())
+	}
+
+	// повторы исчерпаны, сообщение уходит в parking очередь
+	outcome, err = consumer.Settle(ctx, retried, mq.OutcomeRetry)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if outcome != mq.OutcomeDeadLetter {
+		t.Fatalf("got outcome %v, want %v", outcome, mq.OutcomeDeadLetter)
+	}
+	if n := broker.Len(parkingQueue("tracks")); n != 1 {
+		t.Fatalf("parking queue has %d messages, want 1", n)
+	}
+	expectNone(t, messages)
+}
+
+func TestSettleWithoutRetryDrops(t *testing.T) {
+	ctx := context.Background()
+	broker, producer, consumer := newPair(t, ConsumerConfig{})
+
+	messages, err := consumer.Consume(ctx, "tracks")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := producer.Publish(ctx, "tracks", []byte("track")); err != nil {
+		t.Fatal(err)
+	}
+	msg := receive(t, messages)
+	outcome, err := consumer.Settle(ctx, msg, mq.OutcomeDeadLetter)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if outcome != mq.OutcomeDrop {
+		t.Fatalf("got outcome %v, want %v", outcome, mq.OutcomeDrop)
+	}
+	if n := broker.Len(parkingQueue("tracks")); n != 0 {
+		t.Fatalf("parking queue has %d messages, want 0", n)
+	}
+}
@@ -0,0 +1,163 @@
+package memory
+
+import (
+	"context"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/Maksat-luci/Telegram-Bot/pkg/client/mq"
+)
+
+// memoryBase общая часть продьюсера и консьюмера, объявление очередей и exchange
+type memoryBase struct {
+	broker *Broker
+	lock   sync.Mutex
+	closed bool
+}
+
+// DeclareQueue объявляет очередь в брокере, флаги durable, autoDelete и exclusive в памяти не имеют смысла
+func (m *memoryBase) DeclareQueue(ctx context.Context, name string, durable, autoDelete, exclusive bool, args map[string]interface{}) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	if m.isClosed() {
+		return errClosed
+	}
+	m.broker.DeclareQueue(name)
+	return nil
+}
+
+// DeclareExchange объявляет exchange в брокере
+func (m *memoryBase) DeclareExchange(ctx context.Context, name, kind string, durable, autoDelete bool, args map[string]interface{}) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	if m.isClosed() {
+		return errClosed
+	}
+	return m.broker.DeclareExchange(name, kind)
+}
+
+// BindQueue привязывает очередь к exchange
+func (m *memoryBase) BindQueue(ctx context.Context, queue, exchange, key string, args map[string]interface{}) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	if m.isClosed() {
+		return errClosed
+	}
+	return m.broker.BindQueue(queue, exchange, key, args)
+}
+
+// InspectQueue возвращает число сообщений готовых к доставке, консьюмеров брокер в памяти не считает
+func (m *memoryBase) InspectQueue(ctx context.Context, name string) (mq.QueueStats, error) {
+	if err := ctx.Err(); err != nil {
+		return mq.QueueStats{}, err
+	}
+	return mq.QueueStats{Messages: m.broker.Len(name), Consumers: -1}, nil
+}
+
+func (m *memoryBase) isClosed() bool {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	return m.closed
+}
+
+// ProducerConfig настройки продьюсера в памяти
+type ProducerConfig struct {
+	// AppID и ContentType проставляются сообщениям у которых они не заданы
+	AppID       string
+	ContentType string
+}
+
+// memoryProducer продьюсер который сразу кладёт сообщения в очереди брокера
+type memoryProducer struct {
+	*memoryBase
+	appID       string
+	contentType string
+}
+
+// NewMemoryProducer конструктор продьюсера поверх брокера в памяти
+func NewMemoryProducer(broker *Broker, cfg ProducerConfig) mq.Producer {
+	return &memoryProducer{
+		memoryBase:  &memoryBase{broker: broker},
+		appID:       cfg.AppID,
+		contentType: cfg.ContentType,
+	}
+}
+
+// Publish отправляет сообщение в очередь
+func (p *memoryProducer) Publish(ctx context.Context, target string, body []byte) error {
+	return p.PublishMessage(ctx, target, mq.Message{Body: body})
+}
+
+// PublishMessage отправляет сообщение в очередь через default exchange
+func (p *memoryProducer) PublishMessage(ctx context.Context, target string, msg mq.Message) error {
+	return p.PublishExchange(ctx, "", target, msg)
+}
+
+// PublishExchange маршрутизирует сообщение, после возврата сообщение уже лежит в очередях
+func (p *memoryProducer) PublishExchange(ctx context.Context, exchange, key string, msg mq.Message) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	if p.isClosed() {
+		return errClosed
+	}
+	return p.broker.route(exchange, key, msg.WithDefaults(p.appID, p.contentType))
+}
+
+// PublishAsync в памяти публикация синхронная, результат готов сразу
+func (p *memoryProducer) PublishAsync(ctx context.Context, exchange, key string, msg mq.Message) <-chan error {
+	result := make(chan error, 1)
+	result <- p.PublishExchange(ctx, exchange, key, msg)
+	return result
+}
+
+// PublishBatch отправляет все сообщения, останавливается на первой ошибке
+func (p *memoryProducer) PublishBatch(ctx context.Context, exchange, key string, msgs []mq.Message) error {
+	for _, msg := range msgs {
+		if err := p.PublishExchange(ctx, exchange, key, msg); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// PublishAt маршрутизирует сообщение когда наступит at
+func (p *memoryProducer) PublishAt(ctx context.Context, exchange, key string, msg mq.Message, at time.Time) error {
+	return p.PublishAfter(ctx, exchange, key, msg, time.Until(at))
+}
+
+// PublishAfter маршрутизирует сообщение через delay. Отложенное сообщение живёт только в памяти процесса,
+// ошибки маршрутизации в момент срабатывания пишутся в лог
+func (p *memoryProducer) PublishAfter(ctx context.Context, exchange, key string, msg mq.Message, delay time.Duration) error {
+	if delay <= 0 {
+		return p.PublishExchange(ctx, exchange, key, msg)
+	}
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	if p.isClosed() {
+		return errClosed
+	}
+	msg = msg.WithDefaults(p.appID, p.contentType)
+	p.broker.wheel.schedule(delay, func() {
+		if err := p.broker.route(exchange, key, msg); err != nil {
+			log.Printf("failed to publish scheduled message due %v", err)
+		}
+	})
+	return nil
+}
+
+// Close закрывает продьюсер, брокер продолжает работать
+func (p *memoryProducer) Close() error {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	if p.closed {
+		return errClosed
+	}
+	p.closed = true
+	return nil
+}
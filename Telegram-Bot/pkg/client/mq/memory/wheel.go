@@ -0,0 +1,88 @@
+package memory
+
+import (
+	"sync"
+	"time"
+)
+
+const (
+	// wheelTick точность колеса таймеров, задача срабатывает не раньше своего времени и не позже чем через тик после него
+	wheelTick = 10 * time.Millisecond
+	// wheelSlots число слотов, задачи дальше одного оборота ждут нужное число оборотов в своём слоте
+	wheelSlots = 512
+)
+
+// timerWheel колесо таймеров: задачи раскладываются по слотам, стрелка проходит один слот за тик.
+// Один тикер на все задачи вместо таймера на каждую, тикер работает только пока есть задачи
+type timerWheel struct {
+	lock    sync.Mutex
+	slots   [wheelSlots][]*wheelTask
+	cursor  int
+	count   int
+	running bool
+}
+
+// wheelTask задача колеса
+type wheelTask struct {
+	// rounds сколько ещё полных оборотов ждать
+	rounds int
+	fn     func()
+}
+
+// schedule выполнит fn через delay в отдельной горутине колеса
+func (w *timerWheel) schedule(delay time.Duration, fn func()) {
+	ticks := int((delay + wheelTick - 1) / wheelTick)
+	if ticks < 1 {
+		ticks = 1
+	}
+
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	slot := (w.cursor + ticks) % wheelSlots
+	w.slots[slot] = append(w.slots[slot], &wheelTask{rounds: (ticks - 1) / wheelSlots, fn: fn})
+	w.count++
+	if !w.running {
+		w.running = true
+		go w.run()
+	}
+}
+
+// run крутит колесо пока в нём есть задачи
+func (w *timerWheel) run() {
+	ticker := time.NewTicker(wheelTick)
+	defer ticker.Stop()
+	for range ticker.C {
+		due, more := w.advance()
+		for _, fn := range due {
+			fn()
+		}
+		// колесо уже отмечено остановленным, следующая задача запустит новую горутину
+		if !more {
+			return
+		}
+	}
+}
+
+// advance сдвигает стрелку на слот и забирает созревшие задачи. more false если задач больше нет,
+// тогда колесо останавливается до следующей задачи
+func (w *timerWheel) advance() (due []func(), more bool) {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	w.cursor = (w.cursor + 1) % wheelSlots
+	tasks := w.slots[w.cursor]
+	kept := tasks[:0]
+	for _, task := range tasks {
+		if task.rounds > 0 {
+			task.rounds--
+			kept = append(kept, task)
+			continue
+		}
+		due = append(due, task.fn)
+	}
+	w.slots[w.cursor] = kept
+	w.count -= len(due)
+	if w.count == 0 {
+		w.running = false
+	}
+	return due, w.count > 0
+}
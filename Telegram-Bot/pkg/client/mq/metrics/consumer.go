@@ -0,0 +1,78 @@
+package metrics
+
+import (
+	"context"
+	"log"
+
+	"github.com/Maksat-luci/Telegram-Bot/pkg/client/mq"
+)
+
+// Consumer оборачивает консьюмера и считает доставки и подтверждения. Сообщения проходят через
+// промежуточный канал, поэтому читать его нужно до закрытия, как и канал самого консьюмера
+func (m *Metrics) Consumer(c mq.Consumer) mq.Consumer {
+	return &consumer{Consumer: c, metrics: m}
+}
+
+// consumer считает вызовы консьюмера, объявления передаёт как есть
+type consumer struct {
+	mq.Consumer
+	metrics *Metrics
+}
+
+// Consume считает каждое доставленное сообщение очереди target
+func (c *consumer) Consume(ctx context.Context, target string) (<-chan mq.Message, error) {
+	messages, err := c.Consumer.Consume(ctx, target)
+	if err != nil {
+		return nil, err
+	}
+	delivered := c.metrics.delivered.WithLabelValues(target)
+	ch := make(chan mq.Message)
+	go func() {
+		defer close(ch)
+		for msg := range messages {
+			delivered.Inc()
+			select {
+			case ch <- msg:
+			case <-ctx.Done():
+				// сообщение так и не отдали, возвращаем его в очередь как сделал бы сам консьюмер
+				if err := c.Nack(context.Background(), msg.ID, false, true); err != nil {
+					log.Printf("failed to requeue message %d from %s due %v", msg.ID, target, err)
+				}
+				return
+			}
+		}
+	}()
+	return ch, nil
+}
+
+// Ack подтверждает сообщение
+func (c *consumer) Ack(ctx context.Context, id uint64, multiple bool) error {
+	err := c.Consumer.Ack(ctx, id, multiple)
+	c.metrics.settled.WithLabelValues("ack", result(err)).Inc()
+	return err
+}
+
+// Nack возвращает или отбрасывает сообщение
+func (c *consumer) Nack(ctx context.Context, id uint64, multiple bool, requeue bool) error {
+	err := c.Consumer.Nack(ctx, id, multiple, requeue)
+	c.metrics.settled.WithLabelValues("nack", result(err)).Inc()
+	return err
+}
+
+// Reject отклоняет сообщение
+func (c *consumer) Reject(ctx context.Context, id uint64, requeue bool) error {
+	err := c.Consumer.Reject(ctx, id, requeue)
+	c.metrics.settled.WithLabelValues("reject", result(err)).Inc()
+	return err
+}
+
+// Settle завершает неудачное сообщение, action это итог который бэкенд применил на самом деле
+func (c *consumer) Settle(ctx context.Context, msg mq.Message, outcome mq.Outcome) (mq.Outcome, error) {
+	applied, err := c.Consumer.Settle(ctx, msg, outcome)
+	action := applied
+	if err != nil {
+		action = outcome
+	}
+	c.metrics.settled.WithLabelValues(action.String(), result(err)).Inc()
+	return applied, err
+}
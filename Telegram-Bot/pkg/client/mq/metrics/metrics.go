@@ -0,0 +1,163 @@
+// Package metrics метрики Prometheus для mq: публикации, доставки, подтверждения, обработка сообщений,
+// переподключения и глубина очередей. Продьюсер и консьюмер оборачиваются, обработчики получают middleware
+package metrics
+
+import (
+	"context"
+	"time"
+
+	"github.com/Maksat-luci/Telegram-Bot/pkg/client/mq"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// результаты операций в метках
+const (
+	resultOK    = "ok"
+	resultError = "error"
+	// outcomeAck итог обработки без ошибки
+	outcomeAck = "ack"
+)
+
+// Metrics коллекторы mq, регистрируются в одном реестре
+type Metrics struct {
+	published       *prometheus.CounterVec
+	publishDuration *prometheus.HistogramVec
+	delivered       *prometheus.CounterVec
+	settled         *prometheus.CounterVec
+	handled         *prometheus.CounterVec
+	handleDuration  *prometheus.HistogramVec
+	inflight        *prometheus.GaugeVec
+	lag             *prometheus.HistogramVec
+	states          *prometheus.CounterVec
+	connected       *prometheus.GaugeVec
+	registerer      prometheus.Registerer
+}
+
+// New создаёт коллекторы и регистрирует их в reg
+func New(reg prometheus.Registerer) (*Metrics, error) {
+	m := &Metrics{
+		published: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "mq_published_total",
+			Help: "Messages published, by destination (exchange or queue for the default exchange) and result.",
+		}, []string{"destination", "result"}),
+		publishDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name:    "mq_publish_duration_seconds",
+			Help:    "Time to publish a message including broker confirmation.",
+			Buckets: prometheus.DefBuckets,
+		}, []string{"destination"}),
+		delivered: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "mq_delivered_total",
+			Help: "Messages delivered to the consumer.",
+		}, []string{"queue"}),
+		settled: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "mq_settled_total",
+			Help: "Ack, nack, reject and settle calls sent to the broker, by result.",
+		}, []string{"action", "result"}),
+		handled: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "mq_handled_total",
+			Help: "Messages handled, by queue and outcome chosen by the handler.",
+		}, []string{"queue", "outcome"}),
+		handleDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name:    "mq_handle_duration_seconds",
+			Help:    "Time spent in the message handler.",
+			Buckets: prometheus.DefBuckets,
+		}, []string{"queue"}),
+		inflight: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "mq_handler_inflight",
+			Help: "Messages currently being handled.",
+		}, []string{"queue"}),
+		lag: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name:    "mq_consumer_lag_seconds",
+			Help:    "Age of a message when its handler starts, from the publish timestamp.",
+			Buckets: []float64{.01, .05, .1, .5, 1, 5, 10, 30, 60, 300, 900, 3600},
+		}, []string{"queue"}),
+		states: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "mq_connection_state_changes_total",
+			Help: "Connection state changes; state=\"reconnecting\" counts reconnect attempts.",
+		}, []string{"connection", "state"}),
+		connected: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "mq_connected",
+			Help: "1 if the connection to the broker is up.",
+		}, []string{"connection"}),
+		registerer: reg,
+	}
+	collectors := []prometheus.Collector{
+		m.published, m.publishDuration, m.delivered, m.settled, m.handled,
+		m.handleDuration, m.inflight, m.lag, m.states, m.connected,
+	}
+	for _, c := range collectors {
+		if err := reg.Register(c); err != nil {
+			return nil, err
+		}
+	}
+	return m, nil
+}
+
+// Middleware считает обработанные сообщения по итогам, время обработки, сообщения в работе и задержку
+// от публикации до начала обработки. Итог это то что выбрал обработчик, а не то что применил бэкенд
+func (m *Metrics) Middleware() mq.Middleware {
+	return func(next mq.Handler) mq.Handler {
+		return func(ctx context.Context, msg mq.Message) error {
+			start := time.Now()
+			if !msg.Timestamp.IsZero() {
+				m.lag.WithLabelValues(msg.Queue).Observe(start.Sub(msg.Timestamp).Seconds())
+			}
+			inflight := m.inflight.WithLabelValues(msg.Queue)
+			inflight.Inc()
+			defer inflight.Dec()
+
+			err := next(ctx, msg)
+			m.handleDuration.WithLabelValues(msg.Queue).Observe(time.Since(start).Seconds())
+			outcome := outcomeAck
+			if err != nil {
+				outcome = mq.OutcomeOf(err).String()
+			}
+			m.handled.WithLabelValues(msg.Queue, outcome).Inc()
+			return err
+		}
+	}
+}
+
+// WatchState считает смены состояния подключения name и держит gauge mq_connected, если бэкенд о них сообщает.
+// Вызывается до того как продьюсер или консьюмер обёрнуты, обёртка StateNotifier не реализует
+func (m *Metrics) WatchState(name string, backend interface{}) {
+	notifier, ok := backend.(mq.StateNotifier)
+	if !ok {
+		return
+	}
+	connected := m.connected.WithLabelValues(name)
+	// бэкенд создаётся уже подключённым
+	connected.Set(1)
+	states := make(chan mq.StateEvent, 16)
+	notifier.NotifyState(states)
+	go func() {
+		for event := range states {
+			m.states.WithLabelValues(name, event.State.String()).Inc()
+			switch event.State {
+			case mq.StateConnected:
+				connected.Set(1)
+			case mq.StateClosed:
+				connected.Set(0)
+				return
+			default:
+				connected.Set(0)
+			}
+		}
+	}()
+}
+
+// result метка результата операции
+func result(err error) string {
+	if err != nil {
+		return resultError
+	}
+	return resultOK
+}
+
+// destination куда публикуется сообщение: exchange, а для default exchange очередь
+func destination(exchange, key string) string {
+	if exchange == "" {
+		return key
+	}
+	return exchange
+}
@@ -0,0 +1,280 @@
+package metrics
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Maksat-luci/Telegram-Bot/pkg/client/mq"
+	"github.com/Maksat-luci/Telegram-Bot/pkg/client/mq/memory"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+// newTestMetrics создаёт метрики в отдельном реестре
+func newTestMetrics(t *testing.T) (*Metrics, *prometheus.Registry) {
+	t.Helper()
+	reg := prometheus.NewRegistry()
+	m, err := New(reg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return m, reg
+}
+
+// newBackend создаёт продьюсера и консьюмера поверх брокера в памяти с очередью tracks
+func newBackend(t *testing.T) (*memory.Broker, mq.Producer, mq.Consumer) {
+	t.Helper()
+	broker := memory.NewBroker()
+	broker.DeclareQueue("tracks")
+	producer := memory.NewMemoryProducer(broker, memory.ProducerConfig{})
+	consumer := memory.NewMemoryConsumer(broker, memory.ConsumerConfig{})
+	t.Cleanup(func() {
+		_ = producer.Close()
+		_ = consumer.Close()
+	})
+	return broker, producer, consumer
+}
+
+// sampleCount сколько наблюдений записала гистограмма name с метками labels
+func sampleCount(t *testing.T, reg *prometheus.Registry, name string, labels map[string]string) uint64 {
+	t.Helper()
+	families, err := reg.Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, family := range families {
+		if family.GetName() != name {
+			continue
+		}
+	metrics:
+		for _, metric := range family.GetMetric() {
+			for _, pair := range metric.GetLabel() {
+				if labels[pair.GetName()] != pair.GetValue() {
+					continue metrics
+				}
+			}
+			return metric.GetHistogram().GetSampleCount()
+		}
+	}
+	return 0
+}
+
+// expectValue сравнивает значение счётчика или gauge с want
+func expectValue(t *testing.T, c prometheus.Collector, want float64) {
+	t.Helper()
+	if got := testutil.ToFloat64(c); got != want {
+		t.Fatalf("got %v, want %v", got, want)
+	}
+}
+
+func TestProducer(t *testing.T) {
+	ctx := context.Background()
+	m, reg := newTestMetrics(t)
+	_, backend, _ := newBackend(t)
+	producer := m.Producer(backend)
+
+	if err := producer.Publish(ctx, "tracks", []byte("track")); err != nil {
+		t.Fatal(err)
+	}
+	if err := producer.PublishExchange(ctx, "missing", "track.found", mq.Message{}); err == nil {
+		t.Fatal("got nil error for unknown exchange")
+	}
+	// обёртка сохраняет пакетную и отложенную публикацию продьюсера в памяти
+	batch, ok := producer.(mq.BatchProducer)
+	if !ok {
+		t.Fatal("wrapped producer lost BatchProducer")
+	}
+	if _, ok := producer.(mq.ScheduledProducer); !ok {
+		t.Fatal("wrapped producer lost ScheduledProducer")
+	}
+	if err := batch.PublishBatch(ctx, "", "tracks", make([]mq.Message, 3)); err != nil {
+		t.Fatal(err)
+	}
+
+	expectValue(t, m.published.WithLabelValues("tracks", resultOK), 4)
+	expectValue(t, m.published.WithLabelValues("missing", resultError), 1)
+	if n := sampleCount(t, reg, "mq_publish_duration_seconds", map[string]string{"destination": "tracks"}); n != 2 {
+		t.Fatalf("got %d publish durations for tracks, want 2", n)
+	}
+}
+
+func TestConsumer(t *testing.T) {
+	ctx := context.Background()
+	m, _ := newTestMetrics(t)
+	_, producer, backend := newBackend(t)
+	consumer := m.Consumer(backend)
+
+	messages, err := consumer.Consume(ctx, "tracks")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, body := range []string{"first", "second"} {
+		if err := producer.Publish(ctx, "tracks", []byte(body)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	first, second := <-messages, <-messages
+	if err := consumer.Ack(ctx, first.ID, false); err != nil {
+		t.Fatal(err)
+	}
+	if err := consumer.Ack(ctx, first.ID, false); err == nil {
+		t.Fatal("got nil error for acking twice")
+	}
+	// без retry политики бэкенд выбрасывает сообщение, считается то что он применил
+	if _, err := consumer.Settle(ctx, second, mq.OutcomeRetry); err != nil {
+		t.Fatal(err)
+	}
+
+	expectValue(t, m.delivered.WithLabelValues("tracks"), 2)
+	expectValue(t, m.settled.WithLabelValues("ack", resultOK), 1)
+	expectValue(t, m.settled.WithLabelValues("ack", resultError), 1)
+	expectValue(t, m.settled.WithLabelValues(mq.OutcomeDrop.String(), resultOK), 1)
+}
+
+func TestConsumeCancelled(t *testing.T) {
+	m, _ := newTestMetrics(t)
+	broker, producer, backend := newBackend(t)
+	consumer := m.Consumer(backend)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	messages, err := consumer.Consume(ctx, "tracks")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := producer.Publish(context.Background(), "tracks", []byte("track")); err != nil {
+		t.Fatal(err)
+	}
+	// обёртка уже получила сообщение от бэкенда, но его никто не читает
+	deadline := time.Now().Add(time.Second)
+	for testutil.ToFloat64(m.delivered.WithLabelValues("tracks")) != 1 {
+		if time.Now().After(deadline) {
+			t.Fatal("message was not delivered")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	cancel()
+
+	select {
+	case _, ok := <-messages:
+		if ok {
+			t.Fatal("got message after cancel")
+		}
+	case <-time.After(time.Second):
+		t.Fatal("messages channel was not closed after cancel")
+	}
+	if n := broker.Len("tracks"); n != 1 {
+		t.Fatalf("queue has %d messages, want the undelivered one back", n)
+	}
+	expectValue(t, m.settled.WithLabelValues("nack", resultOK), 1)
+}
+
+func TestMiddleware(t *testing.T) {
+	m, reg := newTestMetrics(t)
+	failed := mq.WithOutcome(errors.New("broken"), mq.OutcomeDeadLetter)
+	handler := m.Middleware()(func(ctx context.Context, msg mq.Message) error {
+		expectValue(t, m.inflight.WithLabelValues("tracks"), 1)
+		if string(msg.Body) == "broken" {
+			return failed
+		}
+		return nil
+	})
+
+	ctx := context.Background()
+	if err := handler(ctx, mq.Message{Queue: "tracks", Body: []byte("track"), Timestamp: time.Now().Add(-time.Second)}); err != nil {
+		t.Fatal(err)
+	}
+	if err := handler(ctx, mq.Message{Queue: "tracks", Body: []byte("broken")}); err != failed {
+		t.Fatalf("got %v, want %v", err, failed)
+	}
+
+	expectValue(t, m.handled.WithLabelValues("tracks", outcomeAck), 1)
+	expectValue(t, m.handled.WithLabelValues("tracks", mq.OutcomeDeadLetter.String()), 1)
+	expectValue(t, m.inflight.WithLabelValues("tracks"), 0)
+	queue := map[string]string{"queue": "tracks"}
+	if n := sampleCount(t, reg, "mq_handle_duration_seconds", queue); n != 2 {
+		t.Fatalf("got %d handle durations, want 2", n)
+	}
+	// задержка считается только для сообщения с временем публикации
+	if n := sampleCount(t, reg, "mq_consumer_lag_seconds", queue); n != 1 {
+		t.Fatalf("got %d lag observations, want 1", n)
+	}
+}
+
+// notifier бэкенд который сообщает о смене состояния подключения
+type notifier struct {
+	states chan<- mq.StateEvent
+}
+
+func (n *notifier) NotifyState(ch chan<- mq.StateEvent) {
+	n.states = ch
+}
+
+func TestWatchState(t *testing.T) {
+	m, _ := newTestMetrics(t)
+	backend := &notifier{}
+	m.WatchState("producer", backend)
+	connected := m.connected.WithLabelValues("producer")
+	expectValue(t, connected, 1)
+
+	// ждёт пока gauge станет want
+	wait := func(want float64) {
+		t.Helper()
+		deadline := time.Now().Add(time.Second)
+		for testutil.ToFloat64(connected) != want {
+			if time.Now().After(deadline) {
+				t.Fatalf("mq_connected did not become %v", want)
+			}
+			time.Sleep(time.Millisecond)
+		}
+	}
+	backend.states <- mq.StateEvent{State: mq.StateDisconnected}
+	wait(0)
+	backend.states <- mq.StateEvent{State: mq.StateReconnecting}
+	backend.states <- mq.StateEvent{State: mq.StateConnected}
+	wait(1)
+	backend.states <- mq.StateEvent{State: mq.StateClosed}
+	wait(0)
+
+	for _, state := range []mq.ConnectionState{mq.StateDisconnected, mq.StateReconnecting, mq.StateConnected, mq.StateClosed} {
+		expectValue(t, m.states.WithLabelValues("producer", state.String()), 1)
+	}
+
+	// бэкенд без StateNotifier пропускается
+	m.WatchState("consumer", struct{}{})
+	if n := testutil.CollectAndCount(m.connected); n != 1 {
+		t.Fatalf("got %d connections, want 1", n)
+	}
+}
+
+func TestQueues(t *testing.T) {
+	ctx := context.Background()
+	m, reg := newTestMetrics(t)
+	_, producer, _ := newBackend(t)
+	for _, body := range []string{"first", "second"} {
+		if err := producer.Publish(ctx, "tracks", []byte(body)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// повторы очередей не ломают scrape, консьюмеров брокер в памяти не считает
+	if err := m.Queues(producer, "tracks", "albums", "tracks", ""); err != nil {
+		t.Fatal(err)
+	}
+	want := `
+# HELP mq_queue_messages Messages ready for delivery in the queue.
+# TYPE mq_queue_messages gauge
+mq_queue_messages{queue="albums"} 0
+mq_queue_messages{queue="tracks"} 2
+`
+	if err := testutil.GatherAndCompare(reg, strings.NewReader(want), "mq_queue_messages", "mq_queue_consumers"); err != nil {
+		t.Fatal(err)
+	}
+
+	// бэкенд который не сообщает глубину очередей пропускается
+	if err := m.Queues(struct{}{}, "tracks"); err != nil {
+		t.Fatal(err)
+	}
+}
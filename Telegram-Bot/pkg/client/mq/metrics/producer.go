@@ -0,0 +1,112 @@
+package metrics
+
+import (
+	"context"
+	"time"
+
+	"github.com/Maksat-luci/Telegram-Bot/pkg/client/mq"
+)
+
+// Producer оборачивает продьюсера и считает публикации. Обёртка реализует BatchProducer и
+// ScheduledProducer только если их реализует сам продьюсер, так проверки типов ниже по цепочке не ломаются
+func (m *Metrics) Producer(p mq.Producer) mq.Producer {
+	base := &producer{Producer: p, metrics: m}
+	batch, isBatch := p.(mq.BatchProducer)
+	scheduled, isScheduled := p.(mq.ScheduledProducer)
+	switch {
+	case isBatch && isScheduled:
+		return &struct {
+			*producer
+			batching
+			scheduling
+		}{base, batching{batch: batch, metrics: m}, scheduling{scheduled: scheduled, metrics: m}}
+	case isBatch:
+		return &struct {
+			*producer
+			batching
+		}{base, batching{batch: batch, metrics: m}}
+	case isScheduled:
+		return &struct {
+			*producer
+			scheduling
+		}{base, scheduling{scheduled: scheduled, metrics: m}}
+	}
+	return base
+}
+
+// producer считает Publish, PublishMessage и PublishExchange, объявления передаёт как есть
+type producer struct {
+	mq.Producer
+	metrics *Metrics
+}
+
+// Publish отправляет сообщение в очередь target
+func (p *producer) Publish(ctx context.Context, target string, body []byte) error {
+	return p.PublishExchange(ctx, "", target, mq.Message{Body: body})
+}
+
+// PublishMessage отправляет сообщение в очередь target через default exchange
+func (p *producer) PublishMessage(ctx context.Context, target string, msg mq.Message) error {
+	return p.PublishExchange(ctx, "", target, msg)
+}
+
+// PublishExchange отправляет сообщение и считает результат и время публикации
+func (p *producer) PublishExchange(ctx context.Context, exchange, key string, msg mq.Message) error {
+	start := time.Now()
+	err := p.Producer.PublishExchange(ctx, exchange, key, msg)
+	p.metrics.observePublish(exchange, key, start, 1, err)
+	return err
+}
+
+// batching считает асинхронные и пакетные публикации
+type batching struct {
+	batch   mq.BatchProducer
+	metrics *Metrics
+}
+
+// PublishAsync отправляет сообщение, публикация считается когда придёт подтверждение
+func (b batching) PublishAsync(ctx context.Context, exchange, key string, msg mq.Message) <-chan error {
+	start := time.Now()
+	confirmed := b.batch.PublishAsync(ctx, exchange, key, msg)
+	result := make(chan error, 1)
+	go func() {
+		err := <-confirmed
+		b.metrics.observePublish(exchange, key, start, 1, err)
+		result <- err
+	}()
+	return result
+}
+
+// PublishBatch отправляет пакет, при ошибке весь пакет считается неудачным
+func (b batching) PublishBatch(ctx context.Context, exchange, key string, msgs []mq.Message) error {
+	start := time.Now()
+	err := b.batch.PublishBatch(ctx, exchange, key, msgs)
+	b.metrics.observePublish(exchange, key, start, len(msgs), err)
+	return err
+}
+
+// scheduling считает отложенные публикации в момент передачи брокеру
+type scheduling struct {
+	scheduled mq.ScheduledProducer
+	metrics   *Metrics
+}
+
+// PublishAt передаёт отложенное сообщение брокеру
+func (s scheduling) PublishAt(ctx context.Context, exchange, key string, msg mq.Message, at time.Time) error {
+	start := time.Now()
+	err := s.scheduled.PublishAt(ctx, exchange, key, msg, at)
+	s.metrics.observePublish(exchange, key, start, 1, err)
+	return err
+}
+
+// PublishAfter передаёт брокеру сообщение которое он опубликует через delay
+func (s scheduling) PublishAfter(ctx context.Context, exchange, key string, msg mq.Message, delay time.Duration) error {
+	return s.PublishAt(ctx, exchange, key, msg, time.Now().Add(delay))
+}
+
+// observePublish учитывает публикацию n сообщений
+func (m *Metrics) observePublish(exchange, key string, start time.Time, n int, err error) {
+	dest := destination(exchange, key)
+	m.published.WithLabelValues(dest, result(err)).Add(float64(n))
+	m.publishDuration.WithLabelValues(dest).Observe(time.Since(start).Seconds())
+}
@@ -0,0 +1,76 @@
+package metrics
+
+import (
+	"context"
+	"log"
+	"time"
+
+	"github.com/Maksat-luci/Telegram-Bot/pkg/client/mq"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// inspectTimeout сколько один scrape ждёт ответа брокера по каждой очереди
+const inspectTimeout = 5 * time.Second
+
+// Queues регистрирует глубину очередей queues, брокер опрашивается при каждом scrape. Повторы и пустые
+// имена пропускаются, одна очередь дважды сломала бы scrape. Ничего не делает если бэкенд не умеет
+// сообщать глубину очереди
+func (m *Metrics) Queues(backend interface{}, queues ...string) error {
+	inspector, ok := backend.(mq.QueueInspector)
+	if !ok {
+		return nil
+	}
+	return m.registerer.Register(&queueCollector{
+		inspector: inspector,
+		queues:    unique(queues),
+		messages: prometheus.NewDesc("mq_queue_messages",
+			"Messages ready for delivery in the queue.", []string{"queue"}, nil),
+		consumers: prometheus.NewDesc("mq_queue_consumers",
+			"Consumers reading the queue.", []string{"queue"}, nil),
+	})
+}
+
+// queueCollector опрашивает брокер на каждый scrape
+type queueCollector struct {
+	inspector mq.QueueInspector
+	queues    []string
+	messages  *prometheus.Desc
+	consumers *prometheus.Desc
+}
+
+// Describe описывает метрики коллектора
+func (c *queueCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- c.messages
+	ch <- c.consumers
+}
+
+// Collect запрашивает глубину каждой очереди, очередь которую не удалось опросить пропускается
+func (c *queueCollector) Collect(ch chan<- prometheus.Metric) {
+	for _, queue := range c.queues {
+		ctx, cancel := context.WithTimeout(context.Background(), inspectTimeout)
+		stats, err := c.inspector.InspectQueue(ctx, queue)
+		cancel()
+		if err != nil {
+			log.Printf("failed to collect queue metrics due %v", err)
+			continue
+		}
+		ch <- prometheus.MustNewConstMetric(c.messages, prometheus.GaugeValue, float64(stats.Messages), queue)
+		if stats.Consumers >= 0 {
+			ch <- prometheus.MustNewConstMetric(c.consumers, prometheus.GaugeValue, float64(stats.Consumers), queue)
+		}
+	}
+}
+
+// unique имена без повторов и пустых в исходном порядке
+func unique(names []string) []string {
+	seen := make(map[string]bool, len(names))
+	var result []string
+	for _, name := range names {
+		if name == "" || seen[name] {
+			continue
+		}
+		seen[name] = true
+		result = append(result, name)
+	}
+	return result
+}
@@ -0,0 +1,75 @@
+package mq
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"runtime/debug"
+	"time"
+)
+
+// Chain собирает middlewares в одну, первая выполняется первой
+func Chain(middlewares ...Middleware) Middleware {
+	return func(next Handler) Handler {
+		for i := len(middlewares) - 1; i >= 0; i-- {
+			next = middlewares[i](next)
+		}
+		return next
+	}
+}
+
+// Recover превращает панику обработчика в ошибку, сообщение повторяется как при любой другой ошибке
+func Recover() Middleware {
+	return func(next Handler) Handler {
+		return func(ctx context.Context, msg Message) (err error) {
+			defer func() {
+				if r := recover(); r != nil {
+					log.Printf("handler panicked on message %d from %s: %v\n%s", msg.ID, msg.Queue, r, debug.Stack())
+					err = fmt.Errorf("handler panicked due %v", r)
+				}
+			}()
+			return next(ctx, msg)
+		}
+	}
+}
+
+// Timeout ограничивает обработку одного сообщения. Обработчик должен сам следить за контекстом
+func Timeout(timeout time.Duration) Middleware {
+	return func(next Handler) Handler {
+		return func(ctx context.Context, msg Message) error {
+			ctx, cancel := context.WithTimeout(ctx, timeout)
+			defer cancel()
+			return next(ctx, msg)
+		}
+	}
+}
+
+// Logging пишет в logf сообщения которые не удалось обработать, вместе с итогом и временем обработки
+func Logging(logf func(format string, args ...interface{})) Middleware {
+	return func(next Handler) Handler {
+		return func(ctx context.Context, msg Message) error {
+			start := time.Now()
+			err := next(ctx, msg)
+			if err != nil {
+				logf("failed to handle message %d from %s in %s, %s due %v", msg.ID, msg.Queue, time.Since(start), OutcomeOf(err), err)
+			}
+			return err
+		}
+	}
+}
+
+// Observer начинает наблюдение за обработкой сообщения и возвращает контекст для обработчика
+// и функцию которая вызывается с результатом обработки
+type Observer func(ctx context.Context, msg Message) (context.Context, func(err error))
+
+// Observe подключает метрики или трассировку: observer видит начало и конец обработки каждого сообщения
+func Observe(observer Observer) Middleware {
+	return func(next Handler) Handler {
+		return func(ctx context.Context, msg Message) error {
+			ctx, done := observer(ctx, msg)
+			err := next(ctx, msg)
+			done(err)
+			return err
+		}
+	}
+}
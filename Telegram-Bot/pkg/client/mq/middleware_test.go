@@ -0,0 +1,181 @@
+package mq_test
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Maksat-luci/Telegram-Bot/pkg/client/mq"
+)
+
+// record middleware которая пишет в calls вход и выход под именем name
+func record(name string, calls *[]string) mq.Middleware {
+	return func(next mq.Handler) mq.Handler {
+		return func(ctx context.Context, msg mq.Message) error {
+			*calls = append(*calls, name+" before")
+			err := next(ctx, msg)
+			*calls = append(*calls, name+" after")
+			return err
+		}
+	}
+}
+
+func TestChain(t *testing.T) {
+	var calls []string
+	handler := func(ctx context.Context, msg mq.Message) error {
+		calls = append(calls, "handler")
+		return nil
+	}
+	err := mq.Chain(record("first", &calls), record("second", &calls))(handler)(context.Background(), mq.Message{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{"first before", "second before", "handler", "second after", "first after"}
+	if !reflect.DeepEqual(calls, want) {
+		t.Fatalf("got %v, want %v", calls, want)
+	}
+}
+
+func TestSubscriberMiddlewaresOrder(t *testing.T) {
+	ctx := context.Background()
+	_, producer, consumer := newBackend(t, testRetry)
+
+	// middleware подписчика оборачивают middleware конкретной подписки
+	var calls []string
+	done := make(chan struct{})
+	sub := mq.NewSubscriber(consumer, mq.SubscriberConfig{Middlewares: []mq.Middleware{record("subscriber", &calls)}})
+	handler := func(ctx context.Context, msg mq.Message) error {
+		calls = append(calls, "handler")
+		return nil
+	}
+	last := func(next mq.Handler) mq.Handler {
+		return func(ctx context.Context, msg mq.Message) error {
+			defer close(done)
+			return next(ctx, msg)
+		}
+	}
+	if err := sub.Subscribe(ctx, "tracks", handler, last, record("subscription", &calls)); err != nil {
+		t.Fatal(err)
+	}
+	defer sub.Close()
+
+	if err := producer.Publish(ctx, "tracks", []byte("track")); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-done:
+	case <-time.After(receiveTimeout):
+		t.Fatal("timed out waiting for handler")
+	}
+	if err := sub.Close(); err != nil {
+		t.Fatal(err)
+	}
+	want := []string{"subscriber before", "subscription before", "handler", "subscription after", "subscriber after"}
+	if !reflect.DeepEqual(calls, want) {
+		t.Fatalf("got %v, want %v", calls, want)
+	}
+}
+
+func TestRecover(t *testing.T) {
+	ctx := context.Background()
+	_, producer, consumer := newBackend(t, testRetry)
+
+	handled := make(chan mq.Message, 2)
+	sub := mq.NewSubscriber(consumer, mq.SubscriberConfig{Middlewares: []mq.Middleware{mq.Recover()}})
+	handler := func(ctx context.Context, msg mq.Message) error {
+		handled <- msg
+		if msg.RetryCount() == 0 {
+			panic("broken track")
+		}
+		return nil
+	}
+	if err := sub.Subscribe(ctx, "tracks", handler); err != nil {
+		t.Fatal(err)
+	}
+	defer sub.Close()
+
+	if err := producer.Publish(ctx, "tracks", []byte("track")); err != nil {
+		t.Fatal(err)
+	}
+	receive(t, handled)
+	// паника обработана как обычная ошибка и сообщение пришло повтором
+	if msg := receive(t, handled); msg.RetryCount() != 1 {
+		t.Fatalf("got retry count %d, want 1", msg.RetryCount())
+	}
+	expectNone(t, handled)
+}
+
+func TestRecoverOutcome(t *testing.T) {
+	handler := func(ctx context.Context, msg mq.Message) error { panic("broken track") }
+	err := mq.Recover()(handler)(context.Background(), mq.Message{})
+	if err == nil {
+		t.Fatal("got nil error for panicking handler")
+	}
+	if outcome := mq.OutcomeOf(err); outcome != mq.OutcomeRetry {
+		t.Fatalf("got outcome %v, want %v", outcome, mq.OutcomeRetry)
+	}
+}
+
+func TestTimeout(t *testing.T) {
+	ctx := context.Background()
+	_, producer, consumer := newBackend(t, testRetry)
+
+	errs := make(chan error, 1)
+	sub := mq.NewSubscriber(consumer, mq.SubscriberConfig{Middlewares: []mq.Middleware{mq.Timeout(20 * time.Millisecond)}})
+	handler := func(ctx context.Context, msg mq.Message) error {
+		select {
+		case <-ctx.Done():
+			errs <- ctx.Err()
+			return mq.WithOutcome(ctx.Err(), mq.OutcomeDrop)
+		case <-time.After(receiveTimeout):
+			errs <- nil
+			return nil
+		}
+	}
+	if err := sub.Subscribe(ctx, "tracks", handler); err != nil {
+		t.Fatal(err)
+	}
+	defer sub.Close()
+
+	if err := producer.Publish(ctx, "tracks", []byte("track")); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case err := <-errs:
+		if !errors.Is(err, context.DeadlineExceeded) {
+			t.Fatalf("got %v, want %v", err, context.DeadlineExceeded)
+		}
+	case <-time.After(2 * receiveTimeout):
+		t.Fatal("timed out waiting for handler")
+	}
+}
+
+func TestLogging(t *testing.T) {
+	var logged []string
+	logf := func(format string, args ...interface{}) {
+		logged = append(logged, fmt.Sprintf(format, args...))
+	}
+	failed := errors.New("failed")
+	results := []error{nil, mq.WithOutcome(failed, mq.OutcomeDeadLetter)}
+	for _, result := range results {
+		handler := func(ctx context.Context, msg mq.Message) error { return result }
+		err := mq.Logging(logf)(handler)(context.Background(), mq.Message{ID: 7, Queue: "tracks"})
+		if err != result {
+			t.Fatalf("got %v, want %v", err, result)
+		}
+	}
+	// успешная обработка не логируется
+	if len(logged) != 1 {
+		t.Fatalf("got %d log lines, want 1: %v", len(logged), logged)
+	}
+	if !strings.HasPrefix(logged[0], "failed to handle message 7 from tracks in ") {
+		t.Fatalf("unexpected log %q", logged[0])
+	}
+	if !strings.Contains(logged[0], mq.OutcomeDeadLetter.String()) {
+		t.Fatalf("log %q has no outcome", logged[0])
+	}
+}
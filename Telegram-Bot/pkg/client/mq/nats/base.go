@@ -0,0 +1,279 @@
+package nats
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Maksat-luci/Telegram-Bot/pkg/client/mq"
+	natsio "github.com/nats-io/nats.go"
+)
+
+// Config настройки подключения к NATS
+type Config struct {
+	// URL адрес сервера, можно перечислить несколько через запятую
+	URL string
+	// Name имя подключения, видно в мониторинге сервера
+	Name string
+	// ReconnectWait пауза между попытками переподключения, переподключение бесконечное
+	ReconnectWait time.Duration
+}
+
+// ошибки бэкенда
+var (
+	errClosed              = errors.New("nats client closed")
+	errUnknownID           = errors.New("unknown message id")
+	errUnsupportedExchange = errors.New("headers exchange is not supported by NATS")
+)
+
+// natsBase общая часть продьюсера и консьюмера: подключение, JetStream и объявление стримов.
+// Очередь это стрим с одноимённым subject, exchange это префикс subject
+type natsBase struct {
+	conn *natsio.Conn
+	js   natsio.JetStreamContext
+
+	lock   sync.Mutex
+	closed bool
+	states []chan<- mq.StateEvent
+	// стримы временных очередей удаляются при закрытии
+	tempStreams map[string]bool
+	topology    *topology
+}
+
+// connect подключается к серверу и включает JetStream
+func connect(cfg Config) (*natsBase, error) {
+	b := &natsBase{tempStreams: make(map[string]bool), topology: newTopology()}
+
+	url := cfg.URL
+	if url == "" {
+		url = natsio.DefaultURL
+	}
+	opts := []natsio.Option{
+		natsio.MaxReconnects(-1),
+		natsio.DisconnectErrHandler(func(_ *natsio.Conn, err error) {
+			b.emit(mq.StateDisconnected, err)
+		}),
+		natsio.ReconnectHandler(func(_ *natsio.Conn) {
+			b.reconnected()
+		}),
+		natsio.ClosedHandler(func(_ *natsio.Conn) {
+			b.emit(mq.StateClosed, nil)
+		}),
+	}
+	if cfg.Name != "" {
+		opts = append(opts, natsio.Name(cfg.Name))
+	}
+	if cfg.ReconnectWait > 0 {
+		opts = append(opts, natsio.ReconnectWait(cfg.ReconnectWait))
+	}
+
+	conn, err := natsio.Connect(url, opts...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to NATS due %v", err)
+	}
+	js, err := conn.JetStream()
+	if err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("failed to get JetStream context due %v", err)
+	}
+	b.conn = conn
+	b.js = js
+	return b, nil
+}
+
+// streamName имя стрима очереди, в именах стримов нельзя использовать точки и wildcard
+func streamName(queue string) string {
+	return strings.NewReplacer(".", "_", "*", "_", ">", "_", " ", "_", "/", "_", "\\", "_").Replace(queue)
+}
+
+// subject куда публикуется сообщение: имя очереди для default exchange, иначе exchange.key
+func subject(exchange, key string) string {
+	switch {
+	case exchange == "":
+		return key
+	case key == "":
+		return exchange
+	}
+	return exchange + "." + key
+}
+
+// bindingSubjects subject-ы которые получает очередь привязанная к exchange. Ключ в формате topic
+// exchange RabbitMQ: # становится >, пустой ключ получает всё что публикуется в exchange
+func bindingSubjects(exchange, key string) []string {
+	if key == "" || key == "#" {
+		return []string{exchange, exchange + ".>"}
+	}
+	tokens := strings.Split(key, ".")
+	for i, token := range tokens {
+		if token == "#" {
+			tokens[i] = ">"
+		}
+	}
+	return []string{subject(exchange, strings.Join(tokens, "."))}
+}
+
+// DeclareQueue создаёт стрим очереди если его ещё нет. Не durable очереди хранятся в памяти сервера,
+// временные (autoDelete или exclusive) удаляются при закрытии клиента
+func (b *natsBase) DeclareQueue(ctx context.Context, name string, durable, autoDelete, exclusive bool, args map[string]interface{}) error {
+	if err := b.check(ctx); err != nil {
+		return err
+	}
+	storage := natsio.FileStorage
+	if !durable {
+		storage = natsio.MemoryStorage
+	}
+	if err := b.ensureStream(ctx, name, storage); err != nil {
+		return err
+	}
+	b.topology.add("queue:"+name, func(ctx context.Context) error {
+		return b.ensureStream(ctx, name, storage)
+	})
+	if autoDelete || exclusive {
+		b.lock.Lock()
+		b.tempStreams[streamName(name)] = true
+		b.lock.Unlock()
+	}
+	return nil
+}
+
+// ensureStream создаёт стрим очереди, существующий стрим не трогается чтобы не потерять привязки
+func (b *natsBase) ensureStream(ctx context.Context, queue string, storage natsio.StorageType) error {
+	_, err := b.js.StreamInfo(streamName(queue), natsio.Context(ctx))
+	if err == nil {
+		return nil
+	}
+	if !errors.Is(err, natsio.ErrStreamNotFound) {
+		return fmt.Errorf("failed to get stream of queue %s due %v", queue, err)
+	}
+	_, err = b.js.AddStream(&natsio.StreamConfig{
+		Name:      streamName(queue),
+		Subjects:  []string{queue},
+		Retention: natsio.WorkQueuePolicy,
+		Storage:   storage,
+	}, natsio.Context(ctx))
+	if err != nil {
+		return fmt.Errorf("failed to declare queue due %v", err)
+	}
+	return nil
+}
+
+// DeclareExchange в NATS exchange не существует отдельно от subject, проверяется только тип
+func (b *natsBase) DeclareExchange(ctx context.Context, name, kind string, durable, autoDelete bool, args map[string]interface{}) error {
+	if err := b.check(ctx); err != nil {
+		return err
+	}
+	switch kind {
+	case mq.ExchangeDirect, mq.ExchangeTopic, mq.ExchangeFanout:
+		return nil
+	case mq.ExchangeHeaders:
+		return errUnsupportedExchange
+	}
+	return fmt.Errorf("unknown exchange kind %q", kind)
+}
+
+// BindQueue добавляет subject-ы exchange в стрим очереди. Один subject не может попасть в два стрима,
+// поэтому раздать одно сообщение нескольким очередям через NATS нельзя
+func (b *natsBase) BindQueue(ctx context.Context, queue, exchange, key string, args map[string]interface{}) error {
+	if err := b.check(ctx); err != nil {
+		return err
+	}
+	if err := b.bind(ctx, queue, exchange, key); err != nil {
+		return err
+	}
+	b.topology.add(fmt.Sprintf("binding:%s:%s:%s", queue, exchange, key), func(ctx context.Context) error {
+		return b.bind(ctx, queue, exchange, key)
+	})
+	return nil
+}
+
+// bind добавляет в стрим очереди недостающие subject-ы привязки
+func (b *natsBase) bind(ctx context.Context, queue, exchange, key string) error {
+	info, err := b.js.StreamInfo(streamName(queue), natsio.Context(ctx))
+	if err != nil {
+		return fmt.Errorf("failed to bind queue %s to exchange %s due %v", queue, exchange, err)
+	}
+
+	cfg := info.Config
+	changed := false
+	for _, subj := range bindingSubjects(exchange, key) {
+		if !contains(cfg.Subjects, subj) {
+			cfg.Subjects = append(cfg.Subjects, subj)
+			changed = true
+		}
+	}
+	if !changed {
+		return nil
+	}
+	if _, err := b.js.UpdateStream(&cfg, natsio.Context(ctx)); err != nil {
+		return fmt.Errorf("failed to bind queue %s to exchange %s due %v", queue, exchange, err)
+	}
+	return nil
+}
+
+// NotifyState подписывает канал на события смены состояния подключения
+func (b *natsBase) NotifyState(ch chan<- mq.StateEvent) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	b.states = append(b.states, ch)
+}
+
+// emit рассылает событие подписчикам, медленный подписчик событие пропускает
+func (b *natsBase) emit(state mq.ConnectionState, err error) {
+	event := mq.StateEvent{State: state, Err: err, At: time.Now()}
+
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	for _, ch := range b.states {
+		select {
+		case ch <- event:
+		default:
+		}
+	}
+}
+
+// check проверяет контекст и что клиент не закрыт
+func (b *natsBase) check(ctx context.Context) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	if b.closed {
+		return errClosed
+	}
+	return nil
+}
+
+// close удаляет временные стримы и закрывает подключение
+func (b *natsBase) close() error {
+	b.lock.Lock()
+	if b.closed {
+		b.lock.Unlock()
+		return errClosed
+	}
+	b.closed = true
+	temp := b.tempStreams
+	b.tempStreams = nil
+	b.lock.Unlock()
+
+	for name := range temp {
+		if err := b.js.DeleteStream(name); err != nil {
+			b.conn.Close()
+			return fmt.Errorf("failed to delete stream %s due %v", name, err)
+		}
+	}
+	b.conn.Close()
+	return nil
+}
+
+func contains(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
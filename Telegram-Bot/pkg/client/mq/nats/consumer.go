@@ -0,0 +1,323 @@
+package nats
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"sort"
+	"time"
+
+	"github.com/Maksat-luci/Telegram-Bot/pkg/client/mq"
+	natsio "github.com/nats-io/nats.go"
+)
+
+// ConsumerConfig настройки консьюмера NATS
+type ConsumerConfig struct {
+	Config
+	// PrefetchCount сколько неподтверждённых сообщений сервер отдаёт консьюмеру одновременно
+	PrefetchCount int
+	// AckWait через сколько неподтверждённое сообщение доставляется заново
+	AckWait time.Duration
+	// Retry настройки повторов и parking очереди
+	Retry mq.RetryPolicy
+}
+
+// natsConsumer консьюмер поверх durable pull консьюмеров JetStream, по одному на очередь.
+// Все инстансы бота читающие очередь делят один durable и получают сообщения по очереди
+type natsConsumer struct {
+	*natsBase
+	prefetchCount int
+	ackWait       time.Duration
+	retry         mq.RetryPolicy
+
+	nextID  uint64
+	unacked map[uint64]*natsio.Msg
+	done    chan struct{}
+}
+
+const (
+	// fetchWait сколько один запрос ждёт сообщений в пустой очереди
+	fetchWait = 5 * time.Second
+	// fetchDelay пауза перед следующей попыткой забрать сообщения после ошибки, например при переподключении
+	fetchDelay = time.Second
+)
+
+// NewNATSConsumer конструктор который подключается к NATS и возвращает консьюмера
+func NewNATSConsumer(cfg ConsumerConfig) (mq.Consumer, error) {
+	base, err := connect(cfg.Config)
+	if err != nil {
+		return nil, err
+	}
+	return &natsConsumer{
+		natsBase:      base,
+		prefetchCount: cfg.PrefetchCount,
+		ackWait:       cfg.AckWait,
+		retry:         cfg.Retry,
+		unacked:       make(map[uint64]*natsio.Msg),
+		done:          make(chan struct{}),
+	}, nil
+}
+
+// parkingQueue очередь в которую уходят сообщения после исчерпания повторов
+func parkingQueue(queue string) string {
+	return fmt.Sprintf("%s.parking", queue)
+}
+
+// Consume начинает доставлять сообщения очереди target, стрим и durable консьюмер создаются если их нет.
+// Доставка идёт пока не отменён ctx или не закрыт консьюмер
+func (c *natsConsumer) Consume(ctx context.Context, target string) (<-chan mq.Message, error) {
+	if err := c.check(ctx); err != nil {
+		return nil, err
+	}
+	if err := c.ensureStream(ctx, target, natsio.FileStorage); err != nil {
+		return nil, err
+	}
+	stream := streamName(target)
+	if err := c.ensureConsumer(ctx, stream); err != nil {
+		return nil, err
+	}
+	// консьюмер создан заранее, поэтому при отписке он не удаляется и очередь сохраняет позицию
+	sub, err := c.js.PullSubscribe(target, stream, natsio.Bind(stream, stream))
+	if err != nil {
+		return nil, fmt.Errorf("failed to consume messages due %v", err)
+	}
+
+	ch := make(chan mq.Message)
+	go c.deliver(ctx, sub, target, ch)
+	return ch, nil
+}
+
+// ensureConsumer создаёт durable консьюмер стрима с именем стрима
+func (c *natsConsumer) ensureConsumer(ctx context.Context, stream string) error {
+	_, err := c.js.ConsumerInfo(stream, stream, natsio.Context(ctx))
+	if err == nil {
+		return nil
+	}
+	if !errors.Is(err, natsio.ErrConsumerNotFound) {
+		return fmt.Errorf("failed to get consumer of stream %s due %v", stream, err)
+	}
+	_, err = c.js.AddConsumer(stream, &natsio.ConsumerConfig{
+		Durable:       stream,
+		AckPolicy:     natsio.AckExplicitPolicy,
+		AckWait:       c.ackWait,
+		MaxAckPending: c.prefetchCount,
+	}, natsio.Context(ctx))
+	if err != nil {
+		return fmt.Errorf("failed to declare consumer of stream %s due %v", stream, err)
+	}
+	return nil
+}
+
+// deliver забирает сообщения пачками по prefetch и отдаёт их в канал
+func (c *natsConsumer) deliver(ctx context.Context, sub *natsio.Subscription, target string, ch chan<- mq.Message) {
+	defer close(ch)
+	defer func() {
+		if err := sub.Unsubscribe(); err != nil && !errors.Is(err, natsio.ErrConnectionClosed) {
+			log.Printf("failed to unsubscribe from %s due %v", target, err)
+		}
+	}()
+
+	batch := c.prefetchCount
+	if batch <= 0 {
+		batch = 1
+	}
+	for {
+		fetchCtx, cancel := context.WithTimeout(ctx, fetchWait)
+		msgs, err := sub.Fetch(batch, natsio.Context(fetchCtx))
+		cancel()
+		switch {
+		case err == nil:
+		case ctx.Err() != nil, errors.Is(err, natsio.ErrConnectionClosed), errors.Is(err, natsio.ErrBadSubscription):
+			return
+		case errors.Is(err, natsio.ErrTimeout), errors.Is(err, context.DeadlineExceeded):
+			// в очереди пусто, спрашиваем снова
+			continue
+		default:
+			log.Printf("failed to fetch messages from %s due %v", target, err)
+			select {
+			case <-time.After(fetchDelay):
+				continue
+			case <-ctx.Done():
+				return
+			case <-c.done:
+				return
+			}
+		}
+
+		for i, m := range msgs {
+			select {
+			case ch <- message(m, c.track(m), target):
+			case <-ctx.Done():
+				// сообщения так и не отдали воркеру, возвращаем их в очередь
+				c.requeue(msgs[i:])
+				return
+			case <-c.done:
+				return
+			}
+		}
+	}
+}
+
+// track запоминает сообщение до подтверждения и выдаёт ему идентификатор
+func (c *natsConsumer) track(m *natsio.Msg) uint64 {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.nextID++
+	c.unacked[c.nextID] = m
+	return c.nextID
+}
+
+// requeue сразу возвращает сообщения в стрим не дожидаясь AckWait
+func (c *natsConsumer) requeue(msgs []*natsio.Msg) {
+	for _, m := range msgs {
+		if err := m.Nak(); err != nil {
+			log.Printf("failed to requeue message %s due %v", m.Subject, err)
+		}
+	}
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	for id, m := range c.unacked {
+		for _, requeued := range msgs {
+			if m == requeued {
+				delete(c.unacked, id)
+			}
+		}
+	}
+}
+
+// take забирает сообщение id, а при multiple ещё и все выданные до него
+func (c *natsConsumer) take(id uint64, multiple bool) ([]*natsio.Msg, error) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if _, ok := c.unacked[id]; !ok {
+		return nil, errUnknownID
+	}
+	ids := []uint64{id}
+	if multiple {
+		ids = ids[:0]
+		for _, other := range sortedIDs(c.unacked) {
+			if other <= id {
+				ids = append(ids, other)
+			}
+		}
+	}
+	msgs := make([]*natsio.Msg, 0, len(ids))
+	for _, other := range ids {
+		msgs = append(msgs, c.unacked[other])
+		delete(c.unacked, other)
+	}
+	return msgs, nil
+}
+
+// settle применяет действие к сообщениям id
+func (c *natsConsumer) settle(ctx context.Context, id uint64, multiple bool, action func(m *natsio.Msg) error) error {
+	if err := c.check(ctx); err != nil {
+		return err
+	}
+	msgs, err := c.take(id, multiple)
+	if err != nil {
+		return fmt.Errorf("failed to settle message with id %d due %v", id, err)
+	}
+	for _, m := range msgs {
+		if err := action(m); err != nil {
+			return fmt.Errorf("failed to settle message with id %d due %v", id, err)
+		}
+	}
+	return nil
+}
+
+// Ack подтверждает обработку, сообщение удаляется из стрима
+func (c *natsConsumer) Ack(ctx context.Context, id uint64, multiple bool) error {
+	return c.settle(ctx, id, multiple, func(m *natsio.Msg) error {
+		return m.Ack(natsio.Context(ctx))
+	})
+}
+
+// Nack с requeue возвращает сообщение на повторную доставку, без requeue удаляет его из стрима
+func (c *natsConsumer) Nack(ctx context.Context, id uint64, multiple bool, requeue bool) error {
+	return c.settle(ctx, id, multiple, func(m *natsio.Msg) error {
+		if requeue {
+			return m.Nak(natsio.Context(ctx))
+		}
+		return m.Term(natsio.Context(ctx))
+	})
+}
+
+// Reject как Nack только для одного сообщения
+func (c *natsConsumer) Reject(ctx context.Context, id uint64, requeue bool) error {
+	return c.Nack(ctx, id, false, requeue)
+}
+
+// Settle применяет к сообщению итог outcome. Повтор это отложенная повторная доставка того же сообщения,
+// после исчерпания повторов сообщение перекладывается в parking очередь. Возвращает применённый итог
+func (c *natsConsumer) Settle(ctx context.Context, msg mq.Message, outcome mq.Outcome) (mq.Outcome, error) {
+	if err := c.check(ctx); err != nil {
+		return 0, err
+	}
+	if outcome == mq.OutcomeRetry && msg.RetryCount() >= c.retry.MaxRetries {
+		outcome = mq.OutcomeDeadLetter
+	}
+	if outcome == mq.OutcomeDeadLetter && !c.retry.DeadLetter {
+		outcome = mq.OutcomeDrop
+	}
+
+	switch outcome {
+	case mq.OutcomeRetry:
+		delay := c.retry.Delay(msg.RetryCount())
+		err := c.settle(ctx, msg.ID, false, func(m *natsio.Msg) error {
+			return m.NakWithDelay(delay, natsio.Context(ctx))
+		})
+		if err != nil {
+			return 0, err
+		}
+	case mq.OutcomeDeadLetter:
+		if err := c.park(ctx, msg); err != nil {
+			return 0, err
+		}
+		if err := c.Ack(ctx, msg.ID, false); err != nil {
+			return 0, err
+		}
+	case mq.OutcomeDrop:
+		if err := c.Reject(ctx, msg.ID, false); err != nil {
+			return 0, err
+		}
+	default:
+		return 0, fmt.Errorf("unknown outcome %v", outcome)
+	}
+	return outcome, nil
+}
+
+// park перекладывает сообщение в parking очередь, стрим которой создаётся при первой необходимости
+func (c *natsConsumer) park(ctx context.Context, msg mq.Message) error {
+	parking := parkingQueue(msg.Queue)
+	if err := c.ensureStream(ctx, parking, natsio.FileStorage); err != nil {
+		return err
+	}
+	// идентификатор не переносим, иначе дедупликация может отбросить сообщение
+	msg.MessageID = ""
+	if _, err := c.js.PublishMsg(natsMsg(parking, msg), natsio.Context(ctx)); err != nil {
+		return fmt.Errorf("failed to dead-letter message with id %d due %v", msg.ID, err)
+	}
+	return nil
+}
+
+// Close останавливает доставку, неподтверждённые сообщения сервер доставит заново после AckWait
+func (c *natsConsumer) Close() error {
+	if err := c.close(); err != nil {
+		return err
+	}
+	close(c.done)
+	return nil
+}
+
+// sortedIDs идентификаторы неподтверждённых сообщений по возрастанию
+func sortedIDs(unacked map[uint64]*natsio.Msg) []uint64 {
+	ids := make([]uint64, 0, len(unacked))
+	for id := range unacked {
+		ids = append(ids, id)
+	}
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+	return ids
+}
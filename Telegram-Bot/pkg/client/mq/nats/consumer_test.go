@@ -0,0 +1,269 @@
+package nats
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/Maksat-luci/Telegram-Bot/pkg/client/mq"
+)
+
+// receiveTimeout сколько тест ждёт доставки сообщения
+const receiveTimeout = 5 * time.Second
+
+// runServer запускает встроенный сервер NATS с JetStream, сервер останавливается вместе с тестом
+func runServer(t *testing.T) Config {
+	t.Helper()
+	s := startServer(t, -1)
+	return Config{URL: s.ClientURL(), ReconnectWait: 10 * time.Millisecond}
+}
+
+// newPair подключает продьюсера и консьюмера к серверу
+func newPair(t *testing.T, cfg ConsumerConfig) (mq.Producer, *natsConsumer) {
+	t.Helper()
+	cfg.Config = runServer(t)
+	producer, err := NewNATSProducer(ProducerConfig{Config: cfg.Config, AppID: "test", ContentType: "text/plain"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	consumer, err := NewNATSConsumer(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		_ = consumer.Close()
+		_ = producer.Close()
+	})
+	return producer, consumer.(*natsConsumer)
+}
+
+// receive ждёт следующее сообщение из канала консьюмера
+func receive(t *testing.T, messages <-chan mq.Message) mq.Message {
+	t.Helper()
+	select {
+	case msg, ok := <-messages:
+		if !ok {
+			t.Fatal("messages channel closed")
+		}
+		return msg
+	case <-time.After(receiveTimeout):
+		t.Fatal("timed out waiting for message")
+	}
+	return mq.Message{}
+}
+
+// pending сколько сообщений лежит в стриме очереди
+func pending(t *testing.T, c *natsConsumer, queue string) uint64 {
+	t.Helper()
+	info, err := c.js.StreamInfo(streamName(queue))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return info.State.Msgs
+}
+
+func TestPublishConsume(t *testing.T) {
+	ctx := context.Background()
+	producer, consumer := newPair(t, ConsumerConfig{PrefetchCount: 10})
+
+	if err := consumer.DeclareQueue(ctx, "tracks", true, false, false, nil); err != nil {
+		t.Fatal(err)
+	}
+	messages, err := consumer.Consume(ctx, "tracks")
+	if err != nil {
+		t.Fatal(err)
+	}
+	sent := mq.Message{
+		Body:          []byte("track"),
+		MessageID:     "message-1",
+		CorrelationID: "request-1",
+		ReplyTo:       "replies",
+		Timestamp:     time.Date(2022, 7, 1, 12, 0, 0, 0, time.UTC),
+		Headers:       map[string]interface{}{"x-source": "test", "x-attempt": 2},
+	}
+	if err := producer.PublishMessage(ctx, "tracks", sent); err != nil {
+		t.Fatal(err)
+	}
+
+	msg := receive(t, messages)
+	if string(msg.Body) != "track" || msg.MessageID != sent.MessageID || msg.CorrelationID != sent.CorrelationID || msg.ReplyTo != sent.ReplyTo {
+		t.Fatalf("unexpected message %+v", msg)
+	}
+	if !msg.Timestamp.Equal(sent.Timestamp) {
+		t.Fatalf("got timestamp %s, want %s", msg.Timestamp, sent.Timestamp)
+	}
+	if msg.AppID != "test" || msg.ContentType != "text/plain" {
+		t.Fatalf("producer defaults not applied: app id %q, content type %q", msg.AppID, msg.ContentType)
+	}
+	// заголовки в NATS только строки
+	if msg.Headers["x-source"] != "test" || msg.Headers["x-attempt"] != "2" {
+		t.Fatalf("unexpected headers %v", msg.Headers)
+	}
+	if msg.Queue != "tracks" || msg.Redelivered {
+		t.Fatalf("unexpected delivery metadata %+v", msg)
+	}
+
+	if err := consumer.Ack(ctx, msg.ID, false); err != nil {
+		t.Fatal(err)
+	}
+	if err := consumer.Ack(ctx, msg.ID, false); err == nil {
+		t.Fatal("second ack of the same message succeeded")
+	}
+	// у очереди work queue подтверждённое сообщение удаляется из стрима
+	deadline := time.Now().Add(receiveTimeout)
+	for pending(t, consumer, "tracks") != 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("acked message is still in the stream")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestNackRedelivers(t *testing.T) {
+	ctx := context.Background()
+	producer, consumer := newPair(t, ConsumerConfig{PrefetchCount: 1})
+
+	messages, err := consumer.Consume(ctx, "tracks")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := producer.Publish(ctx, "tracks", []byte("track")); err != nil {
+		t.Fatal(err)
+	}
+	msg := receive(t, messages)
+	if err := consumer.Nack(ctx, msg.ID, false, true); err != nil {
+		t.Fatal(err)
+	}
+
+	redelivered := receive(t, messages)
+	if !redelivered.Redelivered || redelivered.RetryCount() != 1 {
+		t.Fatalf("got redelivered %v retry count %d, want redelivered with retry count 1", redelivered.Redelivered, redelivered.RetryCount())
+	}
+	if redelivered.ID == msg.ID {
+		t.Fatalf("redelivery reused id %d", msg.ID)
+	}
+	if err := consumer.Ack(ctx, redelivered.ID, false); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestSettle(t *testing.T) {
+	ctx := context.Background()
+	retry := mq.RetryPolicy{MaxRetries: 1, InitialDelay: 50 * time.Millisecond, Multiplier: 2, DeadLetter: true}
+	producer, consumer := newPair(t, ConsumerConfig{PrefetchCount: 1, Retry: retry})
+
+	messages, err := consumer.Consume(ctx, "tracks")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := producer.Publish(ctx, "tracks", []byte("track")); err != nil {
+		t.Fatal(err)
+	}
+
+	msg := receive(t, messages)
+	outcome, err := consumer.Settle(ctx, msg, mq.OutcomeRetry)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if outcome != mq.OutcomeRetry {
+		t.Fatalf("got outcome %v, want %v", outcome, mq.OutcomeRetry)
+	}
+
+	retried := receive(t, messages)
+	if retried.RetryCount() != 1 {
+		t.Fatalf("got retry count %d, want 1", retried.RetryCount())
+	}
+	outcome, err = consumer.Settle(ctx, retried, mq.OutcomeRetry)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if outcome != mq.OutcomeDeadLetter {
+		t.Fatalf("got outcome %v, want %v", outcome, mq.OutcomeDeadLetter)
+	}
+	if n := pending(t, consumer, parkingQueue("tracks")); n != 1 {
+		t.Fatalf("parking queue has %d messages, want 1", n)
+	}
+}
+
+func TestBindQueue(t *testing.T) {
+	ctx := context.Background()
+	producer, consumer := newPair(t, ConsumerConfig{PrefetchCount: 1})
+
+	if err := consumer.DeclareExchange(ctx, "events", mq.ExchangeTopic, true, false, nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := consumer.DeclareExchange(ctx, "events", mq.ExchangeHeaders, true, false, nil); !errors.Is(err, errUnsupportedExchange) {
+		t.Fatalf("declare headers exchange: got %v, want %v", err, errUnsupportedExchange)
+	}
+	if err := consumer.DeclareQueue(ctx, "tracks", true, false, false, nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := consumer.BindQueue(ctx, "tracks", "events", "track.#", nil); err != nil {
+		t.Fatal(err)
+	}
+	messages, err := consumer.Consume(ctx, "tracks")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := producer.PublishExchange(ctx, "events", "track.found", mq.Message{Body: []byte("found")}); err != nil {
+		t.Fatal(err)
+	}
+	msg := receive(t, messages)
+	if string(msg.Body) != "found" || msg.RoutingKey != "events.track.found" {
+		t.Fatalf("got %q with subject %q", msg.Body, msg.RoutingKey)
+	}
+}
+
+func TestCloseDeletesTempStreams(t *testing.T) {
+	ctx := context.Background()
+	cfg := runServer(t)
+	consumer, err := NewNATSConsumer(ConsumerConfig{Config: cfg})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := consumer.DeclareQueue(ctx, "replies", false, true, false, nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := consumer.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := consumer.Close(); !errors.Is(err, errClosed) {
+		t.Fatalf("second close: got %v, want %v", err, errClosed)
+	}
+
+	other, err := NewNATSConsumer(ConsumerConfig{Config: cfg})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer other.Close()
+	if _, err := other.(*natsConsumer).js.StreamInfo(streamName("replies")); err == nil {
+		t.Fatal("stream of auto-delete queue survived close")
+	}
+}
+
+func TestBindingSubjects(t *testing.T) {
+	tests := []struct {
+		key  string
+		want []string
+	}{
+		{key: "", want: []string{"events", "events.>"}},
+		{key: "#", want: []string{"events", "events.>"}},
+		{key: "track.#", want: []string{"events.track.>"}},
+		{key: "track.*", want: []string{"events.track.*"}},
+	}
+	for _, tt := range tests {
+		got := bindingSubjects("events", tt.key)
+		if len(got) != len(tt.want) {
+			t.Fatalf("key %q: got %v, want %v", tt.key, got, tt.want)
+		}
+		for i := range got {
+			if got[i] != tt.want[i] {
+				t.Fatalf("key %q: got %v, want %v", tt.key, got, tt.want)
+			}
+		}
+	}
+	if got := streamName("mq.delay/a.b"); got != "mq_delay_a_b" {
+		t.Fatalf("got stream name %q", got)
+	}
+}
@@ -0,0 +1,78 @@
+package nats
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/Maksat-luci/Telegram-Bot/pkg/client/mq"
+	natsio "github.com/nats-io/nats.go"
+)
+
+// заголовки в которых передаются метаданные сообщения, MessageID идёт в Nats-Msg-Id
+// и заодно включает дедупликацию JetStream
+const (
+	headerCorrelationID = "Correlation-Id"
+	headerReplyTo       = "Reply-To"
+	headerContentType   = "Content-Type"
+	headerAppID         = "App-Id"
+	headerTimestamp     = "Timestamp"
+)
+
+// natsMsg переводит сообщение в сообщение NATS. Пользовательские заголовки в NATS
+// бывают только строками, поэтому значения переводятся в строку
+func natsMsg(subj string, msg mq.Message) *natsio.Msg {
+	m := natsio.NewMsg(subj)
+	m.Data = msg.Body
+
+	for k, v := range msg.Headers {
+		m.Header.Set(k, fmt.Sprint(v))
+	}
+	set := func(key, value string) {
+		if value != "" {
+			m.Header.Set(key, value)
+		}
+	}
+	set(natsio.MsgIdHdr, msg.MessageID)
+	set(headerCorrelationID, msg.CorrelationID)
+	set(headerReplyTo, msg.ReplyTo)
+	set(headerContentType, msg.ContentType)
+	set(headerAppID, msg.AppID)
+	if !msg.Timestamp.IsZero() {
+		m.Header.Set(headerTimestamp, msg.Timestamp.UTC().Format(time.RFC3339Nano))
+	}
+	return m
+}
+
+// message переводит сообщение JetStream в сообщение консьюмера с идентификатором id.
+// Число повторов берётся из счётчика доставок JetStream
+func message(m *natsio.Msg, id uint64, queue string) mq.Message {
+	msg := mq.Message{
+		ID:            id,
+		Body:          m.Data,
+		MessageID:     m.Header.Get(natsio.MsgIdHdr),
+		CorrelationID: m.Header.Get(headerCorrelationID),
+		ReplyTo:       m.Header.Get(headerReplyTo),
+		ContentType:   m.Header.Get(headerContentType),
+		AppID:         m.Header.Get(headerAppID),
+		Queue:         queue,
+		RoutingKey:    m.Subject,
+		Headers:       make(map[string]interface{}),
+	}
+	if ts, err := time.Parse(time.RFC3339Nano, m.Header.Get(headerTimestamp)); err == nil {
+		msg.Timestamp = ts
+	}
+
+	for k := range m.Header {
+		switch k {
+		case natsio.MsgIdHdr, headerCorrelationID, headerReplyTo, headerContentType, headerAppID, headerTimestamp:
+			continue
+		}
+		msg.Headers[k] = m.Header.Get(k)
+	}
+
+	if meta, err := m.Metadata(); err == nil && meta.NumDelivered > 1 {
+		msg.Redelivered = true
+		msg.Headers[mq.HeaderRetryCount] = int(meta.NumDelivered - 1)
+	}
+	return msg
+}
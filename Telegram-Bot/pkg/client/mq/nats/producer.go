@@ -0,0 +1,117 @@
+package nats
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/Maksat-luci/Telegram-Bot/pkg/client/mq"
+	natsio "github.com/nats-io/nats.go"
+)
+
+// ProducerConfig настройки продьюсера NATS
+type ProducerConfig struct {
+	Config
+	// AppID и ContentType проставляются сообщениям у которых они не заданы
+	AppID       string
+	ContentType string
+}
+
+// natsProducer продьюсер который публикует в JetStream и ждёт подтверждения от сервера
+type natsProducer struct {
+	*natsBase
+	appID       string
+	contentType string
+	// done останавливает планировщик отложенных сообщений
+	done chan struct{}
+}
+
+// NewNATSProducer конструктор который подключается к NATS, запускает планировщик отложенных сообщений
+// и возвращает продьюсера
+func NewNATSProducer(cfg ProducerConfig) (mq.Producer, error) {
+	base, err := connect(cfg.Config)
+	if err != nil {
+		return nil, err
+	}
+	p := &natsProducer{
+		natsBase:    base,
+		appID:       cfg.AppID,
+		contentType: cfg.ContentType,
+		done:        make(chan struct{}),
+	}
+	go p.schedule()
+	return p, nil
+}
+
+// Publish отправляет сообщение в очередь
+func (p *natsProducer) Publish(ctx context.Context, target string, body []byte) error {
+	return p.PublishMessage(ctx, target, mq.Message{Body: body})
+}
+
+// PublishMessage отправляет сообщение в очередь, subject очереди совпадает с её именем
+func (p *natsProducer) PublishMessage(ctx context.Context, target string, msg mq.Message) error {
+	return p.PublishExchange(ctx, "", target, msg)
+}
+
+// PublishExchange публикует сообщение в subject exchange.key и ждёт подтверждения стрима
+func (p *natsProducer) PublishExchange(ctx context.Context, exchange, key string, msg mq.Message) error {
+	if err := p.check(ctx); err != nil {
+		return err
+	}
+	m := natsMsg(subject(exchange, key), msg.WithDefaults(p.appID, p.contentType))
+	if _, err := p.js.PublishMsg(m, natsio.Context(ctx)); err != nil {
+		return fmt.Errorf("failed to publish message to %s due %v", m.Subject, err)
+	}
+	return nil
+}
+
+// PublishAsync публикует не дожидаясь подтверждения, результат приходит в канал
+func (p *natsProducer) PublishAsync(ctx context.Context, exchange, key string, msg mq.Message) <-chan error {
+	result := make(chan error, 1)
+	if err := p.check(ctx); err != nil {
+		result <- err
+		return result
+	}
+
+	m := natsMsg(subject(exchange, key), msg.WithDefaults(p.appID, p.contentType))
+	future, err := p.js.PublishMsgAsync(m)
+	if err != nil {
+		result <- fmt.Errorf("failed to publish message to %s due %v", m.Subject, err)
+		return result
+	}
+	go func() {
+		select {
+		case <-future.Ok():
+			result <- nil
+		case err := <-future.Err():
+			result <- fmt.Errorf("failed to publish message to %s due %v", m.Subject, err)
+		case <-ctx.Done():
+			result <- ctx.Err()
+		}
+	}()
+	return result
+}
+
+// PublishBatch отправляет все сообщения подряд и только потом ждёт их подтверждения
+func (p *natsProducer) PublishBatch(ctx context.Context, exchange, key string, msgs []mq.Message) error {
+	results := make([]<-chan error, 0, len(msgs))
+	for _, msg := range msgs {
+		results = append(results, p.PublishAsync(ctx, exchange, key, msg))
+	}
+
+	var first error
+	for i, result := range results {
+		if err := <-result; err != nil && first == nil {
+			first = fmt.Errorf("message %d of batch: %w", i, err)
+		}
+	}
+	return first
+}
+
+// Close останавливает планировщик и закрывает подключение продьюсера
+func (p *natsProducer) Close() error {
+	if err := p.close(); err != nil {
+		return err
+	}
+	close(p.done)
+	return nil
+}
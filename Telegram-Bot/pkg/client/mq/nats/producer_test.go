@@ -0,0 +1,76 @@
+package nats
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/Maksat-luci/Telegram-Bot/pkg/client/mq"
+)
+
+func TestPublishBatch(t *testing.T) {
+	ctx := context.Background()
+	producer, consumer := newPair(t, ConsumerConfig{PrefetchCount: 10})
+
+	if err := consumer.DeclareQueue(ctx, "tracks", true, false, false, nil); err != nil {
+		t.Fatal(err)
+	}
+	msgs := make([]mq.Message, 20)
+	for i := range msgs {
+		msgs[i] = mq.Message{Body: []byte(fmt.Sprintf("track %d", i))}
+	}
+	if err := producer.(mq.BatchProducer).PublishBatch(ctx, "", "tracks", msgs); err != nil {
+		t.Fatal(err)
+	}
+	if n := pending(t, consumer, "tracks"); n != uint64(len(msgs)) {
+		t.Fatalf("stream has %d messages, want %d", n, len(msgs))
+	}
+}
+
+func TestPublishDeduplicates(t *testing.T) {
+	ctx := context.Background()
+	producer, consumer := newPair(t, ConsumerConfig{})
+
+	if err := consumer.DeclareQueue(ctx, "tracks", true, false, false, nil); err != nil {
+		t.Fatal(err)
+	}
+	// тот же MessageID в пределах окна дедупликации стрима сохраняется один раз
+	for i := 0; i < 2; i++ {
+		if err := producer.PublishMessage(ctx, "tracks", mq.Message{MessageID: "same", Body: []byte("track")}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if n := pending(t, consumer, "tracks"); n != 1 {
+		t.Fatalf("stream has %d messages, want 1", n)
+	}
+}
+
+func TestPublishAfter(t *testing.T) {
+	ctx := context.Background()
+	producer, consumer := newPair(t, ConsumerConfig{PrefetchCount: 1})
+
+	messages, err := consumer.Consume(ctx, "tracks")
+	if err != nil {
+		t.Fatal(err)
+	}
+	start := time.Now()
+	err = producer.(mq.ScheduledProducer).PublishAfter(ctx, "", "tracks", mq.Message{Body: []byte("later")}, 300*time.Millisecond)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	msg := receive(t, messages)
+	if elapsed := time.Since(start); elapsed < 300*time.Millisecond {
+		t.Fatalf("message delivered after %s, want at least 300ms", elapsed)
+	}
+	if string(msg.Body) != "later" {
+		t.Fatalf("got %q, want later", msg.Body)
+	}
+	// служебные заголовки планировщика не доходят до консьюмера
+	for _, header := range []string{headerDeliverAt, headerExchange, headerRoutingKey} {
+		if _, ok := msg.Headers[header]; ok {
+			t.Fatalf("scheduler header %s leaked to consumer", header)
+		}
+	}
+}
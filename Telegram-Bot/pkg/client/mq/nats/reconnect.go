@@ -0,0 +1,58 @@
+package nats
+
+import (
+	"context"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/Maksat-luci/Telegram-Bot/pkg/client/mq"
+)
+
+// replayTimeout сколько ждать повторное объявление топологии после переподключения
+const replayTimeout = 30 * time.Second
+
+// topology реестр объявленных стримов и привязок. Сервер мог потерять их за время разрыва,
+// например стримы в памяти после рестарта, поэтому после переподключения всё объявляется заново
+type topology struct {
+	lock  sync.Mutex
+	keys  []string
+	items map[string]func(ctx context.Context) error
+}
+
+func newTopology() *topology {
+	return &topology{items: make(map[string]func(ctx context.Context) error)}
+}
+
+// add запоминает объявление, повторное объявление с тем же ключом заменяет прежнее
+func (t *topology) add(key string, declare func(ctx context.Context) error) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	if _, ok := t.items[key]; !ok {
+		t.keys = append(t.keys, key)
+	}
+	t.items[key] = declare
+}
+
+// replay объявляет всю топологию в том же порядке
+func (t *topology) replay(ctx context.Context) error {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	for _, key := range t.keys {
+		if err := t.items[key](ctx); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// reconnected объявляет топологию заново и сообщает подписчикам о подключении. Ошибка объявления
+// только пишется в лог: подключение уже есть, а следующий разрыв повторит попытку
+func (b *natsBase) reconnected() {
+	ctx, cancel := context.WithTimeout(context.Background(), replayTimeout)
+	defer cancel()
+	if err := b.topology.replay(ctx); err != nil {
+		log.Printf("failed to redeclare topology after reconnect due %v", err)
+	}
+	b.emit(mq.StateConnected, nil)
+}
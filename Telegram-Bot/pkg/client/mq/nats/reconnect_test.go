@@ -0,0 +1,86 @@
+package nats
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/Maksat-luci/Telegram-Bot/pkg/client/mq"
+	"github.com/nats-io/nats-server/v2/server"
+)
+
+// startServer запускает встроенный сервер на порту port, -1 значит любой свободный
+func startServer(t *testing.T, port int) *server.Server {
+	t.Helper()
+	s, err := server.NewServer(&server.Options{
+		Host:      "127.0.0.1",
+		Port:      port,
+		JetStream: true,
+		StoreDir:  t.TempDir(),
+		NoLog:     true,
+		NoSigs:    true,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	go s.Start()
+	if !s.ReadyForConnections(5 * time.Second) {
+		t.Fatal("NATS server is not ready")
+	}
+	t.Cleanup(s.Shutdown)
+	return s
+}
+
+// waitState ждёт событие state и возвращает его
+func waitState(t *testing.T, states <-chan mq.StateEvent, state mq.ConnectionState) mq.StateEvent {
+	t.Helper()
+	timeout := time.After(5 * time.Second)
+	for {
+		select {
+		case event := <-states:
+			if event.State == state {
+				return event
+			}
+		case <-timeout:
+			t.Fatalf("timed out waiting for state %v", state)
+		}
+	}
+}
+
+// Сервер перезапускается с пустым хранилищем, стримы и привязки пропадают. Клиент после
+// переподключения объявляет их заново до того как сообщить о подключении
+func TestReconnectReplaysTopology(t *testing.T) {
+	ctx := context.Background()
+	s := startServer(t, -1)
+	port := s.Addr().(*net.TCPAddr).Port
+	cfg := Config{URL: s.ClientURL(), ReconnectWait: 10 * time.Millisecond}
+	consumer, err := NewNATSConsumer(ConsumerConfig{Config: cfg})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer consumer.Close()
+	c := consumer.(*natsConsumer)
+	states := make(chan mq.StateEvent, 16)
+	c.NotifyState(states)
+
+	if err := c.DeclareQueue(ctx, "tracks", false, false, false, nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.BindQueue(ctx, "tracks", "events", "track.#", nil); err != nil {
+		t.Fatal(err)
+	}
+
+	s.Shutdown()
+	waitState(t, states, mq.StateDisconnected)
+	startServer(t, port)
+	waitState(t, states, mq.StateConnected)
+
+	info, err := c.js.StreamInfo(streamName("tracks"))
+	if err != nil {
+		t.Fatalf("stream was not redeclared: %v", err)
+	}
+	if !contains(info.Config.Subjects, "events.track.>") {
+		t.Fatalf("binding was not redeclared, subjects %v", info.Config.Subjects)
+	}
+}
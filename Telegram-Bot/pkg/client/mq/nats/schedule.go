@@ -0,0 +1,166 @@
+package nats
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/Maksat-luci/Telegram-Bot/pkg/client/mq"
+	natsio "github.com/nats-io/nats.go"
+)
+
+// отложенные сообщения лежат в отдельном стриме до своего времени, планировщик
+// каждого продьюсера забирает созревшие и публикует их туда куда их отправили
+const (
+	scheduleQueue    = "mq.scheduled"
+	scheduleConsumer = "scheduler"
+
+	// заголовки отложенного сообщения: когда и куда его опубликовать
+	headerDeliverAt  = "Mq-Deliver-At"
+	headerExchange   = "Mq-Exchange"
+	headerRoutingKey = "Mq-Routing-Key"
+)
+
+// PublishAfter публикует сообщение через delay
+func (p *natsProducer) PublishAfter(ctx context.Context, exchange, key string, msg mq.Message, delay time.Duration) error {
+	return p.PublishAt(ctx, exchange, key, msg, time.Now().Add(delay))
+}
+
+// PublishAt кладёт сообщение в стрим отложенных сообщений, в exchange оно попадёт не раньше at
+func (p *natsProducer) PublishAt(ctx context.Context, exchange, key string, msg mq.Message, at time.Time) error {
+	if !at.After(time.Now()) {
+		return p.PublishExchange(ctx, exchange, key, msg)
+	}
+	if err := p.check(ctx); err != nil {
+		return err
+	}
+	if err := p.ensureStream(ctx, scheduleQueue, natsio.FileStorage); err != nil {
+		return err
+	}
+
+	// MessageID сохраняется, повторная публикация того же сообщения отбрасывается дедупликацией стрима
+	m := natsMsg(scheduleQueue, msg.WithDefaults(p.appID, p.contentType))
+	m.Header.Set(headerDeliverAt, at.UTC().Format(time.RFC3339Nano))
+	m.Header.Set(headerExchange, exchange)
+	m.Header.Set(headerRoutingKey, key)
+	if _, err := p.js.PublishMsg(m, natsio.Context(ctx)); err != nil {
+		return fmt.Errorf("failed to schedule message to %s due %v", subject(exchange, key), err)
+	}
+	return nil
+}
+
+// schedule забирает созревшие отложенные сообщения пока продьюсер не закрыт. Все инстансы делят
+// один durable консьюмер, поэтому сообщение публикуется одним из них
+func (p *natsProducer) schedule() {
+	var sub *natsio.Subscription
+	for sub == nil {
+		var err error
+		if sub, err = p.subscribeSchedule(); err != nil {
+			log.Printf("failed to start scheduler due %v", err)
+			select {
+			case <-time.After(fetchDelay):
+				continue
+			case <-p.done:
+				return
+			}
+		}
+	}
+	defer func() {
+		if err := sub.Unsubscribe(); err != nil && !errors.Is(err, natsio.ErrConnectionClosed) {
+			log.Printf("failed to unsubscribe scheduler due %v", err)
+		}
+	}()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		<-p.done
+		cancel()
+	}()
+
+	for {
+		fetchCtx, cancelFetch := context.WithTimeout(ctx, fetchWait)
+		msgs, err := sub.Fetch(scheduleBatch, natsio.Context(fetchCtx))
+		cancelFetch()
+		switch {
+		case err == nil:
+		case ctx.Err() != nil, errors.Is(err, natsio.ErrConnectionClosed), errors.Is(err, natsio.ErrBadSubscription):
+			return
+		case errors.Is(err, natsio.ErrTimeout), errors.Is(err, context.DeadlineExceeded):
+			continue
+		default:
+			log.Printf("failed to fetch scheduled messages due %v", err)
+			select {
+			case <-time.After(fetchDelay):
+				continue
+			case <-ctx.Done():
+				return
+			}
+		}
+		for _, m := range msgs {
+			p.release(ctx, m)
+		}
+	}
+}
+
+// scheduleBatch сколько отложенных сообщений планировщик забирает за раз
+const scheduleBatch = 100
+
+// subscribeSchedule создаёт стрим и durable консьюмер отложенных сообщений и подписывается на него
+func (p *natsProducer) subscribeSchedule() (*natsio.Subscription, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), fetchWait)
+	defer cancel()
+	if err := p.ensureStream(ctx, scheduleQueue, natsio.FileStorage); err != nil {
+		return nil, err
+	}
+	stream := streamName(scheduleQueue)
+	_, err := p.js.ConsumerInfo(stream, scheduleConsumer, natsio.Context(ctx))
+	if errors.Is(err, natsio.ErrConsumerNotFound) {
+		_, err = p.js.AddConsumer(stream, &natsio.ConsumerConfig{
+			Durable:   scheduleConsumer,
+			AckPolicy: natsio.AckExplicitPolicy,
+		}, natsio.Context(ctx))
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to declare scheduler consumer due %v", err)
+	}
+	sub, err := p.js.PullSubscribe(scheduleQueue, scheduleConsumer, natsio.Bind(stream, scheduleConsumer))
+	if err != nil {
+		return nil, fmt.Errorf("failed to subscribe scheduler due %v", err)
+	}
+	return sub, nil
+}
+
+// release публикует созревшее сообщение, а несозревшее возвращает в стрим до его времени
+func (p *natsProducer) release(ctx context.Context, m *natsio.Msg) {
+	at, err := time.Parse(time.RFC3339Nano, m.Header.Get(headerDeliverAt))
+	if err != nil {
+		log.Printf("drop scheduled message with invalid time %q", m.Header.Get(headerDeliverAt))
+		_ = m.Term()
+		return
+	}
+	if wait := time.Until(at); wait > 0 {
+		if err := m.NakWithDelay(wait); err != nil {
+			log.Printf("failed to reschedule message due %v", err)
+		}
+		return
+	}
+
+	exchange, key := m.Header.Get(headerExchange), m.Header.Get(headerRoutingKey)
+	msg := message(m, 0, "")
+	msg.Redelivered = false
+	msg.RoutingKey = ""
+	for _, header := range []string{headerDeliverAt, headerExchange, headerRoutingKey, mq.HeaderRetryCount} {
+		delete(msg.Headers, header)
+	}
+	if err := p.PublishExchange(ctx, exchange, key, msg); err != nil {
+		log.Printf("failed to publish scheduled message to %s due %v", subject(exchange, key), err)
+		_ = m.NakWithDelay(fetchDelay)
+		return
+	}
+	if err := m.Ack(); err != nil {
+		log.Printf("failed to ack scheduled message due %v", err)
+	}
+}
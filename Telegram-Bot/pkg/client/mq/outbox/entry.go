@@ -0,0 +1,48 @@
+package outbox
+
+import (
+	"bytes"
+	"math"
+
+	"github.com/vmihailenco/msgpack/v5"
+)
+
+// encode кодирует запись в MessagePack, он в отличие от JSON сохраняет целые числа в заголовках целыми
+func encode(entry Entry) ([]byte, error) {
+	return msgpack.Marshal(entry)
+}
+
+// decode раскодирует запись. MessagePack пишет неотрицательные числа беззнаковыми и при чтении они приходят
+// как uint64, который amqp не принимает в заголовках. Поэтому все целые в заголовках, в том числе во вложенных
+// таблицах и списках, приводятся к int64 как и у сообщений из брокера
+func decode(data []byte) (Entry, error) {
+	var entry Entry
+	dec := msgpack.NewDecoder(bytes.NewReader(data))
+	dec.UseLooseInterfaceDecoding(true)
+	if err := dec.Decode(&entry); err != nil {
+		return entry, err
+	}
+	for k, h := range entry.Message.Headers {
+		entry.Message.Headers[k] = normalizeInts(h)
+	}
+	return entry, nil
+}
+
+// normalizeInts приводит uint64 к int64, числа больше math.MaxInt64 остаются как есть
+func normalizeInts(v interface{}) interface{} {
+	switch v := v.(type) {
+	case uint64:
+		if v <= math.MaxInt64 {
+			return int64(v)
+		}
+	case map[string]interface{}:
+		for k, item := range v {
+			v[k] = normalizeInts(item)
+		}
+	case []interface{}:
+		for i, item := range v {
+			v[i] = normalizeInts(item)
+		}
+	}
+	return v
+}
@@ -0,0 +1,106 @@
+package outbox
+
+import (
+	"math"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/Maksat-luci/Telegram-Bot/pkg/client/mq"
+)
+
+func TestEntryRoundTrip(t *testing.T) {
+	at := time.Date(2022, 7, 1, 12, 0, 0, 0, time.UTC)
+	entry := Entry{
+		Seq:      42,
+		Exchange: "events",
+		Key:      "track.found",
+		Message: mq.Message{
+			Body:      []byte("track"),
+			MessageID: "message-1",
+			Timestamp: at,
+			Headers: map[string]interface{}{
+				"small":    1,
+				"int":      200,
+				"int8":     int8(-3),
+				"int16":    int16(1000),
+				"int32":    int32(70000),
+				"int64":    int64(1 << 40),
+				"uint8":    uint8(255),
+				"uint16":   uint16(65535),
+				"uint32":   uint32(1 << 31),
+				"negative": -100000,
+				"huge":     uint64(math.MaxUint64),
+				"float":    1.5,
+				"bool":     true,
+				"string":   "value",
+				"table":    map[string]interface{}{"attempt": 300, "nested": []interface{}{uint16(5), "x"}},
+				"list":     []interface{}{1, 70000, "y"},
+			},
+		},
+		EnqueuedAt: at,
+		At:         at.Add(time.Minute),
+		Attempts:   2,
+		LastError:  "broker is not available",
+	}
+
+	data, err := encode(entry)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := decode(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := map[string]interface{}{
+		"small":    int64(1),
+		"int":      int64(200),
+		"int8":     int64(-3),
+		"int16":    int64(1000),
+		"int32":    int64(70000),
+		"int64":    int64(1 << 40),
+		"uint8":    int64(255),
+		"uint16":   int64(65535),
+		"uint32":   int64(1 << 31),
+		"negative": int64(-100000),
+		"huge":     uint64(math.MaxUint64),
+		"float":    1.5,
+		"bool":     true,
+		"string":   "value",
+		"table":    map[string]interface{}{"attempt": int64(300), "nested": []interface{}{int64(5), "x"}},
+		"list":     []interface{}{int64(1), int64(70000), "y"},
+	}
+	for k, v := range want {
+		if !reflect.DeepEqual(got.Message.Headers[k], v) {
+			t.Errorf("header %s: got %#v, want %#v", k, got.Message.Headers[k], v)
+		}
+	}
+	if got.Message.RetryCount() != 0 {
+		t.Errorf("got retry count %d, want 0", got.Message.RetryCount())
+	}
+
+	got.Message.Headers, entry.Message.Headers = nil, nil
+	if !got.EnqueuedAt.Equal(entry.EnqueuedAt) || !got.At.Equal(entry.At) || !got.Message.Timestamp.Equal(entry.Message.Timestamp) {
+		t.Fatalf("times changed: got %+v", got)
+	}
+	got.EnqueuedAt, got.At, got.Message.Timestamp = entry.EnqueuedAt, entry.At, entry.Message.Timestamp
+	if !reflect.DeepEqual(got, entry) {
+		t.Fatalf("got %+v, want %+v", got, entry)
+	}
+}
+
+func TestDecodeRetryCount(t *testing.T) {
+	entry := Entry{Message: mq.Message{Headers: map[string]interface{}{mq.HeaderRetryCount: 3}}}
+	data, err := encode(entry)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := decode(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.Message.RetryCount() != 3 {
+		t.Fatalf("got retry count %d, want 3", got.Message.RetryCount())
+	}
+}
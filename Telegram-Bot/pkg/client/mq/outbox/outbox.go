@@ -0,0 +1,560 @@
+// Package outbox локальный outbox для исходящих сообщений. Публикация сначала записывает сообщение
+// в файл встроенной базы, а relay доставляет его брокеру когда тот доступен. Сообщения уходят строго
+// в порядке записи: пока первое не опубликовано, следующие ждут. Запись которую подключённый брокер
+// раз за разом не принимает откладывается в parked, чтобы не задерживать остальные
+package outbox
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/Maksat-luci/Telegram-Bot/pkg/client/mq"
+	bolt "go.etcd.io/bbolt"
+)
+
+// Config настройки outbox
+type Config struct {
+	// Path файл базы, каталог создаётся если его нет
+	Path string
+	// BatchSize сколько записей relay читает из базы за раз
+	BatchSize int
+	// RetryInterval пауза перед повторной попыткой после ошибки публикации
+	RetryInterval time.Duration
+	// PublishTimeout сколько ждать одну публикацию
+	PublishTimeout time.Duration
+	// MaxAttempts сколько раз подключённый брокер может не принять запись, после этого она откладывается
+	// в parked и relay переходит к следующей. Ошибки пока продьюсер не подключён не считаются, так
+	// недоступность брокера не разбирает очередь. 0 без ограничения
+	MaxAttempts int
+}
+
+// значения по умолчанию
+const (
+	defaultBatchSize      = 100
+	defaultRetryInterval  = time.Second
+	defaultPublishTimeout = 10 * time.Second
+	// openTimeout сколько ждать блокировку файла, его может держать другой процесс
+	openTimeout = 5 * time.Second
+)
+
+// бакеты базы, ключ это номер записи
+var (
+	// bucketMessages ожидающие записи
+	bucketMessages = []byte("messages")
+	// bucketParked записи которые брокер так и не принял
+	bucketParked = []byte("parked")
+)
+
+// ошибки outbox
+var (
+	errClosed       = errors.New("outbox closed")
+	errUnknownSeq   = errors.New("unknown outbox entry")
+	errPublishing   = errors.New("outbox entry is being published")
+	errNotScheduled = errors.New("producer does not support scheduled publishing")
+)
+
+// Entry запись outbox
+type Entry struct {
+	// Seq номер записи, задаёт порядок доставки
+	Seq        uint64
+	Exchange   string
+	Key        string
+	Message    mq.Message
+	EnqueuedAt time.Time
+	// At время отложенной публикации, нулевое для обычной
+	At time.Time
+	// Attempts неудачные попытки публикации и последняя ошибка
+	Attempts  int
+	LastError string
+	// Rejected сколько из этих попыток не удалось при подключённом брокере
+	Rejected int
+}
+
+// Stats размер outbox и счётчики relay
+type Stats struct {
+	// Pending сколько записей ждёт доставки
+	Pending int
+	// Parked сколько записей отложено после MaxAttempts неудачных попыток
+	Parked int
+	// Oldest когда была записана самая старая ожидающая запись, нулевое если outbox пуст
+	Oldest time.Time
+	// Delivered и Failed сколько публикаций прошло и сколько завершилось ошибкой с момента запуска
+	Delivered uint64
+	Failed    uint64
+}
+
+// Outbox продьюсер который пишет сообщения в локальную базу, а доставляет их relay.
+// Отложенные сообщения relay передаёт брокеру сразу вместе с их временем, если продьюсер это умеет
+type Outbox interface {
+	mq.ScheduledProducer
+	// Pending возвращает до limit ожидающих записей в порядке доставки
+	Pending(limit int) ([]Entry, error)
+	// Parked возвращает до limit отложенных записей
+	Parked(limit int) ([]Entry, error)
+	// Remove удаляет ожидающую или отложенную запись, например сообщение которое брокер никогда не примет
+	Remove(seq uint64) error
+	Stats() Stats
+}
+
+// outbox хранит записи в bbolt и доставляет их через producer
+type outbox struct {
+	producer mq.Producer
+	db       *bolt.DB
+
+	batchSize      int
+	retryInterval  time.Duration
+	publishTimeout time.Duration
+	maxAttempts    int
+
+	lock      sync.Mutex
+	closed    bool
+	pending   int
+	parked    int
+	delivered uint64
+	failed    uint64
+	// connected подключён ли продьюсер, продьюсер без StateNotifier считается подключённым всегда
+	connected bool
+	// publishing номер записи которую relay сейчас публикует, её нельзя удалить
+	publishing uint64
+
+	wake    chan struct{}
+	done    chan struct{}
+	stopped chan struct{}
+}
+
+// NewOutbox открывает базу outbox и запускает relay, который доставляет записи через producer
+// пока не отменён ctx или не закрыт outbox. Записи оставшиеся с прошлого запуска доставляются первыми
+func NewOutbox(ctx context.Context, producer mq.Producer, cfg Config) (Outbox, error) {
+	if dir := filepath.Dir(cfg.Path); dir != "" {
+		if err := os.MkdirAll(dir, 0o755); err != nil {
+			return nil, fmt.Errorf("failed to create outbox directory due %v", err)
+		}
+	}
+	db, err := bolt.Open(cfg.Path, 0o600, &bolt.Options{Timeout: openTimeout})
+	if err != nil {
+		return nil, fmt.Errorf("failed to open outbox due %v", err)
+	}
+
+	o := &outbox{
+		producer:       producer,
+		db:             db,
+		batchSize:      cfg.BatchSize,
+		retryInterval:  cfg.RetryInterval,
+		publishTimeout: cfg.PublishTimeout,
+		maxAttempts:    cfg.MaxAttempts,
+		connected:      true,
+		wake:           make(chan struct{}, 1),
+		done:           make(chan struct{}),
+		stopped:        make(chan struct{}),
+	}
+	if o.batchSize <= 0 {
+		o.batchSize = defaultBatchSize
+	}
+	if o.retryInterval <= 0 {
+		o.retryInterval = defaultRetryInterval
+	}
+	if o.publishTimeout <= 0 {
+		o.publishTimeout = defaultPublishTimeout
+	}
+
+	err = db.Update(func(tx *bolt.Tx) error {
+		b, err := tx.CreateBucketIfNotExists(bucketMessages)
+		if err != nil {
+			return err
+		}
+		o.pending = b.Stats().KeyN
+		if b, err = tx.CreateBucketIfNotExists(bucketParked); err != nil {
+			return err
+		}
+		o.parked = b.Stats().KeyN
+		return nil
+	})
+	if err != nil {
+		_ = db.Close()
+		return nil, fmt.Errorf("failed to open outbox due %v", err)
+	}
+
+	if notifier, ok := producer.(mq.StateNotifier); ok {
+		states := make(chan mq.StateEvent, 16)
+		notifier.NotifyState(states)
+		go o.watch(states)
+	}
+	go o.relay(ctx)
+	return o, nil
+}
+
+// watch следит за подключением продьюсера
+func (o *outbox) watch(states <-chan mq.StateEvent) {
+	for {
+		select {
+		case event := <-states:
+			if event.State == mq.StateClosed {
+				return
+			}
+			o.lock.Lock()
+			o.connected = event.State == mq.StateConnected
+			o.lock.Unlock()
+		case <-o.done:
+			return
+		}
+	}
+}
+
+// DeclareQueue объявляет очередь сразу через producer, топология не проходит через outbox
+func (o *outbox) DeclareQueue(ctx context.Context, name string, durable, autoDelete, exclusive bool, args map[string]interface{}) error {
+	return o.producer.DeclareQueue(ctx, name, durable, autoDelete, exclusive, args)
+}
+
+// DeclareExchange объявляет exchange сразу через producer
+func (o *outbox) DeclareExchange(ctx context.Context, name, kind string, durable, autoDelete bool, args map[string]interface{}) error {
+	return o.producer.DeclareExchange(ctx, name, kind, durable, autoDelete, args)
+}
+
+// BindQueue привязывает очередь сразу через producer
+func (o *outbox) BindQueue(ctx context.Context, queue, exchange, key string, args map[string]interface{}) error {
+	return o.producer.BindQueue(ctx, queue, exchange, key, args)
+}
+
+// Publish записывает сообщение для очереди target
+func (o *outbox) Publish(ctx context.Context, target string, body []byte) error {
+	return o.PublishMessage(ctx, target, mq.Message{Body: body})
+}
+
+// PublishMessage записывает сообщение для очереди target через default exchange
+func (o *outbox) PublishMessage(ctx context.Context, target string, msg mq.Message) error {
+	return o.PublishExchange(ctx, "", target, msg)
+}
+
+// PublishExchange записывает сообщение в outbox. Сообщение уже не потеряется, даже если брокер
+// недоступен или процесс упадёт, но опубликовано оно будет позже. MessageID и Timestamp
+// проставляются сразу, так повторная доставка после падения приходит с тем же идентификатором
+func (o *outbox) PublishExchange(ctx context.Context, exchange, key string, msg mq.Message) error {
+	return o.enqueue(ctx, Entry{Exchange: exchange, Key: key, Message: msg})
+}
+
+// PublishAt записывает сообщение которое брокер опубликует в exchange не раньше at
+func (o *outbox) PublishAt(ctx context.Context, exchange, key string, msg mq.Message, at time.Time) error {
+	if _, ok := o.producer.(mq.ScheduledProducer); !ok {
+		return errNotScheduled
+	}
+	return o.enqueue(ctx, Entry{Exchange: exchange, Key: key, Message: msg, At: at})
+}
+
+// PublishAfter записывает сообщение которое брокер опубликует через delay. Задержка отсчитывается
+// от вызова, а не от доставки записи брокеру
+func (o *outbox) PublishAfter(ctx context.Context, exchange, key string, msg mq.Message, delay time.Duration) error {
+	return o.PublishAt(ctx, exchange, key, msg, time.Now().Add(delay))
+}
+
+// enqueue записывает запись в базу и будит relay
+func (o *outbox) enqueue(ctx context.Context, entry Entry) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	entry.Message = entry.Message.WithDefaults("", "")
+	entry.EnqueuedAt = time.Now()
+
+	o.lock.Lock()
+	defer o.lock.Unlock()
+	if o.closed {
+		return errClosed
+	}
+	err := o.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(bucketMessages)
+		seq, err := b.NextSequence()
+		if err != nil {
+			return err
+		}
+		entry.Seq = seq
+		value, err := encode(entry)
+		if err != nil {
+			return err
+		}
+		return b.Put(seqKey(seq), value)
+	})
+	if err != nil {
+		return fmt.Errorf("failed to write message to outbox due %v", err)
+	}
+	o.pending++
+
+	select {
+	case o.wake <- struct{}{}:
+	default:
+	}
+	return nil
+}
+
+// Pending возвращает до limit ожидающих записей, limit <= 0 возвращает все
+func (o *outbox) Pending(limit int) ([]Entry, error) {
+	return o.list(bucketMessages, limit)
+}
+
+// Parked возвращает до limit отложенных записей, limit <= 0 возвращает все
+func (o *outbox) Parked(limit int) ([]Entry, error) {
+	return o.list(bucketParked, limit)
+}
+
+// list читает до limit записей бакета по порядку номеров
+func (o *outbox) list(bucket []byte, limit int) ([]Entry, error) {
+	var entries []Entry
+	err := o.db.View(func(tx *bolt.Tx) error {
+		c := tx.Bucket(bucket).Cursor()
+		for k, v := c.First(); k != nil; k, v = c.Next() {
+			if limit > 0 && len(entries) >= limit {
+				break
+			}
+			entry, err := decode(v)
+			if err != nil {
+				return err
+			}
+			entries = append(entries, entry)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to read outbox due %v", err)
+	}
+	return entries, nil
+}
+
+// Remove удаляет ожидающую или отложенную запись seq, запись которую relay публикует прямо сейчас удалить нельзя
+func (o *outbox) Remove(seq uint64) error {
+	o.lock.Lock()
+	defer o.lock.Unlock()
+	if o.closed {
+		return errClosed
+	}
+	if o.publishing == seq {
+		return fmt.Errorf("failed to remove entry %d due %w", seq, errPublishing)
+	}
+	var parked bool
+	err := o.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(bucketMessages)
+		if b.Get(seqKey(seq)) == nil {
+			b, parked = tx.Bucket(bucketParked), true
+		}
+		if b.Get(seqKey(seq)) == nil {
+			return errUnknownSeq
+		}
+		return b.Delete(seqKey(seq))
+	})
+	if err != nil {
+		return fmt.Errorf("failed to remove entry %d due %w", seq, err)
+	}
+	if parked {
+		o.parked--
+	} else {
+		o.pending--
+	}
+	return nil
+}
+
+// Stats возвращает размер outbox и счётчики relay
+func (o *outbox) Stats() Stats {
+	o.lock.Lock()
+	stats := Stats{Pending: o.pending, Parked: o.parked, Delivered: o.delivered, Failed: o.failed}
+	o.lock.Unlock()
+
+	_ = o.db.View(func(tx *bolt.Tx) error {
+		if _, v := tx.Bucket(bucketMessages).Cursor().First(); v != nil {
+			if entry, err := decode(v); err == nil {
+				stats.Oldest = entry.EnqueuedAt
+			}
+		}
+		return nil
+	})
+	return stats
+}
+
+// relay доставляет записи пока не отменён ctx или не закрыт outbox
+func (o *outbox) relay(ctx context.Context) {
+	defer close(o.stopped)
+	for {
+		wait := o.flush(ctx)
+		var retry <-chan time.Time
+		if wait {
+			retry = time.After(o.retryInterval)
+		}
+		select {
+		case <-o.wake:
+		case <-retry:
+		case <-ctx.Done():
+			return
+		case <-o.done:
+			return
+		}
+	}
+}
+
+// flush публикует записи по порядку пока outbox не опустеет. Возвращает true если
+// публикация не удалась и нужно попробовать снова через RetryInterval
+func (o *outbox) flush(ctx context.Context) bool {
+	for {
+		entries, err := o.Pending(o.batchSize)
+		if err != nil {
+			log.Print(err)
+			return true
+		}
+		if len(entries) == 0 {
+			return false
+		}
+		for _, entry := range entries {
+			select {
+			case <-ctx.Done():
+				return false
+			case <-o.done:
+				return false
+			default:
+			}
+			if !o.deliver(ctx, entry) {
+				return true
+			}
+		}
+	}
+}
+
+// deliver публикует одну запись и удаляет её из базы. Следующая запись не публикуется
+// пока эта не доставлена, так сохраняется порядок
+func (o *outbox) deliver(ctx context.Context, entry Entry) bool {
+	o.lock.Lock()
+	// запись могли удалить через Remove после того как relay её прочитал
+	exists := o.exists(entry.Seq)
+	if exists {
+		o.publishing = entry.Seq
+	}
+	o.lock.Unlock()
+	if !exists {
+		return true
+	}
+	defer func() {
+		o.lock.Lock()
+		o.publishing = 0
+		o.lock.Unlock()
+	}()
+
+	publishCtx, cancel := context.WithTimeout(ctx, o.publishTimeout)
+	err := o.publish(publishCtx, entry)
+	cancel()
+
+	o.lock.Lock()
+	defer o.lock.Unlock()
+	if err != nil {
+		o.failed++
+		entry.Attempts++
+		entry.LastError = err.Error()
+		// пока продьюсер не подключён ошибка говорит о брокере, а не о записи
+		if o.connected {
+			entry.Rejected++
+		}
+		if o.maxAttempts > 0 && entry.Rejected >= o.maxAttempts {
+			return o.park(entry)
+		}
+		// попытки сохраняются чтобы их было видно в Pending, ошибка записи не мешает повтору
+		if err := o.put(entry); err != nil {
+			log.Printf("failed to update outbox entry %d due %v", entry.Seq, err)
+		}
+		if entry.Attempts == 1 {
+			log.Printf("failed to publish outbox entry %d to %s due %v, will retry", entry.Seq, entry.Key, err)
+		}
+		return false
+	}
+
+	o.delivered++
+	err = o.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(bucketMessages).Delete(seqKey(entry.Seq))
+	})
+	if err != nil {
+		// запись опубликуется ещё раз, подписчик получит дубликат с тем же MessageID
+		log.Printf("failed to remove delivered outbox entry %d due %v", entry.Seq, err)
+		return false
+	}
+	o.pending--
+	return true
+}
+
+// park переносит запись в parked, после этого relay переходит к следующей. Вызывается под локом
+func (o *outbox) park(entry Entry) bool {
+	value, err := encode(entry)
+	if err == nil {
+		err = o.db.Update(func(tx *bolt.Tx) error {
+			if err := tx.Bucket(bucketParked).Put(seqKey(entry.Seq), value); err != nil {
+				return err
+			}
+			return tx.Bucket(bucketMessages).Delete(seqKey(entry.Seq))
+		})
+	}
+	if err != nil {
+		log.Printf("failed to park outbox entry %d due %v", entry.Seq, err)
+		return false
+	}
+	o.pending--
+	o.parked++
+	log.Printf("outbox entry %d to %s parked after %d attempts, last error %s", entry.Seq, entry.Key, entry.Attempts, entry.LastError)
+	return true
+}
+
+// publish передаёт запись продьюсеру, отложенную вместе с её временем
+func (o *outbox) publish(ctx context.Context, entry Entry) error {
+	if entry.At.IsZero() {
+		return o.producer.PublishExchange(ctx, entry.Exchange, entry.Key, entry.Message)
+	}
+	scheduled, ok := o.producer.(mq.ScheduledProducer)
+	if !ok {
+		return errNotScheduled
+	}
+	return scheduled.PublishAt(ctx, entry.Exchange, entry.Key, entry.Message, entry.At)
+}
+
+// exists есть ли запись seq в базе
+func (o *outbox) exists(seq uint64) bool {
+	var found bool
+	_ = o.db.View(func(tx *bolt.Tx) error {
+		found = tx.Bucket(bucketMessages).Get(seqKey(seq)) != nil
+		return nil
+	})
+	return found
+}
+
+// put перезаписывает существующую запись
+func (o *outbox) put(entry Entry) error {
+	value, err := encode(entry)
+	if err != nil {
+		return err
+	}
+	return o.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(bucketMessages).Put(seqKey(entry.Seq), value)
+	})
+}
+
+// Close останавливает relay, закрывает базу и producer. Недоставленные записи остаются в базе до следующего запуска
+func (o *outbox) Close() error {
+	o.lock.Lock()
+	if o.closed {
+		o.lock.Unlock()
+		return errClosed
+	}
+	o.closed = true
+	o.lock.Unlock()
+
+	close(o.done)
+	<-o.stopped
+	if err := o.db.Close(); err != nil {
+		_ = o.producer.Close()
+		return fmt.Errorf("failed to close outbox due %v", err)
+	}
+	return o.producer.Close()
+}
+
+// seqKey ключ записи, big endian сохраняет порядок номеров при обходе курсором
+func seqKey(seq uint64) []byte {
+	key := make([]byte, 8)
+	binary.BigEndian.PutUint64(key, seq)
+	return key
+}
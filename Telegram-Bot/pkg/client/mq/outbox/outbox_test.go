@@ -0,0 +1,298 @@
+package outbox
+
+import (
+	"context"
+	"errors"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/Maksat-luci/Telegram-Bot/pkg/client/mq"
+	"github.com/Maksat-luci/Telegram-Bot/pkg/client/mq/memory"
+)
+
+// waitTimeout сколько тест ждёт пока relay доставит записи
+const waitTimeout = 2 * time.Second
+
+// flakyProducer продьюсер в памяти который отказывает в публикации пока брокер "лежит"
+// или если сообщение отклоняет reject. Сообщает о подключении через NotifyState
+type flakyProducer struct {
+	mq.Producer
+
+	lock   sync.Mutex
+	down   bool
+	reject func(msg mq.Message) bool
+	states []chan<- mq.StateEvent
+}
+
+func (p *flakyProducer) PublishExchange(ctx context.Context, exchange, key string, msg mq.Message) error {
+	p.lock.Lock()
+	down, reject := p.down, p.reject
+	p.lock.Unlock()
+	if down {
+		return errors.New("broker is down")
+	}
+	if reject != nil && reject(msg) {
+		return errors.New("message rejected")
+	}
+	return p.Producer.PublishExchange(ctx, exchange, key, msg)
+}
+
+func (p *flakyProducer) NotifyState(ch chan<- mq.StateEvent) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	p.states = append(p.states, ch)
+}
+
+// setDown роняет или поднимает брокер, notify ещё и сообщает об этом подписчикам состояния
+func (p *flakyProducer) setDown(down, notify bool) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	p.down = down
+	if !notify {
+		return
+	}
+	state := mq.StateConnected
+	if down {
+		state = mq.StateDisconnected
+	}
+	for _, ch := range p.states {
+		ch <- mq.StateEvent{State: state, At: time.Now()}
+	}
+}
+
+// waitConnected ждёт пока outbox узнает о состоянии подключения продьюсера
+func waitConnected(t *testing.T, box *outbox, connected bool) {
+	t.Helper()
+	deadline := time.Now().Add(waitTimeout)
+	for {
+		box.lock.Lock()
+		ok := box.connected == connected
+		box.lock.Unlock()
+		if ok {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("outbox did not see connected %v", connected)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+// newTestOutbox создаёт outbox поверх брокера в памяти с очередью tracks
+func newTestOutbox(t *testing.T, cfg Config) (*outbox, *flakyProducer, *memory.Broker) {
+	t.Helper()
+	broker := memory.NewBroker()
+	broker.DeclareQueue("tracks")
+	producer := &flakyProducer{Producer: memory.NewMemoryProducer(broker, memory.ProducerConfig{})}
+	cfg.Path = filepath.Join(t.TempDir(), "outbox.db")
+	if cfg.RetryInterval == 0 {
+		cfg.RetryInterval = 5 * time.Millisecond
+	}
+	box, err := NewOutbox(context.Background(), producer, cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = box.Close() })
+	return box.(*outbox), producer, broker
+}
+
+// publish записывает в outbox сообщения с телами bodies для очереди tracks
+func publish(t *testing.T, box Outbox, bodies ...string) {
+	t.Helper()
+	for _, body := range bodies {
+		if err := box.Publish(context.Background(), "tracks", []byte(body)); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// waitStats ждёт пока статистика outbox не станет такой как хочет ok
+func waitStats(t *testing.T, box Outbox, ok func(stats Stats) bool) Stats {
+	t.Helper()
+	deadline := time.Now().Add(waitTimeout)
+	for {
+		stats := box.Stats()
+		if ok(stats) {
+			return stats
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for outbox, stats %+v", stats)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+// consumeBodies забирает из очереди tracks n сообщений и возвращает их тела по порядку
+func consumeBodies(t *testing.T, broker *memory.Broker, n int) []string {
+	t.Helper()
+	consumer := memory.NewMemoryConsumer(broker, memory.ConsumerConfig{})
+	defer consumer.Close()
+	messages, err := consumer.Consume(context.Background(), "tracks")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var bodies []string
+	for len(bodies) < n {
+		select {
+		case msg := <-messages:
+			bodies = append(bodies, string(msg.Body))
+		case <-time.After(waitTimeout):
+			t.Fatalf("got %v, want %d messages", bodies, n)
+		}
+	}
+	return bodies
+}
+
+// bodies тела сообщений записей
+func bodies(entries []Entry) []string {
+	var bodies []string
+	for _, entry := range entries {
+		bodies = append(bodies, string(entry.Message.Body))
+	}
+	return bodies
+}
+
+func TestRelayInOrderAcrossOutage(t *testing.T) {
+	box, producer, broker := newTestOutbox(t, Config{MaxAttempts: 1})
+	producer.setDown(true, true)
+	waitConnected(t, box, false)
+	publish(t, box, "first", "second", "third")
+
+	// пока брокер недоступен записи копятся, а отказы не откладывают их в parked
+	waitStats(t, box, func(stats Stats) bool { return stats.Failed >= 3 })
+	entries, err := box.Pending(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := bodies(entries); len(got) != 3 || got[0] != "first" || got[1] != "second" || got[2] != "third" {
+		t.Fatalf("got pending %v, want first, second, third", got)
+	}
+	if entries[0].Attempts == 0 || entries[0].LastError == "" || entries[0].Rejected != 0 {
+		t.Fatalf("got first entry %+v, want failed attempts without rejections", entries[0])
+	}
+	if stats := box.Stats(); stats.Pending != 3 || stats.Parked != 0 || stats.Oldest.IsZero() {
+		t.Fatalf("got stats %+v during outage", stats)
+	}
+
+	producer.setDown(false, true)
+	stats := waitStats(t, box, func(stats Stats) bool { return stats.Pending == 0 })
+	if stats.Delivered != 3 || !stats.Oldest.IsZero() {
+		t.Fatalf("got stats %+v after recovery", stats)
+	}
+	if got := consumeBodies(t, broker, 3); got[0] != "first" || got[1] != "second" || got[2] != "third" {
+		t.Fatalf("got %v, want first, second, third", got)
+	}
+}
+
+func TestParkRejected(t *testing.T) {
+	box, producer, broker := newTestOutbox(t, Config{MaxAttempts: 2})
+	producer.reject = func(msg mq.Message) bool { return string(msg.Body) == "broken" }
+	publish(t, box, "first", "broken", "second")
+
+	// отклонённая запись не задерживает следующую
+	stats := waitStats(t, box, func(stats Stats) bool { return stats.Pending == 0 })
+	if stats.Delivered != 2 || stats.Parked != 1 || stats.Failed != 2 {
+		t.Fatalf("got stats %+v, want 2 delivered, 1 parked and 2 failed", stats)
+	}
+	if got := consumeBodies(t, broker, 2); got[0] != "first" || got[1] != "second" {
+		t.Fatalf("got %v, want first, second", got)
+	}
+
+	parked, err := box.Parked(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(parked) != 1 || string(parked[0].Message.Body) != "broken" || parked[0].Rejected != 2 {
+		t.Fatalf("got parked %+v, want broken entry rejected twice", parked)
+	}
+	if err := box.Remove(parked[0].Seq); err != nil {
+		t.Fatal(err)
+	}
+	if stats := box.Stats(); stats.Parked != 0 {
+		t.Fatalf("got %d parked after remove, want 0", stats.Parked)
+	}
+	if parked, err := box.Parked(0); err != nil || len(parked) != 0 {
+		t.Fatalf("got parked %v, %v after remove", parked, err)
+	}
+}
+
+func TestWithoutMaxAttempts(t *testing.T) {
+	box, producer, _ := newTestOutbox(t, Config{})
+	producer.reject = func(msg mq.Message) bool { return true }
+	publish(t, box, "broken")
+
+	waitStats(t, box, func(stats Stats) bool { return stats.Failed >= 5 })
+	if stats := box.Stats(); stats.Pending != 1 || stats.Parked != 0 {
+		t.Fatalf("got stats %+v, want entry still pending", stats)
+	}
+}
+
+func TestPendingAndRemove(t *testing.T) {
+	box, producer, _ := newTestOutbox(t, Config{RetryInterval: time.Hour})
+	producer.setDown(true, false)
+	publish(t, box, "first", "second", "third")
+
+	entries, err := box.Pending(2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := bodies(entries); len(got) != 2 || got[0] != "first" || got[1] != "second" {
+		t.Fatalf("got pending %v, want first, second", got)
+	}
+
+	// запись которую relay публикует прямо сейчас удалить нельзя, после отказа он ждёт час и её можно удалить
+	waitStats(t, box, func(stats Stats) bool { return stats.Failed >= 1 })
+	for {
+		err := box.Remove(entries[0].Seq)
+		if err == nil {
+			break
+		}
+		if !errors.Is(err, errPublishing) {
+			t.Fatal(err)
+		}
+		time.Sleep(time.Millisecond)
+	}
+	if err := box.Remove(entries[0].Seq); !errors.Is(err, errUnknownSeq) {
+		t.Fatalf("got %v, want %v", err, errUnknownSeq)
+	}
+	entries, err = box.Pending(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := bodies(entries); len(got) != 2 || got[0] != "second" || got[1] != "third" {
+		t.Fatalf("got pending %v, want second, third", got)
+	}
+	if stats := box.Stats(); stats.Pending != 2 {
+		t.Fatalf("got %d pending, want 2", stats.Pending)
+	}
+}
+
+func TestReopenKeepsEntries(t *testing.T) {
+	broker := memory.NewBroker()
+	broker.DeclareQueue("tracks")
+	producer := &flakyProducer{Producer: memory.NewMemoryProducer(broker, memory.ProducerConfig{})}
+	producer.setDown(true, false)
+	path := filepath.Join(t.TempDir(), "outbox.db")
+
+	box, err := NewOutbox(context.Background(), producer, Config{Path: path, RetryInterval: time.Hour})
+	if err != nil {
+		t.Fatal(err)
+	}
+	publish(t, box, "first", "second")
+	if err := box.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	producer = &flakyProducer{Producer: memory.NewMemoryProducer(broker, memory.ProducerConfig{})}
+	box, err = NewOutbox(context.Background(), producer, Config{Path: path})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer box.Close()
+	waitStats(t, box, func(stats Stats) bool { return stats.Delivered == 2 })
+	if got := consumeBodies(t, broker, 2); got[0] != "first" || got[1] != "second" {
+		t.Fatalf("got %v, want first, second", got)
+	}
+}
@@ -0,0 +1,119 @@
+package payload
+
+import (
+	"context"
+	"errors"
+	"log"
+	"sync"
+
+	"github.com/Maksat-luci/Telegram-Bot/pkg/client/mq"
+)
+
+// NewConsumer оборачивает консьюмера, сообщения доставляются уже расшифрованными и распакованными
+func NewConsumer(c mq.Consumer, cfg Config) (mq.Consumer, error) {
+	codec, err := newCodec(cfg)
+	if err != nil {
+		return nil, err
+	}
+	return &consumer{Consumer: c, codec: codec, encoded: make(map[uint64]mq.Message)}, nil
+}
+
+// consumer декодирует тела, объявления передаёт как есть
+type consumer struct {
+	mq.Consumer
+	codec *codec
+
+	mu sync.Mutex
+	// encoded тела и заголовки доставленных и ещё не подтверждённых сообщений в том виде в каком их
+	// прислал брокер, Settle публикует повтор в нём же и расшифрованное тело в брокер не попадает
+	encoded map[uint64]mq.Message
+}
+
+// Consume доставляет сообщения очереди target с восстановленными телами. Сообщение которое не удалось
+// расшифровать или распаковать откладывается в parking очередь, а зашифрованное неизвестным ключом
+// повторяется: во время ротации ключ может быть пока не у всех консьюмеров
+func (c *consumer) Consume(ctx context.Context, target string) (<-chan mq.Message, error) {
+	messages, err := c.Consumer.Consume(ctx, target)
+	if err != nil {
+		return nil, err
+	}
+	ch := make(chan mq.Message)
+	go func() {
+		defer close(ch)
+		for msg := range messages {
+			decoded, err := c.codec.decode(msg)
+			if err != nil {
+				c.fail(msg, err)
+				continue
+			}
+			c.mu.Lock()
+			c.encoded[msg.ID] = mq.Message{Body: msg.Body, Headers: msg.Headers}
+			c.mu.Unlock()
+			select {
+			case ch <- decoded:
+			case <-ctx.Done():
+				// сообщение не подтверждено, брокер доставит его снова
+				c.forget(msg.ID, false)
+			}
+		}
+	}()
+	return ch, nil
+}
+
+// fail завершает сообщение тело которого не удалось восстановить
+func (c *consumer) fail(msg mq.Message, err error) {
+	outcome := mq.OutcomeDeadLetter
+	if errors.Is(err, errUnknownKey) {
+		outcome = mq.OutcomeRetry
+	}
+	log.Printf("failed to decode payload of message %s due %v, %s", msg.MessageID, err, outcome)
+	if _, err := c.Consumer.Settle(context.Background(), msg, outcome); err != nil {
+		log.Printf("failed to settle message %s due %v", msg.MessageID, err)
+	}
+}
+
+// Ack подтверждает сообщение
+func (c *consumer) Ack(ctx context.Context, id uint64, multiple bool) error {
+	c.forget(id, multiple)
+	return c.Consumer.Ack(ctx, id, multiple)
+}
+
+// Nack возвращает или отбрасывает сообщение
+func (c *consumer) Nack(ctx context.Context, id uint64, multiple bool, requeue bool) error {
+	c.forget(id, multiple)
+	return c.Consumer.Nack(ctx, id, multiple, requeue)
+}
+
+// Reject отклоняет сообщение
+func (c *consumer) Reject(ctx context.Context, id uint64, requeue bool) error {
+	c.forget(id, false)
+	return c.Consumer.Reject(ctx, id, requeue)
+}
+
+// Settle завершает неудачное сообщение, бэкенду передаётся тело в том виде в каком его прислал брокер
+func (c *consumer) Settle(ctx context.Context, msg mq.Message, outcome mq.Outcome) (mq.Outcome, error) {
+	c.mu.Lock()
+	encoded, ok := c.encoded[msg.ID]
+	delete(c.encoded, msg.ID)
+	c.mu.Unlock()
+	if ok {
+		msg.Body = encoded.Body
+		msg.Headers = encoded.Headers
+	}
+	return c.Consumer.Settle(ctx, msg, outcome)
+}
+
+// forget убирает сохранённое тело сообщения id, а при multiple и всех доставленных раньше него
+func (c *consumer) forget(id uint64, multiple bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if !multiple {
+		delete(c.encoded, id)
+		return
+	}
+	for tag := range c.encoded {
+		if tag <= id {
+			delete(c.encoded, tag)
+		}
+	}
+}
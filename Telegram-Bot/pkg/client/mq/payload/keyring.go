@@ -0,0 +1,71 @@
+package payload
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"errors"
+	"fmt"
+)
+
+var (
+	// errDecrypt тело не расшифровалось: ключ не тот или сообщение изменено
+	errDecrypt = errors.New("failed to decrypt payload")
+	// errUnknownKey ключа нет у консьюмера, например во время ротации он есть пока только у продьюсера
+	errUnknownKey = errors.New("unknown encryption key")
+)
+
+// Keyring ключи AES-GCM по идентификатору. Новые сообщения шифруются основным ключом, остальные нужны
+// только чтобы расшифровать сообщения которые ещё лежат в очередях. При ротации новый ключ сначала
+// добавляют всем консьюмерам, потом делают основным, а старый убирают когда очереди опустеют
+type Keyring struct {
+	primary string
+	aeads   map[string]cipher.AEAD
+}
+
+// NewKeyring создаёт ключи, каждый ключ 16, 24 или 32 байта для AES-128, AES-192 или AES-256
+func NewKeyring(primary string, keys map[string][]byte) (*Keyring, error) {
+	if _, ok := keys[primary]; !ok {
+		return nil, fmt.Errorf("primary encryption key %q is not configured", primary)
+	}
+	k := &Keyring{primary: primary, aeads: make(map[string]cipher.AEAD, len(keys))}
+	for id, key := range keys {
+		block, err := aes.NewCipher(key)
+		if err != nil {
+			return nil, fmt.Errorf("invalid encryption key %q due %v", id, err)
+		}
+		aead, err := cipher.NewGCM(block)
+		if err != nil {
+			return nil, fmt.Errorf("invalid encryption key %q due %v", id, err)
+		}
+		k.aeads[id] = aead
+	}
+	return k, nil
+}
+
+// seal шифрует тело основным ключом, случайный nonce записывается перед шифротекстом
+func (k *Keyring) seal(body []byte) (string, []byte, error) {
+	aead := k.aeads[k.primary]
+	nonce := make([]byte, aead.NonceSize(), aead.NonceSize()+len(body)+aead.Overhead())
+	if _, err := rand.Read(nonce); err != nil {
+		return "", nil, fmt.Errorf("failed to generate nonce due %v", err)
+	}
+	return k.primary, aead.Seal(nonce, nonce, body, []byte(k.primary)), nil
+}
+
+// open расшифровывает тело ключом id, идентификатор ключа входит в подпись и подменить его нельзя
+func (k *Keyring) open(id string, sealed []byte) ([]byte, error) {
+	aead, ok := k.aeads[id]
+	if !ok {
+		return nil, fmt.Errorf("%w %q", errUnknownKey, id)
+	}
+	if len(sealed) < aead.NonceSize() {
+		return nil, errDecrypt
+	}
+	nonce, ciphertext := sealed[:aead.NonceSize()], sealed[aead.NonceSize():]
+	body, err := aead.Open(nil, nonce, ciphertext, []byte(id))
+	if err != nil {
+		return nil, errDecrypt
+	}
+	return body, nil
+}
@@ -0,0 +1,130 @@
+package payload
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+)
+
+// ключи для тестов, 16 и 32 байта
+var (
+	keyOld = bytes.Repeat([]byte{1}, 16)
+	keyNew = bytes.Repeat([]byte{2}, 32)
+)
+
+// newTestKeyring создаёт ключи или останавливает тест
+func newTestKeyring(t *testing.T, primary string, keys map[string][]byte) *Keyring {
+	t.Helper()
+	k, err := NewKeyring(primary, keys)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return k
+}
+
+func TestNewKeyring(t *testing.T) {
+	tests := []struct {
+		name    string
+		primary string
+		keys    map[string][]byte
+	}{
+		{name: "primary missing", primary: "k2", keys: map[string][]byte{"k1": keyOld}},
+		{name: "no keys", primary: "k1"},
+		{name: "short key", primary: "k1", keys: map[string][]byte{"k1": []byte("short")}},
+		{name: "bad secondary key", primary: "k1", keys: map[string][]byte{"k1": keyOld, "k0": make([]byte, 20)}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := NewKeyring(tt.primary, tt.keys); err == nil {
+				t.Fatal("keyring created")
+			}
+		})
+	}
+}
+
+func TestKeyringSealOpen(t *testing.T) {
+	k := newTestKeyring(t, "k1", map[string][]byte{"k1": keyOld})
+	body := []byte("track")
+
+	id, sealed, err := k.seal(body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if id != "k1" || bytes.Contains(sealed, body) {
+		t.Fatalf("got key %q and sealed %x", id, sealed)
+	}
+	// nonce случайный, одно и то же тело шифруется по-разному
+	_, again, err := k.seal(body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Equal(sealed, again) {
+		t.Fatal("same ciphertext for two seals")
+	}
+
+	opened, err := k.open(id, sealed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(opened, body) {
+		t.Fatalf("got %q, want %q", opened, body)
+	}
+
+	tampered := append([]byte(nil), sealed...)
+	tampered[len(tampered)-1] ^= 1
+	if _, err := k.open(id, tampered); !errors.Is(err, errDecrypt) {
+		t.Fatalf("tampered: got %v, want %v", err, errDecrypt)
+	}
+	if _, err := k.open(id, sealed[:4]); !errors.Is(err, errDecrypt) {
+		t.Fatalf("truncated: got %v, want %v", err, errDecrypt)
+	}
+	if _, err := k.open("k9", sealed); !errors.Is(err, errUnknownKey) {
+		t.Fatalf("unknown key: got %v, want %v", err, errUnknownKey)
+	}
+}
+
+// Идентификатор ключа подписан вместе с телом: даже с теми же байтами ключа под другим
+// идентификатором сообщение не расшифруется
+func TestKeyringKeyIDIsAuthenticated(t *testing.T) {
+	k := newTestKeyring(t, "k1", map[string][]byte{"k1": keyOld, "alias": keyOld})
+	_, sealed, err := k.seal([]byte("track"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := k.open("alias", sealed); !errors.Is(err, errDecrypt) {
+		t.Fatalf("got %v, want %v", err, errDecrypt)
+	}
+}
+
+// Ротация: новый ключ сначала добавляют консьюмерам, потом делают основным у продьюсера.
+// Сообщения зашифрованные старым ключом и лежащие в очередях расшифровываются до конца ротации
+func TestKeyringRotation(t *testing.T) {
+	before := newTestKeyring(t, "k1", map[string][]byte{"k1": keyOld})
+	during := newTestKeyring(t, "k1", map[string][]byte{"k1": keyOld, "k2": keyNew})
+	after := newTestKeyring(t, "k2", map[string][]byte{"k1": keyOld, "k2": keyNew})
+
+	oldID, oldSealed, err := before.seal([]byte("old"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	newID, newSealed, err := after.seal([]byte("new"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if oldID != "k1" || newID != "k2" {
+		t.Fatalf("sealed with %q and %q, want k1 and k2", oldID, newID)
+	}
+
+	for name, k := range map[string]*Keyring{"during": during, "after": after} {
+		if body, err := k.open(oldID, oldSealed); err != nil || string(body) != "old" {
+			t.Fatalf("%s rotation: open message of the older key: %q, %v", name, body, err)
+		}
+		if body, err := k.open(newID, newSealed); err != nil || string(body) != "new" {
+			t.Fatalf("%s rotation: open message of the new key: %q, %v", name, body, err)
+		}
+	}
+	// консьюмер которому новый ключ ещё не раздали не может расшифровать, но это не порча сообщения
+	if _, err := before.open(newID, newSealed); !errors.Is(err, errUnknownKey) {
+		t.Fatalf("got %v, want %v", err, errUnknownKey)
+	}
+}
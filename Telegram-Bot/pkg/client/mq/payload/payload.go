@@ -0,0 +1,206 @@
+// Package payload сжатие и шифрование тел сообщений. Продьюсер сжимает тело gzip или zstd и шифрует его
+// AES-GCM, что было сделано с телом записывается в заголовки. Консьюмер по заголовкам восстанавливает
+// тело до обработки, сообщения без заголовков доставляются как есть
+package payload
+
+import (
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+
+	"github.com/Maksat-luci/Telegram-Bot/pkg/client/mq"
+	"github.com/klauspost/compress/zstd"
+)
+
+// заголовки сообщения
+const (
+	// HeaderContentEncoding алгоритм которым сжато тело
+	HeaderContentEncoding = "x-content-encoding"
+	// HeaderEncryption алгоритм которым зашифровано тело
+	HeaderEncryption = "x-encryption"
+	// HeaderKeyID идентификатор ключа которым зашифровано тело
+	HeaderKeyID = "x-encryption-key"
+)
+
+// алгоритмы сжатия и шифрования
+const (
+	CompressionNone  = "none"
+	CompressionGzip  = "gzip"
+	CompressionZstd  = "zstd"
+	EncryptionAESGCM = "aes-gcm"
+)
+
+const (
+	// defaultMinSize тела меньше этого размера не сжимаются, выигрыш меньше заголовков
+	defaultMinSize = 1 << 10
+	// maxDecodedSize предел распакованного тела, сообщение не должно занять всю память консьюмера
+	maxDecodedSize = 64 << 20
+)
+
+// Config настройки продьюсера и консьюмера
+type Config struct {
+	// Compression none, gzip или zstd, консьюмер распаковывает любой из них независимо от настройки
+	Compression string
+	// MinSize тела меньше этого размера в байтах не сжимаются, по умолчанию 1KB
+	MinSize int
+	// Keys ключи шифрования, nil если тела не шифруются. Консьюмеру без ключей зашифрованное сообщение
+	// не расшифровать, оно уходит в parking очередь
+	Keys *Keyring
+}
+
+var (
+	// errUnknownEncoding в заголовке алгоритм который консьюмер не знает
+	errUnknownEncoding = errors.New("unknown payload encoding")
+	// errTooLarge распакованное тело больше maxDecodedSize
+	errTooLarge = errors.New("decoded payload is too large")
+)
+
+// codec применяет и снимает сжатие и шифрование
+type codec struct {
+	cfg     Config
+	encoder *zstd.Encoder
+	decoder *zstd.Decoder
+}
+
+// newCodec проверяет настройки и создаёт кодек, EncodeAll и DecodeAll zstd можно вызывать параллельно
+func newCodec(cfg Config) (*codec, error) {
+	switch cfg.Compression {
+	case "":
+		cfg.Compression = CompressionNone
+	case CompressionNone, CompressionGzip, CompressionZstd:
+	default:
+		return nil, fmt.Errorf("unknown compression %q", cfg.Compression)
+	}
+	if cfg.MinSize <= 0 {
+		cfg.MinSize = defaultMinSize
+	}
+	encoder, err := zstd.NewWriter(nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create zstd encoder due %v", err)
+	}
+	decoder, err := zstd.NewReader(nil, zstd.WithDecoderMaxMemory(maxDecodedSize))
+	if err != nil {
+		return nil, fmt.Errorf("failed to create zstd decoder due %v", err)
+	}
+	return &codec{cfg: cfg, encoder: encoder, decoder: decoder}, nil
+}
+
+// encode сжимает и шифрует тело, сжатие идёт первым: зашифрованные данные уже не сжать
+func (c *codec) encode(msg mq.Message) (mq.Message, error) {
+	headers := make(map[string]interface{}, len(msg.Headers)+3)
+	for k, v := range msg.Headers {
+		headers[k] = v
+	}
+	body := msg.Body
+	if c.cfg.Compression != CompressionNone && len(body) >= c.cfg.MinSize {
+		compressed, err := c.compress(body)
+		if err != nil {
+			return msg, err
+		}
+		// несжимаемое тело, например уже сжатая картинка, публикуется как есть
+		if len(compressed) < len(body) {
+			body = compressed
+			headers[HeaderContentEncoding] = c.cfg.Compression
+		}
+	}
+	if c.cfg.Keys != nil {
+		id, sealed, err := c.cfg.Keys.seal(body)
+		if err != nil {
+			return msg, err
+		}
+		body = sealed
+		headers[HeaderEncryption] = EncryptionAESGCM
+		headers[HeaderKeyID] = id
+	}
+	msg.Body = body
+	msg.Headers = headers
+	return msg, nil
+}
+
+// decode расшифровывает и распаковывает тело по заголовкам и убирает их, обработчик получает обычное сообщение
+func (c *codec) decode(msg mq.Message) (mq.Message, error) {
+	encryption, _ := msg.Headers[HeaderEncryption].(string)
+	encoding, _ := msg.Headers[HeaderContentEncoding].(string)
+	if encryption == "" && encoding == "" {
+		return msg, nil
+	}
+	body := msg.Body
+	switch encryption {
+	case "":
+	case EncryptionAESGCM:
+		if c.cfg.Keys == nil {
+			return msg, fmt.Errorf("message is encrypted but no keys are configured")
+		}
+		id, _ := msg.Headers[HeaderKeyID].(string)
+		opened, err := c.cfg.Keys.open(id, body)
+		if err != nil {
+			return msg, err
+		}
+		body = opened
+	default:
+		return msg, fmt.Errorf("%w %q", errUnknownEncoding, encryption)
+	}
+	if encoding != "" {
+		decompressed, err := c.decompress(encoding, body)
+		if err != nil {
+			return msg, err
+		}
+		body = decompressed
+	}
+
+	headers := make(map[string]interface{}, len(msg.Headers))
+	for k, v := range msg.Headers {
+		switch k {
+		case HeaderEncryption, HeaderContentEncoding, HeaderKeyID:
+		default:
+			headers[k] = v
+		}
+	}
+	msg.Body = body
+	msg.Headers = headers
+	return msg, nil
+}
+
+// compress сжимает тело алгоритмом из настроек
+func (c *codec) compress(body []byte) ([]byte, error) {
+	if c.cfg.Compression == CompressionZstd {
+		return c.encoder.EncodeAll(body, make([]byte, 0, len(body))), nil
+	}
+	var buf bytes.Buffer
+	w := gzip.NewWriter(&buf)
+	if _, err := w.Write(body); err != nil {
+		return nil, fmt.Errorf("failed to compress payload due %v", err)
+	}
+	if err := w.Close(); err != nil {
+		return nil, fmt.Errorf("failed to compress payload due %v", err)
+	}
+	return buf.Bytes(), nil
+}
+
+// decompress распаковывает тело алгоритмом encoding
+func (c *codec) decompress(encoding string, body []byte) ([]byte, error) {
+	switch encoding {
+	case CompressionZstd:
+		decoded, err := c.decoder.DecodeAll(body, nil)
+		if err != nil {
+			return nil, fmt.Errorf("failed to decompress payload due %v", err)
+		}
+		return decoded, nil
+	case CompressionGzip:
+		r, err := gzip.NewReader(bytes.NewReader(body))
+		if err != nil {
+			return nil, fmt.Errorf("failed to decompress payload due %v", err)
+		}
+		decoded, err := io.ReadAll(io.LimitReader(r, maxDecodedSize+1))
+		if err != nil {
+			return nil, fmt.Errorf("failed to decompress payload due %v", err)
+		}
+		if len(decoded) > maxDecodedSize {
+			return nil, errTooLarge
+		}
+		return decoded, nil
+	}
+	return nil, fmt.Errorf("%w %q", errUnknownEncoding, encoding)
+}
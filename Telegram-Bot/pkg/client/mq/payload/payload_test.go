@@ -0,0 +1,152 @@
+package payload
+
+import (
+	"bytes"
+	"compress/gzip"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"testing"
+
+	"github.com/Maksat-luci/Telegram-Bot/pkg/client/mq"
+)
+
+// newTestCodec создаёт кодек или останавливает тест
+func newTestCodec(t *testing.T, cfg Config) *codec {
+	t.Helper()
+	c, err := newCodec(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return c
+}
+
+func TestCodecRoundTrip(t *testing.T) {
+	keys := newTestKeyring(t, "k1", map[string][]byte{"k1": keyOld})
+	large := bytes.Repeat([]byte("track "), 1000)
+	for _, compression := range []string{CompressionNone, CompressionGzip, CompressionZstd} {
+		for _, encrypted := range []bool{false, true} {
+			t.Run(fmt.Sprintf("%s encrypted=%v", compression, encrypted), func(t *testing.T) {
+				cfg := Config{Compression: compression}
+				if encrypted {
+					cfg.Keys = keys
+				}
+				c := newTestCodec(t, cfg)
+
+				sent := mq.Message{Body: large, Headers: map[string]interface{}{"x-source": "test"}}
+				encoded, err := c.encode(sent)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if compression != CompressionNone {
+					if encoded.Headers[HeaderContentEncoding] != compression {
+						t.Fatalf("got encoding header %v, want %s", encoded.Headers[HeaderContentEncoding], compression)
+					}
+					if !encrypted && len(encoded.Body) >= len(large) {
+						t.Fatalf("body was not compressed: %d bytes", len(encoded.Body))
+					}
+				}
+				if encrypted && (encoded.Headers[HeaderEncryption] != EncryptionAESGCM || encoded.Headers[HeaderKeyID] != "k1") {
+					t.Fatalf("unexpected encryption headers %v", encoded.Headers)
+				}
+				if _, ok := sent.Headers[HeaderContentEncoding]; ok {
+					t.Fatal("encode changed headers of the original message")
+				}
+
+				decoded, err := c.decode(encoded)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if !bytes.Equal(decoded.Body, large) {
+					t.Fatalf("got %d bytes, want %d", len(decoded.Body), len(large))
+				}
+				if len(decoded.Headers) != 1 || decoded.Headers["x-source"] != "test" {
+					t.Fatalf("got headers %v, want only x-source", decoded.Headers)
+				}
+			})
+		}
+	}
+}
+
+func TestCodecSkipsSmallAndIncompressible(t *testing.T) {
+	c := newTestCodec(t, Config{Compression: CompressionGzip, MinSize: 100})
+
+	small, err := c.encode(mq.Message{Body: bytes.Repeat([]byte("a"), 99)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := small.Headers[HeaderContentEncoding]; ok {
+		t.Fatal("body smaller than MinSize was compressed")
+	}
+
+	random := make([]byte, 4096)
+	if _, err := rand.Read(random); err != nil {
+		t.Fatal(err)
+	}
+	encoded, err := c.encode(mq.Message{Body: random})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := encoded.Headers[HeaderContentEncoding]; ok || !bytes.Equal(encoded.Body, random) {
+		t.Fatal("incompressible body was replaced by a larger compressed one")
+	}
+
+	// сообщение без заголовков доставляется как есть
+	plain := mq.Message{Body: []byte("plain")}
+	decoded, err := c.decode(plain)
+	if err != nil || string(decoded.Body) != "plain" {
+		t.Fatalf("got %q, %v", decoded.Body, err)
+	}
+}
+
+func TestCodecDecodeErrors(t *testing.T) {
+	keys := newTestKeyring(t, "k1", map[string][]byte{"k1": keyOld})
+	withKeys := newTestCodec(t, Config{Keys: keys})
+	withoutKeys := newTestCodec(t, Config{})
+
+	encrypted, err := withKeys.encode(mq.Message{Body: []byte("track")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := withoutKeys.decode(encrypted); err == nil {
+		t.Fatal("encrypted message decoded without keys")
+	}
+
+	// gzip распаковывает подряд идущие потоки как один, так тело больше maxDecodedSize собирается
+	// из копий маленького потока без сжатия 64MB в тесте
+	var member bytes.Buffer
+	w := gzip.NewWriter(&member)
+	if _, err := w.Write(make([]byte, 1<<20)); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	bomb := bytes.Repeat(member.Bytes(), maxDecodedSize>>20+1)
+
+	tests := []struct {
+		name    string
+		headers map[string]interface{}
+		body    []byte
+		want    error
+	}{
+		{name: "unknown encryption", headers: map[string]interface{}{HeaderEncryption: "rot13"}, want: errUnknownEncoding},
+		{name: "unknown compression", headers: map[string]interface{}{HeaderContentEncoding: "brotli"}, want: errUnknownEncoding},
+		{name: "unknown key", headers: map[string]interface{}{HeaderEncryption: EncryptionAESGCM, HeaderKeyID: "k9"}, body: encrypted.Body, want: errUnknownKey},
+		{name: "too large", headers: map[string]interface{}{HeaderContentEncoding: CompressionGzip}, body: bomb, want: errTooLarge},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := withKeys.decode(mq.Message{Body: tt.body, Headers: tt.headers})
+			if !errors.Is(err, tt.want) {
+				t.Fatalf("got %v, want %v", err, tt.want)
+			}
+		})
+	}
+}
+
+func TestNewCodecUnknownCompression(t *testing.T) {
+	if _, err := newCodec(Config{Compression: "brotli"}); err == nil {
+		t.Fatal("codec created with unknown compression")
+	}
+}
@@ -0,0 +1,113 @@
+package payload
+
+import (
+	"context"
+	"time"
+
+	"github.com/Maksat-luci/Telegram-Bot/pkg/client/mq"
+)
+
+// NewProducer оборачивает продьюсера, тела сжимаются и шифруются перед публикацией.
+// Обёртка реализует BatchProducer и ScheduledProducer только если их реализует сам продьюсер
+func NewProducer(p mq.Producer, cfg Config) (mq.Producer, error) {
+	c, err := newCodec(cfg)
+	if err != nil {
+		return nil, err
+	}
+	base := &producer{Producer: p, codec: c}
+	batch, isBatch := p.(mq.BatchProducer)
+	scheduled, isScheduled := p.(mq.ScheduledProducer)
+	switch {
+	case isBatch && isScheduled:
+		return &struct {
+			*producer
+			batching
+			scheduling
+		}{base, batching{c, batch}, scheduling{c, scheduled}}, nil
+	case isBatch:
+		return &struct {
+			*producer
+			batching
+		}{base, batching{c, batch}}, nil
+	case isScheduled:
+		return &struct {
+			*producer
+			scheduling
+		}{base, scheduling{c, scheduled}}, nil
+	}
+	return base, nil
+}
+
+// producer кодирует тела, объявления передаёт как есть
+type producer struct {
+	mq.Producer
+	codec *codec
+}
+
+// Publish отправляет сообщение в очередь target
+func (p *producer) Publish(ctx context.Context, target string, body []byte) error {
+	return p.PublishExchange(ctx, "", target, mq.Message{Body: body})
+}
+
+// PublishMessage отправляет сообщение в очередь target через default exchange
+func (p *producer) PublishMessage(ctx context.Context, target string, msg mq.Message) error {
+	return p.PublishExchange(ctx, "", target, msg)
+}
+
+// PublishExchange кодирует и отправляет сообщение
+func (p *producer) PublishExchange(ctx context.Context, exchange, key string, msg mq.Message) error {
+	msg, err := p.codec.encode(msg)
+	if err != nil {
+		return err
+	}
+	return p.Producer.PublishExchange(ctx, exchange, key, msg)
+}
+
+// batching кодирует асинхронные и пакетные публикации
+type batching struct {
+	codec *codec
+	batch mq.BatchProducer
+}
+
+// PublishAsync кодирует и отправляет сообщение не дожидаясь подтверждения
+func (b batching) PublishAsync(ctx context.Context, exchange, key string, msg mq.Message) <-chan error {
+	msg, err := b.codec.encode(msg)
+	if err != nil {
+		result := make(chan error, 1)
+		result <- err
+		return result
+	}
+	return b.batch.PublishAsync(ctx, exchange, key, msg)
+}
+
+// PublishBatch кодирует и отправляет пакет
+func (b batching) PublishBatch(ctx context.Context, exchange, key string, msgs []mq.Message) error {
+	encoded := make([]mq.Message, len(msgs))
+	for i, msg := range msgs {
+		var err error
+		if encoded[i], err = b.codec.encode(msg); err != nil {
+			return err
+		}
+	}
+	return b.batch.PublishBatch(ctx, exchange, key, encoded)
+}
+
+// scheduling кодирует отложенные публикации, у брокера сообщение ждёт уже зашифрованным
+type scheduling struct {
+	codec     *codec
+	scheduled mq.ScheduledProducer
+}
+
+// PublishAt кодирует и отправляет сообщение не раньше at
+func (s scheduling) PublishAt(ctx context.Context, exchange, key string, msg mq.Message, at time.Time) error {
+	msg, err := s.codec.encode(msg)
+	if err != nil {
+		return err
+	}
+	return s.scheduled.PublishAt(ctx, exchange, key, msg, at)
+}
+
+// PublishAfter кодирует и отправляет сообщение через delay
+func (s scheduling) PublishAfter(ctx context.Context, exchange, key string, msg mq.Message, delay time.Duration) error {
+	return s.PublishAt(ctx, exchange, key, msg, time.Now().Add(delay))
+}
@@ -1,26 +1,39 @@
 package rabbitmq
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	"log"
 	"sync"
 	"time"
 
+	"github.com/Maksat-luci/Telegram-Bot/pkg/client/mq"
 	"github.com/streadway/amqp"
 )
 
 //BaseConfig базовая структура конфига//... базовая структура для структура Consumer and producer
 type BaseConfig struct {
+	// URI полный адрес брокера amqp:// или amqps://, если задан то Host, Port, Username и Password не нужны
+	URI      string
 	Host     string
 	Port     string
 	Username string
 	Password string
+	// VHost виртуальный хост, по умолчанию "/"
+	VHost string
+	TLS   TLSConfig
+	// Heartbeat интервал heartbeat, ноль значит интервал который предложит брокер
+	Heartbeat time.Duration
+	// ConnectionName имя подключения в панели управления RabbitMQ
+	ConnectionName string
+	// Reconnect задержки между попытками переподключения
+	Reconnect Backoff
 }
 
-// константное время реконнекта
 const (
-	reconnectDelay = 5 * time.Second
+	// размер буфера подтверждений публикаций
+	confirmBufferSize = 256
 )
 
 // константные ошибки в случае не подключения
@@ -35,34 +48,128 @@ type rabbitMQBase struct {
 	isConnected bool
 	conn        *amqp.Connection
 	ch          *amqp.Channel
+	// generation растёт с каждым новым каналом, по нему отличаются доставки старого канала
+	generation uint64
 	done        chan bool
+	closeOnce   sync.Once
 	notifyClose chan *amqp.Error
-	reconnects  []chan<- bool
+	reconnects  []chan bool
+	states      []chan<- mq.StateEvent
+	backoff     Backoff
+	amqpConfig  amqp.Config
+	// topology всё что было объявлено, после переподключения объявляется заново
+	topology *topology
+}
+
+// newRabbitMQBase конструктор базовой структуры, подключение делает connect
+func newRabbitMQBase(cfg BaseConfig) *rabbitMQBase {
+	return &rabbitMQBase{
+		done:     make(chan bool),
+		backoff:  cfg.Reconnect.withDefaults(),
+		topology: newTopology(),
+	}
 }
 
 // функция которая обьявляет очередь
-func (r *rabbitMQBase) DeclareQueue(name string, durable, autoDelete, exclusive bool, args map[string]interface{}) error {
+func (r *rabbitMQBase) DeclareQueue(ctx context.Context, name string, durable, autoDelete, exclusive bool, args map[string]interface{}) error {
+	// метод который создаёт очередь с нужными настройками
+	declare := func(ch *amqp.Channel) error {
+		_, err := ch.QueueDeclare(
+			name,
+			durable,
+			autoDelete,
+			exclusive,
+			false,
+			args,
+		)
+		return err
+	}
 	// проверка на подключение
-	if !r.Connected() {
-		return errNotConnected
+	ch, _, err := r.channel()
+	if err != nil {
+		return err
 	}
-	// метод который создаёт очередь с нужными настройками
-	_, err := r.ch.QueueDeclare(
-		name,
-		durable,
-		autoDelete,
-		exclusive,
-		false,
-		args,
-	)
+	err = withContext(ctx, func() error {
+		return declare(ch)
+	})
 
 	if err != nil {
 		return fmt.Errorf("failed to declare queue due %v", err)
 	}
+	// очередь с именем от брокера после реконнекта получит другое имя, её повторять бессмысленно
+	if name != "" {
+		r.topology.add("queue:"+name, declare)
+	}
 
 	return nil
 }
 
+// DeclareExchange объявляет exchange нужного типа
+func (r *rabbitMQBase) DeclareExchange(ctx context.Context, name, kind string, durable, autoDelete bool, args map[string]interface{}) error {
+	declare := func(ch *amqp.Channel) error {
+		return ch.ExchangeDeclare(
+			name,
+			kind,
+			durable,
+			autoDelete,
+			false,
+			false,
+			args,
+		)
+	}
+	// проверка на подключение
+	ch, _, err := r.channel()
+	if err != nil {
+		return err
+	}
+	err = withContext(ctx, func() error {
+		return declare(ch)
+	})
+	if err != nil {
+		return fmt.Errorf("failed to declare exchange due %v", err)
+	}
+	r.topology.add("exchange:"+name, declare)
+	return nil
+}
+
+// BindQueue привязывает очередь к exchange, для fanout ключ игнорируется брокером
+func (r *rabbitMQBase) BindQueue(ctx context.Context, queue, exchange, key string, args map[string]interface{}) error {
+	declare := func(ch *amqp.Channel) error {
+		return ch.QueueBind(queue, key, exchange, false, args)
+	}
+	// проверка на подключение
+	ch, _, err := r.channel()
+	if err != nil {
+		return err
+	}
+	err = withContext(ctx, func() error {
+		return declare(ch)
+	})
+	if err != nil {
+		return fmt.Errorf("failed to bind queue %s to exchange %s due %v", queue, exchange, err)
+	}
+	r.topology.add(fmt.Sprintf("binding:%s:%s:%s", queue, exchange, key), declare)
+	return nil
+}
+
+// withContext выполняет вызов брокера, но возвращает управление как только ctx отменён.
+// Сам вызов при этом доводится до конца в фоне, протокол AMQP не умеет его прерывать
+func withContext(ctx context.Context, fn func() error) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	result := make(chan error, 1)
+	go func() {
+		result <- fn()
+	}()
+	select {
+	case err := <-result:
+		return err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
 func (r *rabbitMQBase) handleReconnect(addr string) {
 	// запускаем бесконечный цикл который будет чекать ошибки и в случае ошибки пытаться переподключиться
 	for {
@@ -77,33 +184,101 @@ func (r *rabbitMQBase) handleReconnect(addr string) {
 			if err == nil {
 				return
 			}
+			r.emit(mq.StateDisconnected, 0, err)
 			// уведоляем о том что пытаемся переподключиться к RabbitMQ
 			log.Print("Trying to reconnect to RabbitMQ...")
-			// запускаем форик и проверяет подключился ли наш адрес снова
-			for !r.boolConnect(addr) {
-				log.Print("Failed to connect to RabbitMQ. Retrying...")
-				// засыпает на 5 секунд для повторной проверки "подключился ли адррес или нет"
-				time.Sleep(reconnectDelay)
+			if !r.reconnect(addr) {
+				return
 			}
 
 			// если всё хорошо то уведомляем через консоль об успешном поделючении
 			log.Print("send signal about successfully reconnect to RabbitMQ")
-			// меняем значение канала на true и добавляем в массив каналов
+			r.emit(mq.StateConnected, 0, nil)
+			// будим всех кто ждёт переподключения, например подписки консьюмера
+			r.lock.Lock()
 			for _, ch := range r.reconnects {
-				ch <- true
+				select {
+				case ch <- true:
+				default:
+				}
 			}
+			r.lock.Unlock()
 		}
 	}
 }
 
-// методы уведомлений тех или иных случаев
-func (r *rabbitMQBase) notifyReconnect(ch chan<- bool) {
+// reconnect пытается подключиться с растущей задержкой и объявляет топологию заново.
+// Возвращает false если во время попыток подключение закрыли
+func (r *rabbitMQBase) reconnect(addr string) bool {
+	for attempt := 0; ; attempt++ {
+		r.emit(mq.StateReconnecting, attempt, nil)
+
+		err := r.connect(addr)
+		var ch *amqp.Channel
+		if err == nil {
+			ch, _, err = r.channel()
+		}
+		if err == nil {
+			if err = r.topology.replay(ch); err != nil {
+				err = fmt.Errorf("failed to redeclare topology due %v", err)
+				r.setConnected(false)
+				_ = r.connection().Close()
+			}
+		}
+		if err == nil {
+			return true
+		}
+
+		delay := r.backoff.Delay(attempt)
+		log.Printf("Failed to connect to RabbitMQ due %v. Retrying in %s...", err, delay)
+		r.emit(mq.StateDisconnected, attempt, err)
+
+		select {
+		case <-time.After(delay):
+		case <-r.done:
+			return false
+		}
+	}
+}
+
+// notifyReconnect подписывает канал на сигнал об успешном переподключении и возвращает функцию отписки.
+// Сигнал отправляется без блокировки, поэтому каналу достаточно буфера на одно значение
+func (r *rabbitMQBase) notifyReconnect(ch chan bool) func() {
+	r.lock.Lock()
+	defer r.lock.Unlock()
 	r.reconnects = append(r.reconnects, ch)
+
+	return func() {
+		r.lock.Lock()
+		defer r.lock.Unlock()
+		for i, c := range r.reconnects {
+			if c == ch {
+				r.reconnects = append(r.reconnects[:i], r.reconnects[i+1:]...)
+				return
+			}
+		}
+	}
 }
 
-// методы уведомлений тех или иных случаев
-func (r *rabbitMQBase) boolConnect(addr string) bool {
-	return r.connect(addr) == nil
+// NotifyState подписывает канал на события смены состояния подключения
+func (r *rabbitMQBase) NotifyState(ch chan<- mq.StateEvent) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.states = append(r.states, ch)
+}
+
+// emit рассылает событие подписчикам, медленный подписчик событие пропускает
+func (r *rabbitMQBase) emit(state mq.ConnectionState, attempt int, err error) {
+	event := mq.StateEvent{State: state, Attempt: attempt, Err: err, At: time.Now()}
+
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	for _, ch := range r.states {
+		select {
+		case ch <- event:
+		default:
+		}
+	}
 }
 
 func (r *rabbitMQBase) connect(addr string) error {
@@ -112,30 +287,40 @@ func (r *rabbitMQBase) connect(addr string) error {
 		return nil
 	}
 	// получаем соединение и обьект для дальнейшей работы с RabbitMQ
-	conn, err := amqp.Dial(addr)
+	conn, err := amqp.DialConfig(addr, r.amqpConfig)
 	if err != nil {
 		return fmt.Errorf("failed to connect to RabbitMQ due %v", err)
 	}
 	//
 	ch, err := conn.Channel()
 	if err != nil {
+		_ = conn.Close()
 		return fmt.Errorf("failed to open channel due %v", err)
 	}
 	// заполняем структуру базового RabbitMQbase
+	r.lock.Lock()
 	r.conn = conn
 	r.ch = ch
+	r.generation++
+	r.lock.Unlock()
 	r.notifyClose = make(chan *amqp.Error)
 	// устанавливаем параметр что мы подключены
 	r.setConnected(true)
 	// в случае ошибки закрывает консьюмера и уведомляет всех продьюсеров что этот консьюмер сломался
 	ch.NotifyClose(r.notifyClose)
-	fmt.Println("Notify")
 	// уведомляем в консоль что мы подключились
 	log.Print("Successfully connected to RabbitMQ")
 
 	return nil
 }
 
+// connection возвращает текущее соединение, после реконнекта это уже новое соединение
+func (r *rabbitMQBase) connection() *amqp.Connection {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	return r.conn
+}
+
 // методы уведомлений тех или иных случаев
 func (r *rabbitMQBase) setConnected(flag bool) {
 	r.lock.Lock()
@@ -153,21 +338,33 @@ func (r *rabbitMQBase) Connected() bool {
 
 // close закрывает все каналы и соединения происходит полное закрытие
 func (r *rabbitMQBase) close() error {
-	// проверка на подключение
+	// проверка на подключение, попытки переподключения при этом всё равно прекращаются
 	if !r.Connected() {
+		r.stop()
 		return errAlreadyClosed
 	}
+	r.lock.Lock()
+	conn, ch := r.conn, r.ch
+	r.lock.Unlock()
 	// закрывает канал
-	if err := r.ch.Close(); err != nil {
+	if err := ch.Close(); err != nil {
 		return fmt.Errorf("failed to close channel due %v", err)
 	}
 	// закрывает все соединения в RabbitMQ и всё что связано с ним
-	if err := r.conn.Close(); err != nil {
+	if err := conn.Close(); err != nil {
 		return fmt.Errorf("failed to close connection due %v", err)
 	}
 	// закрываем канал
-	close(r.done)
+	r.stop()
 	// меняеи значение isConnected на false
 	r.setConnected(false)
 	return nil
 }
+
+// stop останавливает переподключение и сообщает подписчикам о закрытии, повторный вызов ничего не делает
+func (r *rabbitMQBase) stop() {
+	r.closeOnce.Do(func() {
+		close(r.done)
+		r.emit(mq.StateClosed, 0, nil)
+	})
+}
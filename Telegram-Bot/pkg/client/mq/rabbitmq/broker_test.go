@@ -0,0 +1,797 @@
+package rabbitmq
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeBroker сервер AMQP 0-9-1 для тестов. Умеет ровно то, чем пользуется клиент: рукопожатие, каналы,
+// объявления, подтверждения публикаций, подписки, доставку через default exchange и direct привязки. Каждый метод
+// клиента записывается, по этому журналу тесты проверяют что на самом деле дошло до брокера
+type fakeBroker struct {
+	listener net.Listener
+	// latency сколько канал брокера обрабатывает публикацию перед подтверждением. Публикации
+	// одного канала подтверждаются по очереди, как это делает процесс канала в RabbitMQ
+	latency time.Duration
+
+	lock    sync.Mutex
+	conns   map[*fakeConn]bool
+	nextID  int
+	queues  map[string]*fakeQueue
+	methods []fakeMethod
+	// refuse закрывает новые подключения сразу после accept
+	refuse bool
+	// bindings очереди привязанные к exchange, ключ exchange и routing key
+	bindings map[[2]string][]string
+	// nack ключи публикации которые брокер не принимает и отвечает на них basic.nack
+	nack map[string]bool
+	// refuseConfirm отвечает на confirm.select чужим методом, клиент получает ошибку а канал остаётся открытым
+	refuseConfirm bool
+}
+
+// fakeMethod вызов метода клиентом
+type fakeMethod struct {
+	conn    int
+	channel uint16
+	name    string
+	// arg имя очереди или exchange, тег подписки
+	arg string
+	tag uint64
+}
+
+// fakeQueue очередь брокера
+type fakeQueue struct {
+	messages  []fakeMessage
+	consumers []*fakeConsumer
+	next      int
+}
+
+// fakeMessage опубликованное сообщение, свойства хранятся в том виде в каком их прислал клиент
+type fakeMessage struct {
+	exchange    string
+	key         string
+	properties  []byte
+	body        []byte
+	redelivered bool
+}
+
+// fakeConsumer подписка канала на очередь
+type fakeConsumer struct {
+	tag     string
+	queue   string
+	channel *fakeChannel
+}
+
+// fakeConn подключение клиента
+type fakeConn struct {
+	id     int
+	broker *fakeBroker
+	conn   net.Conn
+	wlock  sync.Mutex
+
+	// поля ниже под локом брокера
+	channels map[uint16]*fakeChannel
+}
+
+// fakeChannel канал подключения
+type fakeChannel struct {
+	id   uint16
+	conn *fakeConn
+	// acks очередь подтверждений публикаций, её разбирает горутина канала
+	acks chan fakeConfirm
+
+	// поля ниже под локом брокера
+	published uint64
+	delivered uint64
+	unacked   map[uint64]fakeMessage
+	// incoming публикация у которой ещё не дочитано тело
+	incoming *fakeMessage
+	size     uint64
+}
+
+// fakeConfirm подтверждение публикации, ack false значит basic.nack
+type fakeConfirm struct {
+	tag uint64
+	ack bool
+}
+
+// типы фреймов и их окончание
+const (
+	fakeFrameMethod    = 1
+	fakeFrameHeader    = 2
+	fakeFrameBody      = 3
+	fakeFrameHeartbeat = 8
+	fakeFrameEnd       = 0xCE
+	fakeFrameMax       = 128 * 1024
+)
+
+// newFakeBroker запускает брокер на свободном порту, брокер останавливается вместе с тестом
+func newFakeBroker(t testing.TB) *fakeBroker {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	b := &fakeBroker{
+		listener: listener,
+		conns:    make(map[*fakeConn]bool),
+		queues:   make(map[string]*fakeQueue),
+		bindings: make(map[[2]string][]string),
+		nack:     make(map[string]bool),
+	}
+	go b.serve()
+	t.Cleanup(func() {
+		_ = listener.Close()
+		b.drop()
+	})
+	return b
+}
+
+// config базовый конфиг клиента для подключения к брокеру
+func (b *fakeBroker) config() BaseConfig {
+	return BaseConfig{
+		URI: fmt.Sprintf("amqp://guest:guest@%s/", b.listener.Addr()),
+		// в тестах переподключение не должно ждать секунду
+		Reconnect: Backoff{Initial: 10 * time.Millisecond, Max: 50 * time.Millisecond},
+	}
+}
+
+func (b *fakeBroker) serve() {
+	for {
+		conn, err := b.listener.Accept()
+		if err != nil {
+			return
+		}
+		b.lock.Lock()
+		if b.refuse {
+			b.lock.Unlock()
+			_ = conn.Close()
+			continue
+		}
+		b.nextID++
+		c := &fakeConn{id: b.nextID, broker: b, conn: conn, channels: make(map[uint16]*fakeChannel)}
+		b.conns[c] = true
+		b.lock.Unlock()
+		go c.serve()
+	}
+}
+
+// setLatency задаёт задержку подтверждений для каналов которые включат подтверждения после вызова
+func (b *fakeBroker) setLatency(latency time.Duration) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	b.latency = latency
+}
+
+// drop обрывает все подключения, как это бывает при рестарте брокера
+func (b *fakeBroker) drop() {
+	b.lock.Lock()
+	conns := make([]*fakeConn, 0, len(b.conns))
+	for c := range b.conns {
+		conns = append(conns, c)
+	}
+	b.lock.Unlock()
+	for _, c := range conns {
+		_ = c.conn.Close()
+	}
+}
+
+// setRefuse включает или выключает отказ в новых подключениях
+func (b *fakeBroker) setRefuse(refuse bool) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	b.refuse = refuse
+}
+
+// setRefuseConfirm ломает или чинит перевод каналов в режим подтверждений
+func (b *fakeBroker) setRefuseConfirm(refuse bool) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	b.refuseConfirm = refuse
+}
+
+// connections сколько подключений брокер принял за всё время
+func (b *fakeBroker) connections() int {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	return b.nextID
+}
+
+// calls вызовы метода name в порядке поступления
+func (b *fakeBroker) calls(name string) []fakeMethod {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	var calls []fakeMethod
+	for _, m := range b.methods {
+		if m.name == name {
+			calls = append(calls, m)
+		}
+	}
+	return calls
+}
+
+// ready сколько сообщений очереди ждут доставки
+func (b *fakeBroker) ready(queue string) int {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	if q, ok := b.queues[queue]; ok {
+		return len(q.messages)
+	}
+	return 0
+}
+
+// waitFor ждёт пока cond не станет истинным
+func waitFor(t testing.TB, what string, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func (c *fakeConn) serve() {
+	defer c.closed()
+
+	header := make([]byte, 8)
+	if _, err := io.ReadFull(c.conn, header); err != nil || string(header) != "AMQP\x00\x00\x09\x01" {
+		return
+	}
+	if err := c.handshake(); err != nil {
+		return
+	}
+	for {
+		kind, channel, payload, err := c.readFrame()
+		if err != nil {
+			return
+		}
+		switch kind {
+		case fakeFrameMethod:
+			if !c.method(channel, payload) {
+				return
+			}
+		case fakeFrameHeader:
+			c.header(channel, payload)
+		case fakeFrameBody:
+			c.body(channel, payload)
+		case fakeFrameHeartbeat:
+		}
+	}
+}
+
+// handshake start, tune и open подключения. Heartbeat отключён, если клиент сам его не попросит
+func (c *fakeConn) handshake() error {
+	var start fakeWriter
+	start.octet(0)
+	start.octet(9)
+	start.emptyTable()
+	start.longstr("PLAIN")
+	start.longstr("en_US")
+	if err := c.send(0, 10, 10, start.Bytes()); err != nil {
+		return err
+	}
+	if _, err := c.expect(10, 11); err != nil {
+		return err
+	}
+	var tune fakeWriter
+	tune.short(0)
+	tune.long(fakeFrameMax)
+	tune.short(0)
+	if err := c.send(0, 10, 30, tune.Bytes()); err != nil {
+		return err
+	}
+	if _, err := c.expect(10, 31); err != nil {
+		return err
+	}
+	if _, err := c.expect(10, 40); err != nil {
+		return err
+	}
+	var ok fakeWriter
+	ok.shortstr("")
+	return c.send(0, 10, 41, ok.Bytes())
+}
+
+// expect читает следующий метод и проверяет что это class.method
+func (c *fakeConn) expect(class, method uint16) (*fakeReader, error) {
+	kind, _, payload, err := c.readFrame()
+	if err != nil {
+		return nil, err
+	}
+	r := &fakeReader{b: payload}
+	if kind != fakeFrameMethod || r.short() != class || r.short() != method {
+		return nil, fmt.Errorf("unexpected frame, want method %d.%d", class, method)
+	}
+	return r, nil
+}
+
+func (c *fakeConn) readFrame() (byte, uint16, []byte, error) {
+	header := make([]byte, 7)
+	if _, err := io.ReadFull(c.conn, header); err != nil {
+		return 0, 0, nil, err
+	}
+	payload := make([]byte, binary.BigEndian.Uint32(header[3:])+1)
+	if _, err := io.ReadFull(c.conn, payload); err != nil {
+		return 0, 0, nil, err
+	}
+	if payload[len(payload)-1] != fakeFrameEnd {
+		return 0, 0, nil, errors.New("missing frame end")
+	}
+	return header[0], binary.BigEndian.Uint16(header[1:]), payload[:len(payload)-1], nil
+}
+
+// frame дописывает фрейм в буфер
+func frame(buf *bytes.Buffer, kind byte, channel uint16, payload []byte) {
+	var header [7]byte
+	header[0] = kind
+	binary.BigEndian.PutUint16(header[1:], channel)
+	binary.BigEndian.PutUint32(header[3:], uint32(len(payload)))
+	buf.Write(header[:])
+	buf.Write(payload)
+	buf.WriteByte(fakeFrameEnd)
+}
+
+// send отправляет метод class.method с аргументами args
+func (c *fakeConn) send(channel, class, method uint16, args []byte) error {
+	var buf bytes.Buffer
+	frame(&buf, fakeFrameMethod, channel, methodPayload(class, method, args))
+	return c.write(buf.Bytes())
+}
+
+func methodPayload(class, method uint16, args []byte) []byte {
+	payload := make([]byte, 4, 4+len(args))
+	binary.BigEndian.PutUint16(payload, class)
+	binary.BigEndian.PutUint16(payload[2:], method)
+	return append(payload, args...)
+}
+
+// write пишет фреймы одним куском, так фреймы одного сообщения не перемешаются с другими
+func (c *fakeConn) write(frames []byte) error {
+	c.wlock.Lock()
+	defer c.wlock.Unlock()
+	_, err := c.conn.Write(frames)
+	return err
+}
+
+// method обрабатывает метод клиента, false значит подключение закрыто
+func (c *fakeConn) method(channel uint16, payload []byte) bool {
+	r := &fakeReader{b: payload}
+	class, method := r.short(), r.short()
+	b := c.broker
+
+	switch {
+	case class == 10 && method == 50: // connection.close
+		b.record(c, channel, "connection.close", "", 0)
+		_ = c.send(0, 10, 51, nil)
+		return false
+
+	case class == 20 && method == 10: // channel.open
+		b.lock.Lock()
+		ch := &fakeChannel{id: channel, conn: c, unacked: make(map[uint64]fakeMessage)}
+		c.channels[channel] = ch
+		b.lock.Unlock()
+		var ok fakeWriter
+		ok.longstr("")
+		_ = c.send(channel, 20, 11, ok.Bytes())
+
+	case class == 20 && method == 40: // channel.close
+		b.record(c, channel, "channel.close", "", 0)
+		b.closeChannel(c, channel)
+		_ = c.send(channel, 20, 41, nil)
+
+	case class == 20 && method == 41: // channel.close-ok
+
+	case class == 40 && method == 10: // exchange.declare
+		r.short()
+		b.record(c, channel, "exchange.declare", r.shortstr(), 0)
+		_ = c.send(channel, 40, 11, nil)
+
+	case class == 50 && method == 10: // queue.declare
+		r.short()
+		name := r.shortstr()
+		b.record(c, channel, "queue.declare", name, 0)
+		b.lock.Lock()
+		q := b.queue(name)
+		messages, consumers := len(q.messages), len(q.consumers)
+		b.lock.Unlock()
+		var ok fakeWriter
+		ok.shortstr(name)
+		ok.long(uint32(messages))
+		ok.long(uint32(consumers))
+		_ = c.send(channel, 50, 11, ok.Bytes())
+
+	case class == 50 && method == 20: // queue.bind
+		r.short()
+		queue, exchange, key := r.shortstr(), r.shortstr(), r.shortstr()
+		b.record(c, channel, "queue.bind", queue, 0)
+		b.lock.Lock()
+		binding := [2]string{exchange, key}
+		b.bindings[binding] = append(b.bindings[binding], queue)
+		b.lock.Unlock()
+		_ = c.send(channel, 50, 21, nil)
+
+	case class == 60 && method == 10: // basic.qos
+		_ = c.send(channel, 60, 11, nil)
+
+	case class == 60 && method == 20: // basic.consume
+		r.short()
+		queue, tag := r.shortstr(), r.shortstr()
+		b.record(c, channel, "basic.consume", queue, 0)
+		var ok fakeWriter
+		ok.shortstr(tag)
+		_ = c.send(channel, 60, 21, ok.Bytes())
+		b.lock.Lock()
+		if ch := c.channels[channel]; ch != nil {
+			q := b.queue(queue)
+			q.consumers = append(q.consumers, &fakeConsumer{tag: tag, queue: queue, channel: ch})
+			b.dispatch(q)
+		}
+		b.lock.Unlock()
+
+	case class == 60 && method == 30: // basic.cancel
+		tag := r.shortstr()
+		b.record(c, channel, "basic.cancel", tag, 0)
+		b.lock.Lock()
+		for _, q := range b.queues {
+			q.remove(func(consumer *fakeConsumer) bool { return consumer.tag == tag })
+		}
+		b.lock.Unlock()
+		var ok fakeWriter
+		ok.shortstr(tag)
+		_ = c.send(channel, 60, 31, ok.Bytes())
+
+	case class == 60 && method == 40: // basic.publish
+		r.short()
+		exchange, key := r.shortstr(), r.shortstr()
+		b.record(c, channel, "basic.publish", key, 0)
+		b.lock.Lock()
+		if ch := c.channels[channel]; ch != nil {
+			ch.incoming = &fakeMessage{exchange: exchange, key: key}
+		}
+		b.lock.Unlock()
+
+	case class == 60 && method == 80: // basic.ack
+		tag := r.longlong()
+		multiple := r.octet()&1 != 0
+		b.record(c, channel, "basic.ack", "", tag)
+		b.settle(c, channel, tag, multiple, false)
+
+	case class == 60 && method == 90: // basic.reject
+		tag := r.longlong()
+		requeue := r.octet()&1 != 0
+		b.record(c, channel, "basic.reject", "", tag)
+		b.settle(c, channel, tag, false, requeue)
+
+	case class == 60 && method == 120: // basic.nack
+		tag := r.longlong()
+		bits := r.octet()
+		b.record(c, channel, "basic.nack", "", tag)
+		b.settle(c, channel, tag, bits&1 != 0, bits&2 != 0)
+
+	case class == 85 && method == 10: // confirm.select
+		b.record(c, channel, "confirm.select", "", 0)
+		b.lock.Lock()
+		if b.refuseConfirm {
+			b.lock.Unlock()
+			_ = c.send(channel, 60, 11, nil)
+			break
+		}
+		ch := c.channels[channel]
+		if ch != nil && ch.acks == nil {
+			ch.acks = make(chan fakeConfirm, 1024)
+			go ch.confirm(b.latency)
+		}
+		b.lock.Unlock()
+		_ = c.send(channel, 85, 11, nil)
+
+	default:
+		b.record(c, channel, fmt.Sprintf("%d.%d", class, method), "", 0)
+	}
+	return true
+}
+
+// header заголовок публикации: размер тела и свойства сообщения
+func (c *fakeConn) header(channel uint16, payload []byte) {
+	b := c.broker
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	ch := c.channels[channel]
+	if ch == nil || ch.incoming == nil || len(payload) < 12 {
+		return
+	}
+	ch.size = binary.BigEndian.Uint64(payload[4:])
+	ch.incoming.properties = append([]byte(nil), payload[12:]...)
+	if ch.size == 0 {
+		b.publish(ch)
+	}
+}
+
+// body кусок тела публикации, когда тело дочитано сообщение попадает в очередь
+func (c *fakeConn) body(channel uint16, payload []byte) {
+	b := c.broker
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	ch := c.channels[channel]
+	if ch == nil || ch.incoming == nil {
+		return
+	}
+	ch.incoming.body = append(ch.incoming.body, payload...)
+	if uint64(len(ch.incoming.body)) >= ch.size {
+		b.publish(ch)
+	}
+}
+
+// closed освобождает всё что держало подключение, неподтверждённые сообщения возвращаются в очереди
+func (c *fakeConn) closed() {
+	_ = c.conn.Close()
+	b := c.broker
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	delete(b.conns, c)
+	for id := range c.channels {
+		b.closeChannelLocked(c, id)
+	}
+}
+
+// confirm подтверждает публикации канала по очереди, на каждую уходит latency. Время считается от
+// окончания предыдущей публикации, а не от пробуждения, так неточность таймеров не снижает пропускную способность
+func (ch *fakeChannel) confirm(latency time.Duration) {
+	var done time.Time
+	for confirm := range ch.acks {
+		if latency > 0 {
+			if now := time.Now(); done.Before(now) {
+				done = now
+			}
+			done = done.Add(latency)
+			time.Sleep(time.Until(done))
+		}
+		var ack fakeWriter
+		ack.longlong(confirm.tag)
+		ack.octet(0)
+		if confirm.ack {
+			_ = ch.conn.send(ch.id, 60, 80, ack.Bytes())
+		} else {
+			_ = ch.conn.send(ch.id, 60, 120, ack.Bytes())
+		}
+	}
+}
+
+// record записывает вызов метода
+func (b *fakeBroker) record(c *fakeConn, channel uint16, name, arg string, tag uint64) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	b.methods = append(b.methods, fakeMethod{conn: c.id, channel: channel, name: name, arg: arg, tag: tag})
+}
+
+// queue возвращает очередь, создавая её. Вызывается под локом брокера
+func (b *fakeBroker) queue(name string) *fakeQueue {
+	q, ok := b.queues[name]
+	if !ok {
+		q = &fakeQueue{}
+		b.queues[name] = q
+	}
+	return q
+}
+
+// publish кладёт дочитанную публикацию в очередь и подтверждает её. Вызывается под локом брокера.
+// Default exchange кладёт сообщение в объявленную очередь с именем ключа, остальные exchange в очереди
+// привязанные с тем же ключом, сообщения без очереди брокер молча выбрасывает. Публикацию с ключом из nack
+// брокер теряет и отвечает basic.nack
+func (b *fakeBroker) publish(ch *fakeChannel) {
+	msg := *ch.incoming
+	ch.incoming = nil
+	ack := !b.nack[msg.key]
+	if ack {
+		queues := b.bindings[[2]string{msg.exchange, msg.key}]
+		if msg.exchange == "" {
+			queues = []string{msg.key}
+		}
+		for _, name := range queues {
+			if q, ok := b.queues[name]; ok {
+				q.messages = append(q.messages, msg)
+				b.dispatch(q)
+			}
+		}
+	}
+	if ch.acks != nil {
+		ch.published++
+		ch.acks <- fakeConfirm{tag: ch.published, ack: ack}
+	}
+}
+
+// setNack задаёт ключ публикации которую брокер не примет
+func (b *fakeBroker) setNack(key string, nack bool) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	b.nack[key] = nack
+}
+
+// messages тела сообщений ожидающих в очереди
+func (b *fakeBroker) messages(queue string) []string {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	var bodies []string
+	if q, ok := b.queues[queue]; ok {
+		for _, msg := range q.messages {
+			bodies = append(bodies, string(msg.body))
+		}
+	}
+	return bodies
+}
+
+// dispatch раздаёт сообщения очереди подписчикам по кругу. Вызывается под локом брокера
+func (b *fakeBroker) dispatch(q *fakeQueue) {
+	for len(q.messages) > 0 && len(q.consumers) > 0 {
+		msg := q.messages[0]
+		q.messages = q.messages[1:]
+		consumer := q.consumers[q.next%len(q.consumers)]
+		q.next++
+
+		ch := consumer.channel
+		ch.delivered++
+		ch.unacked[ch.delivered] = fakeMessage{key: consumer.queue, properties: msg.properties, body: msg.body}
+
+		var deliver fakeWriter
+		deliver.shortstr(consumer.tag)
+		deliver.longlong(ch.delivered)
+		if msg.redelivered {
+			deliver.octet(1)
+		} else {
+			deliver.octet(0)
+		}
+		deliver.shortstr(msg.exchange)
+		deliver.shortstr(msg.key)
+
+		var header fakeWriter
+		header.short(60)
+		header.short(0)
+		header.longlong(uint64(len(msg.body)))
+		header.Write(msg.properties)
+
+		var buf bytes.Buffer
+		frame(&buf, fakeFrameMethod, ch.id, methodPayload(60, 60, deliver.Bytes()))
+		frame(&buf, fakeFrameHeader, ch.id, header.Bytes())
+		if len(msg.body) > 0 {
+			frame(&buf, fakeFrameBody, ch.id, msg.body)
+		}
+		_ = ch.conn.write(buf.Bytes())
+	}
+}
+
+// settle ack, nack или reject доставки, requeue возвращает сообщения в начало очереди
+func (b *fakeBroker) settle(c *fakeConn, channel uint16, tag uint64, multiple, requeue bool) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	ch := c.channels[channel]
+	if ch == nil {
+		return
+	}
+	var tags []uint64
+	if multiple {
+		for t := uint64(1); t <= tag; t++ {
+			tags = append(tags, t)
+		}
+	} else {
+		tags = []uint64{tag}
+	}
+	for i := len(tags) - 1; i >= 0; i-- {
+		msg, ok := ch.unacked[tags[i]]
+		if !ok {
+			continue
+		}
+		delete(ch.unacked, tags[i])
+		if requeue {
+			b.requeue(msg)
+		}
+	}
+}
+
+// requeue возвращает доставленное сообщение в начало его очереди. Вызывается под локом брокера
+func (b *fakeBroker) requeue(msg fakeMessage) {
+	q := b.queue(msg.key)
+	msg.redelivered = true
+	q.messages = append([]fakeMessage{msg}, q.messages...)
+	b.dispatch(q)
+}
+
+func (b *fakeBroker) closeChannel(c *fakeConn, channel uint16) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	b.closeChannelLocked(c, channel)
+}
+
+// closeChannelLocked снимает подписки канала и возвращает его неподтверждённые сообщения в очереди
+func (b *fakeBroker) closeChannelLocked(c *fakeConn, channel uint16) {
+	ch := c.channels[channel]
+	if ch == nil {
+		return
+	}
+	delete(c.channels, channel)
+	if ch.acks != nil {
+		close(ch.acks)
+	}
+	for _, q := range b.queues {
+		q.remove(func(consumer *fakeConsumer) bool { return consumer.channel == ch })
+	}
+	for tag := ch.delivered; tag > 0; tag-- {
+		if msg, ok := ch.unacked[tag]; ok {
+			b.requeue(msg)
+		}
+	}
+}
+
+// remove снимает подписки для которых match истинно
+func (q *fakeQueue) remove(match func(*fakeConsumer) bool) {
+	kept := q.consumers[:0]
+	for _, consumer := range q.consumers {
+		if !match(consumer) {
+			kept = append(kept, consumer)
+		}
+	}
+	q.consumers = kept
+}
+
+// fakeReader читает аргументы метода, на коротких данных возвращает нули
+type fakeReader struct {
+	b []byte
+}
+
+func (r *fakeReader) take(n int) []byte {
+	if len(r.b) < n {
+		r.b = nil
+		return make([]byte, n)
+	}
+	v := r.b[:n]
+	r.b = r.b[n:]
+	return v
+}
+
+func (r *fakeReader) octet() byte      { return r.take(1)[0] }
+func (r *fakeReader) short() uint16    { return binary.BigEndian.Uint16(r.take(2)) }
+func (r *fakeReader) longlong() uint64 { return binary.BigEndian.Uint64(r.take(8)) }
+func (r *fakeReader) shortstr() string { return string(r.take(int(r.octet()))) }
+
+// fakeWriter пишет аргументы метода
+type fakeWriter struct {
+	bytes.Buffer
+}
+
+func (w *fakeWriter) octet(v byte) { w.WriteByte(v) }
+
+func (w *fakeWriter) short(v uint16) {
+	var b [2]byte
+	binary.BigEndian.PutUint16(b[:], v)
+	w.Write(b[:])
+}
+
+func (w *fakeWriter) long(v uint32) {
+	var b [4]byte
+	binary.BigEndian.PutUint32(b[:], v)
+	w.Write(b[:])
+}
+
+func (w *fakeWriter) longlong(v uint64) {
+	var b [8]byte
+	binary.BigEndian.PutUint64(b[:], v)
+	w.Write(b[:])
+}
+
+func (w *fakeWriter) shortstr(s string) {
+	w.octet(byte(len(s)))
+	w.WriteString(s)
+}
+
+func (w *fakeWriter) longstr(s string) {
+	w.long(uint32(len(s)))
+	w.WriteString(s)
+}
+
+func (w *fakeWriter) emptyTable() { w.long(0) }
@@ -0,0 +1,118 @@
+package rabbitmq
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/streadway/amqp"
+)
+
+// ошибки подтверждения публикаций
+var (
+	ErrPublishNacked  = errors.New("message was nacked by RabbitMQ")
+	ErrConfirmTimeout = errors.New("timed out waiting for publish confirmation")
+	ErrConfirmLost    = errors.New("channel closed before publish confirmation")
+)
+
+// ConfirmError ошибка публикации которую брокер не подтвердил
+type ConfirmError struct {
+	Exchange    string
+	Key         string
+	DeliveryTag uint64
+	Err         error
+}
+
+func (e *ConfirmError) Error() string {
+	return fmt.Sprintf("failed to confirm message %d to exchange %q with key %q due %v", e.DeliveryTag, e.Exchange, e.Key, e.Err)
+}
+
+// Unwrap позволяет проверять причину через errors.Is
+func (e *ConfirmError) Unwrap() error {
+	return e.Err
+}
+
+// confirms хранит ожидающие подтверждения публикации одного канала по их delivery tag
+type confirms struct {
+	lock    sync.Mutex
+	next    uint64
+	pending map[uint64]chan bool
+}
+
+// newConfirms начинает слушать подтверждения канала, нумерация публикаций на новом канале начинается с 1
+func newConfirms(notify <-chan amqp.Confirmation) *confirms {
+	c := &confirms{
+		next:    1,
+		pending: make(map[uint64]chan bool),
+	}
+	go c.listen(notify)
+	return c
+}
+
+// add регистрирует следующую публикацию, вызывается под тем же локом что и сама публикация
+func (c *confirms) add() (uint64, <-chan bool) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	tag := c.next
+	c.next++
+	waiter := make(chan bool, 1)
+	c.pending[tag] = waiter
+	return tag, waiter
+}
+
+// remove забывает публикацию которая не дошла до брокера или больше не ждёт подтверждения
+func (c *confirms) remove(tag uint64) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	delete(c.pending, tag)
+}
+
+// listen раздаёт подтверждения ожидающим, а когда канал закрывается отпускает всех оставшихся
+func (c *confirms) listen(notify <-chan amqp.Confirmation) {
+	for confirmation := range notify {
+		c.lock.Lock()
+		waiter, ok := c.pending[confirmation.DeliveryTag]
+		delete(c.pending, confirmation.DeliveryTag)
+		c.lock.Unlock()
+
+		if ok {
+			waiter <- confirmation.Ack
+		}
+	}
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	for tag, waiter := range c.pending {
+		close(waiter)
+		delete(c.pending, tag)
+	}
+}
+
+// wait ждёт подтверждения публикации до истечения timeout или отмены ctx
+func (c *confirms) wait(ctx context.Context, exchange, key string, tag uint64, waiter <-chan bool, timeout time.Duration) error {
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+
+	var err error
+	select {
+	case ack, ok := <-waiter:
+		switch {
+		case !ok:
+			err = ErrConfirmLost
+		case !ack:
+			err = ErrPublishNacked
+		default:
+			return nil
+		}
+	case <-timer.C:
+		c.remove(tag)
+		err = ErrConfirmTimeout
+	case <-ctx.Done():
+		c.remove(tag)
+		err = ctx.Err()
+	}
+	return &ConfirmError{Exchange: exchange, Key: key, DeliveryTag: tag, Err: err}
+}
@@ -1,6 +1,7 @@
 package rabbitmq
 
 import (
+	"context"
 	"fmt"
 	"log"
 	"time"
@@ -14,40 +15,56 @@ type ConsumerConfig struct {
 	BaseConfig
 	// в крации нагружаемость консьюмера сообщениями
 	PrefetchCount int
+	// Retry настройки повторов и dead-letter, нулевое значение отключает их
+	Retry mq.RetryPolicy
+	// ConfirmTimeout сколько ждать подтверждения копии сообщения в retry или parking очереди
+	ConfirmTimeout time.Duration
 }
 
 // rabbitMQConsumer структура содержит в себе ссылку на базовую структуру rabbitMQ а в нём все филды для комфортной работы
 type rabbitMQConsumer struct {
 	*rabbitMQBase
-	reconnectCh   chan bool
 	prefetchCount int
+	retry         mq.RetryPolicy
+	// очереди для которых объявлена retry топология
+	retryQueues map[string]bool
+	// временные очереди (exclusive или auto-delete), им retry топология не нужна
+	tempQueues map[string]bool
+	// pool каналы с подтверждениями для копий сообщений, исходное сообщение подтверждается только после ack копии
+	pool           *channelPool
+	confirmTimeout time.Duration
 }
 
-const (
-	consumeDelay = 1 * time.Second
-)
+// settleChannels сколько каналов держит пул для копий, Settle вызывают воркеры параллельно
+const settleChannels = 4
 
 // NewRabbitMQConsumer конструктор который автоматически подключается к серверу RabbitMQ и возвращает интерфейс консьюмера
 func NewRabbitMQConsumer(cfg ConsumerConfig) (mq.Consumer, error) {
 	// получаем обьект и заполняем его  базовые филды
 	consumer := &rabbitMQConsumer{
-		prefetchCount: cfg.PrefetchCount,
-		reconnectCh:   make(chan bool),
-		rabbitMQBase: &rabbitMQBase{
-			done: make(chan bool),
-		},
+		prefetchCount:  cfg.PrefetchCount,
+		retry:          cfg.Retry,
+		retryQueues:    make(map[string]bool),
+		tempQueues:     make(map[string]bool),
+		rabbitMQBase:   newRabbitMQBase(cfg.BaseConfig),
+		confirmTimeout: cfg.ConfirmTimeout,
+	}
+	if consumer.confirmTimeout <= 0 {
+		consumer.confirmTimeout = defaultConfirmTimeout
 	}
+	consumer.pool = newChannelPool(consumer.connection, settleChannels, true)
 	// строим стринг и передаём из конфига нужные данные
-	addr := fmt.Sprintf("amqp://%s:%s@%s:%s/", cfg.Username, cfg.Password, cfg.Host, cfg.Port)
+	addr, err := consumer.configure(cfg.BaseConfig)
+	if err != nil {
+		return nil, err
+	}
 	// устанавливаем соединение передаём туда адресс и заполняем основную структура RabbitMQBase
-	err := consumer.connect(addr)
+	err = consumer.connect(addr)
 	// в случае ошибки валидируем её
 
 	if err != nil {
 		return nil, err
 	}
-	// записываем наш канал в список каналов основной структуры RabbitMQBase
-	consumer.notifyReconnect(consumer.reconnectCh)
 	// запускаем горутину которая в случае ошибки будет пытаться переподключиться
 	go consumer.handleReconnect(addr)
 	// возвращаем интерфейс консьюмера
@@ -58,53 +75,82 @@ func NewRabbitMQConsumer(cfg ConsumerConfig) (mq.Consumer, error) {
 Далее идут методы интерфейса КОНСЬЮМЕРА  для взаимодейтсвия с продюсером и так далее
 */
 
-// забераем с очереди сообщения, далее структурируем его в канал сообщения, и возвращаем
-func (r *rabbitMQConsumer) Consume(target string) (<-chan mq.Message, error) {
+// забераем с очереди сообщения, далее структурируем его в канал сообщения, и возвращаем.
+// Когда ctx отменяется подписка на очередь снимается и канал закрывается
+func (r *rabbitMQConsumer) Consume(ctx context.Context, target string) (<-chan mq.Message, error) {
 	// проверяем на подключение
 	if !r.Connected() {
 		return nil, errNotConnected
 	}
+	// объявляем очереди задержки и parking очередь для неудачных сообщений
+	if r.retry.Enabled() && !r.isTempQueue(target) {
+		err := withContext(ctx, func() error {
+			return r.declareRetryTopology(target)
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+	// тег подписки нужен чтобы потом снять именно её
+	tag := fmt.Sprintf("%s.%s", target, mq.NewID())
 	// получаем канал типа структуры с которого будет непрерывно записываться информация для наших консьюмеров
 	// получаем сообщения с определенной очереди
-	messages, err := r.consume(target)
+	var messages <-chan amqp.Delivery
+	var generation uint64
+	err := withContext(ctx, func() error {
+		var err error
+		messages, generation, err = r.consume(target, tag)
+		return err
+	})
 	if err != nil {
 		return nil, fmt.Errorf("failed to consume messages due %v", err)
 	}
+	// подписка на сигнал о переподключении, у каждой подписки на очередь своя
+	reconnected := make(chan bool, 1)
+	unsubscribe := r.notifyReconnect(reconnected)
 	// создаём канал типом структуры Message у которого филды ID uint64 and BODY []byte
 	ch := make(chan mq.Message)
 	// запускаем горутину
 	go func() {
+		defer close(ch)
+		defer unsubscribe()
 		// запускаем бесконечный цикл внутри горутины
 		for {
 			// c помощью селект проверяем каналы
 			select {
 			// считываем с канала данные
-			case message, ok := <-messages:
+			case delivery, ok := <-messages:
 				if !ok {
-					// если ничего нет то засыпаем на 1 секунду
-					time.Sleep(consumeDelay)
+					// канал доставок закрылся вместе с соединением, ждём сигнала о переподключении
+					messages = nil
 					continue
 				}
-				// создаём обьект структуры Message, заполнем его поля из полученного ранее структуры Delivery из канала message
-				ch <- mq.Message{
-					ID:   message.DeliveryTag,
-					Body: message.Body,
+				// создаём обьект структуры Message, заполнем его поля из полученного ранее структуры Delivery
+				msg := message(delivery, target)
+				// ID помнит канал доставки, подтверждение после переподключения не уйдёт в новый канал
+				msg.ID = deliveryID(generation, delivery.DeliveryTag)
+				select {
+				case ch <- msg:
+				case <-ctx.Done():
+					// сообщение так и не отдали воркеру, возвращаем его в очередь
+					if err := delivery.Nack(false, true); err != nil {
+						log.Printf("failed to requeue message with id %d due %v", delivery.DeliveryTag, err)
+					}
+					r.cancel(tag)
+					return
+				case <-r.done:
+					return
 				}
 				// если с этого канала поступает плохая информация то мы переотправляем сообщение
-			case <-r.reconnectCh:
+			case <-reconnected:
 				log.Print("Start to reconsume messages")
-				for {
-					// пытаемся получить канал со структурой для дальнейшей обработки
-					messages, err = r.consume(target)
-					if err != nil {
-						break
-					}
-					// уведомляем о том что не удалось отправить сообщение
-					log.Printf("failed to reconsume messages due %v", err)
-				}
+				messages, generation = r.reconsume(ctx, target, tag)
+
+			case <-ctx.Done():
+				r.cancel(tag)
+				return
 
 			case <-r.done:
-				close(ch)
 				return
 
 			}
@@ -114,18 +160,77 @@ func (r *rabbitMQConsumer) Consume(target string) (<-chan mq.Message, error) {
 	return ch, nil
 }
 
+// reconsume заново подписывается на очередь после переподключения, пока не получится
+// или пока подписку не отменят. Возвращает nil если подписаться так и не удалось
+func (r *rabbitMQConsumer) reconsume(ctx context.Context, target, tag string) (<-chan amqp.Delivery, uint64) {
+	for attempt := 0; ; attempt++ {
+		// топология уже объявлена заново при переподключении, consume выставляет QoS на новом канале
+		messages, generation, err := r.consume(target, tag)
+		if err == nil {
+			return messages, generation
+		}
+		// уведомляем о том что не удалось переподписаться
+		delay := r.backoff.Delay(attempt)
+		log.Printf("failed to reconsume messages due %v. Retrying in %s...", err, delay)
+
+		select {
+		case <-time.After(delay):
+		case <-ctx.Done():
+			return nil, 0
+		case <-r.done:
+			return nil, 0
+		}
+	}
+}
+
+// cancel снимает подписку, новые сообщения перестают приходить, неподтверждённые остаются за консьюмером
+func (r *rabbitMQConsumer) cancel(tag string) {
+	ch, _, err := r.channel()
+	if err != nil {
+		return
+	}
+	if err := ch.Cancel(tag, false); err != nil {
+		log.Printf("failed to cancel consumer %s due %v", tag, err)
+	}
+}
+
+// DeclareQueue объявляет очередь и запоминает временные очереди
+func (r *rabbitMQConsumer) DeclareQueue(ctx context.Context, name string, durable, autoDelete, exclusive bool, args map[string]interface{}) error {
+	if err := r.rabbitMQBase.DeclareQueue(ctx, name, durable, autoDelete, exclusive, args); err != nil {
+		return err
+	}
+	if autoDelete || exclusive {
+		r.lock.Lock()
+		r.tempQueues[name] = true
+		r.lock.Unlock()
+	}
+	return nil
+}
+
+// isTempQueue объявлялась ли очередь как временная
+func (r *rabbitMQConsumer) isTempQueue(name string) bool {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	return r.tempQueues[name]
+}
+
 // забирает данные с очереди которая указана в принемаемых параметрах, и возвращаем канал структуры Delivery с сообщением от продьюсера
-func (r *rabbitMQConsumer)consume(target string) (<-chan amqp.Delivery, error) {
+// вместе с поколением канала на котором идёт доставка
+func (r *rabbitMQConsumer)consume(target, tag string) (<-chan amqp.Delivery, uint64, error) {
+	ch, generation, err := r.channel()
+	if err != nil {
+		return nil, 0, err
+	}
 	// настраиваем Qos который отвечает за передачу сообщений consumeram до получение подтверждения от них
-	err := r.ch.Qos(r.prefetchCount, 0, false)
+	err = ch.Qos(r.prefetchCount, 0, false)
 	if err != nil {
-		return nil, fmt.Errorf("failed to set QoS due %v", err)
+		return nil, 0, fmt.Errorf("failed to set QoS due %v", err)
 	}
 	// Consume метод который начинает немедленно доставлять сообщения консьюмером у него есть многие параметры которые нужно настраивать в зависимости от функционала
 	// подключаемся к очереди и забираем отуда канал с данными Delivery
-	messages, err := r.ch.Consume(
+	messages, err := ch.Consume(
 		target,
-		"",
+		tag,
 		false,
 		false,
 		false,
@@ -134,20 +239,25 @@ func (r *rabbitMQConsumer)consume(target string) (<-chan amqp.Delivery, error) {
 	)
 
 	if err != nil {
-		return nil, err
+		return nil, 0, err
 	}
 	// возвращаем канал с которого можно только считывать.
-	return messages, nil
+	return messages, generation, nil
 }
 
 // Ack подтверждает-то что принял сообщение
-func (r *rabbitMQConsumer)Ack(id uint64, multiple bool) error {
-	// проверяем на подключение
-	if !r.Connected() {
-		return errNotConnected
+func (r *rabbitMQConsumer)Ack(ctx context.Context, id uint64, multiple bool) error {
+	// отменённый контекст значит что вызывающий уже не ждёт результата
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	// проверяем на подключение и что сообщение доставил текущий канал
+	ch, tag, err := r.deliveryChannel(id)
+	if err != nil {
+		return err
 	}
 	// подтверждает доставку сообщения
-	err := r.ch.Ack(id, multiple)
+	err = ch.Ack(tag, multiple)
 	if err != nil {
 		return fmt.Errorf("failed to ack message with id %d due %v", id, err)
 	}
@@ -155,13 +265,18 @@ func (r *rabbitMQConsumer)Ack(id uint64, multiple bool) error {
 }
 
 //Nack метод который уведомляет сервер о том что не удалось обработать сообщение
-func (r *rabbitMQConsumer)Nack(id uint64, multiple bool, requeue bool) error {
-	// проверка на подключение
-	if !r.Connected() {
-		return errNotConnected
+func (r *rabbitMQConsumer)Nack(ctx context.Context, id uint64, multiple bool, requeue bool) error {
+	// отменённый контекст значит что вызывающий уже не ждёт результата
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	// проверка на подключение и что сообщение доставил текущий канал
+	ch, tag, err := r.deliveryChannel(id)
+	if err != nil {
+		return err
 	}
 	// метод который говорит о том что сообщение не удалось обработать и ее необходимо доставить повторно или отбросить
-	err := r.ch.Nack(id, multiple, requeue)
+	err = ch.Nack(tag, multiple, requeue)
 	if err != nil {
 		return fmt.Errorf("failed to nack message with %d due %v", id, err)
 	}
@@ -169,13 +284,18 @@ func (r *rabbitMQConsumer)Nack(id uint64, multiple bool, requeue bool) error {
 }
 
 // подобие Nack только для единичных сообщений
-func (r *rabbitMQConsumer)Reject(id uint64, requeue bool) error {
-	// проверка на подключение
-	if !r.Connected() {
-		return errNotConnected
+func (r *rabbitMQConsumer)Reject(ctx context.Context, id uint64, requeue bool) error {
+	// отменённый контекст значит что вызывающий уже не ждёт результата
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	// проверка на подключение и что сообщение доставил текущий канал
+	ch, tag, err := r.deliveryChannel(id)
+	if err != nil {
+		return err
 	}
 	// работает точно так же как Nack только reject уведомляет сервер только об одном сообщение а Nack имеет возможность уведомить о всех
-	err := r.ch.Reject(id, requeue)
+	err = ch.Reject(tag, requeue)
 	if err != nil {
 		return fmt.Errorf("failed to reject message with %d due %v", id, err)
 	}
@@ -184,6 +304,7 @@ func (r *rabbitMQConsumer)Reject(id uint64, requeue bool) error {
 
 // метод который закрывает все подключения и соединения в Rabbit MQ
 func (r *rabbitMQConsumer)Close() error {
+	r.pool.close()
 	if err := r.close(); err != nil {
 		return err
 	}
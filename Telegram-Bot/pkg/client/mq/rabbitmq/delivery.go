@@ -0,0 +1,52 @@
+package rabbitmq
+
+import (
+	"github.com/Maksat-luci/Telegram-Bot/pkg/client/mq"
+	"github.com/streadway/amqp"
+)
+
+// Delivery tag имеет смысл только на канале который доставил сообщение, а после переподключения
+// канал уже другой. Поэтому ID сообщения консьюмера хранит в старших битах поколение канала, а в
+// младших сам delivery tag: подтверждение сообщения со старого канала не уходит в новый
+const (
+	// tagBits сколько младших бит ID отдано под delivery tag, столько сообщений один канал не доставит
+	tagBits = 40
+	tagMask = 1<<tagBits - 1
+)
+
+// deliveryID собирает ID сообщения из поколения канала и delivery tag
+func deliveryID(generation, tag uint64) uint64 {
+	return generation<<tagBits | tag&tagMask
+}
+
+// splitDeliveryID разбирает ID сообщения на поколение канала и delivery tag
+func splitDeliveryID(id uint64) (generation, tag uint64) {
+	return id >> tagBits, id & tagMask
+}
+
+// channel возвращает текущий канал и его поколение. Состояние и канал читаются под одной блокировкой,
+// поэтому разрыв между проверкой подключения и получением канала не отдаст вызывающему nil
+func (r *rabbitMQBase) channel() (*amqp.Channel, uint64, error) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if !r.isConnected || r.ch == nil {
+		return nil, 0, errNotConnected
+	}
+	return r.ch, r.generation, nil
+}
+
+// deliveryChannel возвращает канал который доставил сообщение id и его delivery tag.
+// Если канал с тех пор переподключился возвращает mq.ErrStaleDelivery, ничего не отправляя брокеру:
+// старый канал закрыт, и брокер сам доставит сообщение ещё раз
+func (r *rabbitMQBase) deliveryChannel(id uint64) (*amqp.Channel, uint64, error) {
+	generation, tag := splitDeliveryID(id)
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if !r.isConnected {
+		return nil, 0, errNotConnected
+	}
+	if generation != r.generation {
+		return nil, 0, mq.ErrStaleDelivery
+	}
+	return r.ch, tag, nil
+}
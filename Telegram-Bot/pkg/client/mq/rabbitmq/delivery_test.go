@@ -0,0 +1,133 @@
+package rabbitmq
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/Maksat-luci/Telegram-Bot/pkg/client/mq"
+)
+
+func TestDeliveryID(t *testing.T) {
+	tests := []struct {
+		generation, tag uint64
+	}{
+		{generation: 0, tag: 1},
+		{generation: 1, tag: 1},
+		{generation: 7, tag: 12345},
+		{generation: 1, tag: tagMask},
+		{generation: 1<<(64-tagBits) - 1, tag: tagMask},
+	}
+	for _, tt := range tests {
+		id := deliveryID(tt.generation, tt.tag)
+		generation, tag := splitDeliveryID(id)
+		if generation != tt.generation || tag != tt.tag {
+			t.Fatalf("split(deliveryID(%d, %d)) = %d, %d", tt.generation, tt.tag, generation, tag)
+		}
+	}
+
+	// один и тот же delivery tag на разных поколениях канала даёт разные ID
+	if deliveryID(1, 5) == deliveryID(2, 5) {
+		t.Fatal("same id for different generations")
+	}
+	// tag шире tagBits не задевает поколение
+	if generation, tag := splitDeliveryID(deliveryID(3, tagMask+2)); generation != 3 || tag != 1 {
+		t.Fatalf("overflowing tag changed generation: got %d, %d", generation, tag)
+	}
+}
+
+// Воркер ещё обрабатывает сообщения, а канал за это время переподключился. Новый канал нумерует доставки
+// заново с единицы, поэтому подтверждение по старому tag задело бы чужое сообщение. Все способы
+// подтвердить старое сообщение возвращают ErrStaleDelivery и ничего не отправляют брокеру
+func TestStaleDelivery(t *testing.T) {
+	ctx := context.Background()
+	broker := newFakeBroker(t)
+	retry := mq.RetryPolicy{MaxRetries: 3, InitialDelay: time.Second, Multiplier: 2, DeadLetter: true}
+	consumer := newTestConsumer(t, broker, ConsumerConfig{PrefetchCount: 10, Retry: retry})
+	producer := newTestProducer(t, broker, ProducerConfig{Confirm: true, ConfirmTimeout: time.Second})
+	states := make(chan mq.StateEvent, 16)
+	consumer.NotifyState(states)
+
+	if err := consumer.DeclareQueue(ctx, "tracks", true, false, false, nil); err != nil {
+		t.Fatal(err)
+	}
+	messages, err := consumer.Consume(ctx, "tracks")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 3; i++ {
+		if err := producer.Publish(ctx, "tracks", []byte(fmt.Sprintf("track %d", i))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	stale := make([]mq.Message, 3)
+	for i := range stale {
+		stale[i] = receiveMessage(t, messages)
+	}
+
+	broker.drop()
+	waitState(t, states, mq.StateConnected)
+	waitFor(t, "consumer to resubscribe", func() bool { return len(broker.calls("basic.consume")) == 2 })
+
+	// брокер вернул неподтверждённые сообщения в очередь и доставил их новому каналу
+	fresh := make([]mq.Message, 3)
+	for i := range fresh {
+		fresh[i] = receiveMessage(t, messages)
+		if !fresh[i].Redelivered {
+			t.Fatalf("message %q after reconnect is not marked redelivered", fresh[i].Body)
+		}
+	}
+
+	if err := consumer.Ack(ctx, stale[0].ID, false); !errors.Is(err, mq.ErrStaleDelivery) {
+		t.Fatalf("ack: got %v, want %v", err, mq.ErrStaleDelivery)
+	}
+	if err := consumer.Nack(ctx, stale[1].ID, false, true); !errors.Is(err, mq.ErrStaleDelivery) {
+		t.Fatalf("nack: got %v, want %v", err, mq.ErrStaleDelivery)
+	}
+	if err := consumer.Reject(ctx, stale[1].ID, false); !errors.Is(err, mq.ErrStaleDelivery) {
+		t.Fatalf("reject: got %v, want %v", err, mq.ErrStaleDelivery)
+	}
+	if _, err := consumer.Settle(ctx, stale[2], mq.OutcomeRetry); !errors.Is(err, mq.ErrStaleDelivery) {
+		t.Fatalf("settle: got %v, want %v", err, mq.ErrStaleDelivery)
+	}
+	for _, name := range []string{"basic.ack", "basic.nack", "basic.reject"} {
+		if calls := broker.calls(name); len(calls) != 0 {
+			t.Fatalf("stale settlement reached the broker: %v", calls)
+		}
+	}
+	// копия для повтора тоже не публикуется, иначе вместе с повторной доставкой брокера вышел бы дубликат
+	if n := len(broker.calls("basic.publish")); n != 3 {
+		t.Fatalf("broker got %d publishes, want only the 3 original ones", n)
+	}
+
+	for _, msg := range fresh {
+		if err := consumer.Ack(ctx, msg.ID, false); err != nil {
+			t.Fatal(err)
+		}
+	}
+	waitFor(t, "acks on the new channel", func() bool { return len(broker.calls("basic.ack")) == 3 })
+	resubscribed := broker.calls("basic.consume")[1]
+	for _, call := range broker.calls("basic.ack") {
+		if call.conn != resubscribed.conn || call.channel != resubscribed.channel {
+			t.Fatalf("ack went to connection %d channel %d, want the new channel %d of connection %d",
+				call.conn, call.channel, resubscribed.channel, resubscribed.conn)
+		}
+	}
+}
+
+// receiveMessage ждёт следующее сообщение из канала консьюмера
+func receiveMessage(t *testing.T, messages <-chan mq.Message) mq.Message {
+	t.Helper()
+	select {
+	case msg, ok := <-messages:
+		if !ok {
+			t.Fatal("messages channel closed")
+		}
+		return msg
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for message")
+	}
+	return mq.Message{}
+}
@@ -0,0 +1,133 @@
+package rabbitmq
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"os"
+	"strconv"
+
+	"github.com/streadway/amqp"
+)
+
+// TLSConfig настройки TLS подключения (amqps)
+type TLSConfig struct {
+	Enabled bool
+	// CAFile сертификат центра который подписал сертификат брокера, если пусто то используются системные
+	CAFile string
+	// CertFile и KeyFile клиентский сертификат, нужен если брокер проверяет клиентов
+	CertFile string
+	KeyFile  string
+	// ServerName имя в сертификате брокера, по умолчанию хост
+	ServerName string
+	// InsecureSkipVerify отключает проверку сертификата брокера, только для разработки
+	InsecureSkipVerify bool
+}
+
+// порты RabbitMQ по умолчанию
+const (
+	defaultPort    = 5672
+	defaultTLSPort = 5671
+)
+
+// configure собирает адрес брокера и настройки подключения из конфига.
+// Если задан URI то он используется как есть, отдельные поля только дополняют его
+func (r *rabbitMQBase) configure(cfg BaseConfig) (string, error) {
+	uri, err := cfg.uri()
+	if err != nil {
+		return "", err
+	}
+
+	r.amqpConfig = amqp.Config{
+		Heartbeat: cfg.Heartbeat,
+	}
+	if cfg.ConnectionName != "" {
+		// имя подключения видно в панели управления RabbitMQ
+		r.amqpConfig.Properties = amqp.Table{
+			"product":         "Telegram-Bot",
+			"connection_name": cfg.ConnectionName,
+		}
+	}
+	if uri.Scheme == "amqps" {
+		host := uri.Host
+		if cfg.TLS.ServerName != "" {
+			host = cfg.TLS.ServerName
+		}
+		r.amqpConfig.TLSClientConfig, err = cfg.TLS.load(host)
+		if err != nil {
+			return "", err
+		}
+	}
+	return uri.String(), nil
+}
+
+// uri разбирает URI из конфига или собирает его из отдельных полей, экранирование делает amqp.URI
+func (cfg BaseConfig) uri() (amqp.URI, error) {
+	if cfg.URI != "" {
+		uri, err := amqp.ParseURI(cfg.URI)
+		if err != nil {
+			// сам URI в ошибку не пишем, в нём пароль
+			return amqp.URI{}, fmt.Errorf("failed to parse RabbitMQ URI due %v", err)
+		}
+		if cfg.VHost != "" {
+			uri.Vhost = cfg.VHost
+		}
+		if cfg.TLS.Enabled && uri.Scheme != "amqps" {
+			uri.Scheme = "amqps"
+			if uri.Port == defaultPort {
+				uri.Port = defaultTLSPort
+			}
+		}
+		return uri, nil
+	}
+
+	uri := amqp.URI{
+		Scheme:   "amqp",
+		Host:     cfg.Host,
+		Port:     defaultPort,
+		Username: cfg.Username,
+		Password: cfg.Password,
+		Vhost:    "/",
+	}
+	if cfg.TLS.Enabled {
+		uri.Scheme = "amqps"
+		uri.Port = defaultTLSPort
+	}
+	if cfg.Port != "" {
+		port, err := strconv.Atoi(cfg.Port)
+		if err != nil {
+			return amqp.URI{}, fmt.Errorf("invalid RabbitMQ port %q", cfg.Port)
+		}
+		uri.Port = port
+	}
+	if cfg.VHost != "" {
+		uri.Vhost = cfg.VHost
+	}
+	return uri, nil
+}
+
+// load читает сертификаты и возвращает конфиг TLS
+func (t TLSConfig) load(serverName string) (*tls.Config, error) {
+	config := &tls.Config{
+		ServerName:         serverName,
+		InsecureSkipVerify: t.InsecureSkipVerify,
+	}
+	if t.CAFile != "" {
+		ca, err := os.ReadFile(t.CAFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read CA file due %v", err)
+		}
+		config.RootCAs = x509.NewCertPool()
+		if !config.RootCAs.AppendCertsFromPEM(ca) {
+			return nil, fmt.Errorf("no certificates found in CA file %s", t.CAFile)
+		}
+	}
+	if t.CertFile != "" || t.KeyFile != "" {
+		cert, err := tls.LoadX509KeyPair(t.CertFile, t.KeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load client certificate due %v", err)
+		}
+		config.Certificates = []tls.Certificate{cert}
+	}
+	return config, nil
+}
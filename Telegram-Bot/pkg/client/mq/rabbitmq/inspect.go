@@ -0,0 +1,31 @@
+package rabbitmq
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/Maksat-luci/Telegram-Bot/pkg/client/mq"
+	"github.com/streadway/amqp"
+)
+
+// InspectQueue запрашивает у брокера число готовых сообщений и консьюмеров очереди. Запрос идёт
+// через отдельный канал: если очереди нет брокер закрывает канал, и основной канал должен это пережить
+func (r *rabbitMQBase) InspectQueue(ctx context.Context, name string) (mq.QueueStats, error) {
+	if !r.Connected() {
+		return mq.QueueStats{}, errNotConnected
+	}
+	var queue amqp.Queue
+	err := withContext(ctx, func() error {
+		ch, err := r.connection().Channel()
+		if err != nil {
+			return err
+		}
+		defer ch.Close()
+		queue, err = ch.QueueInspect(name)
+		return err
+	})
+	if err != nil {
+		return mq.QueueStats{}, fmt.Errorf("failed to inspect queue %s due %v", name, err)
+	}
+	return mq.QueueStats{Messages: queue.Messages, Consumers: queue.Consumers}, nil
+}
@@ -0,0 +1,40 @@
+package rabbitmq
+
+import (
+	"github.com/Maksat-luci/Telegram-Bot/pkg/client/mq"
+	"github.com/streadway/amqp"
+)
+
+// publishing переводит наше сообщение в публикацию AMQP со всеми метаданными
+func publishing(msg mq.Message) amqp.Publishing {
+	return amqp.Publishing{
+		DeliveryMode:  amqp.Persistent,
+		Headers:       amqp.Table(msg.Headers),
+		ContentType:   msg.ContentType,
+		CorrelationId: msg.CorrelationID,
+		ReplyTo:       msg.ReplyTo,
+		MessageId:     msg.MessageID,
+		Timestamp:     msg.Timestamp,
+		AppId:         msg.AppID,
+		Body:          msg.Body,
+	}
+}
+
+// message переводит доставку AMQP из очереди queue в наше сообщение
+func message(d amqp.Delivery, queue string) mq.Message {
+	return mq.Message{
+		ID:            d.DeliveryTag,
+		Body:          d.Body,
+		MessageID:     d.MessageId,
+		CorrelationID: d.CorrelationId,
+		Timestamp:     d.Timestamp,
+		ContentType:   d.ContentType,
+		AppID:         d.AppId,
+		Redelivered:   d.Redelivered,
+		ReplyTo:       d.ReplyTo,
+		Queue:         queue,
+		Exchange:      d.Exchange,
+		RoutingKey:    d.RoutingKey,
+		Headers:       d.Headers,
+	}
+}
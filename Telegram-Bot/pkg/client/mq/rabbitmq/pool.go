@@ -0,0 +1,132 @@
+package rabbitmq
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/streadway/amqp"
+)
+
+// pooledChannel канал пула, у каждого канала свои подтверждения публикаций
+type pooledChannel struct {
+	ch       *amqp.Channel
+	confirms *confirms
+	closed   chan *amqp.Error
+}
+
+// broken закрыт ли канал брокером или вместе с соединением
+func (pc *pooledChannel) broken() bool {
+	select {
+	case <-pc.closed:
+		return true
+	default:
+		return false
+	}
+}
+
+// channelPool пул каналов продьюсера. Канал выдаётся одному вызывающему, поэтому
+// порядок публикаций на нём совпадает с порядком номеров подтверждений
+type channelPool struct {
+	connection func() *amqp.Connection
+	confirm    bool
+	// slots ограничивает число выданных и свободных каналов размером пула
+	slots chan struct{}
+	idle  chan *pooledChannel
+}
+
+// newChannelPool создаёт пул на size каналов, каналы открываются лениво на текущем соединении
+func newChannelPool(connection func() *amqp.Connection, size int, confirm bool) *channelPool {
+	if size <= 0 {
+		size = 1
+	}
+	return &channelPool{
+		connection: connection,
+		confirm:    confirm,
+		slots:      make(chan struct{}, size),
+		idle:       make(chan *pooledChannel, size),
+	}
+}
+
+// get выдаёт свободный канал. Сломанные каналы выбрасываются и вместо них открываются новые,
+// остальные каналы и соединение при этом не трогаются
+func (p *channelPool) get(ctx context.Context) (*pooledChannel, error) {
+	select {
+	case p.slots <- struct{}{}:
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+
+	for {
+		select {
+		case pc := <-p.idle:
+			if pc.broken() {
+				continue
+			}
+			return pc, nil
+		default:
+			pc, err := p.open()
+			if err != nil {
+				<-p.slots
+				return nil, err
+			}
+			return pc, nil
+		}
+	}
+}
+
+// put возвращает канал в пул, сломанный канал просто освобождает место
+func (p *channelPool) put(pc *pooledChannel) {
+	if !pc.broken() {
+		p.idle <- pc
+	}
+	<-p.slots
+}
+
+// discard закрывает канал и освобождает его место, вместо него пул потом откроет новый
+func (p *channelPool) discard(pc *pooledChannel) {
+	if !pc.broken() {
+		_ = pc.ch.Close()
+	}
+	<-p.slots
+}
+
+// open открывает новый канал на текущем соединении
+func (p *channelPool) open() (*pooledChannel, error) {
+	conn := p.connection()
+	if conn == nil || conn.IsClosed() {
+		return nil, errNotConnected
+	}
+	ch, err := conn.Channel()
+	if err != nil {
+		return nil, fmt.Errorf("failed to open channel due %v", err)
+	}
+
+	pc := &pooledChannel{
+		ch:     ch,
+		closed: ch.NotifyClose(make(chan *amqp.Error, 1)),
+	}
+	// переводим канал в режим подтверждений, нумерация публикаций на новом канале начинается с 1
+	if p.confirm {
+		if err := ch.Confirm(false); err != nil {
+			// канал без подтверждений не нужен, а открытым он так и висел бы на соединении
+			_ = ch.Close()
+			return nil, fmt.Errorf("failed to put channel into confirm mode due %v", err)
+		}
+		pc.confirms = newConfirms(ch.NotifyPublish(make(chan amqp.Confirmation, confirmBufferSize)))
+	}
+	return pc, nil
+}
+
+// close закрывает все свободные каналы пула
+func (p *channelPool) close() {
+	for {
+		select {
+		case pc := <-p.idle:
+			if !pc.broken() {
+				_ = pc.ch.Close()
+			}
+		default:
+			return
+		}
+	}
+}
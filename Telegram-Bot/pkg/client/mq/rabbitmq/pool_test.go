@@ -0,0 +1,84 @@
+package rabbitmq
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+// Отброшенный канал закрывается и не возвращается в пул, его место занимает новый канал
+func TestPoolDiscard(t *testing.T) {
+	broker := newFakeBroker(t)
+	producer := newTestProducer(t, broker, ProducerConfig{Confirm: true, Channels: 1})
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	pc, err := producer.pool.get(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	producer.pool.discard(pc)
+	if !pc.broken() {
+		t.Fatal("discarded channel is still open")
+	}
+
+	// в пуле один слот, если discard его не освободил get будет ждать до дедлайна
+	next, err := producer.pool.get(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer producer.pool.put(next)
+	if next == pc {
+		t.Fatal("discarded channel returned to the pool")
+	}
+}
+
+// Сломанный канал пул выбрасывает сам и открывает вместо него новый
+func TestPoolReplacesBrokenChannel(t *testing.T) {
+	broker := newFakeBroker(t)
+	producer := newTestProducer(t, broker, ProducerConfig{Channels: 1})
+
+	ctx := context.Background()
+	pc, err := producer.pool.get(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	producer.pool.put(pc)
+	if err := pc.ch.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	next, err := producer.pool.get(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer producer.pool.put(next)
+	if next == pc {
+		t.Fatal("broken channel returned from the pool")
+	}
+}
+
+// Канал который не удалось перевести в режим подтверждений закрывается, а не остаётся висеть на соединении
+func TestPoolClosesChannelWithoutConfirm(t *testing.T) {
+	broker := newFakeBroker(t)
+	producer := newTestProducer(t, broker, ProducerConfig{Confirm: true, Channels: 1})
+	broker.setRefuseConfirm(true)
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	if _, err := producer.pool.get(ctx); err == nil {
+		t.Fatal("got channel without confirm mode")
+	}
+	selects, closes := broker.calls("confirm.select"), broker.calls("channel.close")
+	if len(selects) != 1 || len(closes) != 1 || closes[0].channel != selects[0].channel {
+		t.Fatalf("got confirm.select %v and channel.close %v, want the refused channel closed", selects, closes)
+	}
+
+	// место в пуле освободилось, следующий канал открывается
+	broker.setRefuseConfirm(false)
+	pc, err := producer.pool.get(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	producer.pool.put(pc)
+}
@@ -1,32 +1,67 @@
 package rabbitmq
 
 import (
+	"context"
 	"fmt"
+	"time"
 
 	"github.com/Maksat-luci/Telegram-Bot/pkg/client/mq"
-	"github.com/streadway/amqp"
 )
 // ProducerConfig который внутри себя содержит базовую конфигурацию
 type ProducerConfig struct {
 	BaseConfig
+	// Confirm включает подтверждения публикаций, Publish ждёт ack или nack от брокера
+	Confirm bool
+	// ConfirmTimeout сколько ждать подтверждения
+	ConfirmTimeout time.Duration
+	// AppID и ContentType проставляются сообщениям у которых они не заданы
+	AppID       string
+	ContentType string
+	// Channels сколько каналов держит пул для параллельных публикаций
+	Channels int
+	// DelayPrecision до скольки округляется задержка отложенной публикации, по умолчанию секунда
+	DelayPrecision time.Duration
 }
 // rabbitMQProducer структура которая содержит внутри себя ссылку на базовую структуру rabbitmqBase
 type rabbitMQProducer struct {
 	*rabbitMQBase
+	// pool каналы для публикаций, основной канал базовой структуры используется только для объявлений
+	pool           *channelPool
+	confirmTimeout time.Duration
+	appID          string
+	contentType    string
+	delayPrecision time.Duration
 }
 
+const (
+	defaultConfirmTimeout = 5 * time.Second
+)
+
 // NewRabbitMQProducer конструктор который подключается к серверу RabbitMQ возвращает продьюсера
 func NewRabbitMQProducer(cfg ProducerConfig) (mq.Producer, error) {
 	// создаём обьект структуры продьюсера 
 	producer := &rabbitMQProducer{
-		rabbitMQBase: &rabbitMQBase{
-			done: make(chan bool),
-		},
+		confirmTimeout: cfg.ConfirmTimeout,
+		appID:          cfg.AppID,
+		contentType:    cfg.ContentType,
+		delayPrecision: cfg.DelayPrecision,
+		rabbitMQBase:   newRabbitMQBase(cfg.BaseConfig),
+	}
+	if producer.confirmTimeout <= 0 {
+		producer.confirmTimeout = defaultConfirmTimeout
 	}
+	if producer.delayPrecision <= 0 {
+		producer.delayPrecision = defaultDelayPrecision
+	}
+	// каналы пула открываются на текущем соединении, после реконнекта старые каналы отбрасываются сами
+	producer.pool = newChannelPool(producer.connection, cfg.Channels, cfg.Confirm)
 	// строим стрингу и получаем адрес который вылеплен из конфига
-	addr := fmt.Sprintf("amqp://%s:%s@%s:%s/", cfg.Username, cfg.Password, cfg.Host, cfg.Port)
+	addr, err := producer.configure(cfg.BaseConfig)
+	if err != nil {
+		return nil, err
+	}
 	// подключаемся к RabbitMQ
-	err := producer.connect(addr)
+	err = producer.connect(addr)
 
 	if err != nil {
 		return nil, err
@@ -39,32 +74,99 @@ func NewRabbitMQProducer(cfg ProducerConfig) (mq.Producer, error) {
 }
 
 // функция отправки сообщения в очередь
-func (r *rabbitMQProducer) Publish(target string, body []byte) error {
+func (r *rabbitMQProducer) Publish(ctx context.Context, target string, body []byte) error {
+	return r.PublishMessage(ctx, target, mq.Message{Body: body})
+}
+
+// PublishMessage отправляет сообщение в очередь вместе с его correlation id и очередью ответа
+func (r *rabbitMQProducer) PublishMessage(ctx context.Context, target string, msg mq.Message) error {
+	// default exchange маршрутизирует сообщение в очередь с именем ключа
+	return r.PublishExchange(ctx, "", target, msg)
+}
+
+// PublishExchange отправляет сообщение в exchange, дальше брокер маршрутизирует его по привязкам очередей.
+// В режиме подтверждений возвращается только после ack брокера, nack, таймаут и отмена ctx возвращаются как *ConfirmError
+func (r *rabbitMQProducer) PublishExchange(ctx context.Context, exchange, key string, msg mq.Message) error {
+	tag, waiter, c, err := r.publish(ctx, exchange, key, msg)
+	if err != nil || c == nil {
+		return err
+	}
+	return c.wait(ctx, exchange, key, tag, waiter, r.confirmTimeout)
+}
+
+// PublishAsync отправляет сообщение и не ждёт подтверждения, результат придёт в возвращаемый канал
+func (r *rabbitMQProducer) PublishAsync(ctx context.Context, exchange, key string, msg mq.Message) <-chan error {
+	result := make(chan error, 1)
+
+	tag, waiter, c, err := r.publish(ctx, exchange, key, msg)
+	if err != nil || c == nil {
+		result <- err
+		return result
+	}
+	go func() {
+		result <- c.wait(ctx, exchange, key, tag, waiter, r.confirmTimeout)
+	}()
+	return result
+}
+
+// PublishBatch отправляет все сообщения подряд и только потом ждёт их подтверждения
+func (r *rabbitMQProducer) PublishBatch(ctx context.Context, exchange, key string, msgs []mq.Message) error {
+	results := make([]<-chan error, 0, len(msgs))
+	for _, msg := range msgs {
+		results = append(results, r.PublishAsync(ctx, exchange, key, msg))
+	}
+
+	var first error
+	for i, result := range results {
+		if err := <-result; err != nil && first == nil {
+			first = fmt.Errorf("message %d of batch: %w", i, err)
+		}
+	}
+	return first
+}
+
+// publish берёт канал из пула, отправляет сообщение и сразу возвращает канал,
+// в режиме подтверждений возвращает по чему ждать ack
+func (r *rabbitMQProducer) publish(ctx context.Context, exchange, key string, msg mq.Message) (uint64, <-chan bool, *confirms, error) {
 	// проверка на подключение
 	if !r.Connected() {
-		return errNotConnected
+		return 0, nil, nil, errNotConnected
+	}
+	pub := publishing(msg.WithDefaults(r.appID, r.contentType))
+	// Publish отклоняет неверные заголовки ещё до отправки и не считает такую публикацию,
+	// поэтому проверяем их до того как занять номер подтверждения
+	if err := pub.Headers.Validate(); err != nil {
+		return 0, nil, nil, fmt.Errorf("invalid message headers due %w", err)
 	}
-	// отправляет сообщение в очередь
-	err := r.ch.Publish(
-		"",
-		target,
-		false,
-		false,
-		amqp.Publishing{
-			DeliveryMode: amqp.Persistent,
-			ContentType: "text/plain",
-			Body: body,
-		},
+	// ожидание свободного канала ограничено контекстом
+	pc, err := r.pool.get(ctx)
+	if err != nil {
+		return 0, nil, nil, fmt.Errorf("failed to get channel due %w", err)
+	}
+
+	var (
+		tag    uint64
+		waiter <-chan bool
 	)
+	if pc.confirms != nil {
+		tag, waiter = pc.confirms.add()
+	}
+	// отправляет сообщение в exchange, канал выдан только нам, поэтому номер публикации совпадёт с tag
+	err = pc.ch.Publish(exchange, key, false, false, pub)
 	if err != nil {
-		return fmt.Errorf("failed to publish message dur %v", err)
+		if pc.confirms != nil {
+			pc.confirms.remove(tag)
+		}
+		// неизвестно засчитал ли канал эту публикацию, его номера подтверждений больше нельзя сопоставить с нашими
+		r.pool.discard(pc)
+		return 0, nil, nil, fmt.Errorf("failed to publish message dur %w", err)
 	}
-	return nil
+	r.pool.put(pc)
+	return tag, waiter, pc.confirms, nil
 }
-// аналогичный метод закрытия всех каналов и соединений 
+
+// аналогичный метод закрытия всех каналов и соединений
 func (r *rabbitMQProducer) Close() error {
-	if err := r.Close(); err != nil {
-		return err
-	}
-	return nil
-}
\ No newline at end of file
+	r.pool.close()
+	return r.close()
+}
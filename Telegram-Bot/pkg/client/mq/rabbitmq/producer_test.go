@@ -0,0 +1,146 @@
+package rabbitmq
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/Maksat-luci/Telegram-Bot/pkg/client/mq"
+)
+
+// newTestProducer подключает продьюсера к брокеру, продьюсер закрывается вместе с тестом
+func newTestProducer(t testing.TB, broker *fakeBroker, cfg ProducerConfig) *rabbitMQProducer {
+	t.Helper()
+	cfg.BaseConfig = broker.config()
+	producer, err := NewRabbitMQProducer(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = producer.Close() })
+	return producer.(*rabbitMQProducer)
+}
+
+func TestPublishConfirm(t *testing.T) {
+	ctx := context.Background()
+	broker := newFakeBroker(t)
+	producer := newTestProducer(t, broker, ProducerConfig{Confirm: true, ConfirmTimeout: time.Second})
+
+	if err := producer.DeclareQueue(ctx, "tracks", true, false, false, nil); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 3; i++ {
+		if err := producer.Publish(ctx, "tracks", []byte("track")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if n := broker.ready("tracks"); n != 3 {
+		t.Fatalf("queue has %d messages, want 3", n)
+	}
+}
+
+// Неверные заголовки amqp отклоняет до отправки и не засчитывает публикацию. Номер подтверждения
+// под неё занимать нельзя, иначе каждая следующая публикация канала ждала бы чужое подтверждение
+func TestPublishInvalidHeadersKeepsConfirms(t *testing.T) {
+	ctx := context.Background()
+	broker := newFakeBroker(t)
+	// один канал, чтобы все публикации шли через канал на котором была ошибка
+	producer := newTestProducer(t, broker, ProducerConfig{Confirm: true, ConfirmTimeout: time.Second, Channels: 1})
+
+	invalid := []map[string]interface{}{
+		{"attempt": uint64(1)},
+		{"nested": map[string]interface{}{"k": "v"}},
+	}
+	for _, headers := range invalid {
+		if err := producer.PublishMessage(ctx, "tracks", mq.Message{Headers: headers}); err == nil {
+			t.Fatalf("publish with headers %v succeeded", headers)
+		}
+	}
+	for i := 0; i < 3; i++ {
+		if err := producer.PublishMessage(ctx, "tracks", mq.Message{Headers: map[string]interface{}{"attempt": int64(i)}}); err != nil {
+			t.Fatalf("publish %d after invalid headers: %v", i, err)
+		}
+	}
+	if n := len(broker.calls("basic.publish")); n != 3 {
+		t.Fatalf("broker got %d publishes, want 3", n)
+	}
+}
+
+func TestPublishBatch(t *testing.T) {
+	ctx := context.Background()
+	broker := newFakeBroker(t)
+	producer := newTestProducer(t, broker, ProducerConfig{Confirm: true, ConfirmTimeout: time.Second, Channels: 4})
+
+	if err := producer.DeclareQueue(ctx, "tracks", true, false, false, nil); err != nil {
+		t.Fatal(err)
+	}
+	msgs := make([]mq.Message, 50)
+	for i := range msgs {
+		msgs[i] = mq.Message{Body: []byte(fmt.Sprintf("track %d", i))}
+	}
+	if err := producer.PublishBatch(ctx, "", "tracks", msgs); err != nil {
+		t.Fatal(err)
+	}
+	if n := broker.ready("tracks"); n != len(msgs) {
+		t.Fatalf("queue has %d messages, want %d", n, len(msgs))
+	}
+}
+
+func TestPublishConcurrent(t *testing.T) {
+	ctx := context.Background()
+	broker := newFakeBroker(t)
+	producer := newTestProducer(t, broker, ProducerConfig{Confirm: true, ConfirmTimeout: time.Second, Channels: 4})
+
+	var wg sync.WaitGroup
+	errs := make(chan error, 100)
+	for i := 0; i < 100; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			errs <- producer.Publish(ctx, "tracks", []byte("track"))
+		}()
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	channels := make(map[uint16]bool)
+	for _, call := range broker.calls("basic.publish") {
+		channels[call.channel] = true
+	}
+	if len(channels) > 4 {
+		t.Fatalf("publishes used %d channels, pool size is 4", len(channels))
+	}
+}
+
+// BenchmarkPublishConfirm публикации с подтверждениями из многих горутин. Брокер подтверждает публикации
+// одного канала по очереди за миллисекунду каждую, поэтому с одним каналом все публикации ждут одну очередь
+// подтверждений, а пул каналов подтверждается параллельно
+func BenchmarkPublishConfirm(b *testing.B) {
+	for _, channels := range []int{1, 4, 16} {
+		b.Run(fmt.Sprintf("channels=%d", channels), func(b *testing.B) {
+			ctx := context.Background()
+			broker := newFakeBroker(b)
+			broker.setLatency(time.Millisecond)
+			producer := newTestProducer(b, broker, ProducerConfig{Confirm: true, ConfirmTimeout: time.Minute, Channels: channels})
+			body := make([]byte, 1024)
+
+			b.SetParallelism(16)
+			b.ResetTimer()
+			start := time.Now()
+			b.RunParallel(func(pb *testing.PB) {
+				for pb.Next() {
+					if err := producer.Publish(ctx, "bench", body); err != nil {
+						b.Error(err)
+						return
+					}
+				}
+			})
+			b.ReportMetric(float64(b.N)/time.Since(start).Seconds(), "msgs/s")
+		})
+	}
+}
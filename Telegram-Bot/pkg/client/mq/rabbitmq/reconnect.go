@@ -0,0 +1,100 @@
+package rabbitmq
+
+import (
+	"math/rand"
+	"sync"
+	"time"
+
+	"github.com/streadway/amqp"
+)
+
+// Backoff настройки задержки между попытками переподключения
+type Backoff struct {
+	// Initial задержка перед второй попыткой, первая делается сразу
+	Initial time.Duration
+	// Max верхняя граница задержки
+	Max time.Duration
+	// Multiplier во сколько раз растёт задержка с каждой попыткой
+	Multiplier float64
+	// Jitter доля задержки на которую она случайно отклоняется в обе стороны, до 1.
+	// Ноль значит значение по умолчанию, отрицательное значение отключает отклонение
+	Jitter float64
+}
+
+// значения по умолчанию для незаданных полей Backoff
+const (
+	defaultBackoffInitial    = time.Second
+	defaultBackoffMax        = time.Minute
+	defaultBackoffMultiplier = 2
+	defaultBackoffJitter     = 0.2
+)
+
+// withDefaults заполняет незаданные поля значениями по умолчанию
+func (b Backoff) withDefaults() Backoff {
+	if b.Initial <= 0 {
+		b.Initial = defaultBackoffInitial
+	}
+	if b.Max <= 0 {
+		b.Max = defaultBackoffMax
+	}
+	if b.Multiplier < 1 {
+		b.Multiplier = defaultBackoffMultiplier
+	}
+	switch {
+	case b.Jitter == 0:
+		b.Jitter = defaultBackoffJitter
+	case b.Jitter > 1:
+		b.Jitter = 1
+	}
+	return b
+}
+
+// Delay задержка после неудачной попытки attempt: экспоненциальный рост до Max и случайное отклонение,
+// чтобы все инстансы бота не переподключались к брокеру одновременно
+func (b Backoff) Delay(attempt int) time.Duration {
+	d := float64(b.Initial)
+	for i := 0; i < attempt && d < float64(b.Max); i++ {
+		d *= b.Multiplier
+	}
+	if d > float64(b.Max) {
+		d = float64(b.Max)
+	}
+	if b.Jitter > 0 {
+		d += d * b.Jitter * (2*rand.Float64() - 1)
+	}
+	return time.Duration(d)
+}
+
+// topology реестр объявленных exchange, очередей и привязок. После переподключения
+// всё объявляется заново в том же порядке, exclusive очереди при разрыве удаляются брокером
+type topology struct {
+	lock  sync.Mutex
+	keys  []string
+	items map[string]func(ch *amqp.Channel) error
+}
+
+func newTopology() *topology {
+	return &topology{items: make(map[string]func(ch *amqp.Channel) error)}
+}
+
+// add запоминает объявление, повторное объявление с тем же ключом заменяет прежнее
+func (t *topology) add(key string, declare func(ch *amqp.Channel) error) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	if _, ok := t.items[key]; !ok {
+		t.keys = append(t.keys, key)
+	}
+	t.items[key] = declare
+}
+
+// replay объявляет всю топологию на канале
+func (t *topology) replay(ch *amqp.Channel) error {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	for _, key := range t.keys {
+		if err := t.items[key](ch); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,219 @@
+package rabbitmq
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/Maksat-luci/Telegram-Bot/pkg/client/mq"
+)
+
+func TestBackoffWithDefaults(t *testing.T) {
+	tests := []struct {
+		name   string
+		in     Backoff
+		jitter float64
+	}{
+		{name: "unset", in: Backoff{}, jitter: defaultBackoffJitter},
+		{name: "custom", in: Backoff{Jitter: 0.5}, jitter: 0.5},
+		{name: "disabled", in: Backoff{Jitter: -1}, jitter: -1},
+		{name: "above one", in: Backoff{Jitter: 3}, jitter: 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b := tt.in.withDefaults()
+			if b.Jitter != tt.jitter {
+				t.Fatalf("got jitter %v, want %v", b.Jitter, tt.jitter)
+			}
+			if b.Initial != defaultBackoffInitial || b.Max != defaultBackoffMax || b.Multiplier != defaultBackoffMultiplier {
+				t.Fatalf("defaults not applied: %+v", b)
+			}
+		})
+	}
+}
+
+func TestBackoffDelay(t *testing.T) {
+	b := Backoff{Initial: time.Second, Max: 5 * time.Second, Multiplier: 2, Jitter: -1}.withDefaults()
+	want := []time.Duration{time.Second, 2 * time.Second, 4 * time.Second, 5 * time.Second, 5 * time.Second}
+	for attempt, delay := range want {
+		if got := b.Delay(attempt); got != delay {
+			t.Fatalf("attempt %d: got %s, want %s", attempt, got, delay)
+		}
+	}
+
+	b.Jitter = 0.2
+	for i := 0; i < 100; i++ {
+		got := b.Delay(1)
+		if got < 1600*time.Millisecond || got > 2400*time.Millisecond {
+			t.Fatalf("delay %s is outside 2s ± 20%%", got)
+		}
+	}
+}
+
+// newTestConsumer подключает консьюмера к брокеру, консьюмер закрывается вместе с тестом
+func newTestConsumer(t testing.TB, broker *fakeBroker, cfg ConsumerConfig) *rabbitMQConsumer {
+	t.Helper()
+	cfg.BaseConfig = broker.config()
+	consumer, err := NewRabbitMQConsumer(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = consumer.Close() })
+	return consumer.(*rabbitMQConsumer)
+}
+
+// waitState ждёт событие state и возвращает его
+func waitState(t *testing.T, states <-chan mq.StateEvent, state mq.ConnectionState) mq.StateEvent {
+	t.Helper()
+	timeout := time.After(5 * time.Second)
+	for {
+		select {
+		case event := <-states:
+			if event.State == state {
+				return event
+			}
+		case <-timeout:
+			t.Fatalf("timed out waiting for state %v", state)
+		}
+	}
+}
+
+// declared объявления метода name на подключении conn
+func declared(broker *fakeBroker, name string, conn int) []string {
+	var args []string
+	for _, call := range broker.calls(name) {
+		if call.conn == conn {
+			args = append(args, call.arg)
+		}
+	}
+	return args
+}
+
+func TestReconnectReplaysTopology(t *testing.T) {
+	ctx := context.Background()
+	broker := newFakeBroker(t)
+	consumer := newTestConsumer(t, broker, ConsumerConfig{})
+	states := make(chan mq.StateEvent, 16)
+	consumer.NotifyState(states)
+
+	if err := consumer.DeclareExchange(ctx, "events", mq.ExchangeDirect, true, false, nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := consumer.DeclareQueue(ctx, "tracks", true, false, false, nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := consumer.BindQueue(ctx, "tracks", "events", "track", nil); err != nil {
+		t.Fatal(err)
+	}
+
+	broker.drop()
+	waitState(t, states, mq.StateDisconnected)
+	waitState(t, states, mq.StateConnected)
+
+	if broker.connections() != 2 {
+		t.Fatalf("broker accepted %d connections, want 2", broker.connections())
+	}
+	if got := declared(broker, "exchange.declare", 2); len(got) != 1 || got[0] != "events" {
+		t.Fatalf("exchanges redeclared after reconnect: %v", got)
+	}
+	if got := declared(broker, "queue.declare", 2); len(got) != 1 || got[0] != "tracks" {
+		t.Fatalf("queues redeclared after reconnect: %v", got)
+	}
+	if got := declared(broker, "queue.bind", 2); len(got) != 1 || got[0] != "tracks" {
+		t.Fatalf("bindings redeclared after reconnect: %v", got)
+	}
+}
+
+func TestReconnectBackoff(t *testing.T) {
+	broker := newFakeBroker(t)
+	consumer := newTestConsumer(t, broker, ConsumerConfig{})
+	states := make(chan mq.StateEvent, 64)
+	consumer.NotifyState(states)
+
+	// брокер недоступен, клиент пробует подключиться снова и снова
+	broker.setRefuse(true)
+	broker.drop()
+	for attempt := 0; attempt < 3; {
+		attempt = waitState(t, states, mq.StateReconnecting).Attempt
+	}
+	if consumer.Connected() {
+		t.Fatal("consumer reports connected while broker refuses connections")
+	}
+
+	broker.setRefuse(false)
+	waitState(t, states, mq.StateConnected)
+	if !consumer.Connected() {
+		t.Fatal("consumer did not reconnect")
+	}
+}
+
+func TestConsumeAfterReconnect(t *testing.T) {
+	ctx := context.Background()
+	broker := newFakeBroker(t)
+	consumer := newTestConsumer(t, broker, ConsumerConfig{})
+	producer := newTestProducer(t, broker, ProducerConfig{Confirm: true, ConfirmTimeout: time.Second})
+
+	if err := consumer.DeclareQueue(ctx, "tracks", true, false, false, nil); err != nil {
+		t.Fatal(err)
+	}
+	messages, err := consumer.Consume(ctx, "tracks")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	broker.drop()
+	// подписка восстанавливается сама, без нового вызова Consume
+	waitFor(t, "consumer to resubscribe", func() bool { return len(broker.calls("basic.consume")) == 2 })
+	waitFor(t, "producer to reconnect", producer.Connected)
+	if err := producer.Publish(ctx, "tracks", []byte("track")); err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case msg := <-messages:
+		if string(msg.Body) != "track" {
+			t.Fatalf("got %q, want track", msg.Body)
+		}
+		if err := consumer.Ack(ctx, msg.ID, false); err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("no message after reconnect")
+	}
+}
+
+// Подключение может пропасть между вызовами, без канала методы возвращают ошибку, а не паникуют на nil канале
+func TestWithoutChannel(t *testing.T) {
+	ctx := context.Background()
+	for name, connected := range map[string]bool{"disconnected": false, "connected flag without channel": true} {
+		t.Run(name, func(t *testing.T) {
+			consumer := &rabbitMQConsumer{
+				rabbitMQBase: newRabbitMQBase(BaseConfig{}),
+				retry:        mq.RetryPolicy{MaxRetries: 1, InitialDelay: time.Second},
+				retryQueues:  make(map[string]bool),
+				tempQueues:   make(map[string]bool),
+			}
+			consumer.isConnected = connected
+
+			calls := map[string]error{
+				"declare queue":          consumer.DeclareQueue(ctx, "tracks", true, false, false, nil),
+				"declare exchange":       consumer.DeclareExchange(ctx, "events", "topic", true, false, nil),
+				"bind queue":             consumer.BindQueue(ctx, "tracks", "events", "#", nil),
+				"declare retry topology": consumer.declareRetryTopology("tracks"),
+			}
+			for call, err := range calls {
+				if !errors.Is(err, errNotConnected) {
+					t.Fatalf("%s: got %v, want %v", call, err, errNotConnected)
+				}
+			}
+			if _, _, err := consumer.consume("tracks", "tag"); !errors.Is(err, errNotConnected) {
+				t.Fatalf("consume: got %v, want %v", err, errNotConnected)
+			}
+			consumer.cancel("tag")
+			if len(consumer.topology.keys) != 0 {
+				t.Fatalf("failed declarations were added to topology: %v", consumer.topology.keys)
+			}
+		})
+	}
+}
@@ -0,0 +1,151 @@
+package rabbitmq
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/Maksat-luci/Telegram-Bot/pkg/client/mq"
+	"github.com/streadway/amqp"
+)
+
+// имена объектов retry топологии для очереди
+func deadLetterExchange(queue string) string { return fmt.Sprintf("%s.dlx", queue) }
+func parkingQueue(queue string) string       { return fmt.Sprintf("%s.parking", queue) }
+func retryQueue(queue string, delay time.Duration) string {
+	return fmt.Sprintf("%s.retry.%d", queue, delay.Milliseconds())
+}
+
+// declareRetryTopology объявляет retry топологию очереди и запоминает её для повторного объявления после переподключения
+func (r *rabbitMQConsumer) declareRetryTopology(queue string) error {
+	declare := func(ch *amqp.Channel) error {
+		return r.retryTopology(ch, queue)
+	}
+	ch, _, err := r.channel()
+	if err != nil {
+		return err
+	}
+	if err := declare(ch); err != nil {
+		return err
+	}
+	r.topology.add("retry:"+queue, declare)
+
+	r.lock.Lock()
+	r.retryQueues[queue] = true
+	r.lock.Unlock()
+	return nil
+}
+
+// retryTopology объявляет для очереди dead-letter exchange, parking очередь и очереди задержки.
+// Очередь задержки держит сообщение TTL миллисекунд и возвращает его через default exchange в исходную очередь
+func (r *rabbitMQConsumer) retryTopology(ch *amqp.Channel, queue string) error {
+	err := ch.ExchangeDeclare(deadLetterExchange(queue), amqp.ExchangeDirect, true, false, false, false, nil)
+	if err != nil {
+		return fmt.Errorf("failed to declare dead-letter exchange due %v", err)
+	}
+	if _, err := ch.QueueDeclare(parkingQueue(queue), true, false, false, false, nil); err != nil {
+		return fmt.Errorf("failed to declare parking queue due %v", err)
+	}
+	if err := ch.QueueBind(parkingQueue(queue), queue, deadLetterExchange(queue), false, nil); err != nil {
+		return fmt.Errorf("failed to bind parking queue due %v", err)
+	}
+
+	for _, delay := range r.retry.Tiers() {
+		_, err := ch.QueueDeclare(retryQueue(queue, delay), true, false, false, false, amqp.Table{
+			"x-message-ttl":             int32(delay.Milliseconds()),
+			"x-dead-letter-exchange":    "",
+			"x-dead-letter-routing-key": queue,
+		})
+		if err != nil {
+			return fmt.Errorf("failed to declare retry queue due %v", err)
+		}
+	}
+	return nil
+}
+
+// hasRetryTopology объявлена ли для очереди retry топология
+func (r *rabbitMQConsumer) hasRetryTopology(queue string) bool {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	return r.retryQueues[queue]
+}
+
+// Settle применяет к сообщению итог outcome. Если повторы исчерпаны сообщение уходит в parking очередь,
+// а если у очереди нет retry топологии сообщение выбрасывается. Возвращает итог который был применён.
+// Копия в retry или parking очереди публикуется с подтверждением, исходное сообщение подтверждается
+// только после ack брокера, а если копию брокер не принял возвращается в очередь
+func (r *rabbitMQConsumer) Settle(ctx context.Context, msg mq.Message, outcome mq.Outcome) (mq.Outcome, error) {
+	// проверка на подключение. Сообщение со старого канала брокер доставит ещё раз сам,
+	// его копия в retry или parking очереди стала бы дубликатом
+	if _, _, err := r.deliveryChannel(msg.ID); err != nil {
+		return 0, err
+	}
+
+	if outcome == mq.OutcomeRetry && msg.RetryCount() >= r.retry.MaxRetries {
+		outcome = mq.OutcomeDeadLetter
+	}
+	if outcome == mq.OutcomeDeadLetter && !r.hasRetryTopology(msg.Queue) {
+		outcome = mq.OutcomeDrop
+	}
+
+	switch outcome {
+	case mq.OutcomeRetry:
+		delay := r.retry.Delay(msg.RetryCount())
+		headers := republishHeaders(msg)
+		headers[mq.HeaderRetryCount] = int32(msg.RetryCount() + 1)
+		if err := r.republish(ctx, "", retryQueue(msg.Queue, delay), msg, headers); err != nil {
+			return 0, r.requeue(msg, fmt.Errorf("failed to retry message with id %d due %w", msg.ID, err))
+		}
+	case mq.OutcomeDeadLetter:
+		if err := r.republish(ctx, deadLetterExchange(msg.Queue), msg.Queue, msg, republishHeaders(msg)); err != nil {
+			return 0, r.requeue(msg, fmt.Errorf("failed to dead-letter message with id %d due %w", msg.ID, err))
+		}
+	case mq.OutcomeDrop:
+		return outcome, r.Reject(ctx, msg.ID, false)
+	default:
+		return 0, fmt.Errorf("unknown outcome %v", outcome)
+	}
+
+	// копия опубликована, исходное сообщение больше не нужно
+	return outcome, r.Ack(ctx, msg.ID, false)
+}
+
+// republish публикует копию полученного сообщения с новыми заголовками через канал пула и ждёт
+// подтверждения брокера, идентификатор сообщения сохраняется
+func (r *rabbitMQConsumer) republish(ctx context.Context, exchange, key string, msg mq.Message, headers amqp.Table) error {
+	msg.Headers = headers
+	pc, err := r.pool.get(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to get channel due %w", err)
+	}
+	// канал выдан только нам, поэтому номер публикации совпадёт с tag
+	tag, waiter := pc.confirms.add()
+	if err := pc.ch.Publish(exchange, key, false, false, publishing(msg)); err != nil {
+		pc.confirms.remove(tag)
+		r.pool.discard(pc)
+		return err
+	}
+	r.pool.put(pc)
+	return pc.confirms.wait(ctx, exchange, key, tag, waiter, r.confirmTimeout)
+}
+
+// requeue возвращает в очередь сообщение, копию которого брокер не принял, и возвращает err.
+// Контекст вызывающего может быть уже отменён, а сообщение всё равно нужно вернуть
+func (r *rabbitMQConsumer) requeue(msg mq.Message, err error) error {
+	if nackErr := r.Nack(context.Background(), msg.ID, false, true); nackErr != nil {
+		return fmt.Errorf("%w, failed to requeue it due %v", err, nackErr)
+	}
+	return err
+}
+
+// republishHeaders копирует заголовки сообщения без служебных заголовков брокера
+func republishHeaders(msg mq.Message) amqp.Table {
+	headers := amqp.Table{}
+	for k, v := range msg.Headers {
+		if k == "x-death" {
+			continue
+		}
+		headers[k] = v
+	}
+	return headers
+}
@@ -0,0 +1,159 @@
+package rabbitmq
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/Maksat-luci/Telegram-Bot/pkg/client/mq"
+)
+
+// newRetryPair консьюмер с двумя уровнями задержки, 1s и 2s, и продьюсер. Консьюмер уже читает очередь tracks
+func newRetryPair(t *testing.T, broker *fakeBroker) (*rabbitMQConsumer, *rabbitMQProducer, <-chan mq.Message) {
+	t.Helper()
+	ctx := context.Background()
+	retry := mq.RetryPolicy{MaxRetries: 2, InitialDelay: time.Second, Multiplier: 2, DeadLetter: true}
+	consumer := newTestConsumer(t, broker, ConsumerConfig{PrefetchCount: 10, Retry: retry, ConfirmTimeout: time.Second})
+	producer := newTestProducer(t, broker, ProducerConfig{Confirm: true, ConfirmTimeout: time.Second})
+	if err := consumer.DeclareQueue(ctx, "tracks", true, false, false, nil); err != nil {
+		t.Fatal(err)
+	}
+	messages, err := consumer.Consume(ctx, "tracks")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return consumer, producer, messages
+}
+
+func TestRetryTopology(t *testing.T) {
+	broker := newFakeBroker(t)
+	newRetryPair(t, broker)
+
+	var queues []string
+	for _, call := range broker.calls("queue.declare") {
+		queues = append(queues, call.arg)
+	}
+	want := []string{"tracks", "tracks.parking", "tracks.retry.1000", "tracks.retry.2000"}
+	if len(queues) != len(want) {
+		t.Fatalf("declared queues %v, want %v", queues, want)
+	}
+	for i := range want {
+		if queues[i] != want[i] {
+			t.Fatalf("declared queues %v, want %v", queues, want)
+		}
+	}
+}
+
+// Уровень задержки выбирается по счётчику повторов, после MaxRetries сообщение уходит в parking очередь
+func TestSettleRetryTiers(t *testing.T) {
+	ctx := context.Background()
+	broker := newFakeBroker(t)
+	consumer, producer, messages := newRetryPair(t, broker)
+
+	tests := []struct {
+		retries int
+		outcome mq.Outcome
+		want    mq.Outcome
+		queue   string
+	}{
+		{retries: 0, outcome: mq.OutcomeRetry, want: mq.OutcomeRetry, queue: "tracks.retry.1000"},
+		{retries: 1, outcome: mq.OutcomeRetry, want: mq.OutcomeRetry, queue: "tracks.retry.2000"},
+		{retries: 2, outcome: mq.OutcomeRetry, want: mq.OutcomeDeadLetter, queue: "tracks.parking"},
+		{retries: 0, outcome: mq.OutcomeDeadLetter, want: mq.OutcomeDeadLetter, queue: "tracks.parking"},
+	}
+	for i, tt := range tests {
+		headers := map[string]interface{}{"x-source": "test"}
+		if tt.retries > 0 {
+			headers[mq.HeaderRetryCount] = int32(tt.retries)
+		}
+		if err := producer.PublishMessage(ctx, "tracks", mq.Message{Body: []byte("track"), Headers: headers}); err != nil {
+			t.Fatal(err)
+		}
+		msg := receiveMessage(t, messages)
+		before := broker.ready(tt.queue)
+		outcome, err := consumer.Settle(ctx, msg, tt.outcome)
+		if err != nil {
+			t.Fatalf("case %d: %v", i, err)
+		}
+		if outcome != tt.want {
+			t.Fatalf("case %d: got outcome %v, want %v", i, outcome, tt.want)
+		}
+		if n := broker.ready(tt.queue); n != before+1 {
+			t.Fatalf("case %d: %s has %d messages, want %d", i, tt.queue, n, before+1)
+		}
+		waitFor(t, "original to be acked", func() bool { return len(broker.calls("basic.ack")) == i+1 })
+	}
+	if n := broker.ready("tracks"); n != 0 {
+		t.Fatalf("tracks has %d messages, want 0", n)
+	}
+
+	// копия в очереди задержки несёт увеличенный счётчик повторов и исходные заголовки
+	reader := newTestConsumer(t, broker, ConsumerConfig{PrefetchCount: 10})
+	copies, err := reader.Consume(ctx, "tracks.retry.1000")
+	if err != nil {
+		t.Fatal(err)
+	}
+	retried := receiveMessage(t, copies)
+	if retried.RetryCount() != 1 || retried.Headers["x-source"] != "test" || string(retried.Body) != "track" {
+		t.Fatalf("got %q with headers %v", retried.Body, retried.Headers)
+	}
+}
+
+func TestSettleDrop(t *testing.T) {
+	ctx := context.Background()
+	broker := newFakeBroker(t)
+	consumer, producer, messages := newRetryPair(t, broker)
+
+	if err := producer.Publish(ctx, "tracks", []byte("track")); err != nil {
+		t.Fatal(err)
+	}
+	outcome, err := consumer.Settle(ctx, receiveMessage(t, messages), mq.OutcomeDrop)
+	if err != nil || outcome != mq.OutcomeDrop {
+		t.Fatalf("got %v, %v", outcome, err)
+	}
+	waitFor(t, "message to be rejected", func() bool { return len(broker.calls("basic.reject")) == 1 })
+	if n := len(broker.calls("basic.publish")); n != 1 {
+		t.Fatalf("broker got %d publishes, want only the original", n)
+	}
+}
+
+// Брокер не принял копию для повтора, исходное сообщение не подтверждается, а возвращается в очередь
+func TestSettleNackedCopyRequeues(t *testing.T) {
+	ctx := context.Background()
+	broker := newFakeBroker(t)
+	consumer, producer, messages := newRetryPair(t, broker)
+	broker.setNack("tracks.retry.1000", true)
+
+	if err := producer.Publish(ctx, "tracks", []byte("track")); err != nil {
+		t.Fatal(err)
+	}
+	msg := receiveMessage(t, messages)
+	if _, err := consumer.Settle(ctx, msg, mq.OutcomeRetry); !errors.Is(err, ErrPublishNacked) {
+		t.Fatalf("got %v, want %v", err, ErrPublishNacked)
+	}
+	if calls := broker.calls("basic.ack"); len(calls) != 0 {
+		t.Fatalf("original acked although its copy was lost: %v", calls)
+	}
+
+	redelivered := receiveMessage(t, messages)
+	if !redelivered.Redelivered || redelivered.RetryCount() != 0 || string(redelivered.Body) != "track" {
+		t.Fatalf("got %q redelivered=%v retry count %d", redelivered.Body, redelivered.Redelivered, redelivered.RetryCount())
+	}
+
+	// брокер снова принимает публикации, повтор проходит как обычно
+	broker.setNack("tracks.retry.1000", false)
+	if _, err := consumer.Settle(ctx, redelivered, mq.OutcomeRetry); err != nil {
+		t.Fatal(err)
+	}
+	if n := broker.ready("tracks.retry.1000"); n != 1 {
+		t.Fatalf("retry queue has %d messages, want 1", n)
+	}
+	// копия идёт каналом пула с подтверждениями, а не каналом который доставил сообщение
+	consume := broker.calls("basic.consume")[0]
+	for _, call := range broker.calls("basic.publish") {
+		if call.arg == "tracks.retry.1000" && call.conn == consume.conn && call.channel == consume.channel {
+			t.Fatal("copy published on the delivery channel")
+		}
+	}
+}
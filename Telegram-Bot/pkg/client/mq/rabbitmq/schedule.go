@@ -0,0 +1,70 @@
+package rabbitmq
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/Maksat-luci/Telegram-Bot/pkg/client/mq"
+	"github.com/streadway/amqp"
+)
+
+const (
+	// defaultDelayPrecision до скольки округляется задержка, от неё зависит сколько очередей задержки появится
+	defaultDelayPrecision = time.Second
+	// delayQueueGrace сколько очередь задержки живёт без публикаций после того как истёк TTL последнего сообщения
+	delayQueueGrace = 10 * time.Minute
+	// defaultExchangeName имя default exchange в именах очередей задержки, пользователь не может создать exchange с таким именем
+	defaultExchangeName = "amq.default"
+)
+
+// delayQueue имя очереди задержки для сообщений в exchange с ключом key
+func delayQueue(exchange, key string, delay time.Duration) string {
+	if exchange == "" {
+		exchange = defaultExchangeName
+	}
+	return fmt.Sprintf("mq.delay.%d.%s/%s", delay.Milliseconds(), exchange, key)
+}
+
+// PublishAt публикует сообщение в exchange с ключом key не раньше at
+func (r *rabbitMQProducer) PublishAt(ctx context.Context, exchange, key string, msg mq.Message, at time.Time) error {
+	return r.PublishAfter(ctx, exchange, key, msg, time.Until(at))
+}
+
+// PublishAfter кладёт сообщение в очередь задержки, TTL которой равен задержке округлённой вверх до DelayPrecision.
+// Когда TTL истекает брокер перекладывает сообщение через dead-letter в exchange с ключом key.
+// Очередь объявляется при каждой публикации на канале из пула и удаляется брокером когда перестаёт использоваться
+func (r *rabbitMQProducer) PublishAfter(ctx context.Context, exchange, key string, msg mq.Message, delay time.Duration) error {
+	if delay <= 0 {
+		return r.PublishExchange(ctx, exchange, key, msg)
+	}
+	if !r.Connected() {
+		return errNotConnected
+	}
+	if rest := delay % r.delayPrecision; rest != 0 {
+		delay += r.delayPrecision - rest
+	}
+
+	// базовый канал не трогаем, отложенные публикации идут из обработчиков параллельно
+	pc, err := r.pool.get(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to get channel due %w", err)
+	}
+	name := delayQueue(exchange, key, delay)
+	err = withContext(ctx, func() error {
+		_, err := pc.ch.QueueDeclare(name, true, false, false, false, amqp.Table{
+			"x-message-ttl":             int64(delay.Milliseconds()),
+			"x-dead-letter-exchange":    exchange,
+			"x-dead-letter-routing-key": key,
+			"x-expires":                 int64((delay + delayQueueGrace).Milliseconds()),
+		})
+		return err
+	})
+	if err != nil {
+		// ошибка объявления закрывает канал на брокере, а при отмене ctx объявление ещё может идти
+		r.pool.discard(pc)
+		return fmt.Errorf("failed to declare delay queue due %v", err)
+	}
+	r.pool.put(pc)
+	return r.PublishExchange(ctx, "", name, msg)
+}
@@ -0,0 +1,64 @@
+package rabbitmq
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/Maksat-luci/Telegram-Bot/pkg/client/mq"
+)
+
+func TestDelayQueue(t *testing.T) {
+	tests := []struct {
+		exchange, key string
+		delay         time.Duration
+		want          string
+	}{
+		{exchange: "", key: "tracks", delay: 2 * time.Second, want: "mq.delay.2000.amq.default/tracks"},
+		{exchange: "events", key: "track.found", delay: time.Minute, want: "mq.delay.60000.events/track.found"},
+	}
+	for _, tt := range tests {
+		if got := delayQueue(tt.exchange, tt.key, tt.delay); got != tt.want {
+			t.Fatalf("delayQueue(%q, %q, %s) = %q, want %q", tt.exchange, tt.key, tt.delay, got, tt.want)
+		}
+	}
+}
+
+// Очередь задержки объявляется на канале из пула. Базовый канал продьюсера общий для объявлений
+// топологии, параллельные отложенные публикации на нём шли бы в обход пула
+func TestPublishAfterUsesPooledChannel(t *testing.T) {
+	ctx := context.Background()
+	broker := newFakeBroker(t)
+	producer := newTestProducer(t, broker, ProducerConfig{Confirm: true, ConfirmTimeout: time.Second, Channels: 1})
+
+	if err := producer.DeclareQueue(ctx, "tracks", true, false, false, nil); err != nil {
+		t.Fatal(err)
+	}
+	base := broker.calls("queue.declare")[0].channel
+
+	// задержка округляется вверх до DelayPrecision
+	if err := producer.PublishAfter(ctx, "", "tracks", mq.Message{Body: []byte("later")}, 1500*time.Millisecond); err != nil {
+		t.Fatal(err)
+	}
+	name := delayQueue("", "tracks", 2*time.Second)
+	var declare *fakeMethod
+	for _, call := range broker.calls("queue.declare") {
+		if call.arg == name {
+			call := call
+			declare = &call
+		}
+	}
+	if declare == nil {
+		t.Fatalf("delay queue %s was not declared", name)
+	}
+	if declare.channel == base {
+		t.Fatalf("delay queue declared on the base channel %d", base)
+	}
+	publishes := broker.calls("basic.publish")
+	if len(publishes) != 1 || publishes[0].channel != declare.channel {
+		t.Fatalf("publish went to channels %v, want pooled channel %d", publishes, declare.channel)
+	}
+	if n := broker.ready(name); n != 1 {
+		t.Fatalf("delay queue has %d messages, want 1", n)
+	}
+}
@@ -0,0 +1,254 @@
+package redisstream
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Maksat-luci/Telegram-Bot/pkg/client/mq"
+	"github.com/go-redis/redis/v8"
+)
+
+// Config настройки подключения к Redis
+type Config struct {
+	Addr     string
+	Username string
+	Password string
+	DB       int
+	// Group группа консьюмеров, все инстансы бота в одной группе делят сообщения очереди
+	Group string
+}
+
+// значения по умолчанию
+const (
+	defaultGroup = "telegram-bot"
+	// connectTimeout сколько ждать ответа Redis при подключении
+	connectTimeout = 5 * time.Second
+)
+
+// ошибки бэкенда
+var (
+	errClosed           = errors.New("redis client closed")
+	errUnknownID        = errors.New("unknown message id")
+	errExchangeNotFound = errors.New("exchange not found")
+)
+
+// redisBase общая часть продьюсера и консьюмера. Очередь это стрим с тем же ключом,
+// exchange и его привязки хранятся в Redis чтобы их видели все инстансы бота
+type redisBase struct {
+	client *redis.Client
+	group  string
+
+	lock   sync.Mutex
+	closed bool
+	// временные очереди удаляются при закрытии
+	tempQueues map[string]bool
+}
+
+// binding привязка очереди к exchange, хранится в множестве привязок exchange в виде JSON
+type binding struct {
+	Queue string                 `json:"queue"`
+	Key   string                 `json:"key"`
+	Args  map[string]interface{} `json:"args,omitempty"`
+}
+
+// ключи в которых хранятся exchange и их привязки
+func exchangeKey(name string) string { return fmt.Sprintf("mq:exchange:%s", name) }
+func bindingsKey(name string) string { return fmt.Sprintf("mq:bindings:%s", name) }
+
+// connect подключается к Redis и проверяет подключение
+func connect(cfg Config) (*redisBase, error) {
+	client := redis.NewClient(&redis.Options{
+		Addr:     cfg.Addr,
+		Username: cfg.Username,
+		Password: cfg.Password,
+		DB:       cfg.DB,
+	})
+
+	ctx, cancel := context.WithTimeout(context.Background(), connectTimeout)
+	defer cancel()
+	if err := client.Ping(ctx).Err(); err != nil {
+		_ = client.Close()
+		return nil, fmt.Errorf("failed to connect to Redis due %v", err)
+	}
+
+	group := cfg.Group
+	if group == "" {
+		group = defaultGroup
+	}
+	return &redisBase{
+		client:     client,
+		group:      group,
+		tempQueues: make(map[string]bool),
+	}, nil
+}
+
+// DeclareQueue создаёт стрим и группу консьюмеров, группа читает стрим с начала.
+// Временные (autoDelete или exclusive) очереди удаляются при закрытии клиента
+func (b *redisBase) DeclareQueue(ctx context.Context, name string, durable, autoDelete, exclusive bool, args map[string]interface{}) error {
+	if err := b.check(ctx); err != nil {
+		return err
+	}
+	if err := b.ensureGroup(ctx, name); err != nil {
+		return err
+	}
+	if autoDelete || exclusive {
+		b.lock.Lock()
+		b.tempQueues[name] = true
+		b.lock.Unlock()
+	}
+	return nil
+}
+
+// ensureGroup создаёт группу консьюмеров стрима, существующая группа не трогается
+func (b *redisBase) ensureGroup(ctx context.Context, queue string) error {
+	err := b.client.XGroupCreateMkStream(ctx, queue, b.group, "0").Err()
+	if err != nil && !strings.HasPrefix(err.Error(), "BUSYGROUP") {
+		return fmt.Errorf("failed to declare queue due %v", err)
+	}
+	return nil
+}
+
+// DeclareExchange сохраняет exchange, повторное объявление с другим типом это ошибка как и в RabbitMQ
+func (b *redisBase) DeclareExchange(ctx context.Context, name, kind string, durable, autoDelete bool, args map[string]interface{}) error {
+	if err := b.check(ctx); err != nil {
+		return err
+	}
+	switch kind {
+	case mq.ExchangeDirect, mq.ExchangeTopic, mq.ExchangeFanout, mq.ExchangeHeaders:
+	default:
+		return fmt.Errorf("unknown exchange kind %q", kind)
+	}
+
+	created, err := b.client.SetNX(ctx, exchangeKey(name), kind, 0).Result()
+	if err != nil {
+		return fmt.Errorf("failed to declare exchange due %v", err)
+	}
+	if created {
+		return nil
+	}
+	existing, err := b.client.Get(ctx, exchangeKey(name)).Result()
+	if err != nil {
+		return fmt.Errorf("failed to declare exchange due %v", err)
+	}
+	if existing != kind {
+		return fmt.Errorf("exchange %s already declared as %s", name, existing)
+	}
+	return nil
+}
+
+// BindQueue привязывает очередь к exchange
+func (b *redisBase) BindQueue(ctx context.Context, queue, exchange, key string, args map[string]interface{}) error {
+	if err := b.check(ctx); err != nil {
+		return err
+	}
+	exists, err := b.client.Exists(ctx, exchangeKey(exchange)).Result()
+	if err != nil {
+		return fmt.Errorf("failed to bind queue %s to exchange %s due %v", queue, exchange, err)
+	}
+	if exists == 0 {
+		return fmt.Errorf("failed to bind queue %s to exchange %s due %w", queue, exchange, errExchangeNotFound)
+	}
+
+	member, err := json.Marshal(binding{Queue: queue, Key: key, Args: args})
+	if err != nil {
+		return fmt.Errorf("failed to bind queue %s to exchange %s due %v", queue, exchange, err)
+	}
+	if err := b.client.SAdd(ctx, bindingsKey(exchange), member).Err(); err != nil {
+		return fmt.Errorf("failed to bind queue %s to exchange %s due %v", queue, exchange, err)
+	}
+	return nil
+}
+
+// route возвращает очереди в которые exchange отправит сообщение с ключом key
+func (b *redisBase) route(ctx context.Context, exchange, key string, headers map[string]interface{}) ([]string, error) {
+	if exchange == "" {
+		return []string{key}, nil
+	}
+	kind, err := b.client.Get(ctx, exchangeKey(exchange)).Result()
+	if errors.Is(err, redis.Nil) {
+		return nil, fmt.Errorf("failed to publish to %s due %w", exchange, errExchangeNotFound)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to publish to %s due %v", exchange, err)
+	}
+	members, err := b.client.SMembers(ctx, bindingsKey(exchange)).Result()
+	if err != nil {
+		return nil, fmt.Errorf("failed to publish to %s due %v", exchange, err)
+	}
+	if kind == mq.ExchangeHeaders {
+		// аргументы привязки прошли через JSON, заголовки приводим к тем же типам
+		headers = normalizeHeaders(headers)
+	}
+
+	// одна очередь получает сообщение один раз, даже если подходит несколько привязок
+	var queues []string
+	routed := make(map[string]bool)
+	for _, member := range members {
+		var bind binding
+		if err := json.Unmarshal([]byte(member), &bind); err != nil {
+			return nil, fmt.Errorf("failed to read binding of exchange %s due %v", exchange, err)
+		}
+		if routed[bind.Queue] || !matches(kind, bind, key, headers) {
+			continue
+		}
+		routed[bind.Queue] = true
+		queues = append(queues, bind.Queue)
+	}
+	return queues, nil
+}
+
+// matches подходит ли сообщение под привязку exchange типа kind
+func matches(kind string, bind binding, key string, headers map[string]interface{}) bool {
+	switch kind {
+	case mq.ExchangeDirect:
+		return bind.Key == key
+	case mq.ExchangeTopic:
+		return mq.MatchTopic(bind.Key, key)
+	case mq.ExchangeFanout:
+		return true
+	case mq.ExchangeHeaders:
+		return mq.MatchHeaders(bind.Args, headers)
+	}
+	return false
+}
+
+// check проверяет контекст и что клиент не закрыт
+func (b *redisBase) check(ctx context.Context) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	if b.closed {
+		return errClosed
+	}
+	return nil
+}
+
+// close удаляет временные очереди и закрывает подключение
+func (b *redisBase) close() error {
+	b.lock.Lock()
+	if b.closed {
+		b.lock.Unlock()
+		return errClosed
+	}
+	b.closed = true
+	temp := make([]string, 0, len(b.tempQueues))
+	for name := range b.tempQueues {
+		temp = append(temp, name)
+	}
+	b.lock.Unlock()
+
+	if len(temp) > 0 {
+		if err := b.client.Del(context.Background(), temp...).Err(); err != nil {
+			_ = b.client.Close()
+			return fmt.Errorf("failed to delete temporary queues due %v", err)
+		}
+	}
+	return b.client.Close()
+}
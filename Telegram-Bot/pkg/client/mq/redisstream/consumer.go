@@ -0,0 +1,452 @@
+package redisstream
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"math"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/Maksat-luci/Telegram-Bot/pkg/client/mq"
+	"github.com/go-redis/redis/v8"
+)
+
+// ConsumerConfig настройки консьюмера Redis
+type ConsumerConfig struct {
+	Config
+	// Consumer имя консьюмера в группе, по умолчанию имя хоста и случайный суффикс
+	Consumer string
+	// PrefetchCount сколько сообщений забирается из стрима за раз
+	PrefetchCount int
+	// ClaimIdle через сколько неподтверждённое сообщение чужого консьюмера считается зависшим и забирается
+	ClaimIdle time.Duration
+	// Retry настройки повторов и parking очереди
+	Retry mq.RetryPolicy
+}
+
+const (
+	defaultClaimIdle = time.Minute
+	// readWait сколько XREADGROUP ждёт новых сообщений, за это время успевают созреть отложенные повторы
+	readWait = time.Second
+	// fetchDelay пауза перед следующей попыткой после ошибки Redis
+	fetchDelay = time.Second
+	// claimPage сколько неподтверждённых сообщений claim читает за один XPENDING
+	claimPage = 100
+)
+
+// pending выданное и ещё не подтверждённое сообщение
+type pending struct {
+	queue string
+	entry string
+	msg   mq.Message
+}
+
+// delayed отложенный повтор, лежит в sorted set очереди до времени повтора
+type delayed struct {
+	// Token делает запись уникальной в sorted set
+	Token      string     `json:"token"`
+	Message    mq.Message `json:"message"`
+	RetryCount int        `json:"retry_count"`
+}
+
+// redisConsumer консьюмер поверх групп консьюмеров Redis Streams
+type redisConsumer struct {
+	*redisBase
+	name          string
+	prefetchCount int
+	claimIdle     time.Duration
+	retry         mq.RetryPolicy
+
+	nextID  uint64
+	unacked map[uint64]pending
+	done    chan struct{}
+}
+
+// NewRedisConsumer конструктор который подключается к Redis и возвращает консьюмера
+func NewRedisConsumer(cfg ConsumerConfig) (mq.Consumer, error) {
+	base, err := connect(cfg.Config)
+	if err != nil {
+		return nil, err
+	}
+	name := cfg.Consumer
+	if name == "" {
+		host, _ := os.Hostname()
+		name = fmt.Sprintf("%s-%s", host, mq.NewID()[:8])
+	}
+	claimIdle := cfg.ClaimIdle
+	if claimIdle <= 0 {
+		claimIdle = defaultClaimIdle
+	}
+	return &redisConsumer{
+		redisBase:     base,
+		name:          name,
+		prefetchCount: cfg.PrefetchCount,
+		claimIdle:     claimIdle,
+		retry:         cfg.Retry,
+		unacked:       make(map[uint64]pending),
+		done:          make(chan struct{}),
+	}, nil
+}
+
+// имена служебных ключей очереди
+func parkingQueue(queue string) string { return fmt.Sprintf("%s.parking", queue) }
+func delayedKey(queue string) string   { return fmt.Sprintf("%s.delayed", queue) }
+
+// Consume начинает доставлять сообщения очереди target, стрим и группа создаются если их нет.
+// Доставка идёт пока не отменён ctx или не закрыт консьюмер
+func (c *redisConsumer) Consume(ctx context.Context, target string) (<-chan mq.Message, error) {
+	if err := c.check(ctx); err != nil {
+		return nil, err
+	}
+	if err := c.ensureGroup(ctx, target); err != nil {
+		return nil, err
+	}
+	ch := make(chan mq.Message)
+	go c.deliver(ctx, target, ch)
+	return ch, nil
+}
+
+// deliver по кругу возвращает созревшие повторы в стрим, забирает зависшие сообщения и читает новые
+func (c *redisConsumer) deliver(ctx context.Context, target string, ch chan<- mq.Message) {
+	defer close(ch)
+
+	batch := int64(c.prefetchCount)
+	if batch <= 0 {
+		batch = 1
+	}
+	var lastClaim time.Time
+
+	for {
+		if err := c.promote(ctx, target); err != nil && ctx.Err() == nil {
+			log.Printf("failed to move delayed messages of %s due %v", target, err)
+		}
+
+		var (
+			entries     []redis.XMessage
+			redelivered bool
+			err         error
+		)
+		if time.Since(lastClaim) >= c.claimIdle/2 {
+			lastClaim = time.Now()
+			entries, err = c.claim(ctx, target, batch)
+			redelivered = true
+		}
+		if err == nil && len(entries) == 0 {
+			entries, err = c.read(ctx, target, batch)
+			redelivered = false
+		}
+
+		switch {
+		case err == nil, errors.Is(err, redis.Nil):
+		case ctx.Err() != nil, errors.Is(err, redis.ErrClosed):
+			return
+		default:
+			log.Printf("failed to read messages from %s due %v", target, err)
+			select {
+			case <-time.After(fetchDelay):
+				continue
+			case <-ctx.Done():
+				return
+			case <-c.done:
+				return
+			}
+		}
+
+		for i, entry := range entries {
+			msg := message(entry, 0, target)
+			msg.Redelivered = msg.Redelivered || redelivered
+			select {
+			case ch <- c.track(target, entry.ID, msg):
+			case <-ctx.Done():
+				// сообщения так и не отдали воркеру, возвращаем их в очередь
+				c.requeue(target, entries[i:])
+				return
+			case <-c.done:
+				return
+			}
+		}
+	}
+}
+
+// claim забирает сообщения которые другие консьюмеры группы держат дольше ClaimIdle, например после падения.
+// Свои сообщения не забираются, их просто долго обрабатывает воркер. Список неподтверждённых читается
+// страницами, поэтому зависшие сообщения находятся и за сотнями свежих или своих
+func (c *redisConsumer) claim(ctx context.Context, target string, batch int64) ([]redis.XMessage, error) {
+	ids := make([]string, 0, batch)
+	start := "-"
+	for int64(len(ids)) < batch {
+		page, err := c.client.XPendingExt(ctx, &redis.XPendingExtArgs{
+			Stream: target,
+			Group:  c.group,
+			Start:  start,
+			End:    "+",
+			Count:  claimPage,
+		}).Result()
+		if err != nil {
+			return nil, err
+		}
+		for _, p := range page {
+			if p.Consumer != c.name && p.Idle >= c.claimIdle && int64(len(ids)) < batch {
+				ids = append(ids, p.ID)
+			}
+		}
+		next, ok := nextEntryID(page[len(page)-1].ID)
+		if len(page) < claimPage || !ok {
+			break
+		}
+		start = next
+	}
+	if len(ids) == 0 {
+		return nil, nil
+	}
+	return c.client.XClaim(ctx, &redis.XClaimArgs{
+		Stream:   target,
+		Group:    c.group,
+		Consumer: c.name,
+		MinIdle:  c.claimIdle,
+		Messages: ids,
+	}).Result()
+}
+
+// read читает новые сообщения группы, ждёт не дольше readWait
+func (c *redisConsumer) read(ctx context.Context, target string, batch int64) ([]redis.XMessage, error) {
+	streams, err := c.client.XReadGroup(ctx, &redis.XReadGroupArgs{
+		Group:    c.group,
+		Consumer: c.name,
+		Streams:  []string{target, ">"},
+		Count:    batch,
+		Block:    readWait,
+	}).Result()
+	if err != nil || len(streams) == 0 {
+		return nil, err
+	}
+	return streams[0].Messages, nil
+}
+
+// promote переносит созревшие повторы из sorted set обратно в стрим. Несколько консьюмеров
+// могут делать это одновременно, WATCH гарантирует что повтор попадёт в стрим один раз
+func (c *redisConsumer) promote(ctx context.Context, target string) error {
+	key := delayedKey(target)
+	err := c.client.Watch(ctx, func(tx *redis.Tx) error {
+		due, err := tx.ZRangeByScore(ctx, key, &redis.ZRangeBy{
+			Min: "-inf",
+			Max: strconv.FormatInt(time.Now().UnixNano()/int64(time.Millisecond), 10),
+		}).Result()
+		if err != nil || len(due) == 0 {
+			return err
+		}
+		_, err = tx.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+			for _, member := range due {
+				var d delayed
+				if err := json.Unmarshal([]byte(member), &d); err != nil {
+					return fmt.Errorf("failed to decode delayed message due %v", err)
+				}
+				if d.Message.Headers == nil {
+					d.Message.Headers = make(map[string]interface{})
+				}
+				d.Message.Headers[mq.HeaderRetryCount] = d.RetryCount
+				pipe.XAdd(ctx, &redis.XAddArgs{Stream: target, Values: values(d.Message)})
+				pipe.ZRem(ctx, key, member)
+			}
+			return nil
+		})
+		return err
+	}, key)
+	// повторы уже перенёс другой консьюмер
+	if errors.Is(err, redis.TxFailedErr) {
+		return nil
+	}
+	return err
+}
+
+// track запоминает сообщение до подтверждения и проставляет ему идентификатор
+func (c *redisConsumer) track(queue, entry string, msg mq.Message) mq.Message {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.nextID++
+	msg.ID = c.nextID
+	c.unacked[c.nextID] = pending{queue: queue, entry: entry, msg: msg}
+	return msg
+}
+
+// requeue добавляет копии прочитанных но не выданных сообщений в конец стрима и удаляет оригиналы
+func (c *redisConsumer) requeue(queue string, entries []redis.XMessage) {
+	ctx := context.Background()
+	_, err := c.client.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		for _, entry := range entries {
+			pipe.XAdd(ctx, &redis.XAddArgs{Stream: queue, Values: entry.Values})
+			pipe.XAck(ctx, queue, c.group, entry.ID)
+			pipe.XDel(ctx, queue, entry.ID)
+		}
+		return nil
+	})
+	if err != nil {
+		log.Printf("failed to requeue messages of %s due %v", queue, err)
+	}
+}
+
+// take забирает сообщение id, а при multiple ещё и все выданные до него
+func (c *redisConsumer) take(id uint64, multiple bool) ([]pending, error) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if _, ok := c.unacked[id]; !ok {
+		return nil, errUnknownID
+	}
+	ids := []uint64{id}
+	if multiple {
+		ids = ids[:0]
+		for _, other := range sortedIDs(c.unacked) {
+			if other <= id {
+				ids = append(ids, other)
+			}
+		}
+	}
+	taken := make([]pending, 0, len(ids))
+	for _, other := range ids {
+		taken = append(taken, c.unacked[other])
+		delete(c.unacked, other)
+	}
+	return taken, nil
+}
+
+// settle одной транзакцией выполняет действие с сообщениями id и удаляет их из стрима.
+// Подтверждённая запись больше не нужна группе, поэтому стрим не растёт
+func (c *redisConsumer) settle(ctx context.Context, id uint64, multiple bool, action func(pipe redis.Pipeliner, p pending) error) error {
+	if err := c.check(ctx); err != nil {
+		return err
+	}
+	taken, err := c.take(id, multiple)
+	if err != nil {
+		return fmt.Errorf("failed to settle message with id %d due %w", id, err)
+	}
+	_, err = c.client.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		for _, p := range taken {
+			if action != nil {
+				if err := action(pipe, p); err != nil {
+					return err
+				}
+			}
+			pipe.XAck(ctx, p.queue, c.group, p.entry)
+			pipe.XDel(ctx, p.queue, p.entry)
+		}
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("failed to settle message with id %d due %v", id, err)
+	}
+	return nil
+}
+
+// Ack подтверждает обработку (XACK) и удаляет запись из стрима
+func (c *redisConsumer) Ack(ctx context.Context, id uint64, multiple bool) error {
+	return c.settle(ctx, id, multiple, nil)
+}
+
+// Nack с requeue добавляет копию сообщения в конец стрима, без requeue сообщение просто удаляется.
+// В Redis Streams нет возврата сообщения группе, поэтому повтор это новая запись
+func (c *redisConsumer) Nack(ctx context.Context, id uint64, multiple bool, requeue bool) error {
+	if !requeue {
+		return c.settle(ctx, id, multiple, nil)
+	}
+	return c.settle(ctx, id, multiple, func(pipe redis.Pipeliner, p pending) error {
+		msg := p.msg
+		msg.Redelivered = true
+		pipe.XAdd(ctx, &redis.XAddArgs{Stream: p.queue, Values: values(msg)})
+		return nil
+	})
+}
+
+// Reject как Nack только для одного сообщения
+func (c *redisConsumer) Reject(ctx context.Context, id uint64, requeue bool) error {
+	return c.Nack(ctx, id, false, requeue)
+}
+
+// Settle применяет к сообщению итог outcome. Повтор откладывается в sorted set очереди до времени повтора,
+// после исчерпания повторов сообщение перекладывается в parking очередь. Возвращает применённый итог
+func (c *redisConsumer) Settle(ctx context.Context, msg mq.Message, outcome mq.Outcome) (mq.Outcome, error) {
+	if err := c.check(ctx); err != nil {
+		return 0, err
+	}
+	if outcome == mq.OutcomeRetry && msg.RetryCount() >= c.retry.MaxRetries {
+		outcome = mq.OutcomeDeadLetter
+	}
+	if outcome == mq.OutcomeDeadLetter && !c.retry.DeadLetter {
+		outcome = mq.OutcomeDrop
+	}
+
+	var action func(pipe redis.Pipeliner, p pending) error
+	switch outcome {
+	case mq.OutcomeRetry:
+		action = func(pipe redis.Pipeliner, p pending) error {
+			due := time.Now().Add(c.retry.Delay(msg.RetryCount()))
+			member, err := json.Marshal(delayed{Token: mq.NewID(), Message: p.msg, RetryCount: msg.RetryCount() + 1})
+			if err != nil {
+				return err
+			}
+			pipe.ZAdd(ctx, delayedKey(p.queue), &redis.Z{
+				Score:  float64(due.UnixNano() / int64(time.Millisecond)),
+				Member: member,
+			})
+			return nil
+		}
+	case mq.OutcomeDeadLetter:
+		action = func(pipe redis.Pipeliner, p pending) error {
+			pipe.XAdd(ctx, &redis.XAddArgs{Stream: parkingQueue(p.queue), Values: values(p.msg)})
+			return nil
+		}
+	case mq.OutcomeDrop:
+	default:
+		return 0, fmt.Errorf("unknown outcome %v", outcome)
+	}
+	if err := c.settle(ctx, msg.ID, false, action); err != nil {
+		return 0, err
+	}
+	return outcome, nil
+}
+
+// Close останавливает доставку, неподтверждённые сообщения через ClaimIdle заберут другие консьюмеры группы
+func (c *redisConsumer) Close() error {
+	if err := c.close(); err != nil {
+		return err
+	}
+	close(c.done)
+	return nil
+}
+
+// nextEntryID идентификатор записи стрима сразу после id, с него начинается следующая страница XPENDING.
+// Исключающая граница "(id" есть только с Redis 6.2, поэтому следующий идентификатор считается сам
+func nextEntryID(id string) (string, bool) {
+	i := strings.IndexByte(id, '-')
+	if i < 0 {
+		return "", false
+	}
+	ms, err := strconv.ParseUint(id[:i], 10, 64)
+	if err != nil {
+		return "", false
+	}
+	seq, err := strconv.ParseUint(id[i+1:], 10, 64)
+	if err != nil {
+		return "", false
+	}
+	if seq == math.MaxUint64 {
+		return fmt.Sprintf("%d-0", ms+1), true
+	}
+	return fmt.Sprintf("%d-%d", ms, seq+1), true
+}
+
+// sortedIDs идентификаторы неподтверждённых сообщений по возрастанию
+func sortedIDs(unacked map[uint64]pending) []uint64 {
+	ids := make([]uint64, 0, len(unacked))
+	for id := range unacked {
+		ids = append(ids, id)
+	}
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+	return ids
+}
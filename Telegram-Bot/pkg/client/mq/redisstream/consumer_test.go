@@ -0,0 +1,286 @@
+package redisstream
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/Maksat-luci/Telegram-Bot/pkg/client/mq"
+	"github.com/alicebob/miniredis/v2"
+	"github.com/go-redis/redis/v8"
+)
+
+// receiveTimeout сколько тест ждёт доставки сообщения
+const receiveTimeout = 5 * time.Second
+
+// runServer запускает miniredis, сервер останавливается вместе с тестом
+func runServer(t *testing.T) Config {
+	t.Helper()
+	s := miniredis.RunT(t)
+	return Config{Addr: s.Addr(), Group: "test"}
+}
+
+// newTestConsumer подключает консьюмера к серверу, консьюмер закрывается вместе с тестом
+func newTestConsumer(t *testing.T, cfg ConsumerConfig) *redisConsumer {
+	t.Helper()
+	consumer, err := NewRedisConsumer(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = consumer.Close() })
+	return consumer.(*redisConsumer)
+}
+
+// newPair подключает продьюсера и консьюмера к серверу
+func newPair(t *testing.T, cfg ConsumerConfig) (mq.Producer, *redisConsumer) {
+	t.Helper()
+	cfg.Config = runServer(t)
+	producer, err := NewRedisProducer(ProducerConfig{Config: cfg.Config, AppID: "test", ContentType: "text/plain"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = producer.Close() })
+	return producer, newTestConsumer(t, cfg)
+}
+
+// receive ждёт следующее сообщение из канала консьюмера
+func receive(t *testing.T, messages <-chan mq.Message) mq.Message {
+	t.Helper()
+	select {
+	case msg, ok := <-messages:
+		if !ok {
+			t.Fatal("messages channel closed")
+		}
+		return msg
+	case <-time.After(receiveTimeout):
+		t.Fatal("timed out waiting for message")
+	}
+	return mq.Message{}
+}
+
+// length сколько записей лежит в стриме очереди
+func length(t *testing.T, c *redisConsumer, queue string) int64 {
+	t.Helper()
+	n, err := c.client.XLen(context.Background(), queue).Result()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return n
+}
+
+func TestPublishConsume(t *testing.T) {
+	ctx := context.Background()
+	producer, consumer := newPair(t, ConsumerConfig{PrefetchCount: 10})
+
+	messages, err := consumer.Consume(ctx, "tracks")
+	if err != nil {
+		t.Fatal(err)
+	}
+	sent := mq.Message{
+		Body:          []byte("track"),
+		MessageID:     "message-1",
+		CorrelationID: "request-1",
+		ReplyTo:       "replies",
+		Timestamp:     time.Date(2022, 7, 1, 12, 0, 0, 0, time.UTC),
+		Headers:       map[string]interface{}{"x-source": "test"},
+	}
+	if err := producer.PublishMessage(ctx, "tracks", sent); err != nil {
+		t.Fatal(err)
+	}
+
+	msg := receive(t, messages)
+	if string(msg.Body) != "track" || msg.MessageID != sent.MessageID || msg.CorrelationID != sent.CorrelationID || msg.ReplyTo != sent.ReplyTo {
+		t.Fatalf("unexpected message %+v", msg)
+	}
+	if !msg.Timestamp.Equal(sent.Timestamp) {
+		t.Fatalf("got timestamp %s, want %s", msg.Timestamp, sent.Timestamp)
+	}
+	if msg.AppID != "test" || msg.ContentType != "text/plain" {
+		t.Fatalf("producer defaults not applied: app id %q, content type %q", msg.AppID, msg.ContentType)
+	}
+	if msg.Headers["x-source"] != "test" || msg.Queue != "tracks" || msg.Redelivered {
+		t.Fatalf("unexpected message %+v", msg)
+	}
+
+	if err := consumer.Ack(ctx, msg.ID, false); err != nil {
+		t.Fatal(err)
+	}
+	if err := consumer.Ack(ctx, msg.ID, false); !errors.Is(err, errUnknownID) {
+		t.Fatalf("second ack: got %v, want %v", err, errUnknownID)
+	}
+	// подтверждённая запись удаляется из стрима
+	if n := length(t, consumer, "tracks"); n != 0 {
+		t.Fatalf("stream has %d entries after ack, want 0", n)
+	}
+}
+
+func TestAckMultiple(t *testing.T) {
+	ctx := context.Background()
+	producer, consumer := newPair(t, ConsumerConfig{PrefetchCount: 10})
+
+	messages, err := consumer.Consume(ctx, "tracks")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 3; i++ {
+		if err := producer.Publish(ctx, "tracks", []byte(fmt.Sprintf("track %d", i))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	var last mq.Message
+	for i := 0; i < 3; i++ {
+		last = receive(t, messages)
+	}
+	if err := consumer.Ack(ctx, last.ID, true); err != nil {
+		t.Fatal(err)
+	}
+	if n := length(t, consumer, "tracks"); n != 0 {
+		t.Fatalf("stream has %d entries after ack, want 0", n)
+	}
+}
+
+func TestNackRedelivers(t *testing.T) {
+	ctx := context.Background()
+	producer, consumer := newPair(t, ConsumerConfig{PrefetchCount: 1})
+
+	messages, err := consumer.Consume(ctx, "tracks")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := producer.Publish(ctx, "tracks", []byte("track")); err != nil {
+		t.Fatal(err)
+	}
+	msg := receive(t, messages)
+	if err := consumer.Nack(ctx, msg.ID, false, true); err != nil {
+		t.Fatal(err)
+	}
+
+	redelivered := receive(t, messages)
+	if !redelivered.Redelivered || string(redelivered.Body) != "track" {
+		t.Fatalf("unexpected redelivery %+v", redelivered)
+	}
+	if err := consumer.Reject(ctx, redelivered.ID, false); err != nil {
+		t.Fatal(err)
+	}
+	if n := length(t, consumer, "tracks"); n != 0 {
+		t.Fatalf("stream has %d entries after reject, want 0", n)
+	}
+}
+
+func TestSettle(t *testing.T) {
+	ctx := context.Background()
+	retry := mq.RetryPolicy{MaxRetries: 1, InitialDelay: 50 * time.Millisecond, Multiplier: 2, DeadLetter: true}
+	producer, consumer := newPair(t, ConsumerConfig{PrefetchCount: 1, Retry: retry})
+
+	messages, err := consumer.Consume(ctx, "tracks")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := producer.Publish(ctx, "tracks", []byte("track")); err != nil {
+		t.Fatal(err)
+	}
+
+	msg := receive(t, messages)
+	outcome, err := consumer.Settle(ctx, msg, mq.OutcomeRetry)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if outcome != mq.OutcomeRetry {
+		t.Fatalf("got outcome %v, want %v", outcome, mq.OutcomeRetry)
+	}
+
+	retried := receive(t, messages)
+	if retried.RetryCount() != 1 {
+		t.Fatalf("got retry count %d, want 1", retried.RetryCount())
+	}
+	outcome, err = consumer.Settle(ctx, retried, mq.OutcomeRetry)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if outcome != mq.OutcomeDeadLetter {
+		t.Fatalf("got outcome %v, want %v", outcome, mq.OutcomeDeadLetter)
+	}
+	if n := length(t, consumer, parkingQueue("tracks")); n != 1 {
+		t.Fatalf("parking queue has %d entries, want 1", n)
+	}
+}
+
+func TestClaimStuckMessages(t *testing.T) {
+	ctx := context.Background()
+	cfg := runServer(t)
+	claimIdle := 50 * time.Millisecond
+	crashed := newTestConsumer(t, ConsumerConfig{Config: cfg, Consumer: "crashed"})
+	worker := newTestConsumer(t, ConsumerConfig{Config: cfg, Consumer: "worker", ClaimIdle: claimIdle})
+
+	if err := crashed.DeclareQueue(ctx, "tracks", true, false, false, nil); err != nil {
+		t.Fatal(err)
+	}
+	// worker сам держит больше страницы XPENDING сообщений, зависшее сообщение упавшего консьюмера лежит после них
+	for i := 0; i < claimPage+20; i++ {
+		if err := crashed.client.XAdd(ctx, &redis.XAddArgs{Stream: "tracks", Values: values(mq.Message{Body: []byte("own")})}).Err(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := worker.read(ctx, "tracks", claimPage+20); err != nil {
+		t.Fatal(err)
+	}
+	if err := crashed.client.XAdd(ctx, &redis.XAddArgs{Stream: "tracks", Values: values(mq.Message{Body: []byte("stuck")})}).Err(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := crashed.read(ctx, "tracks", 1); err != nil {
+		t.Fatal(err)
+	}
+
+	time.Sleep(2 * claimIdle)
+	claimed, err := worker.claim(ctx, "tracks", 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(claimed) != 1 || claimed[0].Values[fieldBody] != "stuck" {
+		t.Fatalf("claimed %d entries, want only the stuck one", len(claimed))
+	}
+}
+
+func TestNextEntryID(t *testing.T) {
+	tests := []struct {
+		id   string
+		want string
+		ok   bool
+	}{
+		{id: "1526985054069-0", want: "1526985054069-1", ok: true},
+		{id: "1526985054069-18446744073709551615", want: "1526985054070-0", ok: true},
+		{id: "1526985054069", ok: false},
+		{id: "x-1", ok: false},
+	}
+	for _, tt := range tests {
+		got, ok := nextEntryID(tt.id)
+		if got != tt.want || ok != tt.ok {
+			t.Fatalf("nextEntryID(%q) = %q, %v, want %q, %v", tt.id, got, ok, tt.want, tt.ok)
+		}
+	}
+}
+
+func TestCloseDeletesTempQueues(t *testing.T) {
+	ctx := context.Background()
+	cfg := runServer(t)
+	consumer, err := NewRedisConsumer(ConsumerConfig{Config: cfg})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := consumer.DeclareQueue(ctx, "replies", false, true, false, nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := consumer.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := consumer.Close(); !errors.Is(err, errClosed) {
+		t.Fatalf("second close: got %v, want %v", err, errClosed)
+	}
+
+	other := newTestConsumer(t, ConsumerConfig{Config: cfg})
+	if n, err := other.client.Exists(ctx, "replies").Result(); err != nil || n != 0 {
+		t.Fatalf("stream of auto-delete queue survived close: %d, %v", n, err)
+	}
+}
@@ -0,0 +1,109 @@
+package redisstream
+
+import (
+	"encoding/json"
+	"strconv"
+	"time"
+
+	"github.com/Maksat-luci/Telegram-Bot/pkg/client/mq"
+	"github.com/go-redis/redis/v8"
+)
+
+// поля записи стрима в которых лежит сообщение
+const (
+	fieldBody          = "body"
+	fieldMessageID     = "message_id"
+	fieldCorrelationID = "correlation_id"
+	fieldTimestamp     = "timestamp"
+	fieldContentType   = "content_type"
+	fieldAppID         = "app_id"
+	fieldReplyTo       = "reply_to"
+	fieldExchange      = "exchange"
+	fieldRoutingKey    = "routing_key"
+	fieldHeaders       = "headers"
+	fieldRetryCount    = "retry_count"
+	fieldRedelivered   = "redelivered"
+)
+
+// values переводит сообщение в поля записи стрима. Заголовки хранятся в JSON,
+// счётчик повторов отдельным полем чтобы после JSON он остался целым числом
+func values(msg mq.Message) map[string]interface{} {
+	v := map[string]interface{}{
+		fieldBody: msg.Body,
+	}
+	set := func(field, value string) {
+		if value != "" {
+			v[field] = value
+		}
+	}
+	set(fieldMessageID, msg.MessageID)
+	set(fieldCorrelationID, msg.CorrelationID)
+	set(fieldContentType, msg.ContentType)
+	set(fieldAppID, msg.AppID)
+	set(fieldReplyTo, msg.ReplyTo)
+	set(fieldExchange, msg.Exchange)
+	set(fieldRoutingKey, msg.RoutingKey)
+	if !msg.Timestamp.IsZero() {
+		v[fieldTimestamp] = msg.Timestamp.UnixNano()
+	}
+	if count := msg.RetryCount(); count > 0 {
+		v[fieldRetryCount] = count
+	}
+	if msg.Redelivered {
+		v[fieldRedelivered] = 1
+	}
+
+	headers := make(map[string]interface{}, len(msg.Headers))
+	for k, h := range msg.Headers {
+		if k != mq.HeaderRetryCount {
+			headers[k] = h
+		}
+	}
+	if len(headers) > 0 {
+		if encoded, err := json.Marshal(headers); err == nil {
+			v[fieldHeaders] = encoded
+		}
+	}
+	return v
+}
+
+// message переводит запись стрима в сообщение консьюмера с идентификатором id
+func message(xm redis.XMessage, id uint64, queue string) mq.Message {
+	get := func(field string) string {
+		s, _ := xm.Values[field].(string)
+		return s
+	}
+	msg := mq.Message{
+		ID:            id,
+		Body:          []byte(get(fieldBody)),
+		MessageID:     get(fieldMessageID),
+		CorrelationID: get(fieldCorrelationID),
+		ContentType:   get(fieldContentType),
+		AppID:         get(fieldAppID),
+		ReplyTo:       get(fieldReplyTo),
+		Exchange:      get(fieldExchange),
+		RoutingKey:    get(fieldRoutingKey),
+		Redelivered:   get(fieldRedelivered) != "",
+		Queue:         queue,
+		Headers:       make(map[string]interface{}),
+	}
+	if ns, err := strconv.ParseInt(get(fieldTimestamp), 10, 64); err == nil {
+		msg.Timestamp = time.Unix(0, ns)
+	}
+	if encoded := get(fieldHeaders); encoded != "" {
+		_ = json.Unmarshal([]byte(encoded), &msg.Headers)
+	}
+	if count, err := strconv.Atoi(get(fieldRetryCount)); err == nil {
+		msg.Headers[mq.HeaderRetryCount] = count
+	}
+	return msg
+}
+
+// normalizeHeaders пропускает заголовки через JSON, так их можно сравнивать с аргументами привязок
+func normalizeHeaders(headers map[string]interface{}) map[string]interface{} {
+	normalized := make(map[string]interface{})
+	if encoded, err := json.Marshal(headers); err == nil {
+		_ = json.Unmarshal(encoded, &normalized)
+	}
+	return normalized
+}
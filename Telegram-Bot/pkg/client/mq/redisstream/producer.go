@@ -0,0 +1,107 @@
+package redisstream
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/Maksat-luci/Telegram-Bot/pkg/client/mq"
+	"github.com/go-redis/redis/v8"
+)
+
+// ProducerConfig настройки продьюсера Redis
+type ProducerConfig struct {
+	Config
+	// MaxLen примерная максимальная длина стрима, старые записи обрезаются. 0 без ограничения
+	MaxLen int64
+	// AppID и ContentType проставляются сообщениям у которых они не заданы
+	AppID       string
+	ContentType string
+}
+
+// redisProducer продьюсер который добавляет сообщения в стримы через XADD
+type redisProducer struct {
+	*redisBase
+	maxLen      int64
+	appID       string
+	contentType string
+}
+
+// NewRedisProducer конструктор который подключается к Redis и возвращает продьюсера
+func NewRedisProducer(cfg ProducerConfig) (mq.Producer, error) {
+	base, err := connect(cfg.Config)
+	if err != nil {
+		return nil, err
+	}
+	return &redisProducer{
+		redisBase:   base,
+		maxLen:      cfg.MaxLen,
+		appID:       cfg.AppID,
+		contentType: cfg.ContentType,
+	}, nil
+}
+
+// Publish отправляет сообщение в очередь
+func (p *redisProducer) Publish(ctx context.Context, target string, body []byte) error {
+	return p.PublishMessage(ctx, target, mq.Message{Body: body})
+}
+
+// PublishMessage отправляет сообщение в очередь через default exchange
+func (p *redisProducer) PublishMessage(ctx context.Context, target string, msg mq.Message) error {
+	return p.PublishExchange(ctx, "", target, msg)
+}
+
+// PublishExchange добавляет сообщение во все очереди exchange одной транзакцией
+func (p *redisProducer) PublishExchange(ctx context.Context, exchange, key string, msg mq.Message) error {
+	return p.PublishBatch(ctx, exchange, key, []mq.Message{msg})
+}
+
+// PublishAsync публикует в отдельной горутине, результат приходит в канал
+func (p *redisProducer) PublishAsync(ctx context.Context, exchange, key string, msg mq.Message) <-chan error {
+	result := make(chan error, 1)
+	go func() {
+		result <- p.PublishExchange(ctx, exchange, key, msg)
+	}()
+	return result
+}
+
+// PublishBatch добавляет все сообщения одной транзакцией, либо все либо ни одного
+func (p *redisProducer) PublishBatch(ctx context.Context, exchange, key string, msgs []mq.Message) error {
+	if err := p.check(ctx); err != nil {
+		return err
+	}
+	// очереди считаются для каждого сообщения, у headers exchange они зависят от заголовков
+	queues := make([][]string, len(msgs))
+	for i, msg := range msgs {
+		routed, err := p.route(ctx, exchange, key, msg.Headers)
+		if err != nil {
+			return err
+		}
+		queues[i] = routed
+	}
+
+	_, err := p.client.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		for i, msg := range msgs {
+			msg = msg.WithDefaults(p.appID, p.contentType)
+			msg.Exchange = exchange
+			msg.RoutingKey = key
+			for _, queue := range queues[i] {
+				pipe.XAdd(ctx, &redis.XAddArgs{
+					Stream: queue,
+					MaxLen: p.maxLen,
+					Approx: p.maxLen > 0,
+					Values: values(msg),
+				})
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("failed to publish to %s due %v", key, err)
+	}
+	return nil
+}
+
+// Close закрывает подключение продьюсера
+func (p *redisProducer) Close() error {
+	return p.close()
+}
@@ -0,0 +1,84 @@
+package redisstream
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/Maksat-luci/Telegram-Bot/pkg/client/mq"
+)
+
+func TestPublishBatch(t *testing.T) {
+	ctx := context.Background()
+	producer, consumer := newPair(t, ConsumerConfig{})
+
+	msgs := make([]mq.Message, 20)
+	for i := range msgs {
+		msgs[i] = mq.Message{Body: []byte(fmt.Sprintf("track %d", i))}
+	}
+	if err := producer.(mq.BatchProducer).PublishBatch(ctx, "", "tracks", msgs); err != nil {
+		t.Fatal(err)
+	}
+	if n := length(t, consumer, "tracks"); n != int64(len(msgs)) {
+		t.Fatalf("stream has %d entries, want %d", n, len(msgs))
+	}
+}
+
+func TestPublishExchange(t *testing.T) {
+	ctx := context.Background()
+	producer, consumer := newPair(t, ConsumerConfig{})
+
+	if err := producer.PublishExchange(ctx, "events", "track.found", mq.Message{}); !errors.Is(err, errExchangeNotFound) {
+		t.Fatalf("publish to undeclared exchange: got %v, want %v", err, errExchangeNotFound)
+	}
+	if err := consumer.DeclareExchange(ctx, "events", mq.ExchangeTopic, true, false, nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := consumer.DeclareExchange(ctx, "events", mq.ExchangeFanout, true, false, nil); err == nil {
+		t.Fatal("redeclare exchange with another kind succeeded")
+	}
+	bindings := map[string]string{"tracks": "track.#", "found": "*.found", "albums": "album.#"}
+	for queue, key := range bindings {
+		if err := consumer.BindQueue(ctx, queue, "events", key, nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// вторая подходящая привязка той же очереди не дублирует сообщение
+	if err := consumer.BindQueue(ctx, "tracks", "events", "track.found", nil); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := producer.PublishExchange(ctx, "events", "track.found", mq.Message{Body: []byte("found")}); err != nil {
+		t.Fatal(err)
+	}
+	for queue, want := range map[string]int64{"tracks": 1, "found": 1, "albums": 0} {
+		if n := length(t, consumer, queue); n != want {
+			t.Fatalf("queue %s has %d entries, want %d", queue, n, want)
+		}
+	}
+}
+
+func TestPublishAfter(t *testing.T) {
+	ctx := context.Background()
+	producer, consumer := newPair(t, ConsumerConfig{PrefetchCount: 1})
+
+	messages, err := consumer.Consume(ctx, "tracks")
+	if err != nil {
+		t.Fatal(err)
+	}
+	start := time.Now()
+	err = producer.(mq.ScheduledProducer).PublishAfter(ctx, "", "tracks", mq.Message{Body: []byte("later")}, 300*time.Millisecond)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	msg := receive(t, messages)
+	if elapsed := time.Since(start); elapsed < 300*time.Millisecond {
+		t.Fatalf("message delivered after %s, want at least 300ms", elapsed)
+	}
+	if string(msg.Body) != "later" || msg.AppID != "test" {
+		t.Fatalf("unexpected message %+v", msg)
+	}
+}
@@ -0,0 +1,53 @@
+package redisstream
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/Maksat-luci/Telegram-Bot/pkg/client/mq"
+	"github.com/go-redis/redis/v8"
+)
+
+// PublishAfter публикует сообщение через delay
+func (p *redisProducer) PublishAfter(ctx context.Context, exchange, key string, msg mq.Message, delay time.Duration) error {
+	return p.PublishAt(ctx, exchange, key, msg, time.Now().Add(delay))
+}
+
+// PublishAt кладёт сообщение в sorted set отложенных сообщений каждой очереди exchange, туда же куда
+// консьюмер кладёт повторы. Консьюмер очереди переносит его в стрим когда наступит at.
+// Очереди выбираются в момент вызова, привязки добавленные позже сообщение не получат
+func (p *redisProducer) PublishAt(ctx context.Context, exchange, key string, msg mq.Message, at time.Time) error {
+	if !at.After(time.Now()) {
+		return p.PublishExchange(ctx, exchange, key, msg)
+	}
+	if err := p.check(ctx); err != nil {
+		return err
+	}
+	queues, err := p.route(ctx, exchange, key, msg.Headers)
+	if err != nil {
+		return err
+	}
+
+	msg = msg.WithDefaults(p.appID, p.contentType)
+	msg.Exchange = exchange
+	msg.RoutingKey = key
+	member, err := json.Marshal(delayed{Token: mq.NewID(), Message: msg, RetryCount: msg.RetryCount()})
+	if err != nil {
+		return fmt.Errorf("failed to schedule message to %s due %v", key, err)
+	}
+	_, err = p.client.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		for _, queue := range queues {
+			pipe.ZAdd(ctx, delayedKey(queue), &redis.Z{
+				Score:  float64(at.UnixNano() / int64(time.Millisecond)),
+				Member: member,
+			})
+		}
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("failed to schedule message to %s due %v", key, err)
+	}
+	return nil
+}
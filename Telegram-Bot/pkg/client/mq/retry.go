@@ -0,0 +1,50 @@
+package mq
+
+import "time"
+
+// RetryPolicy настройки повторной обработки и dead-letter для очередей консьюмера, общие для всех бэкендов
+type RetryPolicy struct {
+	// MaxRetries сколько раз повторять сообщение прежде чем отправить его в parking очередь
+	MaxRetries int
+	// InitialDelay задержка перед первым повтором
+	InitialDelay time.Duration
+	// Multiplier во сколько раз растёт задержка с каждым повтором
+	Multiplier float64
+	// MaxDelay верхняя граница задержки
+	MaxDelay time.Duration
+	// DeadLetter объявлять ли dead-letter exchange и parking очередь
+	DeadLetter bool
+}
+
+// Enabled нужна ли очередям retry топология
+func (p RetryPolicy) Enabled() bool {
+	return p.DeadLetter || p.MaxRetries > 0
+}
+
+// Delay возвращает задержку перед повтором с номером attempt начиная с нуля
+func (p RetryPolicy) Delay(attempt int) time.Duration {
+	d := float64(p.InitialDelay)
+	for i := 0; i < attempt; i++ {
+		d *= p.Multiplier
+		if p.MaxDelay > 0 && d >= float64(p.MaxDelay) {
+			return p.MaxDelay
+		}
+	}
+	if p.MaxDelay > 0 && d > float64(p.MaxDelay) {
+		return p.MaxDelay
+	}
+	return time.Duration(d)
+}
+
+// Tiers возвращает все различные задержки повторов по возрастанию
+func (p RetryPolicy) Tiers() []time.Duration {
+	var tiers []time.Duration
+	for attempt := 0; attempt < p.MaxRetries; attempt++ {
+		d := p.Delay(attempt)
+		if len(tiers) > 0 && tiers[len(tiers)-1] == d {
+			continue
+		}
+		tiers = append(tiers, d)
+	}
+	return tiers
+}
@@ -0,0 +1,88 @@
+package mq
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestRetryPolicyDelay(t *testing.T) {
+	policy := RetryPolicy{InitialDelay: time.Second, Multiplier: 2, MaxDelay: 5 * time.Second}
+	tests := []struct {
+		attempt int
+		want    time.Duration
+	}{
+		{attempt: 0, want: time.Second},
+		{attempt: 1, want: 2 * time.Second},
+		{attempt: 2, want: 4 * time.Second},
+		{attempt: 3, want: 5 * time.Second},
+		{attempt: 100, want: 5 * time.Second},
+	}
+	for _, tt := range tests {
+		if got := policy.Delay(tt.attempt); got != tt.want {
+			t.Errorf("Delay(%d) = %s, want %s", tt.attempt, got, tt.want)
+		}
+	}
+
+	// без MaxDelay задержка растёт без ограничения
+	policy.MaxDelay = 0
+	if got := policy.Delay(4); got != 16*time.Second {
+		t.Errorf("Delay(4) = %s, want %s", got, 16*time.Second)
+	}
+	// MaxDelay меньше начальной задержки ограничивает и первый повтор
+	policy.MaxDelay = 500 * time.Millisecond
+	if got := policy.Delay(0); got != 500*time.Millisecond {
+		t.Errorf("Delay(0) = %s, want %s", got, 500*time.Millisecond)
+	}
+}
+
+func TestRetryPolicyTiers(t *testing.T) {
+	tests := []struct {
+		name   string
+		policy RetryPolicy
+		want   []time.Duration
+	}{
+		{
+			name:   "growing",
+			policy: RetryPolicy{MaxRetries: 3, InitialDelay: time.Second, Multiplier: 2},
+			want:   []time.Duration{time.Second, 2 * time.Second, 4 * time.Second},
+		},
+		{
+			name:   "capped",
+			policy: RetryPolicy{MaxRetries: 5, InitialDelay: time.Second, Multiplier: 2, MaxDelay: 3 * time.Second},
+			want:   []time.Duration{time.Second, 2 * time.Second, 3 * time.Second},
+		},
+		{
+			name:   "constant",
+			policy: RetryPolicy{MaxRetries: 4, InitialDelay: time.Second, Multiplier: 1},
+			want:   []time.Duration{time.Second},
+		},
+		{
+			name:   "no retries",
+			policy: RetryPolicy{InitialDelay: time.Second, Multiplier: 2, DeadLetter: true},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.policy.Tiers(); !reflect.DeepEqual(got, tt.want) {
+				t.Fatalf("got %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRetryPolicyEnabled(t *testing.T) {
+	tests := []struct {
+		policy RetryPolicy
+		want   bool
+	}{
+		{policy: RetryPolicy{}, want: false},
+		{policy: RetryPolicy{MaxRetries: 1}, want: true},
+		{policy: RetryPolicy{DeadLetter: true}, want: true},
+	}
+	for _, tt := range tests {
+		if got := tt.policy.Enabled(); got != tt.want {
+			t.Errorf("%+v Enabled() = %v, want %v", tt.policy, got, tt.want)
+		}
+	}
+}
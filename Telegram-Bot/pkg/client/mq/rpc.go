@@ -0,0 +1,187 @@
+package mq
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"sync"
+	"time"
+)
+
+// ошибки RPC клиента
+var (
+	ErrRPCTimeout = errors.New("rpc call timed out")
+	ErrRPCClosed  = errors.New("rpc client closed")
+)
+
+// RPCConfig настройки клиента запрос/ответ
+type RPCConfig struct {
+	// ReplyQueue очередь ответов этого инстанса бота, если пусто то генерируется уникальное имя
+	ReplyQueue string
+	// Timeout сколько ждать ответ, если в контексте нет своего дедлайна
+	Timeout time.Duration
+	// Late получает ответы на запросы которые уже не ждут ответа, например после таймаута.
+	// Если nil такие ответы отбрасываются
+	Late func(msg Message)
+}
+
+// RPCClient интерфейс клиента запрос/ответ поверх Producer и Consumer
+type RPCClient interface {
+	io.Closer
+	Call(ctx context.Context, target string, body []byte) ([]byte, error)
+	// CallMessage как Call, но запрос и ответ передаются целиком вместе с метаданными
+	CallMessage(ctx context.Context, target string, msg Message) (Message, error)
+}
+
+// rpcClient структура которая хранит ожидающие ответа запросы по correlation id
+type rpcClient struct {
+	producer   Producer
+	consumer   Consumer
+	replyQueue string
+	timeout    time.Duration
+	late       func(msg Message)
+
+	lock    sync.Mutex
+	pending map[string]chan Message
+
+	// cancel останавливает чтение очереди ответов
+	cancel    context.CancelFunc
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+// NewRPCClient конструктор который объявляет очередь ответов, начинает её слушать и возвращает RPCClient.
+// Очередь ответов слушается пока не отменён ctx или не закрыт клиент
+func NewRPCClient(ctx context.Context, producer Producer, consumer Consumer, cfg RPCConfig) (RPCClient, error) {
+	replyQueue := cfg.ReplyQueue
+	if replyQueue == "" {
+		replyQueue = fmt.Sprintf("rpc.reply.%s", NewID())
+	}
+	// очередь ответов принадлежит только этому инстансу и удаляется вместе с ним
+	if err := consumer.DeclareQueue(ctx, replyQueue, false, true, true, nil); err != nil {
+		return nil, fmt.Errorf("failed to declare reply queue due %v", err)
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	replies, err := consumer.Consume(ctx, replyQueue)
+	if err != nil {
+		cancel()
+		return nil, fmt.Errorf("failed to consume reply queue due %v", err)
+	}
+
+	c := &rpcClient{
+		producer:   producer,
+		consumer:   consumer,
+		replyQueue: replyQueue,
+		timeout:    cfg.Timeout,
+		late:       cfg.Late,
+		pending:    make(map[string]chan Message),
+		cancel:     cancel,
+		done:       make(chan struct{}),
+	}
+	go c.dispatch(replies)
+
+	return c, nil
+}
+
+// Call отправляет запрос в очередь target и ждёт ответ, дедлайн контекста или закрытия клиента
+func (c *rpcClient) Call(ctx context.Context, target string, body []byte) ([]byte, error) {
+	reply, err := c.CallMessage(ctx, target, Message{Body: body})
+	if err != nil {
+		return nil, err
+	}
+	return reply.Body, nil
+}
+
+// CallMessage отправляет запрос msg в очередь target и ждёт ответное сообщение.
+// CorrelationID и ReplyTo запроса проставляются клиентом
+func (c *rpcClient) CallMessage(ctx context.Context, target string, msg Message) (Message, error) {
+	if _, ok := ctx.Deadline(); !ok && c.timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, c.timeout)
+		defer cancel()
+	}
+
+	id := NewID()
+	reply := make(chan Message, 1)
+
+	c.lock.Lock()
+	c.pending[id] = reply
+	c.lock.Unlock()
+	// запрос больше не ждёт ответа в любом случае, поздний ответ будет отброшен
+	defer func() {
+		c.lock.Lock()
+		delete(c.pending, id)
+		c.lock.Unlock()
+	}()
+
+	msg.CorrelationID = id
+	msg.ReplyTo = c.replyQueue
+	if err := c.producer.PublishMessage(ctx, target, msg); err != nil {
+		return Message{}, err
+	}
+
+	select {
+	case msg := <-reply:
+		return msg, nil
+	case <-ctx.Done():
+		if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+			return Message{}, ErrRPCTimeout
+		}
+		return Message{}, ctx.Err()
+	case <-c.done:
+		return Message{}, ErrRPCClosed
+	}
+}
+
+// dispatch читает очередь ответов и отдаёт каждый ответ ожидающему его запросу
+func (c *rpcClient) dispatch(replies <-chan Message) {
+	for msg := range replies {
+		if err := c.consumer.Ack(context.Background(), msg.ID, false); err != nil {
+			log.Printf("failed to ack rpc reply %s due %v", msg.CorrelationID, err)
+		}
+
+		c.lock.Lock()
+		reply, ok := c.pending[msg.CorrelationID]
+		c.lock.Unlock()
+
+		if !ok {
+			if c.late != nil {
+				c.late(msg)
+				continue
+			}
+			log.Printf("drop rpc reply with unknown correlation id %q", msg.CorrelationID)
+			continue
+		}
+		// повторный ответ на тот же запрос не должен блокировать очередь
+		select {
+		case reply <- msg:
+		default:
+		}
+	}
+}
+
+// Close отменяет все ожидающие запросы, продьюсер и консьюмер закрываются их владельцем
+func (c *rpcClient) Close() error {
+	c.closeOnce.Do(func() {
+		c.cancel()
+		close(c.done)
+	})
+	return nil
+}
+
+// Reply отправляет ответ на запрос req в его очередь ReplyTo
+func Reply(ctx context.Context, producer Producer, req Message, body []byte) error {
+	return ReplyMessage(ctx, producer, req, Message{Body: body})
+}
+
+// ReplyMessage отправляет ответное сообщение reply на запрос req, например событие в конверте
+func ReplyMessage(ctx context.Context, producer Producer, req Message, reply Message) error {
+	if req.ReplyTo == "" {
+		return fmt.Errorf("message %d has no reply queue", req.ID)
+	}
+	reply.CorrelationID = req.CorrelationID
+	return producer.PublishMessage(ctx, req.ReplyTo, reply)
+}
@@ -0,0 +1,173 @@
+package mq_test
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/Maksat-luci/Telegram-Bot/pkg/client/mq"
+	"github.com/Maksat-luci/Telegram-Bot/pkg/client/mq/memory"
+)
+
+// newRPC создаёт RPC клиента поверх брокера в памяти и продьюсера для ответов
+func newRPC(t *testing.T, cfg mq.RPCConfig) (*memory.Broker, mq.Producer, mq.RPCClient) {
+	t.Helper()
+	broker, producer, consumer := newBackend(t, mq.RetryPolicy{})
+	client, err := mq.NewRPCClient(context.Background(), producer, consumer, cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = client.Close() })
+	return broker, producer, client
+}
+
+// serve отвечает на запросы очереди echo телом запроса, delay задаёт задержку ответа для каждого запроса
+func serve(t *testing.T, broker *memory.Broker, producer mq.Producer, delay func(req mq.Message) time.Duration) {
+	t.Helper()
+	consumer := memory.NewMemoryConsumer(broker, memory.ConsumerConfig{})
+	sub := mq.NewSubscriber(consumer, mq.SubscriberConfig{Workers: 8})
+	handler := func(ctx context.Context, req mq.Message) error {
+		time.Sleep(delay(req))
+		return mq.Reply(ctx, producer, req, req.Body)
+	}
+	if err := sub.Subscribe(context.Background(), "echo", handler); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		_ = sub.Close()
+		_ = consumer.Close()
+	})
+}
+
+func TestRPCConcurrentCalls(t *testing.T) {
+	broker, producer, client := newRPC(t, mq.RPCConfig{Timeout: receiveTimeout})
+	// первые запросы отвечаются последними, так ответы приходят не в порядке запросов
+	serve(t, broker, producer, func(req mq.Message) time.Duration {
+		var n int
+		fmt.Sscanf(string(req.Body), "call %d", &n)
+		return time.Duration(8-n) * 5 * time.Millisecond
+	})
+
+	var wg sync.WaitGroup
+	errs := make(chan error, 8)
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			body := fmt.Sprintf("call %d", i)
+			reply, err := client.Call(context.Background(), "echo", []byte(body))
+			if err != nil {
+				errs <- err
+				return
+			}
+			if string(reply) != body {
+				errs <- fmt.Errorf("got reply %q for %q", reply, body)
+			}
+		}(i)
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Error(err)
+	}
+	if n := mq.PendingCalls(client); n != 0 {
+		t.Fatalf("%d calls still pending", n)
+	}
+}
+
+func TestRPCTimeout(t *testing.T) {
+	_, _, client := newRPC(t, mq.RPCConfig{Timeout: 20 * time.Millisecond})
+
+	// на очередь echo никто не отвечает
+	if _, err := client.Call(context.Background(), "echo", []byte("call")); !errors.Is(err, mq.ErrRPCTimeout) {
+		t.Fatalf("got %v, want %v", err, mq.ErrRPCTimeout)
+	}
+	if n := mq.PendingCalls(client); n != 0 {
+		t.Fatalf("%d calls still pending after timeout", n)
+	}
+
+	// дедлайн контекста вызывающего важнее таймаута клиента
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	if _, err := client.Call(ctx, "echo", []byte("call")); !errors.Is(err, mq.ErrRPCTimeout) {
+		t.Fatalf("got %v, want %v", err, mq.ErrRPCTimeout)
+	}
+	if elapsed := time.Since(start); elapsed >= 20*time.Millisecond {
+		t.Fatalf("call took %s, caller deadline was ignored", elapsed)
+	}
+}
+
+func TestRPCLateReply(t *testing.T) {
+	late := make(chan mq.Message, 1)
+	broker, producer, client := newRPC(t, mq.RPCConfig{
+		Timeout: 20 * time.Millisecond,
+		Late:    func(msg mq.Message) { late <- msg },
+	})
+
+	// запрос забирается напрямую, чтобы ответить на него только после таймаута
+	requests := memory.NewMemoryConsumer(broker, memory.ConsumerConfig{})
+	defer requests.Close()
+	messages, err := requests.Consume(context.Background(), "echo")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := client.Call(context.Background(), "echo", []byte("call")); !errors.Is(err, mq.ErrRPCTimeout) {
+		t.Fatalf("got %v, want %v", err, mq.ErrRPCTimeout)
+	}
+	var req mq.Message
+	select {
+	case req = <-messages:
+	case <-time.After(receiveTimeout):
+		t.Fatal("timed out waiting for request")
+	}
+	if err := mq.Reply(context.Background(), producer, req, []byte("reply")); err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case msg := <-late:
+		if msg.CorrelationID != req.CorrelationID || string(msg.Body) != "reply" {
+			t.Fatalf("got late reply %q with correlation id %q, want %q", msg.Body, msg.CorrelationID, req.CorrelationID)
+		}
+	case <-time.After(receiveTimeout):
+		t.Fatal("late reply was not reported")
+	}
+}
+
+func TestRPCClose(t *testing.T) {
+	_, _, client := newRPC(t, mq.RPCConfig{})
+
+	errs := make(chan error, 2)
+	for i := 0; i < 2; i++ {
+		go func() {
+			_, err := client.Call(context.Background(), "echo", []byte("call"))
+			errs <- err
+		}()
+	}
+	// оба запроса уже ждут ответа
+	deadline := time.Now().Add(receiveTimeout)
+	for mq.PendingCalls(client) != 2 {
+		if time.Now().After(deadline) {
+			t.Fatal("calls were not sent")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	if err := client.Close(); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 2; i++ {
+		select {
+		case err := <-errs:
+			if !errors.Is(err, mq.ErrRPCClosed) {
+				t.Fatalf("got %v, want %v", err, mq.ErrRPCClosed)
+			}
+		case <-time.After(receiveTimeout):
+			t.Fatal("close did not unblock the call")
+		}
+	}
+}
@@ -0,0 +1,50 @@
+package mq
+
+import (
+	"fmt"
+	"time"
+)
+
+// ConnectionState состояние подключения к брокеру
+type ConnectionState int
+
+const (
+	// StateConnected подключение установлено и топология объявлена
+	StateConnected ConnectionState = iota + 1
+	// StateDisconnected подключение потеряно
+	StateDisconnected
+	// StateReconnecting идёт попытка переподключения
+	StateReconnecting
+	// StateClosed подключение закрыто владельцем и больше не восстанавливается
+	StateClosed
+)
+
+func (s ConnectionState) String() string {
+	switch s {
+	case StateConnected:
+		return "connected"
+	case StateDisconnected:
+		return "disconnected"
+	case StateReconnecting:
+		return "reconnecting"
+	case StateClosed:
+		return "closed"
+	}
+	return fmt.Sprintf("state(%d)", int(s))
+}
+
+// StateEvent событие смены состояния подключения
+type StateEvent struct {
+	State ConnectionState
+	// Attempt номер попытки переподключения начиная с нуля
+	Attempt int
+	// Err причина потери подключения или неудачной попытки
+	Err error
+	At  time.Time
+}
+
+// StateNotifier бэкенд который сообщает о смене состояния подключения.
+// События отправляются без блокировки, если канал подписчика полон событие пропускается
+type StateNotifier interface {
+	NotifyState(ch chan<- StateEvent)
+}
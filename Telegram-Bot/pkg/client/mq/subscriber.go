@@ -0,0 +1,243 @@
+package mq
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+)
+
+// ErrSubscriberClosed подписчик уже закрыт
+var ErrSubscriberClosed = errors.New("subscriber closed")
+
+// defaultAbortTimeout сколько Drain ждёт обработчики после отмены их контекста
+const defaultAbortTimeout = time.Second
+
+// SubscriberConfig настройки подписчика
+type SubscriberConfig struct {
+	// Workers сколько сообщений одной подписки обрабатывается параллельно, по умолчанию одно
+	Workers int
+	// Middlewares оборачивают обработчик каждой подписки, первый выполняется первым
+	Middlewares []Middleware
+	// AbortTimeout сколько Drain после своего дедлайна ждёт обработчики которым отменил контекст,
+	// по умолчанию секунду
+	AbortTimeout time.Duration
+}
+
+// DrainStats итог Drain
+type DrainStats struct {
+	// Requeued сколько сообщений вернулось в очередь так и не обработанными
+	Requeued int
+	// Abandoned сколько обработчиков не завершились даже после отмены контекста. Их сообщения
+	// вернутся в очередь когда обработчики всё же завершатся
+	Abandoned int
+}
+
+// Subscriber обрабатывает очереди обработчиками. Результат обработчика решает судьбу сообщения:
+// nil подтверждает его, ошибка завершает итогом из OutcomeOf, так что забыть Ack нельзя
+type Subscriber interface {
+	// Subscribe начинает обрабатывать очередь queue и сразу возвращается. Обработка идёт пока не отменён ctx
+	// или не закрыт подписчик. middlewares оборачивают handler внутри общих middleware подписчика
+	Subscribe(ctx context.Context, queue string, handler Handler, middlewares ...Middleware) error
+	// Drain мягко останавливает подписки: перестаёт читать очереди и ждёт пока обработчики закончат
+	// и подтвердят текущие сообщения, но не дольше дедлайна ctx. После дедлайна обработчикам отменяется
+	// контекст, а их сообщения возвращаются в очередь. Консьюмер после Drain можно закрывать, если
+	// в DrainStats нет брошенных обработчиков
+	Drain(ctx context.Context) (DrainStats, error)
+	// Close останавливает все подписки и ждёт пока обработчики закончат текущие сообщения
+	Close() error
+}
+
+// subscriber структура которая держит подписки поверх одного консьюмера
+type subscriber struct {
+	consumer     Consumer
+	workers      int
+	middlewares  []Middleware
+	abortTimeout time.Duration
+
+	lock   sync.Mutex
+	closed bool
+	// stops останавливают чтение очередей, aborts отменяют контекст обработчиков
+	stops  []context.CancelFunc
+	aborts []context.CancelFunc
+	// aborted дедлайн Drain истёк, недообработанные сообщения возвращаются в очередь
+	aborted  bool
+	inflight int
+	requeued int
+	wg       sync.WaitGroup
+}
+
+// NewSubscriber конструктор подписчика поверх consumer
+func NewSubscriber(consumer Consumer, cfg SubscriberConfig) Subscriber {
+	workers := cfg.Workers
+	if workers <= 0 {
+		workers = 1
+	}
+	abortTimeout := cfg.AbortTimeout
+	if abortTimeout <= 0 {
+		abortTimeout = defaultAbortTimeout
+	}
+	return &subscriber{
+		consumer:     consumer,
+		workers:      workers,
+		middlewares:  cfg.Middlewares,
+		abortTimeout: abortTimeout,
+	}
+}
+
+// Subscribe начинает читать очередь и запускает воркеров подписки
+func (s *subscriber) Subscribe(ctx context.Context, queue string, handler Handler, middlewares ...Middleware) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.closed {
+		return ErrSubscriberClosed
+	}
+
+	// чтение останавливается и при отмене ctx, и при остановке подписчика. Обработчики отменяются
+	// отдельно, так Drain даёт им закончить текущие сообщения
+	consumeCtx, stop := context.WithCancel(ctx)
+	messages, err := s.consumer.Consume(consumeCtx, queue)
+	if err != nil {
+		stop()
+		return fmt.Errorf("failed to subscribe to %s due %v", queue, err)
+	}
+	handleCtx, abort := context.WithCancel(ctx)
+	s.stops = append(s.stops, stop)
+	s.aborts = append(s.aborts, abort)
+
+	handler = Chain(middlewares...)(handler)
+	handler = Chain(s.middlewares...)(handler)
+	for i := 0; i < s.workers; i++ {
+		s.wg.Add(1)
+		go func() {
+			defer s.wg.Done()
+			// канал закрывается после отмены consumeCtx, но бэкенд может успеть отдать ещё сообщение
+			for msg := range messages {
+				s.handle(handleCtx, handler, msg)
+			}
+		}()
+	}
+	return nil
+}
+
+// handle обрабатывает сообщение если подписчик ещё работает, иначе сразу возвращает его в очередь
+func (s *subscriber) handle(ctx context.Context, handler Handler, msg Message) {
+	s.lock.Lock()
+	if s.closed {
+		s.requeued++
+		s.lock.Unlock()
+		s.requeue(msg)
+		return
+	}
+	s.inflight++
+	s.lock.Unlock()
+
+	err := handler(ctx, msg)
+
+	s.lock.Lock()
+	s.inflight--
+	// дедлайн Drain истёк, обработчику отменили контекст и его результату уже нельзя доверять
+	aborted := s.aborted
+	if aborted {
+		s.requeued++
+	}
+	s.lock.Unlock()
+	if aborted {
+		s.requeue(msg)
+		return
+	}
+	s.finish(msg, err)
+}
+
+// requeue возвращает сообщение в очередь без счётчика повторов
+func (s *subscriber) requeue(msg Message) {
+	if err := s.consumer.Nack(context.Background(), msg.ID, false, true); err != nil {
+		log.Printf("failed to requeue message %d from %s due %v", msg.ID, msg.Queue, err)
+	}
+}
+
+// finish подтверждает обработанное сообщение или завершает его итогом ошибки. Контекст подписки
+// к этому моменту может быть уже отменён, а результат обработки всё равно нужно отдать брокеру
+func (s *subscriber) finish(msg Message, err error) {
+	ctx := context.Background()
+	if err == nil {
+		err := s.consumer.Ack(ctx, msg.ID, false)
+		switch {
+		case errors.Is(err, ErrStaleDelivery):
+			// обработанное сообщение придёт ещё раз, повтор отсеет dedup middleware
+			log.Printf("message %d from %s was handled but its channel reconnected, it will be redelivered", msg.ID, msg.Queue)
+		case err != nil:
+			log.Printf("failed to ack message %d from %s due %v", msg.ID, msg.Queue, err)
+		}
+		return
+	}
+	outcome := OutcomeOf(err)
+	if outcome == OutcomeRequeue {
+		s.requeue(msg)
+		return
+	}
+	if _, err := s.consumer.Settle(ctx, msg, outcome); err != nil {
+		log.Printf("failed to %s message %d from %s due %v", outcome, msg.ID, msg.Queue, err)
+	}
+}
+
+// Drain перестаёт читать очереди и ждёт воркеров до дедлайна ctx. Сообщения которые бэкенд успел отдать
+// после остановки возвращаются в очередь и тоже считаются. Если дедлайн истёк, обработчикам отменяется
+// контекст и Drain ещё abortTimeout ждёт пока они завершатся, их сообщения возвращаются в очередь
+// не дожидаясь результата. Обработчики которые не завершились и тогда, считаются брошенными
+func (s *subscriber) Drain(ctx context.Context) (DrainStats, error) {
+	s.lock.Lock()
+	if s.closed {
+		s.lock.Unlock()
+		return DrainStats{}, ErrSubscriberClosed
+	}
+	s.closed = true
+	for _, stop := range s.stops {
+		stop()
+	}
+	s.lock.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		s.wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		s.abort()
+		s.lock.Lock()
+		defer s.lock.Unlock()
+		return DrainStats{Requeued: s.requeued}, nil
+	case <-ctx.Done():
+	}
+
+	s.lock.Lock()
+	s.aborted = true
+	s.lock.Unlock()
+	s.abort()
+	select {
+	case <-done:
+	case <-time.After(s.abortTimeout):
+	}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return DrainStats{Requeued: s.requeued, Abandoned: s.inflight}, ctx.Err()
+}
+
+// abort отменяет контекст обработчиков всех подписок
+func (s *subscriber) abort() {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	for _, abort := range s.aborts {
+		abort()
+	}
+}
+
+// Close останавливает подписки и ждёт пока обработчики закончат текущие сообщения сколько бы это ни заняло
+func (s *subscriber) Close() error {
+	_, err := s.Drain(context.Background())
+	return err
+}
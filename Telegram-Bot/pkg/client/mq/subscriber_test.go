@@ -0,0 +1,368 @@
+package mq_test
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/Maksat-luci/Telegram-Bot/pkg/client/mq"
+	"github.com/Maksat-luci/Telegram-Bot/pkg/client/mq/memory"
+)
+
+// receiveTimeout сколько тест ждёт обработки сообщения
+const receiveTimeout = time.Second
+
+// testRetry политика повторов с короткой задержкой
+var testRetry = mq.RetryPolicy{MaxRetries: 1, InitialDelay: 10 * time.Millisecond, Multiplier: 2, DeadLetter: true}
+
+// newBackend создаёт продьюсера и консьюмера поверх нового брокера в памяти
+func newBackend(t *testing.T, retry mq.RetryPolicy) (*memory.Broker, mq.Producer, mq.Consumer) {
+	t.Helper()
+	broker := memory.NewBroker()
+	producer := memory.NewMemoryProducer(broker, memory.ProducerConfig{AppID: "test", ContentType: "text/plain"})
+	consumer := memory.NewMemoryConsumer(broker, memory.ConsumerConfig{Retry: retry})
+	t.Cleanup(func() {
+		_ = producer.Close()
+		_ = consumer.Close()
+	})
+	return broker, producer, consumer
+}
+
+// receive ждёт следующее сообщение которое получил обработчик
+func receive(t *testing.T, handled <-chan mq.Message) mq.Message {
+	t.Helper()
+	select {
+	case msg := <-handled:
+		return msg
+	case <-time.After(receiveTimeout):
+		t.Fatal("timed out waiting for message")
+	}
+	return mq.Message{}
+}
+
+// expectNone проверяет что обработчик больше ничего не получает
+func expectNone(t *testing.T, handled <-chan mq.Message) {
+	t.Helper()
+	select {
+	case msg := <-handled:
+		t.Fatalf("unexpected message %q", msg.Body)
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+// subscribe подписывает на очередь tracks обработчик, который отдаёт полученные сообщения в канал
+// и возвращает для них ошибку из results по очереди, после конца results обработчик возвращает nil
+func subscribe(t *testing.T, consumer mq.Consumer, results ...error) (mq.Subscriber, <-chan mq.Message) {
+	t.Helper()
+	handled := make(chan mq.Message, 16)
+	sub := mq.NewSubscriber(consumer, mq.SubscriberConfig{})
+	calls := 0
+	handler := func(ctx context.Context, msg mq.Message) error {
+		var err error
+		if calls < len(results) {
+			err = results[calls]
+		}
+		calls++
+		handled <- msg
+		return err
+	}
+	if err := sub.Subscribe(context.Background(), "tracks", handler); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = sub.Close() })
+	return sub, handled
+}
+
+func TestSubscriberAcksHandled(t *testing.T) {
+	ctx := context.Background()
+	broker, producer, consumer := newBackend(t, testRetry)
+	sub, handled := subscribe(t, consumer)
+
+	if err := producer.Publish(ctx, "tracks", []byte("track")); err != nil {
+		t.Fatal(err)
+	}
+	receive(t, handled)
+	if err := sub.Close(); err != nil {
+		t.Fatal(err)
+	}
+	// неподтверждённое сообщение вернулось бы в очередь при закрытии консьюмера
+	if err := consumer.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if n := broker.Len("tracks"); n != 0 {
+		t.Fatalf("queue has %d messages, want 0", n)
+	}
+}
+
+func TestSubscriberSettlesErrors(t *testing.T) {
+	failed := errors.New("failed")
+	tests := []struct {
+		name string
+		err  error
+		// redelivered приходит ли сообщение повторно и с каким счётчиком повторов
+		redelivered bool
+		retryCount  int
+		parked      int
+	}{
+		{name: "retry", err: failed, redelivered: true, retryCount: 1},
+		{name: "requeue", err: mq.WithOutcome(failed, mq.OutcomeRequeue), redelivered: true},
+		{name: "dead letter", err: mq.WithOutcome(failed, mq.OutcomeDeadLetter), parked: 1},
+		{name: "drop", err: mq.WithOutcome(failed, mq.OutcomeDrop)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx := context.Background()
+			broker, producer, consumer := newBackend(t, testRetry)
+			_, handled := subscribe(t, consumer, tt.err)
+
+			if err := producer.Publish(ctx, "tracks", []byte("track")); err != nil {
+				t.Fatal(err)
+			}
+			receive(t, handled)
+			if !tt.redelivered {
+				expectNone(t, handled)
+			} else {
+				msg := receive(t, handled)
+				if msg.RetryCount() != tt.retryCount {
+					t.Fatalf("got retry count %d, want %d", msg.RetryCount(), tt.retryCount)
+				}
+			}
+			if n := broker.Len("tracks.parking"); n != tt.parked {
+				t.Fatalf("parking queue has %d messages, want %d", n, tt.parked)
+			}
+		})
+	}
+}
+
+func TestSubscriberRetriesThenParks(t *testing.T) {
+	ctx := context.Background()
+	broker, producer, consumer := newBackend(t, testRetry)
+	failed := errors.New("failed")
+	_, handled := subscribe(t, consumer, failed, failed)
+
+	if err := producer.Publish(ctx, "tracks", []byte("track")); err != nil {
+		t.Fatal(err)
+	}
+	receive(t, handled)
+	receive(t, handled)
+	expectNone(t, handled)
+	if n := broker.Len("tracks.parking"); n != 1 {
+		t.Fatalf("parking queue has %d messages, want 1", n)
+	}
+}
+
+func TestSubscriberClosed(t *testing.T) {
+	_, _, consumer := newBackend(t, testRetry)
+	sub := mq.NewSubscriber(consumer, mq.SubscriberConfig{})
+	if err := sub.Close(); err != nil {
+		t.Fatal(err)
+	}
+	handler := func(ctx context.Context, msg mq.Message) error { return nil }
+	if err := sub.Subscribe(context.Background(), "tracks", handler); !errors.Is(err, mq.ErrSubscriberClosed) {
+		t.Fatalf("got %v, want %v", err, mq.ErrSubscriberClosed)
+	}
+}
+
+// bufferedConsumer консьюмер у которого в канале уже лежат все сообщения очереди, так что после
+// остановки подписки воркеры ещё успевают их получить. Канал закрывается при отмене подписки
+type bufferedConsumer struct {
+	messages []mq.Message
+
+	lock     sync.Mutex
+	acked    []uint64
+	requeued []uint64
+}
+
+func (c *bufferedConsumer) Consume(ctx context.Context, target string) (<-chan mq.Message, error) {
+	ch := make(chan mq.Message, len(c.messages))
+	for _, msg := range c.messages {
+		ch <- msg
+	}
+	go func() {
+		<-ctx.Done()
+		close(ch)
+	}()
+	return ch, nil
+}
+
+func (c *bufferedConsumer) Ack(ctx context.Context, id uint64, multiple bool) error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.acked = append(c.acked, id)
+	return nil
+}
+
+func (c *bufferedConsumer) Nack(ctx context.Context, id uint64, multiple bool, requeue bool) error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if requeue {
+		c.requeued = append(c.requeued, id)
+	}
+	return nil
+}
+
+func (c *bufferedConsumer) Reject(ctx context.Context, id uint64, requeue bool) error {
+	return c.Nack(ctx, id, false, requeue)
+}
+
+func (c *bufferedConsumer) Settle(ctx context.Context, msg mq.Message, outcome mq.Outcome) (mq.Outcome, error) {
+	return outcome, nil
+}
+
+func (c *bufferedConsumer) DeclareQueue(ctx context.Context, name string, durable, autoDelete, exclusive bool, args map[string]interface{}) error {
+	return nil
+}
+
+func (c *bufferedConsumer) DeclareExchange(ctx context.Context, name, kind string, durable, autoDelete bool, args map[string]interface{}) error {
+	return nil
+}
+
+func (c *bufferedConsumer) BindQueue(ctx context.Context, queue, exchange, key string, args map[string]interface{}) error {
+	return nil
+}
+
+func (c *bufferedConsumer) Close() error { return nil }
+
+// settled сколько сообщений подтверждено и сколько возвращено в очередь
+func (c *bufferedConsumer) settled() (int, int) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return len(c.acked), len(c.requeued)
+}
+
+// newBufferedConsumer консьюмер с тремя сообщениями в канале
+func newBufferedConsumer() *bufferedConsumer {
+	return &bufferedConsumer{messages: []mq.Message{{ID: 1}, {ID: 2}, {ID: 3}}}
+}
+
+// blockingHandler обработчик который сообщает о начале обработки в started и ждёт release.
+// watchCtx завершает его и при отмене контекста
+func blockingHandler(started chan<- uint64, release <-chan struct{}, watchCtx bool) mq.Handler {
+	return func(ctx context.Context, msg mq.Message) error {
+		started <- msg.ID
+		if !watchCtx {
+			<-release
+			return nil
+		}
+		select {
+		case <-release:
+			return nil
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// waitStarted ждёт пока обработчик начнёт обрабатывать сообщение
+func waitStarted(t *testing.T, started <-chan uint64) {
+	t.Helper()
+	select {
+	case <-started:
+	case <-time.After(receiveTimeout):
+		t.Fatal("timed out waiting for handler")
+	}
+}
+
+func TestDrain(t *testing.T) {
+	consumer := newBufferedConsumer()
+	started := make(chan uint64, 3)
+	release := make(chan struct{})
+	sub := mq.NewSubscriber(consumer, mq.SubscriberConfig{})
+	if err := sub.Subscribe(context.Background(), "tracks", blockingHandler(started, release, true)); err != nil {
+		t.Fatal(err)
+	}
+	waitStarted(t, started)
+
+	drained := make(chan struct{})
+	var stats mq.DrainStats
+	var err error
+	go func() {
+		defer close(drained)
+		stats, err = sub.Drain(context.Background())
+	}()
+	select {
+	case <-drained:
+		t.Fatal("drain returned while handler was running")
+	case <-time.After(50 * time.Millisecond):
+	}
+	close(release)
+	<-drained
+
+	if err != nil {
+		t.Fatal(err)
+	}
+	// текущее сообщение обработано, два оставшихся в канале вернулись в очередь
+	if stats != (mq.DrainStats{Requeued: 2}) {
+		t.Fatalf("got %+v, want 2 requeued", stats)
+	}
+	if acked, requeued := consumer.settled(); acked != 1 || requeued != 2 {
+		t.Fatalf("got %d acked and %d requeued, want 1 and 2", acked, requeued)
+	}
+	if _, err := sub.Drain(context.Background()); !errors.Is(err, mq.ErrSubscriberClosed) {
+		t.Fatalf("got %v, want %v", err, mq.ErrSubscriberClosed)
+	}
+}
+
+func TestDrainDeadline(t *testing.T) {
+	consumer := newBufferedConsumer()
+	started := make(chan uint64, 3)
+	sub := mq.NewSubscriber(consumer, mq.SubscriberConfig{})
+	if err := sub.Subscribe(context.Background(), "tracks", blockingHandler(started, nil, true)); err != nil {
+		t.Fatal(err)
+	}
+	waitStarted(t, started)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	stats, err := sub.Drain(ctx)
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("got %v, want %v", err, context.DeadlineExceeded)
+	}
+	// обработчик отменён и Drain дождался его, так что посчитаны и его сообщение, и два из канала
+	if stats != (mq.DrainStats{Requeued: 3}) {
+		t.Fatalf("got %+v, want 3 requeued", stats)
+	}
+	if acked, requeued := consumer.settled(); acked != 0 || requeued != 3 {
+		t.Fatalf("got %d acked and %d requeued, want 0 and 3", acked, requeued)
+	}
+}
+
+func TestDrainAbandoned(t *testing.T) {
+	consumer := newBufferedConsumer()
+	started := make(chan uint64, 3)
+	release := make(chan struct{})
+	sub := mq.NewSubscriber(consumer, mq.SubscriberConfig{AbortTimeout: 20 * time.Millisecond})
+	if err := sub.Subscribe(context.Background(), "tracks", blockingHandler(started, release, false)); err != nil {
+		t.Fatal(err)
+	}
+	waitStarted(t, started)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	stats, err := sub.Drain(ctx)
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("got %v, want %v", err, context.DeadlineExceeded)
+	}
+	if stats != (mq.DrainStats{Abandoned: 1}) {
+		t.Fatalf("got %+v, want 1 abandoned", stats)
+	}
+
+	// брошенный обработчик всё же завершился, его сообщение и оставшиеся в канале возвращаются в очередь
+	close(release)
+	deadline := time.Now().Add(receiveTimeout)
+	for {
+		acked, requeued := consumer.settled()
+		if acked != 0 {
+			t.Fatalf("abandoned message was acked")
+		}
+		if requeued == 3 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("got %d requeued, want 3", requeued)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
@@ -0,0 +1,72 @@
+package mq
+
+import (
+	"context"
+	"fmt"
+)
+
+// Topology exchange, очереди и привязки которые должны существовать у брокера
+type Topology struct {
+	Exchanges []ExchangeSpec
+	Queues    []QueueSpec
+	Bindings  []BindingSpec
+}
+
+// ExchangeSpec описание exchange, Kind один из Exchange*
+type ExchangeSpec struct {
+	Name       string
+	Kind       string
+	Durable    bool
+	AutoDelete bool
+	Args       map[string]interface{}
+}
+
+// QueueSpec описание очереди. Args передаются брокеру как есть, например x-queue-type, x-max-length,
+// x-message-ttl или x-dead-letter-exchange
+type QueueSpec struct {
+	Name       string
+	Durable    bool
+	AutoDelete bool
+	Exclusive  bool
+	Args       map[string]interface{}
+}
+
+// BindingSpec привязка очереди к exchange
+type BindingSpec struct {
+	Queue    string
+	Exchange string
+	Key      string
+	Args     map[string]interface{}
+}
+
+// HasQueue описана ли очередь name
+func (t Topology) HasQueue(name string) bool {
+	for _, q := range t.Queues {
+		if q.Name == name {
+			return true
+		}
+	}
+	return false
+}
+
+// Apply объявляет сначала exchange, потом очереди, потом привязки. Объявление идемпотентно, поэтому Apply
+// можно повторять при каждом старте и после переподключения. Если очередь уже существует с другими
+// аргументами брокер вернёт ошибку, аргументы существующей очереди так не поменять
+func (t Topology) Apply(ctx context.Context, queue MessageQueue) error {
+	for _, ex := range t.Exchanges {
+		if err := queue.DeclareExchange(ctx, ex.Name, ex.Kind, ex.Durable, ex.AutoDelete, ex.Args); err != nil {
+			return fmt.Errorf("failed to declare exchange %s due %v", ex.Name, err)
+		}
+	}
+	for _, q := range t.Queues {
+		if err := queue.DeclareQueue(ctx, q.Name, q.Durable, q.AutoDelete, q.Exclusive, q.Args); err != nil {
+			return fmt.Errorf("failed to declare queue %s due %v", q.Name, err)
+		}
+	}
+	for _, b := range t.Bindings {
+		if err := queue.BindQueue(ctx, b.Queue, b.Exchange, b.Key, b.Args); err != nil {
+			return fmt.Errorf("failed to bind queue %s to %s due %v", b.Queue, b.Exchange, err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,84 @@
+package mq
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"testing"
+)
+
+// recordingQueue MessageQueue который записывает объявления и может вернуть ошибку на одном из них
+type recordingQueue struct {
+	calls []string
+	fail  string
+}
+
+func (q *recordingQueue) record(call string) error {
+	q.calls = append(q.calls, call)
+	if call == q.fail {
+		return errors.New("refused")
+	}
+	return nil
+}
+
+func (q *recordingQueue) DeclareQueue(ctx context.Context, name string, durable, autoDelete, exclusive bool, args map[string]interface{}) error {
+	return q.record("queue " + name)
+}
+
+func (q *recordingQueue) DeclareExchange(ctx context.Context, name, kind string, durable, autoDelete bool, args map[string]interface{}) error {
+	return q.record("exchange " + name + " " + kind)
+}
+
+func (q *recordingQueue) BindQueue(ctx context.Context, queue, exchange, key string, args map[string]interface{}) error {
+	return q.record("bind " + queue + " " + exchange + " " + key)
+}
+
+func (q *recordingQueue) Close() error { return nil }
+
+// testTopology exchange событий с двумя очередями
+var testTopology = Topology{
+	Queues: []QueueSpec{{Name: "tracks", Durable: true}, {Name: "albums", Durable: true}},
+	Bindings: []BindingSpec{
+		{Queue: "tracks", Exchange: "events", Key: "track.*"},
+		{Queue: "albums", Exchange: "events", Key: "album.*"},
+	},
+	Exchanges: []ExchangeSpec{{Name: "events", Kind: ExchangeTopic, Durable: true}},
+}
+
+func TestTopologyApply(t *testing.T) {
+	queue := &recordingQueue{}
+	if err := testTopology.Apply(context.Background(), queue); err != nil {
+		t.Fatal(err)
+	}
+	// exchange и очереди объявляются раньше привязок, даже если описаны после них
+	want := []string{
+		"exchange events topic",
+		"queue tracks",
+		"queue albums",
+		"bind tracks events track.*",
+		"bind albums events album.*",
+	}
+	if !reflect.DeepEqual(queue.calls, want) {
+		t.Fatalf("got %v, want %v", queue.calls, want)
+	}
+}
+
+func TestTopologyApplyStopsOnError(t *testing.T) {
+	queue := &recordingQueue{fail: "queue tracks"}
+	if err := testTopology.Apply(context.Background(), queue); err == nil {
+		t.Fatal("got nil error for refused queue")
+	}
+	want := []string{"exchange events topic", "queue tracks"}
+	if !reflect.DeepEqual(queue.calls, want) {
+		t.Fatalf("got %v, want %v", queue.calls, want)
+	}
+}
+
+func TestTopologyHasQueue(t *testing.T) {
+	if !testTopology.HasQueue("albums") {
+		t.Fatal("albums queue not found")
+	}
+	if testTopology.HasQueue("events") {
+		t.Fatal("exchange reported as queue")
+	}
+}
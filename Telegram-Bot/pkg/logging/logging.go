@@ -44,6 +44,13 @@ func GetLogger() *Logger {
 	return &Logger{e}
 }
 
+// Discard логгер который никуда не пишет, для компонентов которым логгер не передали
+func Discard() *Logger {
+	l := logrus.New()
+	l.SetOutput(ioutil.Discard)
+	return &Logger{logrus.NewEntry(l)}
+}
+
 // GetLoggerWithField функция для 
 func (l *Logger) GetLoggerWithField(k string, v interface{}) *Logger {
 	return &Logger{l.WithField(k, v)}